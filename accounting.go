@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ingestCounts follows records through the ingest pipeline. A received
+// record is either rejected or parsed, a parsed one is then a duplicate,
+// written, dropped or still pending in the write buffer.
+type ingestCounts struct {
+	Received   atomic.Int64
+	Parsed     atomic.Int64
+	Rejected   atomic.Int64
+	Duplicates atomic.Int64
+	Written    atomic.Int64
+	Dropped    atomic.Int64
+}
+
+func (c *ingestCounts) snapshot() map[string]int64 {
+	s := map[string]int64{
+		"received":   c.Received.Load(),
+		"parsed":     c.Parsed.Load(),
+		"rejected":   c.Rejected.Load(),
+		"duplicates": c.Duplicates.Load(),
+		"written":    c.Written.Load(),
+		"dropped":    c.Dropped.Load(),
+	}
+	s["pending"] = s["parsed"] - s["duplicates"] - s["written"] - s["dropped"]
+	return s
+}
+
+// ingestStats holds the counts of a tenant in total and per node
+type ingestStats struct {
+	total ingestCounts
+
+	mu    sync.Mutex
+	nodes map[string]*ingestCounts
+}
+
+func newIngestStats() *ingestStats {
+	return &ingestStats{nodes: make(map[string]*ingestCounts)}
+}
+
+// add applies f to the total and to the counts of node
+func (s *ingestStats) add(node string, f func(c *ingestCounts)) {
+	s.mu.Lock()
+	c, ok := s.nodes[node]
+	if !ok {
+		c = new(ingestCounts)
+		s.nodes[node] = c
+	}
+	s.mu.Unlock()
+
+	f(&s.total)
+	f(c)
+}
+
+// byNode returns a snapshot of the counts of every node, sorted by name
+func (s *ingestStats) byNode() ([]string, []map[string]int64) {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.nodes))
+	for name := range s.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	counts := make([]*ingestCounts, len(names))
+	for i, name := range names {
+		counts[i] = s.nodes[name]
+	}
+	s.mu.Unlock()
+
+	snapshots := make([]map[string]int64, len(names))
+	for i, c := range counts {
+		snapshots[i] = c.snapshot()
+	}
+	return names, snapshots
+}
+
+// getStatsz reports the ingest counts of the tenant, so it can be verified
+// that every received record ends up written or is accounted for
+func getStatsz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	t := r.Context().Value(key("tenant")).(*tenant)
+	scope := requestScope(r.Context())
+	names, snapshots := t.stats.byNode()
+	nodes := make(map[string]map[string]int64, len(names))
+	for i, name := range names {
+		if scope.allows(name) {
+			nodes[name] = snapshots[i]
+		}
+	}
+	res := map[string]interface{}{
+		"tenant": t.Name,
+		"nodes":  nodes,
+	}
+	// the total would count the nodes outside the scope
+	if scope == nil {
+		res["total"] = t.stats.total.snapshot()
+	}
+	writeJSON(w, res)
+}
+
+// ingest stages in the order of the pipeline, as exported to Prometheus
+var ingestStages = []string{"received", "parsed", "rejected", "duplicates", "written", "dropped"}
+
+// collectIngest exports the ingest counts of every tenant and node
+func collectIngest(reg *tenantRegistry) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		tenants := sortedTenants(reg)
+
+		mw.family("sensor_ingest_records_total", "counter", "Records passing each ingest stage.")
+		for _, t := range tenants {
+			total := t.stats.total.snapshot()
+			for _, stage := range ingestStages {
+				mw.sample("sensor_ingest_records_total", float64(total[stage]), "tenant", t.Name, "stage", stage)
+			}
+		}
+
+		mw.family("sensor_node_ingest_records_total", "counter", "Records of a node passing each ingest stage.")
+		for _, t := range tenants {
+			names, snapshots := t.stats.byNode()
+			for i, name := range names {
+				for _, stage := range ingestStages {
+					mw.sample("sensor_node_ingest_records_total", float64(snapshots[i][stage]), "tenant", t.Name, "node", name, "stage", stage)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Adaptive reporting: the server picks the interval each node should report
+// at and returns it with every ingest and heartbeat response, so nodes sleep
+// longer when nothing happens.
+//
+//   - a field changing faster than its ADAPTIVE_RATES limit per minute makes
+//     the node report at ADAPTIVE_MIN_INTERVAL
+//   - during ADAPTIVE_NIGHT, in the timezone of the node, it reports at
+//     ADAPTIVE_MAX_INTERVAL
+//   - otherwise every quiet report, with all rates below a quarter of their
+//     limit, doubles the interval up to ADAPTIVE_MAX_INTERVAL, and any other
+//     report returns it to ADAPTIVE_INTERVAL
+
+// nightHours is a range of local hours, from inclusive to exclusive, that
+// may wrap around midnight
+type nightHours struct {
+	from, to int
+}
+
+// parseNightHours reads "22-6", empty for none
+func parseNightHours(v string) (*nightHours, error) {
+	if v == "" {
+		return nil, nil
+	}
+	a, b, ok := strings.Cut(v, "-")
+	from, errFrom := strconv.Atoi(a)
+	to, errTo := strconv.Atoi(b)
+	if !ok || errFrom != nil || errTo != nil || from < 0 || from > 23 || to < 0 || to > 23 || from == to {
+		return nil, fmt.Errorf("invalid ADAPTIVE_NIGHT: expected from-to hours, got %q", v)
+	}
+	return &nightHours{from, to}, nil
+}
+
+func (n *nightHours) contains(at time.Time) bool {
+	if n == nil {
+		return false
+	}
+	h := at.Hour()
+	if n.from < n.to {
+		return h >= n.from && h < n.to
+	}
+	return h >= n.from || h < n.to
+}
+
+// adaptInterval picks the next reporting interval of node after a report at
+// the given time and returns it, 0 when adaptive reporting is disabled
+func adaptInterval(t *tenant, cfg *config, node string, at time.Time) time.Duration {
+	if cfg.AdaptiveInterval <= 0 {
+		return 0
+	}
+	loc := time.UTC
+	if l, ok := cfg.NodeTimezones[node]; ok {
+		loc = l
+	}
+	return t.nodes.adaptInterval(node, func(current time.Duration, rates map[string]float64) time.Duration {
+		quiet := true
+		for f, limit := range cfg.AdaptiveRates {
+			rate := math.Abs(rates[f])
+			if rate > limit {
+				return cfg.AdaptiveMinInterval
+			}
+			if rate >= limit/4 {
+				quiet = false
+			}
+		}
+		switch {
+		case cfg.AdaptiveNight.contains(at.In(loc)):
+			return cfg.AdaptiveMaxInterval
+		case quiet && current > 0:
+			if current *= 2; current > cfg.AdaptiveMaxInterval {
+				current = cfg.AdaptiveMaxInterval
+			}
+			return current
+		default:
+			return cfg.AdaptiveInterval
+		}
+	})
+}
+
+// reportInterval returns the reporting interval last picked for node
+func (s *nodeStore) reportInterval(node string) time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if n, ok := s.nodes[node]; ok {
+		return time.Duration(n.ReportInterval) * time.Second
+	}
+	return 0
+}
+
+// adaptInterval replaces the reporting interval of node with what next makes
+// of the current one and the last rates of change
+func (s *nodeStore) adaptInterval(node string, next func(current time.Duration, rates map[string]float64) time.Duration) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.get(node)
+	interval := next(time.Duration(n.ReportInterval)*time.Second, n.Rates)
+	n.ReportInterval = int(interval / time.Second)
+	return interval
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// withAdmin only lets requests through that carry the configured admin token
+// as a bearer token, or act with the admin role, see rbac.go. Admin endpoints
+// are disabled when neither is configured.
+func withAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := r.Context().Value(key("config")).(*config)
+		reg := r.Context().Value(key("tenants")).(*tenantRegistry)
+		if cfg.AdminToken == "" && cfg.JWTSecret == "" && len(reg.keys) == 0 && len(cfg.BasicAuth) == 0 {
+			http.Error(w, "404 not found.", http.StatusNotFound)
+			return
+		}
+		token := bearerToken(r)
+		if cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1 {
+			next.ServeHTTP(w, withPrincipal(r, &principal{Name: "admin", Role: "admin"}))
+			return
+		}
+		// a bearer token that is no JWT is a wrong admin token, and
+		// requests without credentials would act anonymously
+		var p *principal
+		var err error
+		_, _, basic := r.BasicAuth()
+		if !looksLikeJWT(token) && (token != "" || requestAPIKey(r) == "" && sessionToken(r) == "" && !basic) {
+			err = fmt.Errorf("invalid admin token")
+		} else {
+			p, _, err = authenticate(r, cfg, reg)
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			challengeBasic(w, cfg)
+			http.Error(w, "401 - Invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		if !p.can(permAdmin) {
+			http.Error(w, fmt.Sprintf("403 - Role %s may not %s", p.Role, permAdmin), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, withPrincipal(r, p))
+	})
+}
+
+type deleteRequest struct {
+	Tenant      string    `json:"tenant"`
+	Node        string    `json:"node"`
+	Measurement string    `json:"measurement"`
+	Start       time.Time `json:"start"`
+	Stop        time.Time `json:"stop"`
+}
+
+// deletePredicate quotes a value for an InfluxDB delete predicate, escaping
+// backslashes before quotes so a trailing one cannot end the string
+func deletePredicate(name string, value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return name + `="` + r.Replace(value) + `"`
+}
+
+// postDelete removes the readings of one node in a time range, e.g. after a
+// sensor was miswired
+func postDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	reg := ctx.Value(key("tenants")).(*tenantRegistry)
+	audit := ctx.Value(key("audit")).(*auditLog)
+
+	var req deleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "400 - Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.Node == "" || req.Start.IsZero() || req.Stop.IsZero() || !req.Stop.After(req.Start) {
+		http.Error(w, "400 - node, start and stop are required", http.StatusBadRequest)
+		return
+	}
+	if err := validNode(req.Node); err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg := ctx.Value(key("config")).(*config)
+	if _, ok := cfg.Schema.Measurements[req.Measurement]; req.Measurement != "" && !ok {
+		http.Error(w, "400 - Unknown measurement", http.StatusBadRequest)
+		return
+	}
+	t := reg.byName(req.Tenant)
+	if t == nil {
+		http.Error(w, "400 - Unknown tenant", http.StatusBadRequest)
+		return
+	}
+
+	predicate := deletePredicate("location", req.Node)
+	if req.Measurement != "" {
+		predicate = deletePredicate("_measurement", req.Measurement) + " AND " + predicate
+	}
+
+	client := ctx.Value(key("db")).(influxdb2.Client)
+	err := client.DeleteAPI().DeleteWithName(ctx, t.Org, t.Bucket, req.Start, req.Stop, predicate)
+	audit.record(r, "delete", map[string]interface{}{
+		"tenant":    t.Name,
+		"predicate": predicate,
+		"start":     req.Start,
+		"stop":      req.Stop,
+		"error":     errString(err),
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "502 - Delete failed", http.StatusBadGateway)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"status":    "ok",
+		"tenant":    t.Name,
+		"predicate": predicate,
+		"start":     req.Start,
+		"stop":      req.Stop,
+	})
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return fmt.Sprint(err)
+}
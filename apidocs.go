@@ -0,0 +1,30 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed apidocs/openapi.json
+var openapiSpec []byte
+
+//go:embed apidocs/index.html
+var docsPage []byte
+
+func getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openapiSpec)
+}
+
+func getDocs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// auditLog appends one JSON line per administrative action. The file is only
+// ever appended to; GET /admin/audit reads it back.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+type auditEntry struct {
+	Time   time.Time              `json:"time"`
+	Actor  string                 `json:"actor"`
+	Remote string                 `json:"remote"`
+	Action string                 `json:"action"`
+	Params map[string]interface{} `json:"params"`
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path, file: f}, nil
+}
+
+func (a *auditLog) record(r *http.Request, action string, params map[string]interface{}) {
+	entry := auditEntry{
+		Time:   time.Now(),
+		Actor:  r.Context().Value(key("principal")).(*principal).Name,
+		Remote: r.RemoteAddr,
+		Action: action,
+		Params: params,
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("audit log: %s\n", err)
+	}
+}
+
+// entries reads the entries of action (all when empty) since the given time,
+// the newest limit of them in the order they were recorded
+func (a *auditLog) entries(action string, since time.Time, limit int) ([]auditEntry, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []auditEntry{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			// a line cut short by a crash
+			continue
+		}
+		if (action != "" && e.Action != action) || e.Time.Before(since) {
+			continue
+		}
+		entries = append(entries, e)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	return entries, sc.Err()
+}
+
+// getAudit lists the recorded administrative actions, read-only
+func getAudit(w http.ResponseWriter, r *http.Request) {
+	audit := r.Context().Value(key("audit")).(*auditLog)
+	q := r.URL.Query()
+
+	since, err := parseTimeParam(q.Get("since"), time.Time{})
+	if err != nil {
+		http.Error(w, "400 - invalid since", http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 10000 {
+			http.Error(w, "400 - invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := audit.entries(q.Get("action"), since, limit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "500 - Reading the audit log failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"entries": entries})
+}
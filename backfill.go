@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// rows are checked for conflicts and written in chunks of this size
+const backfillChunk = 5000
+
+// at most this many row errors are kept in a job
+const backfillMaxErrors = 100
+
+const (
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictTag       = "tag"
+)
+
+type backfillRow struct {
+	node string
+	rd   reading
+	// the time was an epoch timestamp of the node clock, not RFC3339
+	epoch bool
+}
+
+// backfillJob is an import running in the background, polled by the client
+type backfillJob struct {
+	mu sync.Mutex
+
+	ID        string        `json:"id"`
+	Tenant    string        `json:"tenant"`
+	Bucket    string        `json:"bucket"`
+	Conflict  string        `json:"conflict"`
+	State     string        `json:"state"`
+	Total     int           `json:"total"`
+	Processed int           `json:"processed"`
+	Written   int           `json:"written"`
+	Skipped   int           `json:"skipped"`
+	Tagged    int           `json:"tagged"`
+	Rejected  int           `json:"rejected"`
+	Errors    []recordError `json:"errors,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	Started   time.Time     `json:"started"`
+	Finished  *time.Time    `json:"finished,omitempty"`
+}
+
+func (j *backfillJob) snapshot() map[string]interface{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	raw, _ := json.Marshal(j)
+	var m map[string]interface{}
+	json.Unmarshal(raw, &m)
+	if j.Total > 0 {
+		m["progress"] = float64(j.Processed) / float64(j.Total)
+	}
+	return m
+}
+
+type backfillJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*backfillJob
+}
+
+func newBackfillJobs() *backfillJobs {
+	return &backfillJobs{jobs: make(map[string]*backfillJob)}
+}
+
+func (b *backfillJobs) add(j *backfillJob) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.jobs[j.ID] = j
+}
+
+func (b *backfillJobs) get(id string) *backfillJob {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.jobs[id]
+}
+
+// pending counts the rows of running jobs that are not written yet
+func (b *backfillJobs) pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for _, j := range b.jobs {
+		j.mu.Lock()
+		if j.State == "running" {
+			n += j.Total - j.Processed
+		}
+		j.mu.Unlock()
+	}
+	return n
+}
+
+func newJobID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// postBackfill imports a historical dataset given as CSV or JSON. The rows
+// are parsed up front, then written in the background while the client
+// polls the returned job.
+func postBackfill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+	jobs := ctx.Value(key("backfill")).(*backfillJobs)
+	client := ctx.Value(key("db")).(influxdb2.Client)
+
+	q := r.URL.Query()
+	conflict := q.Get("conflict")
+	if conflict == "" {
+		conflict = conflictSkip
+	}
+	if conflict != conflictSkip && conflict != conflictOverwrite && conflict != conflictTag {
+		http.Error(w, "400 - conflict must be skip, overwrite or tag", http.StatusBadRequest)
+		return
+	}
+
+	bucket := q.Get("bucket")
+	if bucket == "" {
+		bucket = t.Bucket
+	}
+	if bucket != t.Bucket && !contains(cfg.BackfillBuckets, bucket) {
+		http.Error(w, "403 - Bucket is not allowed", http.StatusForbidden)
+		return
+	}
+
+	unit := cfg.TimestampPrecision
+	if p := q.Get("precision"); p != "" {
+		var err error
+		if unit, err = parsePrecision(p); err != nil {
+			http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	format := q.Get("format")
+	if format == "" {
+		format = formatJSON
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			format = formatCSV
+		}
+	}
+
+	body := http.MaxBytesReader(w, r.Body, cfg.BackfillMaxBytes)
+	var rows []backfillRow
+	var rejected []recordError
+	var err error
+	switch format {
+	case formatCSV:
+		rows, rejected, err = parseBackfillCSV(body, cfg.Schema, unit)
+	case formatJSON:
+		rows, rejected, err = parseBackfillJSON(body, cfg.Schema, unit)
+	default:
+		http.Error(w, "400 - format must be csv or json", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range rows {
+		if rows[i].epoch {
+			rows[i].rd.Time = cfg.deviceTime(rows[i].node, rows[i].rd.Time)
+		}
+	}
+
+	job := &backfillJob{
+		ID:       newJobID(),
+		Tenant:   t.Name,
+		Bucket:   bucket,
+		Conflict: conflict,
+		State:    "running",
+		Total:    len(rows) + len(rejected),
+		Rejected: len(rejected),
+		Started:  time.Now(),
+	}
+	job.Processed = job.Rejected
+	if len(rejected) > backfillMaxErrors {
+		rejected = rejected[:backfillMaxErrors]
+	}
+	job.Errors = rejected
+	jobs.add(job)
+
+	go job.run(client.WriteAPIBlocking(t.Org, bucket), t.queryApi, t.cache, cfg.Schema, rows)
+
+	w.Header().Set("Location", r.URL.Path+"/"+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	msg, _ := json.Marshal(job.snapshot())
+	w.Write(msg)
+}
+
+func getBackfillJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	t := r.Context().Value(key("tenant")).(*tenant)
+	jobs := r.Context().Value(key("backfill")).(*backfillJobs)
+
+	id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	job := jobs.get(id)
+	if job == nil || job.Tenant != t.Name {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, job.snapshot())
+}
+
+func (j *backfillJob) run(writeApi api.WriteAPIBlocking, queryApi api.QueryAPI, cache *queryCache, schema *sensorSchema, rows []backfillRow) {
+	ctx := context.Background()
+
+	for start := 0; start < len(rows); start += backfillChunk {
+		end := start + backfillChunk
+		if end > len(rows) {
+			end = len(rows)
+		}
+		chunk := rows[start:end]
+
+		var existing map[string]bool
+		if j.Conflict != conflictOverwrite {
+			var err error
+			if existing, err = existingTimestamps(ctx, queryApi, schema, j.Bucket, chunk); err != nil {
+				j.fail(err)
+				return
+			}
+		}
+
+		var points []*write.Point
+		written, skipped, tagged := 0, 0, 0
+		for _, row := range chunk {
+			conflicting := existing[row.node+"\x00"+strconv.FormatInt(row.rd.Time.UnixNano(), 10)]
+			if conflicting && j.Conflict == conflictSkip {
+				skipped++
+				continue
+			}
+			ps := schema.points(row.node, row.rd, false, time.Time{})
+			if conflicting && j.Conflict == conflictTag {
+				// a differing tag keeps the stored point next to the imported one
+				for _, p := range ps {
+					p.AddTag("backfill_conflict", "true")
+				}
+				tagged++
+			}
+			points = append(points, ps...)
+			written++
+		}
+
+		if len(points) > 0 {
+			if err := writeApi.WritePoint(ctx, points...); err != nil {
+				j.fail(err)
+				return
+			}
+			for _, row := range chunk {
+				cache.invalidate(row.node)
+			}
+		}
+
+		j.mu.Lock()
+		j.Processed += len(chunk)
+		j.Written += written
+		j.Skipped += skipped
+		j.Tagged += tagged
+		j.mu.Unlock()
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.State = "done"
+	j.Finished = &now
+	log.Printf("backfill %s done: %d written, %d skipped, %d tagged, %d rejected\n", j.ID, j.Written, j.Skipped, j.Tagged, j.Rejected)
+}
+
+func (j *backfillJob) fail(err error) {
+	log.Printf("backfill %s failed: %s\n", j.ID, err)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.State = "failed"
+	j.Error = err.Error()
+	j.Finished = &now
+}
+
+// existingTimestamps returns the node and time keys of readings already
+// stored in the time range of chunk
+func existingTimestamps(ctx context.Context, queryApi api.QueryAPI, schema *sensorSchema, bucket string, chunk []backfillRow) (map[string]bool, error) {
+	nodes := make(map[string]bool)
+	first, last := chunk[0].rd.Time, chunk[0].rd.Time
+	for _, row := range chunk {
+		nodes[row.node] = true
+		if row.rd.Time.Before(first) {
+			first = row.rd.Time
+		}
+		if row.rd.Time.After(last) {
+			last = row.rd.Time
+		}
+	}
+	var filters []string
+	for n := range nodes {
+		filters = append(filters, "r.location == "+fluxString(n))
+	}
+
+	flux := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %s and r._field == %s)
+  |> filter(fn: (r) => %s)
+  |> keep(columns: ["_time", "location"])`,
+		fluxString(bucket), first.UTC().Format(time.RFC3339Nano), last.Add(time.Nanosecond).UTC().Format(time.RFC3339Nano),
+		fluxString(schema.primary().Measurement), fluxString(schema.primary().Name), strings.Join(filters, " or "))
+
+	result, err := queryApi.Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	existing := make(map[string]bool)
+	for result.Next() {
+		rec := result.Record()
+		node, _ := rec.ValueByKey("location").(string)
+		existing[node+"\x00"+strconv.FormatInt(rec.Time().UnixNano(), 10)] = true
+	}
+	return existing, result.Err()
+}
+
+// parseBackfillTime accepts RFC3339 or an epoch timestamp in unit, which
+// is read from the node clock
+func parseBackfillTime(v string, unit time.Duration) (t time.Time, epoch bool, err error) {
+	if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+		t, err = epochTime(ts, unit)
+		return t, true, err
+	}
+	t, err = time.Parse(time.RFC3339Nano, v)
+	return t, false, err
+}
+
+// backfillColumns are node, time and the schema fields; only optional
+// fields may be missing
+func backfillColumns(schema *sensorSchema) (columns []string, required []string) {
+	columns = []string{"node", "time"}
+	required = []string{"node", "time"}
+	for _, f := range schema.Fields {
+		columns = append(columns, f.Name)
+		if !f.Optional {
+			required = append(required, f.Name)
+		}
+	}
+	return columns, required
+}
+
+// parseBackfillCSV reads a CSV with a header naming the backfillColumns
+func parseBackfillCSV(body io.Reader, schema *sensorSchema, unit time.Duration) ([]backfillRow, []recordError, error) {
+	cr := csv.NewReader(body)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	index := make(map[string]int)
+	for i, name := range header {
+		index[strings.TrimSpace(name)] = i
+	}
+	columns, required := backfillColumns(schema)
+	for _, c := range required {
+		if _, ok := index[c]; !ok {
+			return nil, nil, fmt.Errorf("CSV header is missing column %q", c)
+		}
+	}
+
+	var rows []backfillRow
+	var rejected []recordError
+	for i := 0; ; i++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				rejected = append(rejected, recordError{Index: i, Reason: err.Error()})
+				continue
+			}
+			return nil, nil, err
+		}
+		values := make(map[string]string)
+		for _, c := range columns {
+			if i, ok := index[c]; ok && i < len(record) {
+				values[c] = strings.TrimSpace(record[i])
+			}
+		}
+		row, err := backfillRowFrom(values, schema, unit)
+		if err != nil {
+			rejected = append(rejected, recordError{Index: i, Reason: err.Error()})
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, rejected, nil
+}
+
+// parseBackfillJSON reads an array of objects with the backfillColumns as keys
+func parseBackfillJSON(body io.Reader, schema *sensorSchema, unit time.Duration) ([]backfillRow, []recordError, error) {
+	var objects []map[string]interface{}
+	if err := json.NewDecoder(body).Decode(&objects); err != nil {
+		return nil, nil, fmt.Errorf("invalid JSON body: %w", err)
+	}
+
+	columns, _ := backfillColumns(schema)
+	var rows []backfillRow
+	var rejected []recordError
+	for i, obj := range objects {
+		values := make(map[string]string)
+		for _, c := range columns {
+			switch v := obj[c].(type) {
+			case string:
+				values[c] = v
+			case float64:
+				values[c] = strconv.FormatFloat(v, 'f', -1, 64)
+			}
+		}
+		row, err := backfillRowFrom(values, schema, unit)
+		if err != nil {
+			rejected = append(rejected, recordError{Index: i, Reason: err.Error()})
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, rejected, nil
+}
+
+func backfillRowFrom(values map[string]string, schema *sensorSchema, unit time.Duration) (backfillRow, error) {
+	row := backfillRow{node: values["node"]}
+	if row.node == "" {
+		return row, errors.New("missing node")
+	}
+	if err := validNode(row.node); err != nil {
+		return row, err
+	}
+	var err error
+	if row.rd.Time, row.epoch, err = parseBackfillTime(values["time"], unit); err != nil {
+		return row, errors.New("invalid time")
+	}
+	row.rd.Values = make(map[string]float64)
+	for _, f := range schema.Fields {
+		if values[f.Name] == "" && f.Optional {
+			continue
+		}
+		v, err := parseValue(f.Name, values[f.Name])
+		if err != nil {
+			return row, err
+		}
+		row.rd.Values[f.Name] = v
+	}
+	return row, nil
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Basic auth: for small single-tenant deployments BASIC_AUTH lists the
+// accounts of the read and admin endpoints and of the dashboard as
+// user:password[:role], without a users file or a provider. The password may
+// be a hash of hashPassword, the role defaults to admin. Nodes keep posting
+// without credentials.
+
+type basicAccount struct {
+	Name     string
+	Password string
+	Role     string
+}
+
+// parseBasicAuth reads "lab:secret,assistant:pbkdf2-sha256$...:viewer"
+func parseBasicAuth(v string) ([]basicAccount, error) {
+	var accounts []basicAccount
+	for _, entry := range splitList(v) {
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid BASIC_AUTH: expected user:password[:role], got %q", parts[0])
+		}
+		a := basicAccount{Name: parts[0], Password: parts[1], Role: "admin"}
+		if len(parts) == 3 {
+			a.Role = parts[2]
+		}
+		if !validRole(a.Role) {
+			return nil, fmt.Errorf("invalid BASIC_AUTH: unknown role %q of %q", a.Role, a.Name)
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, nil
+}
+
+// basicPrincipal checks the basic auth credentials of a request, false when
+// it carries none
+func basicPrincipal(r *http.Request, cfg *config) (*principal, bool, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok || len(cfg.BasicAuth) == 0 {
+		return nil, false, nil
+	}
+	for _, a := range cfg.BasicAuth {
+		if a.Name != username {
+			continue
+		}
+		if strings.HasPrefix(a.Password, "pbkdf2-sha256$") {
+			ok = checkPassword(a.Password, password)
+		} else {
+			want, got := sha256.Sum256([]byte(a.Password)), sha256.Sum256([]byte(password))
+			ok = subtle.ConstantTimeCompare(want[:], got[:]) == 1
+		}
+		if ok {
+			return &principal{Name: a.Name, Role: a.Role}, true, nil
+		}
+		break
+	}
+	return nil, true, fmt.Errorf("invalid username or password")
+}
+
+// challengeBasic asks browsers for the credentials of BASIC_AUTH
+func challengeBasic(w http.ResponseWriter, cfg *config) {
+	if len(cfg.BasicAuth) > 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="sensor server", charset="UTF-8"`)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+)
+
+// observeBattery keeps the last battery voltage and RSSI reported by node
+// and returns true when its battery just dropped below the threshold
+func (s *nodeStore) observeBattery(node string, rd reading, threshold float64) bool {
+	battery, hasBattery := rd.Values["battery"]
+	rssi, hasRSSI := rd.Values["rssi"]
+	if !hasBattery && !hasRSSI {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.get(node)
+	if hasRSSI {
+		n.RSSI = &rssi
+	}
+	if !hasBattery {
+		return false
+	}
+	n.Battery = &battery
+	wasLow := n.LowBattery
+	n.LowBattery = threshold > 0 && battery < threshold
+	return n.LowBattery && !wasLow
+}
+
+// lowBattery raises an event for a node whose battery dropped below the
+// configured voltage
+func (b *eventBus) lowBattery(t *tenant, node string, rd reading) {
+	b.emit(t, event{
+		Node:  node,
+		Type:  "low_battery",
+		Title: "Low battery",
+		Text:  fmt.Sprintf("battery at %.2f V, below %.2f V", rd.Values["battery"], b.cfg.LowBatteryVoltage),
+		Time:  rd.Time,
+	})
+}
+
+// collectBattery exports the last battery voltage and RSSI of every node
+// reporting them, for alerting on low batteries and weak links
+func collectBattery(reg *tenantRegistry) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		type row struct {
+			tenant string
+			n      nodeStatus
+		}
+		var rows []row
+		for _, t := range sortedTenants(reg) {
+			for _, n := range t.nodes.list() {
+				rows = append(rows, row{t.Name, n})
+			}
+		}
+
+		families := []struct {
+			name, help string
+			value      func(n nodeStatus) *float64
+		}{
+			{"sensor_node_battery_volts", "Last battery voltage reported by a node.", func(n nodeStatus) *float64 { return n.Battery }},
+			{"sensor_node_rssi_dbm", "Last Wi-Fi or LoRa signal strength reported by a node.", func(n nodeStatus) *float64 { return n.RSSI }},
+		}
+		for _, f := range families {
+			mw.family(f.name, "gauge", f.help)
+			for _, row := range rows {
+				if v := f.value(row.n); v != nil {
+					mw.sample(f.name, *v, "tenant", row.tenant, "node", row.n.Node)
+				}
+			}
+		}
+	}
+}
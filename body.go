@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// bodyError is a request body that cannot be decoded, answered with status
+type bodyError struct {
+	status int
+	msg    string
+}
+
+func (e *bodyError) Error() string {
+	return e.msg
+}
+
+// writeBodyError answers err with its status, or 400 for other errors
+func writeBodyError(w http.ResponseWriter, err error) {
+	log.Printf("Error: %s\n", err)
+	status := http.StatusBadRequest
+	var be *bodyError
+	if errors.As(err, &be) {
+		status = be.status
+	}
+	http.Error(w, fmt.Sprintf("%d - %s", status, err), status)
+}
+
+// mediaType returns the media type of the body without parameters, "" when
+// the request declares none
+func mediaType(r *http.Request) (string, error) {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return "", nil
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return "", &bodyError{http.StatusBadRequest, fmt.Sprintf("invalid Content-Type %q", ct)}
+	}
+	return mt, nil
+}
+
+// parseForm parses the query and a urlencoded or multipart body of at most
+// INGEST_MAX_BYTES, which is kept in memory. It runs before any handler
+// reads a form value, which would otherwise silently see a malformed body as
+// missing values.
+func parseForm(r *http.Request) error {
+	mt, err := mediaType(r)
+	if err != nil {
+		return err
+	}
+	// other bodies are left to the handler, which sets its own limit
+	var limit int64
+	switch mt {
+	case "multipart/form-data":
+		limit = limitBody(nil, r)
+		err = r.ParseMultipartForm(limit)
+	case "application/x-www-form-urlencoded":
+		limit = limitBody(nil, r)
+		err = r.ParseForm()
+	default:
+		err = r.ParseForm()
+	}
+	if err == nil {
+		return nil
+	}
+	if tooLarge(err) {
+		return &bodyError{http.StatusRequestEntityTooLarge, fmt.Sprintf("body larger than %d bytes", limit)}
+	}
+	msg := "malformed form body: " + err.Error()
+	if strings.Contains(err.Error(), "semicolon") {
+		msg += " (percent-encode ';' in values as %3B)"
+	}
+	return &bodyError{http.StatusBadRequest, msg}
+}
+
+// limitBody caps the body of r at INGEST_MAX_BYTES and returns the limit. w
+// may be nil, MaxBytesReader only uses it to close the connection.
+func limitBody(w http.ResponseWriter, r *http.Request) int64 {
+	limit := r.Context().Value(key("config")).(*config).IngestMaxBytes
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return limit
+}
+
+// tooLarge reports whether err comes from reading past http.MaxBytesReader.
+// The multipart reader formats the error with %v, so the message is checked
+// too.
+func tooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe) || strings.Contains(err.Error(), "http: request body too large")
+}
+
+// legacyForm marks requests to the original /api endpoint, see decodeIngest
+func legacyForm(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), key("legacyForm"), true)))
+	})
+}
+
+const ingestMediaTypes = "application/x-www-form-urlencoded, multipart/form-data, text/plain or application/json"
+
+// ingestBody is an ingest request decoded from any of the accepted encodings
+type ingestBody struct {
+	Node      string
+	Precision string
+	// age of the newest reading, form and text bodies only
+	Age string
+	// number of the submission, see sequence.go
+	Seq string
+	// message ID, index and count of a fragment, see fragments.go; form and
+	// text bodies only
+	Msg, Frag, Frags string
+	// records as sent, form and text bodies only
+	Data string
+	// JSON bodies only
+	JSON *jsonPayload
+}
+
+// decodeIngest reads an ingest request by its Content-Type:
+//   - application/x-www-form-urlencoded and multipart/form-data carry the
+//     node, precision, age, seq, msg, frag, frags and data form values
+//   - text/plain carries the records as the raw body, the other values go
+//     in the query
+//   - application/json, see jsonpayload.go
+//
+// Requests to /api without a Content-Type are read as form values, the way
+// the original endpoint did. Bodies are limited to INGEST_MAX_BYTES by
+// limitBody.
+func decodeIngest(r *http.Request) (ingestBody, error) {
+	mt, err := mediaType(r)
+	if err != nil {
+		return ingestBody{}, err
+	}
+
+	var body ingestBody
+	switch mt {
+	case "application/json":
+		payload, err := decodeJSONPayload(r.Body)
+		if err != nil {
+			return body, err
+		}
+		body.JSON = &payload
+		body.Node = payload.Node
+		body.Precision = payload.Precision
+		body.Seq = payload.Seq.String()
+		return body, nil
+	case "text/plain":
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			return body, &bodyError{http.StatusBadRequest, "reading body: " + err.Error()}
+		}
+		if len(raw) == 0 {
+			return body, &bodyError{http.StatusBadRequest, "empty body"}
+		}
+		body.Data = string(raw)
+	case "":
+		if r.Context().Value(key("legacyForm")) == nil {
+			return body, &bodyError{http.StatusUnsupportedMediaType, "missing Content-Type, expected " + ingestMediaTypes}
+		}
+		// the original endpoint read form values, deployed nodes send
+		// them in the query without a Content-Type
+		fallthrough
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if err := parseForm(r); err != nil {
+			return body, err
+		}
+		if _, ok := r.Form["data"]; !ok {
+			return body, &bodyError{http.StatusBadRequest, "missing form value data"}
+		}
+		body.Data = r.FormValue("data")
+	default:
+		return body, &bodyError{http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported Content-Type %q, expected %s", mt, ingestMediaTypes)}
+	}
+	body.Node = r.FormValue("node")
+	body.Precision = r.FormValue("precision")
+	body.Age = r.FormValue("age")
+	body.Seq = r.FormValue("seq")
+	body.Msg = r.FormValue("msg")
+	body.Frag = r.FormValue("frag")
+	body.Frags = r.FormValue("frags")
+	return body, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+)
+
+// bootstrap creates the orgs and buckets of the tenants that do not exist
+// yet, the buckets with BUCKET_RETENTION. Existing buckets are left as they
+// are. It needs a token allowed to create them, usually the operator token
+// of a fresh install; an unreachable InfluxDB is only logged.
+func bootstrap(cfg *config, client influxdb2.Client) error {
+	reg, err := loadTenants(cfg, client)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	orgs := client.OrganizationsAPI()
+	buckets := client.BucketsAPI()
+	for _, t := range sortedTenants(reg) {
+		org, err := orgs.FindOrganizationByName(ctx, t.Org)
+		if err != nil && isNotFound(err) {
+			org, err = orgs.CreateOrganizationWithName(ctx, t.Org)
+			if err == nil {
+				log.Printf("bootstrap: created org %q\n", t.Org)
+			}
+		}
+		if err != nil {
+			return bootstrapError(err, fmt.Sprintf("org %q", t.Org))
+		}
+
+		if _, err := buckets.FindBucketByName(ctx, t.Bucket); err == nil {
+			continue
+		} else if !isNotFound(err) {
+			return bootstrapError(err, fmt.Sprintf("bucket %q", t.Bucket))
+		}
+		b := &domain.Bucket{
+			OrgID:          org.Id,
+			Name:           t.Bucket,
+			RetentionRules: retentionRules(cfg.BucketRetention),
+		}
+		if _, err := buckets.CreateBucket(ctx, b); err != nil {
+			return bootstrapError(err, fmt.Sprintf("bucket %q", t.Bucket))
+		}
+		retention := "forever"
+		if cfg.BucketRetention > 0 {
+			retention = shortDuration(cfg.BucketRetention)
+		}
+		log.Printf("bootstrap: created bucket %q in org %q, retention %s\n", t.Bucket, t.Org, retention)
+	}
+	return nil
+}
+
+// managementError classifies an error of the management API, which the
+// client only reports as text: "<code>: <message>" for answers of InfluxDB,
+// "<org|bucket> '<name>' not found" for empty lookups
+func managementError(err error) domain.ErrorCode {
+	msg := err.Error()
+	if strings.HasSuffix(msg, "' not found") {
+		return domain.ErrorCodeNotFound
+	}
+	for _, code := range []domain.ErrorCode{domain.ErrorCodeNotFound, domain.ErrorCodeUnauthorized, domain.ErrorCodeForbidden} {
+		if strings.HasPrefix(msg, string(code)+": ") {
+			return code
+		}
+	}
+	return ""
+}
+
+func isNotFound(err error) bool {
+	return managementError(err) == domain.ErrorCodeNotFound
+}
+
+func bootstrapError(err error, what string) error {
+	switch managementError(err) {
+	case domain.ErrorCodeUnauthorized, domain.ErrorCodeForbidden:
+		return fmt.Errorf("bootstrap: the token may not look up or create %s, use an operator token or create it by hand: %w", what, err)
+	case domain.ErrorCodeNotFound:
+		return fmt.Errorf("bootstrap: %s: %w", what, err)
+	}
+	log.Printf("bootstrap skipped, InfluxDB not usable yet: %s\n", err)
+	return nil
+}
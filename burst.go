@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// burstMeasurement holds the samples of burst uploads, tagged with the id of
+// the burst command as burst
+const burstMeasurement = "bursts"
+
+// Burst mode: when an event of BURST_EVENTS is detected on a node, a "burst"
+// command asks it to sample the BURST_MEASUREMENT fields at BURST_RATE Hz for
+// BURST_DURATION. The node uploads the samples to /v1/burst in one request:
+//
+//	{"node": "lab-1", "burst": "<command id>", "start": <epoch>,
+//	 "samples": [[x, y, z], ...]}
+//
+// start is the time of the first sample in TIMESTAMP_PRECISION units, the
+// others follow at the commanded rate. The upload acknowledges the command.
+
+// validateBurst checks the params of a burst command
+func validateBurst(params map[string]interface{}) error {
+	rate, okRate := params["rate"].(float64)
+	duration, okDuration := params["duration"].(float64)
+	if len(params) != 2 || !okRate || !okDuration || rate <= 0 || duration <= 0 {
+		return fmt.Errorf("burst takes a positive rate in Hz and duration in seconds")
+	}
+	return nil
+}
+
+// requestBurst queues a burst command for node unless one is still pending
+func requestBurst(t *tenant, cfg *config, ev event) {
+	c, queued := t.commands.enqueueOnce(ev.Node, "burst", map[string]interface{}{
+		"rate":     cfg.BurstRate,
+		"duration": cfg.BurstDuration.Seconds(),
+	})
+	if queued {
+		log.Printf("burst %s requested from %s after %s event\n", c.ID, ev.Node, ev.Type)
+	}
+}
+
+type burstUpload struct {
+	Node    string      `json:"node"`
+	Burst   string      `json:"burst"`
+	Start   int64       `json:"start"`
+	Samples [][]float64 `json:"samples"`
+}
+
+// postBurst stores the samples of a requested burst
+func postBurst(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+
+	var body burstUpload
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "400 - Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if body.Node == "" || body.Burst == "" || len(body.Samples) == 0 {
+		http.Error(w, "400 - node, burst and samples are required", http.StatusBadRequest)
+		return
+	}
+	if err := validNode(body.Node); err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, ok := t.commands.get(body.Node, body.Burst)
+	if !ok || c.Command != "burst" || c.Status == "canceled" {
+		http.Error(w, "404 - Unknown burst", http.StatusNotFound)
+		return
+	}
+	rate := c.Params["rate"].(float64)
+	duration := c.Params["duration"].(float64)
+	// some slack for nodes whose clock runs a little fast
+	if limit := int(math.Ceil(rate*duration*1.1)) + 1; len(body.Samples) > limit {
+		http.Error(w, fmt.Sprintf("400 - at most %d samples for a burst of %gs at %g Hz", limit, duration, rate), http.StatusBadRequest)
+		return
+	}
+
+	fields := cfg.Schema.Measurements[cfg.BurstMeasurement]
+	interval := time.Duration(float64(time.Second) / rate)
+	start := time.Unix(0, body.Start*int64(cfg.TimestampPrecision))
+	if body.Start == 0 {
+		// no clock, the upload follows the last sample
+		start = time.Now().Add(-interval * time.Duration(len(body.Samples)-1))
+	} else {
+		start = cfg.deviceTime(body.Node, start)
+	}
+
+	var points []*write.Point
+	for i, s := range body.Samples {
+		if len(s) != len(fields) {
+			http.Error(w, fmt.Sprintf("400 - sample %d: expected %d values", i, len(fields)), http.StatusBadRequest)
+			return
+		}
+		p := cfg.Schema.newPoint(burstMeasurement, body.Node, start.Add(interval*time.Duration(i)))
+		p.AddTag("burst", c.ID)
+		for j, f := range fields {
+			p.AddField(f, s[j])
+		}
+		points = append(points, p)
+	}
+
+	written := func() { t.cache.invalidate(body.Node) }
+	t.maintenance.label(body.Node, points)
+	if _, err := t.writer.write(ctx, written, points...); err != nil {
+		if errors.Is(err, errWriteRejected) {
+			writeRejected(w, err)
+			return
+		}
+		if !errors.Is(err, errBufferFull) {
+			log.Printf("burst upload canceled: %s\n", err)
+			return
+		}
+		log.Println(err)
+		t.usage.Throttled.Add(1)
+		writeOverloaded(w, cfg.RetryAfter)
+		return
+	}
+	t.usage.Readings.Add(int64(len(points)))
+
+	writeIngestResult(w, http.StatusOK, ingestResult{
+		Status:   "ok",
+		Accepted: len(points),
+		Commands: t.commands.exchange(body.Node, append(requestAcks(r), c.ID)),
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queryCache keeps the responses of recent queries of a tenant for a short
+// time (QUERY_CACHE_TTL), so dashboards refreshing at the same moment share
+// one query to InfluxDB. Responses are cached per node or zone and dropped
+// when the node, or a node of the zone, is written to. A nil cache keeps
+// nothing.
+type queryCache struct {
+	ttl   time.Duration
+	max   int
+	zones *zones
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+	// bumped by every write of a scope, a node or "zone:<name>"
+	generations map[string]uint64
+
+	hits, misses atomic.Int64
+}
+
+type cachedResponse struct {
+	// closed once the response is stored or given up on
+	ready      chan struct{}
+	expires    time.Time
+	scope      string
+	generation uint64
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+func newQueryCache(ttl time.Duration, max int, zones *zones) *queryCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &queryCache{
+		ttl:         ttl,
+		max:         max,
+		zones:       zones,
+		entries:     make(map[string]*cachedResponse),
+		generations: make(map[string]uint64),
+	}
+}
+
+// begin returns the entry for k. fill is true when the caller has to run
+// the query and finish the entry, otherwise the entry is filled or being
+// filled by another request.
+func (c *queryCache) begin(k string, scope string) (e *cachedResponse, fill bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if e, found := c.entries[k]; found && now.Before(e.expires) && e.generation == c.generations[scope] {
+		c.hits.Add(1)
+		return e, false
+	}
+	c.misses.Add(1)
+
+	if len(c.entries) >= c.max {
+		c.evict(now)
+	}
+	e = &cachedResponse{
+		ready:      make(chan struct{}),
+		expires:    now.Add(c.ttl),
+		scope:      scope,
+		generation: c.generations[scope],
+	}
+	c.entries[k] = e
+	return e, true
+}
+
+// finish stores the response of an entry returned by begin for filling.
+// Only successful responses are kept.
+func (c *queryCache) finish(k string, e *cachedResponse, rec *responseRecorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer close(e.ready)
+
+	if rec.status != http.StatusOK {
+		if c.entries[k] == e {
+			delete(c.entries, k)
+		}
+		return
+	}
+	e.status = rec.status
+	e.header = ownHeaders(rec.Header(), cachedHeaders)
+	e.body = rec.body.Bytes()
+}
+
+// cachedHeaders are the headers the query handlers set; CORS, the request ID
+// and the server time are set by the middleware for the request at hand
+var cachedHeaders = []string{"Content-Type", "ETag", "Last-Modified", "Link", "Deprecation", "Cache-Control"}
+
+// invalidate drops the cached responses of node and of its zone
+func (c *queryCache) invalidate(node string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generations[node]++
+	if z := c.zones.of(node); z != "" {
+		c.generations["zone:"+z]++
+	}
+}
+
+// evict drops expired and outdated entries, and the oldest one if the cache
+// is still full. c.mu must be held.
+func (c *queryCache) evict(now time.Time) {
+	var oldest string
+	for k, e := range c.entries {
+		if !now.Before(e.expires) || e.generation != c.generations[e.scope] {
+			delete(c.entries, k)
+		} else if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+			oldest = k
+		}
+	}
+	if len(c.entries) >= c.max && oldest != "" {
+		delete(c.entries, oldest)
+	}
+}
+
+// cacheScope is the node or zone a query reads, empty for queries over the
+// whole tenant, which are not cached
+func cacheScope(r *http.Request) string {
+	if node := r.URL.Query().Get("node"); node != "" {
+		return node
+	}
+	for _, prefix := range []string{"/nodes/", "/zones/"} {
+		if _, rest, ok := strings.Cut(r.URL.Path, prefix); ok {
+			name, _, _ := strings.Cut(rest, "/")
+			if name == "" {
+				return ""
+			}
+			if prefix == "/zones/" {
+				return "zone:" + name
+			}
+			return name
+		}
+	}
+	return ""
+}
+
+// withQueryCache answers GET requests from the query cache of the tenant,
+// marking the response with X-Cache
+func withQueryCache(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := r.Context().Value(key("tenant")).(*tenant)
+		scope := cacheScope(r)
+		if t.cache == nil || r.Method != "GET" || scope == "" {
+			next(w, r)
+			return
+		}
+
+		k := r.URL.Path + "?" + r.URL.RawQuery + "\x00" + r.Header.Get("Accept") + "\x00" + scopeKey(r.Context())
+		e, fill := t.cache.begin(k, scope)
+		if !fill {
+			select {
+			case <-e.ready:
+			case <-r.Context().Done():
+				return
+			}
+			// the request filling it failed, try on our own
+			if e.status == 0 {
+				next(w, r)
+				return
+			}
+			for name, values := range e.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		rec := &responseRecorder{ResponseWriter: w}
+		defer t.cache.finish(k, e, rec)
+		next(rec, r)
+	}
+}
+
+// collectQueryCache exports the hits and misses of the query cache of every
+// tenant
+func collectQueryCache(reg *tenantRegistry) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		mw.family("sensor_query_cache_requests_total", "counter", "Cacheable queries answered from the query cache (hit) or InfluxDB (miss).")
+		for _, t := range sortedTenants(reg) {
+			if t.cache == nil {
+				continue
+			}
+			mw.sample("sensor_query_cache_requests_total", float64(t.cache.hits.Load()), "tenant", t.Name, "result", "hit")
+			mw.sample("sensor_query_cache_requests_total", float64(t.cache.misses.Load()), "tenant", t.Name, "result", "miss")
+		}
+	}
+}
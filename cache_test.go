@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryCacheHeaders(t *testing.T) {
+	tn := &tenant{cache: newQueryCache(time.Minute, 10, nil)}
+	queries := 0
+	h := withQueryCache(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"readings":[]}`))
+	})
+
+	for _, origin := range []string{"https://a.example", "https://b.example"} {
+		req := httptest.NewRequest("GET", "/v1/readings?node=n1", nil)
+		req = req.WithContext(context.WithValue(req.Context(), key("tenant"), tn))
+		w := httptest.NewRecorder()
+		// as set by the CORS and trace middleware around every handler
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("X-Request-ID", origin)
+		h(w, req)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != origin {
+			t.Errorf("Access-Control-Allow-Origin for %s = %s", origin, got)
+		}
+		if got := w.Header().Get("X-Request-ID"); got != origin {
+			t.Errorf("X-Request-ID for %s = %s", origin, got)
+		}
+		if got := w.Header().Get("ETag"); got != `"v1"` {
+			t.Errorf("ETag for %s = %s", origin, got)
+		}
+	}
+	if queries != 1 {
+		t.Errorf("handler ran %d times, want once", queries)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+// Payload checksums: serial-to-Wi-Fi bridges occasionally mangle bytes, so a
+// node may append a checksum of its payload after '*', like NMEA sentences
+// do: 4 hex digits for CRC-16/CCITT-FALSE, 8 for CRC-32 (IEEE), e.g.
+// "1700000000|55.5|27.2|0.01,0.02,9.81*0F71". It covers every byte before
+// the '*' as sent and is verified before parsing; a frame failing it is
+// rejected as a whole. In a stream every record carries its own. With
+// REQUIRE_PAYLOAD_CRC frames without one are rejected too.
+
+var errChecksumMissing = errors.New("payload checksum required, append *<crc16 or crc32 in hex>")
+
+// verifyChecksum strips and checks the checksum of payload
+func verifyChecksum(payload string, required bool) (string, error) {
+	// trailing newlines of text bodies are not part of the frame
+	payload = strings.TrimRight(payload, "\r\n")
+	i := strings.LastIndexByte(payload, '*')
+	if i < 0 {
+		if required {
+			return "", errChecksumMissing
+		}
+		return payload, nil
+	}
+	data, sum := payload[:i], payload[i+1:]
+	want, err := strconv.ParseUint(sum, 16, 32)
+	if err != nil || (len(sum) != 4 && len(sum) != 8) {
+		return "", fmt.Errorf("invalid payload checksum %q, expected 4 or 8 hex digits", sum)
+	}
+	var got uint64
+	if len(sum) == 4 {
+		got = uint64(crc16CCITT([]byte(data)))
+	} else {
+		got = uint64(crc32.ChecksumIEEE([]byte(data)))
+	}
+	if got != want {
+		return "", fmt.Errorf("payload checksum mismatch: computed %0*X, sent %s", len(sum), got, strings.ToUpper(sum))
+	}
+	return data, nil
+}
+
+// crc16CCITT is CRC-16/CCITT-FALSE: polynomial 0x1021, initial value 0xFFFF
+func crc16CCITT(b []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// countCorrupted counts a frame of node that failed its checksum
+func (s *nodeStore) countCorrupted(node string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.get(node).CorruptedFrames++
+}
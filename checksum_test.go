@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestCRC16CCITT(t *testing.T) {
+	// check values of the CRC catalogue
+	tests := []struct {
+		in   string
+		want uint16
+	}{
+		{"", 0xFFFF},
+		{"123456789", 0x29B1},
+		{"A", 0xB915},
+	}
+	for _, tt := range tests {
+		if got := crc16CCITT([]byte(tt.in)); got != tt.want {
+			t.Errorf("crc16CCITT(%q) = %04X, want %04X", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	const frame = "1700000000|55.5|27.2|0.01,0.02,9.81"
+	tests := []struct {
+		name     string
+		payload  string
+		required bool
+		want     string
+		wantErr  bool
+	}{
+		{"crc16", frame + "*0F71", false, frame, false},
+		{"crc16 lower case", frame + "*0f71", false, frame, false},
+		{"crc32", frame + "*B5ED078B", false, frame, false},
+		{"trailing newline", frame + "*0F71\r\n", false, frame, false},
+		{"catalogue check value", "123456789*29B1", false, "123456789", false},
+		{"mismatch", frame + "*0F72", false, "", true},
+		{"odd length", frame + "*F71", false, "", true},
+		{"not hex", frame + "*XYZW", false, "", true},
+		{"none", frame, false, frame, false},
+		{"none but required", frame, true, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyChecksum(tt.payload, tt.required)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyChecksum(%q) error = %v, want error %v", tt.payload, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("verifyChecksum(%q) = %q, want %q", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
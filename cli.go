@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/joho/godotenv"
+)
+
+// command is a subcommand of the binary; serve runs when none is given, so
+// existing deployments start the server as before
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "run the server (default)", serve},
+	{"simulate", "post readings of simulated nodes to a server", simulate},
+	{"replay", "post recorded payloads to a server", replay},
+	{"check-config", "validate .env and the files it names, print what is enabled", checkConfig},
+	{"migrate", "create the orgs, buckets and downsampling tasks in InfluxDB", migrate},
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [command] [flags]\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-13s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun %s <command> -h for the flags of a command\n", os.Args[0])
+}
+
+// loadEnvConfig reads the configuration every command shares from .env
+func loadEnvConfig() (*config, error) {
+	env, err := godotenv.Read()
+	if err != nil {
+		return nil, err
+	}
+	return loadConfig(env)
+}
+
+func newInfluxClient(cfg *config) influxdb2.Client {
+	return influxdb2.NewClientWithOptions(cfg.URL, cfg.Token,
+		influxdb2.DefaultOptions().SetPrecision(cfg.WritePrecision))
+}
+
+// checkConfig loads what serve would at startup without starting anything,
+// with -connect it also runs the self-test against InfluxDB
+func checkConfig(args []string) error {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	connect := flags.Bool("connect", false, "also write and delete a test point in every tenant bucket")
+	flags.Parse(args)
+
+	cfg, err := loadEnvConfig()
+	if err != nil {
+		return err
+	}
+	client := newInfluxClient(cfg)
+	defer client.Close()
+	reg, err := loadTenants(cfg, client)
+	if err != nil {
+		return err
+	}
+	if _, err := loadUsers(cfg, reg); err != nil {
+		return err
+	}
+	if _, err := newModbusPollers(cfg.ModbusDevices, reg, nil); err != nil {
+		return err
+	}
+	if _, err := newOPCUASubscribers(cfg.OPCUAServers, reg, nil); err != nil {
+		return err
+	}
+	if _, err := newGraphiteListener(cfg, reg); err != nil {
+		return err
+	}
+	if _, err := newStatsdListener(cfg, reg); err != nil {
+		return err
+	}
+	logConfig(cfg, ":8080")
+	if *connect {
+		if ok, err := client.Ping(context.Background()); !ok {
+			return fmt.Errorf("InfluxDB not reachable: %v", err)
+		}
+		if err := selfTest(cfg, client); err != nil {
+			return err
+		}
+	}
+	log.Println("config ok")
+	return nil
+}
+
+// migrate brings InfluxDB to what the configuration expects: the orgs and
+// buckets of the tenants, then the downsampling buckets and tasks
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.Parse(args)
+
+	cfg, err := loadEnvConfig()
+	if err != nil {
+		return err
+	}
+	client := newInfluxClient(cfg)
+	defer client.Close()
+	// bootstrap only logs an unreachable InfluxDB, here it is a failure
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ok, err := client.Ping(ctx)
+	cancel()
+	if !ok {
+		return fmt.Errorf("InfluxDB not reachable: %v", err)
+	}
+	if err := bootstrap(cfg, client); err != nil {
+		return err
+	}
+	if len(cfg.DownsampleEvery) == 0 {
+		log.Println("migrate: done, no downsampling configured")
+		return nil
+	}
+	reg, err := loadTenants(cfg, client)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, t := range sortedTenants(reg) {
+		plan, err := syncDownsampling(context.Background(), cfg, client, t)
+		if err != nil {
+			return fmt.Errorf("downsampling of %s: %w", t.Name, err)
+		}
+		for _, task := range plan {
+			if task.Error != "" {
+				log.Printf("migrate: downsample task %q: %s\n", task.Name, task.Error)
+				failed++
+			} else {
+				log.Printf("migrate: downsample task %q %s\n", task.Name, task.Action)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("migrate: %d downsample tasks failed", failed)
+	}
+	log.Println("migrate: done")
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acknowledged commands kept per node for the admin listing
+const commandHistory = 50
+
+// nodeCommands validates the parameters of each command nodes understand
+var nodeCommands = map[string]func(params map[string]interface{}) error{
+	"reboot": func(params map[string]interface{}) error {
+		if len(params) > 0 {
+			return fmt.Errorf("reboot takes no params")
+		}
+		return nil
+	},
+	// optionally only one sensor, e.g. {"sensor": "accelerometer"}
+	"recalibrate": func(params map[string]interface{}) error {
+		for k, v := range params {
+			if _, ok := v.(string); k != "sensor" || !ok {
+				return fmt.Errorf("recalibrate takes an optional sensor name")
+			}
+		}
+		return nil
+	},
+	// {"interval": seconds between readings}
+	"set_sampling_rate": func(params map[string]interface{}) error {
+		interval, ok := params["interval"].(float64)
+		if len(params) != 1 || !ok || interval <= 0 {
+			return fmt.Errorf("set_sampling_rate takes a positive interval in seconds")
+		}
+		return nil
+	},
+	// {"rate": Hz, "duration": seconds}, see burst.go
+	"burst": validateBurst,
+}
+
+// nodeCommand is an instruction queued for a node, delivered with the
+// responses to its requests until the node acknowledges it
+type nodeCommand struct {
+	ID        string                 `json:"id"`
+	Node      string                 `json:"node"`
+	Command   string                 `json:"command"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+	Status    string                 `json:"status"`
+	Created   time.Time              `json:"created"`
+	Delivered *time.Time             `json:"delivered,omitempty"`
+	Acked     *time.Time             `json:"acked,omitempty"`
+}
+
+// pendingCommand is the view of a command sent to the node
+type pendingCommand struct {
+	ID      string                 `json:"id"`
+	Command string                 `json:"command"`
+	Params  map[string]interface{} `json:"params,omitempty"`
+}
+
+// commandQueue holds the commands of the nodes of a tenant in memory
+type commandQueue struct {
+	mu    sync.Mutex
+	nodes map[string][]*nodeCommand
+}
+
+func newCommandQueue() *commandQueue {
+	return &commandQueue{nodes: make(map[string][]*nodeCommand)}
+}
+
+func (q *commandQueue) enqueue(node, command string, params map[string]interface{}) nodeCommand {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return *q.add(node, command, params)
+}
+
+// enqueueOnce queues a command unless one of the same kind is still pending
+// for node, in which case it returns that one
+func (q *commandQueue) enqueueOnce(node, command string, params map[string]interface{}) (nodeCommand, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, c := range q.nodes[node] {
+		if c.Command == command && (c.Status == "pending" || c.Status == "delivered") {
+			return *c, false
+		}
+	}
+	return *q.add(node, command, params), true
+}
+
+// add appends a pending command to the queue of node. q.mu must be held.
+func (q *commandQueue) add(node, command string, params map[string]interface{}) *nodeCommand {
+	c := &nodeCommand{
+		ID:      newJobID(),
+		Node:    node,
+		Command: command,
+		Params:  params,
+		Status:  "pending",
+		Created: time.Now(),
+	}
+	q.nodes[node] = append(q.nodes[node], c)
+	return c
+}
+
+// get returns a copy of a command of node
+func (q *commandQueue) get(node, id string) (nodeCommand, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, c := range q.nodes[node] {
+		if c.ID == id {
+			return *c, true
+		}
+	}
+	return nodeCommand{}, false
+}
+
+// exchange acknowledges the given commands of node and returns those still
+// pending, marking them as delivered
+func (q *commandQueue) exchange(node string, acks []string) []pendingCommand {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for _, id := range acks {
+		for _, c := range q.nodes[node] {
+			if c.ID == id && c.Acked == nil && c.Status != "canceled" {
+				c.Acked = &now
+				c.Status = "acked"
+			}
+		}
+	}
+
+	pending := []pendingCommand{}
+	done := 0
+	for _, c := range q.nodes[node] {
+		if c.Status == "acked" || c.Status == "canceled" {
+			done++
+			continue
+		}
+		if c.Delivered == nil {
+			c.Delivered = &now
+			c.Status = "delivered"
+		}
+		pending = append(pending, pendingCommand{c.ID, c.Command, c.Params})
+	}
+
+	// forget the oldest finished commands
+	if done > commandHistory {
+		kept := q.nodes[node][:0]
+		for _, c := range q.nodes[node] {
+			if done > commandHistory && (c.Status == "acked" || c.Status == "canceled") {
+				done--
+				continue
+			}
+			kept = append(kept, c)
+		}
+		q.nodes[node] = kept
+	}
+	return pending
+}
+
+// cancel withdraws a command that was not acknowledged yet. It returns
+// false for a known command that is already finished.
+func (q *commandQueue) cancel(id string) (c nodeCommand, found bool, canceled bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, cmds := range q.nodes {
+		for _, cmd := range cmds {
+			if cmd.ID != id {
+				continue
+			}
+			if cmd.Status == "acked" || cmd.Status == "canceled" {
+				return *cmd, true, false
+			}
+			cmd.Status = "canceled"
+			return *cmd, true, true
+		}
+	}
+	return c, false, false
+}
+
+// list returns copies of the commands of node, or of every node when empty
+func (q *commandQueue) list(node string) []nodeCommand {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	cmds := []nodeCommand{}
+	for name, list := range q.nodes {
+		if node != "" && name != node {
+			continue
+		}
+		for _, c := range list {
+			cmds = append(cmds, *c)
+		}
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Created.Before(cmds[j].Created) })
+	return cmds
+}
+
+// requestAcks reads the ids of the commands a node acknowledges from the
+// comma separated "ack" form or query value
+func requestAcks(r *http.Request) []string {
+	return splitList(r.FormValue("ack"))
+}
+
+// adminCommands lists (GET) and queues (POST) commands of a tenant's nodes;
+// DELETE /admin/commands/{id} cancels one
+func adminCommands(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	reg := ctx.Value(key("tenants")).(*tenantRegistry)
+	audit := ctx.Value(key("audit")).(*auditLog)
+
+	t := reg.byName(r.URL.Query().Get("tenant"))
+	if t == nil {
+		http.Error(w, "404 - Unknown tenant", http.StatusNotFound)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/admin/commands")
+	id = strings.TrimPrefix(id, "/")
+
+	switch {
+	case r.Method == "GET" && id == "":
+		writeJSON(w, map[string]interface{}{"commands": t.commands.list(r.URL.Query().Get("node"))})
+	case r.Method == "POST" && id == "":
+		var req struct {
+			Node    string                 `json:"node"`
+			Command string                 `json:"command"`
+			Params  map[string]interface{} `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "400 - Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		validate, ok := nodeCommands[req.Command]
+		if req.Node == "" || !ok {
+			http.Error(w, "400 - node and a known command are required", http.StatusBadRequest)
+			return
+		}
+		if err := validNode(req.Node); err != nil {
+			http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validate(req.Params); err != nil {
+			http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		c := t.commands.enqueue(req.Node, req.Command, req.Params)
+		audit.record(r, "queue_command", map[string]interface{}{
+			"tenant":  t.Name,
+			"node":    c.Node,
+			"id":      c.ID,
+			"command": c.Command,
+			"params":  c.Params,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		msg, _ := json.Marshal(c)
+		w.Write(msg)
+	case r.Method == "DELETE" && id != "":
+		c, found, canceled := t.commands.cancel(id)
+		if !found {
+			http.Error(w, "404 - Unknown command", http.StatusNotFound)
+			return
+		}
+		if !canceled {
+			http.Error(w, "409 - Command already "+c.Status, http.StatusConflict)
+			return
+		}
+		audit.record(r, "cancel_command", map[string]interface{}{
+			"tenant": t.Name,
+			"node":   c.Node,
+			"id":     c.ID,
+		})
+		writeJSON(w, c)
+	default:
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+	}
+}
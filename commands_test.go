@@ -0,0 +1,28 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestEnqueueOnce(t *testing.T) {
+	q := newCommandQueue()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	queued := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := q.enqueueOnce("n1", "burst", nil); ok {
+				mu.Lock()
+				queued++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if queued != 1 || len(q.nodes["n1"]) != 1 {
+		t.Errorf("concurrent enqueueOnce queued %d, %d commands pending, want one", queued, len(q.nodes["n1"]))
+	}
+}
@@ -0,0 +1,1000 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the settings read from the .env file
+type config struct {
+	Token  string
+	URL    string
+	Org    string
+	Bucket string
+
+	// JSON file with the tenants sharing this server, see tenants.go
+	TenantsFile string
+
+	// write and delete a test point at boot, see selftest.go
+	SelfTest bool
+	// longest wait at boot for InfluxDB to answer, not waiting at 0
+	StartupWait time.Duration
+	// create missing orgs and buckets at boot, buckets keeping data for
+	// BucketRetention (0 forever), see bootstrap.go
+	Bootstrap       bool
+	BucketRetention time.Duration
+
+	// bearer token of the /admin endpoints, which are disabled without one
+	AdminToken string
+	// bearer token of /metrics and /healthz/deep for scrapers without a key
+	MetricsToken string
+	// append-only JSON lines file of administrative actions
+	AuditLog string
+	// JSON file of API keys bound to a role, see rbac.go
+	AccessKeysFile string
+	// HS256 secret of the bearer tokens accepted in place of API keys,
+	// tokens are rejected without one
+	JWTSecret string
+	// role of requests without a key in single-tenant mode, empty when a
+	// key is required
+	AnonymousRole string
+	// accounts of the read and admin endpoints of small deployments, see
+	// basicauth.go
+	BasicAuth []basicAccount
+	// JSON file of the dashboard users, see users.go
+	UsersFile string
+	// single sign-on through an OIDC provider, disabled without an issuer;
+	// groups of the groups claim map to roles, users of other groups get
+	// the default role or no access when it is empty, see oidc.go
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       []string
+	OIDCGroupsClaim  string
+	OIDCRoleGroups   map[string]string
+	OIDCDefaultRole  string
+	OIDCTenant       string
+	// lifetime of a login, and how long an unused one lasts (0 unlimited)
+	SessionTTL         time.Duration
+	SessionIdleTimeout time.Duration
+
+	// unit of the epoch timestamps sent by nodes that do not declare one
+	TimestampPrecision time.Duration
+
+	// nodes without a clock, their readings get the server receive time
+	ServerTimeNodes map[string]bool
+	// longest a node may hold a reading before sending it, by its age
+	MaxReadingAge time.Duration
+	// nodes whose clock runs on local time of a timezone instead of UTC
+	NodeTimezones map[string]*time.Location
+	// time of the points: "device" the node clock, "receive" the receive
+	// time for every node, "both" the node clock with the receive time as
+	// the received_at field
+	TimeSource string
+	// precision of the timestamps written to InfluxDB; readings closer
+	// together collide
+	WritePrecision time.Duration
+
+	// fields whose rate of change per minute is stored, and the rates that
+	// raise an event
+	RateFields []string
+	RateAlerts map[string]float64
+
+	// fields whose vibration indicators are computed per window of
+	// SHMWindow, or until SHMMaxSamples readings
+	SHMFields     []string
+	SHMWindow     time.Duration
+	SHMMaxSamples int
+	// shift of a natural frequency from its baseline, in percent, that
+	// raises an event, and the windows averaged into the baseline
+	FrequencyShiftPercent    float64
+	FrequencyBaselineWindows int
+
+	// shift timestamps of nodes whose clock is off by more than the threshold
+	ClockCorrection     bool
+	ClockDriftThreshold time.Duration
+
+	// how long and how many Idempotency-Key responses are remembered
+	IdempotencyTTL     time.Duration
+	IdempotencyMaxKeys int
+
+	// page size of query endpoints when none is requested, and its upper bound
+	QueryDefaultLimit int
+	QueryMaxLimit     int
+	// how long and how many responses of node and zone queries are cached
+	QueryCacheTTL        time.Duration
+	QueryCacheMaxEntries int
+
+	// fields and measurements of the records sent by nodes, with their
+	// plausible value ranges, see schema.go
+	Schema *sensorSchema
+	// keys accepted in JSON payloads, see jsonpayload.go
+	JSONFields *jsonFields
+	// devices polled over Modbus TCP, see modbus.go
+	ModbusDevices []*modbusDevice
+	// OPC UA servers subscribed to, see opcua.go
+	OPCUAServers []*opcuaServer
+	// address of the Graphite plaintext listener, off when empty, and the
+	// templates mapping its lines, see graphite.go
+	GraphiteListen    string
+	GraphiteTemplates []*graphiteTemplate
+	// UDP address of the StatsD listener, off when empty, and where its
+	// aggregates go, see statsd.go
+	StatsdListen        string
+	StatsdFlushInterval time.Duration
+	StatsdMeasurement   string
+	StatsdNode          string
+	StatsdTenant        string
+
+	// reject text payloads without a checksum, see checksum.go
+	RequirePayloadCRC bool
+	// how long the fragments of a payload wait for the rest, see
+	// fragments.go
+	FragmentTimeout time.Duration
+
+	// longest expected pause between readings, used to score the data
+	// quality of each node
+	GapThreshold time.Duration
+	// how often the link_quality points of the nodes are written, never
+	// at 0
+	LinkQualityInterval time.Duration
+
+	// buckets besides the tenant's own that backfills may target, and the
+	// largest accepted import body
+	BackfillBuckets  []string
+	BackfillMaxBytes int64
+	// largest accepted ingest or form body and stream record, and gateway
+	// batch once decompressed
+	IngestMaxBytes  int64
+	GatewayMaxBytes int64
+
+	// daily archive of raw readings to an S3 compatible bucket, disabled
+	// without a bucket; runs ExportDelay after midnight UTC
+	ExportS3Endpoint  string
+	ExportS3Region    string
+	ExportS3Bucket    string
+	ExportS3AccessKey string
+	ExportS3SecretKey string
+	ExportS3Prefix    string
+	ExportS3PathStyle bool
+	ExportDelay       time.Duration
+
+	// scheduled per-node summaries ("daily", "weekly"), generated ReportDelay
+	// after midnight UTC and optionally emailed
+	ReportPeriods   []string
+	ReportDelay     time.Duration
+	ReportsDir      string
+	SMTPAddr        string
+	SMTPUser        string
+	SMTPPassword    string
+	ReportEmailFrom string
+	ReportEmailTo   []string
+
+	// detected events (vibration, outages) become annotations; a vibration
+	// event fires when |acceleration| deviates from gravity by more than
+	// the threshold in m/s², disabled at 0
+	VibrationThreshold float64
+	// deviation in m/s² that captures the accelerometer samples around it
+	// at full resolution, disabled at 0
+	PeakThreshold   float64
+	PeakPreTrigger  time.Duration
+	PeakPostTrigger time.Duration
+	// events that ask the node for a burst of the measurement's fields at
+	// the rate in Hz for the duration
+	BurstEvents      []string
+	BurstMeasurement string
+	BurstRate        float64
+	BurstDuration    time.Duration
+
+	// reporting interval returned to nodes, disabled at 0, with its bounds,
+	// the rates per minute that count as fast and the hours of the night
+	AdaptiveInterval    time.Duration
+	AdaptiveMinInterval time.Duration
+	AdaptiveMaxInterval time.Duration
+	AdaptiveRates       map[string]float64
+	AdaptiveNight       *nightHours
+	// battery voltage below which a node is reported, disabled at 0
+	LowBatteryVoltage float64
+	EventCooldown     time.Duration
+	GrafanaURL        string
+	GrafanaToken      string
+	// events that become alerts, the contacts notified one after another
+	// and how long each gets to acknowledge
+	EscalationEvents []string
+	EscalationChain  []alertContact
+	EscalationAfter  time.Duration
+
+	// continuous downsampling of each tenant bucket into <bucket>_<every>,
+	// chained in the given order, and how long each level is kept (0 forever)
+	DownsampleEvery     []time.Duration
+	DownsampleRetention []time.Duration
+	// tiered retention run by the server: how long raw data is kept, the
+	// roll-up tiers and how long a window waits for late points
+	RawRetention time.Duration
+	Rollups      []rollupTier
+	RollupDelay  time.Duration
+
+	// consecutive failed writes that open the circuit breaker, how often an
+	// open breaker probes InfluxDB, and the most points buffered meanwhile
+	BreakerFailures int
+	BreakerProbe    time.Duration
+	WriteBufferSize int
+	// file mirroring the write buffers so they survive restarts, memory only
+	// when empty, and the age from which buffered points are dropped
+	WriteQueuePath   string
+	WriteQueueMaxAge time.Duration
+	// how often free space is checked, disabled at 0; below the low share of
+	// free space per-request logging stops, below the minimum on the queue
+	// volume buffering on disk is refused
+	DiskCheckInterval time.Duration
+	DiskLowFree       float64
+	DiskMinFree       float64
+	// points of a series with a timestamp written within the window are
+	// skipped, disabled at 0; the most points remembered
+	DedupWindow  time.Duration
+	DedupMaxKeys int
+	// records of a streamed upload written together, and the longest they
+	// wait for the batch to fill
+	StreamBatchSize     int
+	StreamFlushInterval time.Duration
+
+	// buffered points from which ingest answers 503, and the Retry-After
+	// sent with it
+	WriteBufferHighWater int
+	RetryAfter           time.Duration
+
+	// requests taking longer are logged with their phases, disabled at 0
+	SlowRequestThreshold time.Duration
+	// daily log files kept, all at 0, see logfile.go
+	LogFilesKeep int
+	// info or debug, see loglevel.go
+	LogLevel string
+	// every ingest request is a dry run, see dryrun.go
+	DryRun bool
+
+	// advertise the server on the local network, see mdns.go; the instance
+	// is named after the host unless MDNSName is set
+	MDNS     bool
+	MDNSName string
+
+	// broker that written readings are published to, disabled when empty;
+	// {tenant} and {node} in the topic are replaced
+	MQTTBroker   string
+	MQTTTopic    string
+	MQTTClientID string
+	MQTTUsername string
+	MQTTPassword string
+	MQTTQoS      int
+	// retained topic of the newest reading of each node, off when empty
+	MQTTLatestTopic string
+	// announce the fields of nodes to Home Assistant over MQTT, and where
+	// states posted by Home Assistant go, see homeassistant.go
+	HADiscovery       bool
+	HADiscoveryPrefix string
+	HAMeasurement     string
+	HANode            string
+
+	// downstream endpoints written readings are re-POSTed to as JSON, the
+	// batches queued per endpoint, and the attempts after a failed POST
+	ForwardURLs      []string
+	ForwardQueueSize int
+	ForwardTimeout   time.Duration
+	ForwardRetries   int
+
+	// a share of the written points is also written to a staging bucket,
+	// disabled when the bucket is empty; the URL, token and org default to
+	// those of the main InfluxDB
+	ShadowURL     string
+	ShadowToken   string
+	ShadowOrg     string
+	ShadowBucket  string
+	ShadowPercent float64
+
+	// the dedup cache, Idempotency-Key store and latest node readings are
+	// shared with other instances through this Redis server, under the
+	// prefix
+	RedisURL    string
+	RedisPrefix string
+
+	// as an edge gateway, readings are sent in batches to /v1/gateway of the
+	// central server instead of InfluxDB; the default tenant authenticates
+	// with the key, the tenants of a tenants file with their own
+	GatewayUpstream      string
+	GatewayAPIKey        string
+	GatewayFlushInterval time.Duration
+
+	// series pushed to /api/prom/write, see promwrite.go: the label naming
+	// the node, and a prefix of their measurements
+	PromNodeLabel   string
+	PromWritePrefix string
+
+	// with several replicas behind a load balancer, one is elected through a
+	// lease in LeaderBucket to run the daily exports and reports and to sync
+	// the downsampling tasks
+	LeaderElection bool
+	ReplicaID      string
+	LeaderLease    time.Duration
+	LeaderBucket   string
+
+	// CORS settings for browser based clients, disabled when no origin is set
+	CORSAllowedOrigins []string
+	CORSAllowedMethods []string
+	CORSAllowedHeaders []string
+	CORSMaxAge         int
+}
+
+func loadConfig(env map[string]string) (*config, error) {
+	cfg := &config{
+		Token:  env["INFLUXDB_TOKEN"],
+		URL:    env["URL_DB"],
+		Org:    env["ORG_NAME"],
+		Bucket: env["BUCKET_NAME"],
+
+		TenantsFile: env["TENANTS_FILE"],
+
+		AdminToken:   env["ADMIN_TOKEN"],
+		MetricsToken: env["METRICS_TOKEN"],
+		AuditLog:     envDefault(env, "AUDIT_LOG", "logs/audit.log"),
+
+		AccessKeysFile: env["ACCESS_KEYS_FILE"],
+		JWTSecret:      env["JWT_SECRET"],
+		UsersFile:      env["USERS_FILE"],
+
+		OIDCIssuer:       env["OIDC_ISSUER"],
+		OIDCClientID:     env["OIDC_CLIENT_ID"],
+		OIDCClientSecret: env["OIDC_CLIENT_SECRET"],
+		OIDCRedirectURL:  env["OIDC_REDIRECT_URL"],
+		OIDCScopes:       splitList(envDefault(env, "OIDC_SCOPES", "openid,profile,email")),
+		OIDCGroupsClaim:  envDefault(env, "OIDC_GROUPS_CLAIM", "groups"),
+		OIDCDefaultRole:  env["OIDC_DEFAULT_ROLE"],
+		OIDCTenant:       env["OIDC_TENANT"],
+
+		ServerTimeNodes: make(map[string]bool),
+		NodeTimezones:   make(map[string]*time.Location),
+		BackfillBuckets: splitList(env["BACKFILL_BUCKETS"]),
+
+		ExportS3Endpoint:  envDefault(env, "EXPORT_S3_ENDPOINT", "https://s3.amazonaws.com"),
+		ExportS3Region:    envDefault(env, "EXPORT_S3_REGION", "us-east-1"),
+		ExportS3Bucket:    env["EXPORT_S3_BUCKET"],
+		ExportS3AccessKey: env["EXPORT_S3_ACCESS_KEY"],
+		ExportS3SecretKey: env["EXPORT_S3_SECRET_KEY"],
+		ExportS3Prefix:    env["EXPORT_S3_PREFIX"],
+
+		GrafanaURL:   strings.TrimSuffix(env["GRAFANA_URL"], "/"),
+		GrafanaToken: env["GRAFANA_TOKEN"],
+
+		MDNSName: env["MDNS_NAME"],
+
+		MQTTBroker:   env["MQTT_BROKER"],
+		MQTTTopic:    envDefault(env, "MQTT_TOPIC", "sensors/{node}/air"),
+		MQTTClientID: envDefault(env, "MQTT_CLIENT_ID", "server-skripsi"),
+		MQTTUsername: env["MQTT_USERNAME"],
+		MQTTPassword: env["MQTT_PASSWORD"],
+
+		HADiscoveryPrefix: envDefault(env, "HA_DISCOVERY_PREFIX", "homeassistant"),
+		HAMeasurement:     envDefault(env, "HA_MEASUREMENT", "homeassistant"),
+		HANode:            envDefault(env, "HA_NODE", "homeassistant"),
+
+		ForwardURLs: splitList(env["FORWARD_URLS"]),
+
+		ShadowURL:    envDefault(env, "SHADOW_URL", env["URL_DB"]),
+		ShadowToken:  envDefault(env, "SHADOW_TOKEN", env["INFLUXDB_TOKEN"]),
+		ShadowOrg:    envDefault(env, "SHADOW_ORG", env["ORG_NAME"]),
+		ShadowBucket: env["SHADOW_BUCKET"],
+
+		RedisURL:    env["REDIS_URL"],
+		RedisPrefix: envDefault(env, "REDIS_PREFIX", "sensor:"),
+
+		WriteQueuePath: env["WRITE_QUEUE_PATH"],
+
+		GatewayUpstream: strings.TrimSuffix(env["GATEWAY_UPSTREAM"], "/"),
+		GatewayAPIKey:   env["GATEWAY_API_KEY"],
+
+		PromNodeLabel:   envDefault(env, "PROM_NODE_LABEL", "instance"),
+		PromWritePrefix: env["PROM_WRITE_PREFIX"],
+
+		ReportPeriods:   splitList(env["REPORTS"]),
+		ReportsDir:      envDefault(env, "REPORTS_DIR", "reports"),
+		SMTPAddr:        env["SMTP_ADDR"],
+		SMTPUser:        env["SMTP_USER"],
+		SMTPPassword:    env["SMTP_PASSWORD"],
+		ReportEmailFrom: env["REPORT_EMAIL_FROM"],
+		ReportEmailTo:   splitList(env["REPORT_EMAIL_TO"]),
+
+		CORSAllowedOrigins: splitList(env["CORS_ALLOWED_ORIGINS"]),
+		CORSAllowedMethods: splitList(envDefault(env, "CORS_ALLOWED_METHODS", "GET,POST,OPTIONS")),
+		CORSAllowedHeaders: splitList(envDefault(env, "CORS_ALLOWED_HEADERS", "Content-Type,Authorization,X-API-Key")),
+	}
+
+	for _, node := range splitList(env["SERVER_TIME_NODES"]) {
+		cfg.ServerTimeNodes[node] = true
+	}
+
+	for _, entry := range splitList(env["NODE_TIMEZONES"]) {
+		node, name, ok := strings.Cut(entry, "=")
+		loc, err := time.LoadLocation(name)
+		if !ok || node == "" || name == "" || err != nil {
+			return nil, fmt.Errorf("invalid NODE_TIMEZONES: expected node=Area/City, got %q", entry)
+		}
+		cfg.NodeTimezones[node] = loc
+	}
+
+	var err error
+	if cfg.TimestampPrecision, err = parsePrecision(envDefault(env, "TIMESTAMP_PRECISION", "s")); err != nil {
+		return nil, fmt.Errorf("invalid TIMESTAMP_PRECISION: %w", err)
+	}
+	if cfg.MaxReadingAge, err = envDuration(env, "MAX_READING_AGE", 30*24*time.Hour); err != nil {
+		return nil, err
+	}
+	switch cfg.TimeSource = envDefault(env, "TIME_SOURCE", "device"); cfg.TimeSource {
+	case "device", "receive", "both":
+	default:
+		return nil, fmt.Errorf("invalid TIME_SOURCE: must be device, receive or both")
+	}
+	if cfg.WritePrecision, err = parsePrecision(envDefault(env, "WRITE_PRECISION", "ns")); err != nil {
+		return nil, fmt.Errorf("invalid WRITE_PRECISION: %w", err)
+	}
+	if cfg.SelfTest, err = envBool(env, "SELF_TEST", true); err != nil {
+		return nil, err
+	}
+	if cfg.StartupWait, err = envDuration(env, "STARTUP_WAIT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Bootstrap, err = envBool(env, "BOOTSTRAP", false); err != nil {
+		return nil, err
+	}
+	if cfg.BucketRetention, err = envDuration(env, "BUCKET_RETENTION", 90*24*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.ClockCorrection, err = envBool(env, "CLOCK_CORRECTION", false); err != nil {
+		return nil, err
+	}
+	if cfg.ClockDriftThreshold, err = envDuration(env, "CLOCK_DRIFT_THRESHOLD", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.IdempotencyTTL, err = envDuration(env, "IDEMPOTENCY_TTL", 24*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.IdempotencyMaxKeys, err = envInt(env, "IDEMPOTENCY_MAX_KEYS", 10000); err != nil {
+		return nil, err
+	}
+	if cfg.QueryDefaultLimit, err = envInt(env, "QUERY_DEFAULT_LIMIT", 1000); err != nil {
+		return nil, err
+	}
+	if cfg.QueryMaxLimit, err = envInt(env, "QUERY_MAX_LIMIT", 10000); err != nil {
+		return nil, err
+	}
+	if cfg.QueryCacheTTL, err = envDuration(env, "QUERY_CACHE_TTL", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.QueryCacheMaxEntries, err = envInt(env, "QUERY_CACHE_MAX_ENTRIES", 1000); err != nil {
+		return nil, err
+	}
+	if cfg.Schema, err = parseSchema(envDefault(env, "SENSOR_SCHEMA", defaultSchema), env); err != nil {
+		return nil, fmt.Errorf("invalid SENSOR_SCHEMA: %w", err)
+	}
+	if cfg.Schema.GeohashPrecision, err = envInt(env, "GEOHASH_PRECISION", 6); err != nil {
+		return nil, err
+	}
+	if cfg.Schema.GeohashPrecision < 0 || cfg.Schema.GeohashPrecision > 12 {
+		return nil, fmt.Errorf("invalid GEOHASH_PRECISION: expected 0 to 12")
+	}
+	if cfg.JSONFields, err = loadJSONFields(env["JSON_FIELDS_FILE"], cfg.Schema); err != nil {
+		return nil, fmt.Errorf("invalid JSON_FIELDS_FILE: %w", err)
+	}
+	if cfg.ModbusDevices, err = loadModbusDevices(env["MODBUS_FILE"], cfg.Schema); err != nil {
+		return nil, fmt.Errorf("invalid MODBUS_FILE: %w", err)
+	}
+	if cfg.OPCUAServers, err = loadOPCUAServers(env["OPCUA_FILE"], cfg.Schema); err != nil {
+		return nil, fmt.Errorf("invalid OPCUA_FILE: %w", err)
+	}
+	cfg.GraphiteListen = env["GRAPHITE_LISTEN"]
+	if cfg.GraphiteListen == "" && env["GRAPHITE_FILE"] != "" {
+		return nil, fmt.Errorf("GRAPHITE_FILE needs GRAPHITE_LISTEN")
+	}
+	if cfg.GraphiteListen != "" {
+		if cfg.GraphiteTemplates, err = loadGraphiteTemplates(env["GRAPHITE_FILE"]); err != nil {
+			return nil, fmt.Errorf("invalid GRAPHITE_FILE: %w", err)
+		}
+	}
+	cfg.StatsdListen = env["STATSD_LISTEN"]
+	cfg.StatsdMeasurement = envDefault(env, "STATSD_MEASUREMENT", "statsd")
+	cfg.StatsdNode = envDefault(env, "STATSD_NODE", "statsd")
+	cfg.StatsdTenant = env["STATSD_TENANT"]
+	if cfg.StatsdFlushInterval, err = envDuration(env, "STATSD_FLUSH_INTERVAL", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.StatsdListen != "" && cfg.StatsdFlushInterval <= 0 {
+		return nil, fmt.Errorf("invalid STATSD_FLUSH_INTERVAL: must be positive")
+	}
+	if !nodePattern.MatchString(cfg.StatsdNode) {
+		return nil, fmt.Errorf("invalid STATSD_NODE: %q is not a valid node name", cfg.StatsdNode)
+	}
+	if cfg.Schema.Enrichment, err = loadEnrichment(env["ENRICHMENT_FILE"]); err != nil {
+		return nil, fmt.Errorf("invalid ENRICHMENT_FILE: %w", err)
+	}
+	if cfg.Schema.Zones, err = loadZones(env["ZONES_FILE"]); err != nil {
+		return nil, fmt.Errorf("invalid ZONES_FILE: %w", err)
+	}
+	if cfg.GapThreshold, err = envDuration(env, "GAP_THRESHOLD", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.RequirePayloadCRC, err = envBool(env, "REQUIRE_PAYLOAD_CRC", false); err != nil {
+		return nil, err
+	}
+	if cfg.FragmentTimeout, err = envDuration(env, "FRAGMENT_TIMEOUT", 2*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.FragmentTimeout <= 0 {
+		return nil, fmt.Errorf("invalid FRAGMENT_TIMEOUT: must be positive")
+	}
+	if cfg.LinkQualityInterval, err = envDuration(env, "LINK_QUALITY_INTERVAL", time.Minute); err != nil {
+		return nil, err
+	}
+	maxBytes, err := envInt(env, "BACKFILL_MAX_BYTES", 256<<20)
+	if err != nil {
+		return nil, err
+	}
+	cfg.BackfillMaxBytes = int64(maxBytes)
+	if maxBytes, err = envInt(env, "INGEST_MAX_BYTES", 1<<20); err != nil {
+		return nil, err
+	}
+	cfg.IngestMaxBytes = int64(maxBytes)
+	if maxBytes, err = envInt(env, "GATEWAY_MAX_BYTES", 64<<20); err != nil {
+		return nil, err
+	}
+	cfg.GatewayMaxBytes = int64(maxBytes)
+	if cfg.IngestMaxBytes <= 0 || cfg.GatewayMaxBytes <= 0 {
+		return nil, fmt.Errorf("invalid INGEST_MAX_BYTES or GATEWAY_MAX_BYTES: must be positive")
+	}
+	if cfg.ExportS3PathStyle, err = envBool(env, "EXPORT_S3_PATH_STYLE", true); err != nil {
+		return nil, err
+	}
+	if cfg.ExportDelay, err = envDuration(env, "EXPORT_DELAY", time.Hour); err != nil {
+		return nil, err
+	}
+	for _, p := range cfg.ReportPeriods {
+		if _, ok := reportPeriods[p]; !ok {
+			return nil, fmt.Errorf("invalid REPORTS: unknown period %q", p)
+		}
+	}
+	if cfg.ReportDelay, err = envDuration(env, "REPORT_DELAY", 2*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.VibrationThreshold, err = envFloat(env, "VIBRATION_THRESHOLD", 0); err != nil {
+		return nil, err
+	}
+	if cfg.PeakThreshold, err = envFloat(env, "PEAK_THRESHOLD", 0); err != nil {
+		return nil, err
+	}
+	if cfg.PeakPreTrigger, err = envDuration(env, "PEAK_PRE_TRIGGER", 2*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.PeakPostTrigger, err = envDuration(env, "PEAK_POST_TRIGGER", 5*time.Second); err != nil {
+		return nil, err
+	}
+	cfg.BurstEvents = splitList(env["BURST_EVENTS"])
+	cfg.BurstMeasurement = envDefault(env, "BURST_MEASUREMENT", "accelerometer")
+	if _, ok := cfg.Schema.Measurements[cfg.BurstMeasurement]; !ok {
+		return nil, fmt.Errorf("invalid BURST_MEASUREMENT: unknown measurement %q", cfg.BurstMeasurement)
+	}
+	if cfg.BurstRate, err = envFloat(env, "BURST_RATE", 100); err != nil {
+		return nil, err
+	}
+	if cfg.BurstDuration, err = envDuration(env, "BURST_DURATION", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.BurstRate <= 0 || cfg.BurstDuration <= 0 {
+		return nil, fmt.Errorf("invalid BURST_RATE or BURST_DURATION: both must be positive")
+	}
+	if cfg.LowBatteryVoltage, err = envFloat(env, "LOW_BATTERY_VOLTAGE", 3.3); err != nil {
+		return nil, err
+	}
+	if cfg.EventCooldown, err = envDuration(env, "EVENT_COOLDOWN", time.Minute); err != nil {
+		return nil, err
+	}
+	cfg.EscalationEvents = splitList(env["ESCALATION_EVENTS"])
+	if cfg.EscalationChain, err = parseEscalationChain(env["ESCALATION_CHAIN"]); err != nil {
+		return nil, err
+	}
+	for _, c := range cfg.EscalationChain {
+		if c.Kind == "email" && (cfg.SMTPAddr == "" || cfg.ReportEmailFrom == "") {
+			return nil, fmt.Errorf("invalid ESCALATION_CHAIN: email contacts need SMTP_ADDR and REPORT_EMAIL_FROM")
+		}
+	}
+	if cfg.EscalationAfter, err = envDuration(env, "ESCALATION_AFTER", 15*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.EscalationAfter <= 0 {
+		return nil, fmt.Errorf("invalid ESCALATION_AFTER: must be positive")
+	}
+	cfg.RateFields = splitList(env["RATE_FIELDS"])
+	for _, f := range cfg.RateFields {
+		if _, ok := cfg.Schema.field(f); !ok {
+			return nil, fmt.Errorf("invalid RATE_FIELDS: unknown field %q", f)
+		}
+	}
+	cfg.RateAlerts = make(map[string]float64)
+	for _, entry := range splitList(env["RATE_ALERTS"]) {
+		f, v, _ := strings.Cut(entry, "=")
+		limit, err := strconv.ParseFloat(v, 64)
+		if err != nil || limit <= 0 || !contains(cfg.RateFields, f) {
+			return nil, fmt.Errorf("invalid RATE_ALERTS: expected field=rate of a field in RATE_FIELDS, got %q", entry)
+		}
+		cfg.RateAlerts[f] = limit
+	}
+	cfg.SHMFields = splitList(env["SHM_FIELDS"])
+	for _, f := range cfg.SHMFields {
+		if _, ok := cfg.Schema.field(f); !ok {
+			return nil, fmt.Errorf("invalid SHM_FIELDS: unknown field %q", f)
+		}
+	}
+	if cfg.SHMWindow, err = envDuration(env, "SHM_WINDOW", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.SHMMaxSamples, err = envInt(env, "SHM_MAX_SAMPLES", 1024); err != nil {
+		return nil, err
+	}
+	if cfg.SHMWindow <= 0 || cfg.SHMMaxSamples < 4 {
+		return nil, fmt.Errorf("invalid SHM_WINDOW or SHM_MAX_SAMPLES: need a positive window of at least 4 samples")
+	}
+	if cfg.FrequencyShiftPercent, err = envFloat(env, "FREQUENCY_SHIFT_PERCENT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.FrequencyBaselineWindows, err = envInt(env, "FREQUENCY_BASELINE_WINDOWS", 30); err != nil {
+		return nil, err
+	}
+	if cfg.FrequencyBaselineWindows < 1 {
+		return nil, fmt.Errorf("invalid FREQUENCY_BASELINE_WINDOWS: need at least 1 window")
+	}
+	if cfg.AdaptiveInterval, err = envDuration(env, "ADAPTIVE_INTERVAL", 0); err != nil {
+		return nil, err
+	}
+	if cfg.AdaptiveMinInterval, err = envDuration(env, "ADAPTIVE_MIN_INTERVAL", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.AdaptiveMaxInterval, err = envDuration(env, "ADAPTIVE_MAX_INTERVAL", 15*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.AdaptiveInterval > 0 && (cfg.AdaptiveMinInterval < time.Second || cfg.AdaptiveMinInterval > cfg.AdaptiveInterval || cfg.AdaptiveInterval > cfg.AdaptiveMaxInterval) {
+		return nil, fmt.Errorf("invalid ADAPTIVE_INTERVAL: need 1s <= ADAPTIVE_MIN_INTERVAL <= ADAPTIVE_INTERVAL <= ADAPTIVE_MAX_INTERVAL")
+	}
+	cfg.AdaptiveRates = make(map[string]float64)
+	for _, entry := range splitList(env["ADAPTIVE_RATES"]) {
+		f, v, _ := strings.Cut(entry, "=")
+		limit, err := strconv.ParseFloat(v, 64)
+		if err != nil || limit <= 0 || !contains(cfg.RateFields, f) {
+			return nil, fmt.Errorf("invalid ADAPTIVE_RATES: expected field=rate of a field in RATE_FIELDS, got %q", entry)
+		}
+		cfg.AdaptiveRates[f] = limit
+	}
+	if cfg.AdaptiveNight, err = parseNightHours(env["ADAPTIVE_NIGHT"]); err != nil {
+		return nil, err
+	}
+	if cfg.DownsampleEvery, err = envDurations(env, "DOWNSAMPLE"); err != nil {
+		return nil, err
+	}
+	if cfg.DownsampleRetention, err = envDurations(env, "DOWNSAMPLE_RETENTION"); err != nil {
+		return nil, err
+	}
+	if len(cfg.DownsampleRetention) > len(cfg.DownsampleEvery) {
+		return nil, fmt.Errorf("invalid DOWNSAMPLE_RETENTION: more entries than DOWNSAMPLE")
+	}
+	if cfg.RawRetention, err = envDuration(env, "RAW_RETENTION", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Rollups, err = parseRollups(env["ROLLUPS"]); err != nil {
+		return nil, err
+	}
+	if len(cfg.Rollups) > 0 && len(cfg.DownsampleEvery) > 0 {
+		return nil, fmt.Errorf("invalid ROLLUPS: use either ROLLUPS or DOWNSAMPLE")
+	}
+	if cfg.RollupDelay, err = envDuration(env, "ROLLUP_DELAY", time.Minute); err != nil {
+		return nil, err
+	}
+	// with logins, reading needs them while nodes keep posting without a key
+	if cfg.BasicAuth, err = parseBasicAuth(env["BASIC_AUTH"]); err != nil {
+		return nil, err
+	}
+	if len(cfg.BasicAuth) > 0 && cfg.TenantsFile != "" {
+		return nil, fmt.Errorf("invalid BASIC_AUTH: not supported with TENANTS_FILE")
+	}
+	// once there are credentials, going without must not get more than them
+	anonymous := "operator"
+	if cfg.logins() || len(cfg.BasicAuth) > 0 || cfg.AccessKeysFile != "" || cfg.JWTSecret != "" {
+		anonymous = "device"
+	}
+	cfg.AnonymousRole = envDefault(env, "ANONYMOUS_ROLE", anonymous)
+	switch cfg.AnonymousRole {
+	case "none":
+		cfg.AnonymousRole = ""
+	case "device", "viewer", "operator":
+	default:
+		return nil, fmt.Errorf("invalid ANONYMOUS_ROLE: must be device, viewer, operator or none")
+	}
+	if cfg.UsersFile != "" && cfg.JWTSecret == "" {
+		return nil, fmt.Errorf("invalid USERS_FILE: logins need a JWT_SECRET")
+	}
+	if cfg.OIDCIssuer != "" && (cfg.OIDCClientID == "" || cfg.OIDCRedirectURL == "" || cfg.JWTSecret == "") {
+		return nil, fmt.Errorf("invalid OIDC_ISSUER: OIDC_CLIENT_ID, OIDC_REDIRECT_URL and JWT_SECRET are required")
+	}
+	if cfg.OIDCRoleGroups, err = parseRoleGroups(env["OIDC_ROLE_GROUPS"]); err != nil {
+		return nil, err
+	}
+	if cfg.OIDCDefaultRole != "" && !validRole(cfg.OIDCDefaultRole) {
+		return nil, fmt.Errorf("invalid OIDC_DEFAULT_ROLE: must be device, viewer, operator or admin")
+	}
+	if cfg.SessionTTL, err = envDuration(env, "SESSION_TTL", 12*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.SessionTTL <= 0 {
+		return nil, fmt.Errorf("invalid SESSION_TTL: must be positive")
+	}
+	if cfg.SessionIdleTimeout, err = envDuration(env, "SESSION_IDLE_TIMEOUT", 30*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.BreakerFailures, err = envInt(env, "BREAKER_FAILURES", 3); err != nil {
+		return nil, err
+	}
+	if cfg.BreakerProbe, err = envDuration(env, "BREAKER_PROBE", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.BreakerProbe <= 0 {
+		return nil, fmt.Errorf("invalid BREAKER_PROBE: must be positive")
+	}
+	if cfg.WriteBufferSize, err = envInt(env, "WRITE_BUFFER_SIZE", 100000); err != nil {
+		return nil, err
+	}
+	if cfg.WriteBufferHighWater, err = envInt(env, "WRITE_BUFFER_HIGH_WATER", cfg.WriteBufferSize*8/10); err != nil {
+		return nil, err
+	}
+	if cfg.WriteBufferHighWater > cfg.WriteBufferSize {
+		return nil, fmt.Errorf("invalid WRITE_BUFFER_HIGH_WATER: more than WRITE_BUFFER_SIZE")
+	}
+	if cfg.WriteQueueMaxAge, err = envDuration(env, "WRITE_QUEUE_MAX_AGE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.DiskCheckInterval, err = envDuration(env, "DISK_CHECK_INTERVAL", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.DiskLowFree, err = envFloat(env, "DISK_LOW_FREE", 0.10); err != nil {
+		return nil, err
+	}
+	if cfg.DiskMinFree, err = envFloat(env, "DISK_MIN_FREE", 0.05); err != nil {
+		return nil, err
+	}
+	if cfg.DiskMinFree < 0 || cfg.DiskMinFree > cfg.DiskLowFree || cfg.DiskLowFree >= 1 {
+		return nil, fmt.Errorf("invalid DISK_MIN_FREE or DISK_LOW_FREE: expected 0 <= DISK_MIN_FREE <= DISK_LOW_FREE < 1")
+	}
+	if cfg.DedupWindow, err = envDuration(env, "DEDUP_WINDOW", 10*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.DedupMaxKeys, err = envInt(env, "DEDUP_MAX_KEYS", 100000); err != nil {
+		return nil, err
+	}
+	if cfg.RetryAfter, err = envDuration(env, "RETRY_AFTER", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.SlowRequestThreshold, err = envDuration(env, "SLOW_REQUEST_THRESHOLD", 2*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.LogFilesKeep, err = envInt(env, "LOG_FILES_KEEP", 30); err != nil {
+		return nil, err
+	}
+	if cfg.LogFilesKeep < 0 {
+		return nil, fmt.Errorf("invalid LOG_FILES_KEEP: must not be negative")
+	}
+	cfg.LogLevel = envDefault(env, "LOG_LEVEL", "info")
+	if _, ok := logLevelNames[cfg.LogLevel]; !ok {
+		return nil, fmt.Errorf("invalid LOG_LEVEL: expected info or debug")
+	}
+	if cfg.DryRun, err = envBool(env, "DRY_RUN", false); err != nil {
+		return nil, err
+	}
+	if cfg.MDNS, err = envBool(env, "MDNS", false); err != nil {
+		return nil, err
+	}
+	if cfg.StreamBatchSize, err = envInt(env, "STREAM_BATCH_SIZE", 100); err != nil {
+		return nil, err
+	}
+	if cfg.StreamFlushInterval, err = envDuration(env, "STREAM_FLUSH_INTERVAL", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.StreamFlushInterval <= 0 {
+		return nil, fmt.Errorf("invalid STREAM_FLUSH_INTERVAL: must be positive")
+	}
+	if cfg.MQTTQoS, err = envInt(env, "MQTT_QOS", 0); err != nil {
+		return nil, err
+	}
+	if cfg.MQTTQoS < 0 || cfg.MQTTQoS > 2 {
+		return nil, fmt.Errorf("invalid MQTT_QOS: must be 0, 1 or 2")
+	}
+	// set but empty disables the latest topic
+	cfg.MQTTLatestTopic = "sensors/{node}/latest"
+	if v, ok := env["MQTT_LATEST_TOPIC"]; ok {
+		cfg.MQTTLatestTopic = v
+	}
+	if cfg.HADiscovery, err = envBool(env, "HA_DISCOVERY", false); err != nil {
+		return nil, err
+	}
+	if cfg.HADiscovery && cfg.MQTTBroker == "" {
+		return nil, fmt.Errorf("HA_DISCOVERY needs MQTT_BROKER")
+	}
+	if !nodePattern.MatchString(cfg.HANode) {
+		return nil, fmt.Errorf("invalid HA_NODE: %q is not a valid node name", cfg.HANode)
+	}
+	if cfg.ForwardQueueSize, err = envInt(env, "FORWARD_QUEUE_SIZE", 1000); err != nil {
+		return nil, err
+	}
+	if cfg.ForwardTimeout, err = envDuration(env, "FORWARD_TIMEOUT", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.ForwardRetries, err = envInt(env, "FORWARD_RETRIES", 3); err != nil {
+		return nil, err
+	}
+	if cfg.ShadowPercent, err = envFloat(env, "SHADOW_PERCENT", 100); err != nil {
+		return nil, err
+	}
+	if cfg.ShadowPercent <= 0 || cfg.ShadowPercent > 100 {
+		return nil, fmt.Errorf("invalid SHADOW_PERCENT: must be above 0 and at most 100")
+	}
+	if cfg.ShadowBucket != "" && cfg.GatewayUpstream != "" {
+		return nil, fmt.Errorf("SHADOW_BUCKET cannot be used with GATEWAY_UPSTREAM")
+	}
+	if cfg.GatewayFlushInterval, err = envDuration(env, "GATEWAY_FLUSH_INTERVAL", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.GatewayFlushInterval <= 0 {
+		return nil, fmt.Errorf("invalid GATEWAY_FLUSH_INTERVAL: must be positive")
+	}
+	if cfg.LeaderElection, err = envBool(env, "LEADER_ELECTION", false); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	cfg.ReplicaID = envDefault(env, "REPLICA_ID", hostname)
+	cfg.LeaderBucket = envDefault(env, "LEADER_BUCKET", cfg.Bucket)
+	if cfg.LeaderLease, err = envDuration(env, "LEADER_LEASE", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.LeaderElection && (cfg.ReplicaID == "" || cfg.LeaderBucket == "" || cfg.LeaderLease < 3*time.Second) {
+		return nil, fmt.Errorf("LEADER_ELECTION needs REPLICA_ID, LEADER_BUCKET and a LEADER_LEASE of at least 3s")
+	}
+	if cfg.CORSMaxAge, err = envInt(env, "CORS_MAX_AGE", 600); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// logins tells whether dashboard users log in, with a password or through
+// single sign-on
+func (cfg *config) logins() bool {
+	return cfg.UsersFile != "" || cfg.OIDCIssuer != ""
+}
+
+// serverTime is true when the readings of node get the receive time
+func (cfg *config) serverTime(node string) bool {
+	return cfg.TimeSource == "receive" || cfg.ServerTimeNodes[node]
+}
+
+// deviceTime converts a timestamp of the clock of node to UTC. The clocks
+// of nodes in NODE_TIMEZONES show local time, so their epoch timestamps
+// count the local wall clock time as if it was UTC.
+func (cfg *config) deviceTime(node string, ts time.Time) time.Time {
+	loc, ok := cfg.NodeTimezones[node]
+	if !ok {
+		return ts
+	}
+	u := ts.UTC()
+	return time.Date(u.Year(), u.Month(), u.Day(), u.Hour(), u.Minute(), u.Second(), u.Nanosecond(), loc).UTC()
+}
+
+// receivedAt is the receive time to store along with the points, zero
+// unless TIME_SOURCE is both
+func (cfg *config) receivedAt(received time.Time) time.Time {
+	if cfg.TimeSource != "both" {
+		return time.Time{}
+	}
+	return received
+}
+
+func envDefault(env map[string]string, name string, def string) string {
+	if v, ok := env[name]; ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(env map[string]string, name string, def int) (int, error) {
+	v, ok := env[name]
+	if !ok || v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return n, nil
+}
+
+func envFloat(env map[string]string, name string, def float64) (float64, error) {
+	v, ok := env[name]
+	if !ok || v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return f, nil
+}
+
+func envBool(env map[string]string, name string, def bool) (bool, error) {
+	v, ok := env[name]
+	if !ok || v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return b, nil
+}
+
+func envDuration(env map[string]string, name string, def time.Duration) (time.Duration, error) {
+	v, ok := env[name]
+	if !ok || v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return d, nil
+}
+
+// envDurations reads a comma separated list of durations
+func envDurations(env map[string]string, name string) ([]time.Duration, error) {
+	var list []time.Duration
+	for _, v := range splitList(env[name]) {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		list = append(list, d)
+	}
+	return list, nil
+}
+
+// envRange reads a "min,max" pair
+func envRange(env map[string]string, name string, def valueRange) (valueRange, error) {
+	v, ok := env[name]
+	if !ok || v == "" {
+		return def, nil
+	}
+	parts := splitList(v)
+	if len(parts) != 2 {
+		return def, fmt.Errorf("invalid %s: expected min,max", name)
+	}
+	min, err1 := strconv.ParseFloat(parts[0], 64)
+	max, err2 := strconv.ParseFloat(parts[1], 64)
+	if err1 != nil || err2 != nil || min > max {
+		return def, fmt.Errorf("invalid %s: expected min,max", name)
+	}
+	return valueRange{min, max}, nil
+}
+
+// splitList splits a comma separated value, dropping empty items
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,148 @@
+"use strict";
+
+const API = "../v1";
+const COLORS = ["#1f77b4", "#d62728", "#2ca02c"];
+
+let selected = null;
+
+function fmt(v) {
+  return typeof v === "number" ? v.toFixed(2) : "-";
+}
+
+async function fetchJSON(path) {
+  const headers = {};
+  const apiKey = localStorage.getItem("apiKey");
+  if (apiKey) {
+    headers["X-API-Key"] = apiKey;
+  }
+  const res = await fetch(API + path, { headers });
+  if (res.status === 401 || res.status === 403) {
+    location.href = "login.html";
+  }
+  if (!res.ok) {
+    throw new Error(res.status + " " + (await res.text()));
+  }
+  return res.json();
+}
+
+async function refreshNodes() {
+  const data = await fetchJSON("/nodes");
+  const body = document.querySelector("#nodes tbody");
+  body.innerHTML = "";
+
+  for (const n of data.nodes) {
+    const tr = document.createElement("tr");
+    if (n.node === selected) {
+      tr.className = "selected";
+    }
+    const cells = [
+      n.node,
+      n.online ? "online" : "offline",
+      new Date(n.last_seen).toLocaleString(),
+      fmt(n.latest.humidity),
+      fmt(n.latest.temperature),
+      fmt(n.latest.x),
+      fmt(n.latest.y),
+      fmt(n.latest.z),
+    ];
+    cells.forEach((text, i) => {
+      const td = document.createElement("td");
+      td.textContent = text;
+      if (i === 1) {
+        td.className = text;
+      }
+      tr.appendChild(td);
+    });
+    tr.addEventListener("click", () => select(n.node));
+    body.appendChild(tr);
+  }
+
+  if (selected === null && data.nodes.length > 0) {
+    select(data.nodes[0].node);
+  }
+  document.getElementById("updated").textContent = "Updated " + new Date().toLocaleTimeString();
+}
+
+function drawChart(canvas, rows, fields) {
+  const ctx = canvas.getContext("2d");
+  const w = canvas.width;
+  const h = canvas.height;
+  const pad = 30;
+  ctx.clearRect(0, 0, w, h);
+
+  const values = rows.flatMap((r) => fields.map((f) => r[f]).filter((v) => typeof v === "number"));
+  if (values.length === 0) {
+    ctx.fillText("no data", w / 2 - 20, h / 2);
+    return;
+  }
+
+  const times = rows.map((r) => Date.parse(r.time));
+  const t0 = Math.min(...times);
+  const t1 = Math.max(...times) || t0 + 1;
+  let lo = Math.min(...values);
+  let hi = Math.max(...values);
+  if (lo === hi) {
+    lo -= 1;
+    hi += 1;
+  }
+
+  const x = (t) => pad + ((t - t0) / (t1 - t0 || 1)) * (w - 2 * pad);
+  const y = (v) => h - pad - ((v - lo) / (hi - lo)) * (h - 2 * pad);
+
+  ctx.strokeStyle = "#999";
+  ctx.strokeRect(pad, pad, w - 2 * pad, h - 2 * pad);
+  ctx.fillStyle = "#555";
+  ctx.fillText(hi.toFixed(2), 2, pad);
+  ctx.fillText(lo.toFixed(2), 2, h - pad);
+
+  fields.forEach((f, i) => {
+    ctx.strokeStyle = COLORS[i % COLORS.length];
+    ctx.beginPath();
+    rows.forEach((r, j) => {
+      if (typeof r[f] !== "number") {
+        return;
+      }
+      const px = x(times[j]);
+      const py = y(r[f]);
+      j === 0 ? ctx.moveTo(px, py) : ctx.lineTo(px, py);
+    });
+    ctx.stroke();
+  });
+}
+
+async function refreshCharts() {
+  if (selected === null) {
+    return;
+  }
+  const range = document.getElementById("range").value;
+  const every = { "-1h": "1m", "-6h": "5m", "-24h": "15m", "-168h": "1h" }[range];
+  const q = "?node=" + encodeURIComponent(selected) + "&start=" + range + "&every=" + every;
+
+  const air = await fetchJSON("/readings" + q + "&measurement=air");
+  drawChart(document.getElementById("humidity"), air.readings, ["humidity"]);
+  drawChart(document.getElementById("temperature"), air.readings, ["temperature"]);
+
+  const acc = await fetchJSON("/readings" + q + "&measurement=accelerometer");
+  drawChart(document.getElementById("accelerometer"), acc.readings, ["x", "y", "z"]);
+}
+
+function select(node) {
+  selected = node;
+  document.getElementById("selected").textContent = "- " + node;
+  document.querySelectorAll("#nodes tbody tr").forEach((tr) => {
+    tr.classList.toggle("selected", tr.firstChild.textContent === node);
+  });
+  refreshCharts().catch(console.error);
+}
+
+document.getElementById("logout").addEventListener("click", async () => {
+  localStorage.removeItem("apiKey");
+  await fetch("../logout", { method: "POST" });
+  location.href = "login.html";
+});
+
+document.getElementById("range").addEventListener("change", () => refreshCharts().catch(console.error));
+
+refreshNodes().catch(console.error);
+setInterval(() => refreshNodes().catch(console.error), 5000);
+setInterval(() => refreshCharts().catch(console.error), 60000);
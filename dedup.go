@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// dedupCache drops points already written within the window. The same
+// reading can arrive more than once over different paths (MQTT and the HTTP
+// fallback, a gateway resending a batch), with different idempotency keys
+// or none. Points are identified by their series, the measurement and tags
+// including the node, and their timestamp at the write precision. A nil
+// cache keeps every point.
+type dedupCache struct {
+	window    time.Duration
+	max       int
+	precision time.Duration
+
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []dedupEntry
+
+	// keys shared with other instances under the tenant namespace, see
+	// redis.go
+	shared    *redisClient
+	namespace string
+}
+
+type dedupEntry struct {
+	key string
+	at  time.Time
+}
+
+func newDedupCache(window time.Duration, max int, precision time.Duration) *dedupCache {
+	if window <= 0 {
+		return nil
+	}
+	return &dedupCache{window: window, max: max, precision: precision, seen: make(map[string]time.Time)}
+}
+
+func (c *dedupCache) key(p *write.Point) string {
+	var sb strings.Builder
+	sb.WriteString(p.Name())
+	for _, tag := range p.TagList() {
+		sb.WriteString("\x00" + tag.Key + "=" + tag.Value)
+	}
+	sb.WriteString("\x00")
+	sb.WriteString(strconv.FormatInt(p.Time().Truncate(c.precision).UnixNano(), 10))
+	return sb.String()
+}
+
+// filter returns the points not seen within the window and remembers them
+func (c *dedupCache) filter(points []*write.Point) (kept []*write.Point, duplicates int) {
+	if c == nil {
+		return points, 0
+	}
+	if c.shared != nil {
+		if kept, duplicates, ok := c.filterShared(points); ok {
+			return kept, duplicates
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+	for _, p := range points {
+		k := c.key(p)
+		if _, ok := c.seen[k]; ok {
+			duplicates++
+			continue
+		}
+		c.seen[k] = now
+		c.order = append(c.order, dedupEntry{k, now})
+		kept = append(kept, p)
+	}
+	return kept, duplicates
+}
+
+// forget removes points that were not stored after all, so they are
+// accepted when sent again
+func (c *dedupCache) forget(points []*write.Point) {
+	if c == nil {
+		return
+	}
+	if c.shared != nil {
+		c.forgetShared(points)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range points {
+		delete(c.seen, c.key(p))
+	}
+}
+
+// expire drops the keys that left the window, and the oldest ones while the
+// cache holds more than max. c.mu must be held.
+func (c *dedupCache) expire(now time.Time) {
+	n := 0
+	for ; n < len(c.order); n++ {
+		e := c.order[n]
+		if now.Sub(e.at) < c.window && len(c.order)-n <= c.max {
+			break
+		}
+		// a forgotten key may have been seen again since
+		if at, ok := c.seen[e.key]; ok && at.Equal(e.at) {
+			delete(c.seen, e.key)
+		}
+	}
+	c.order = c.order[n:]
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// ESP32 esp_reset_reason() values, in the order of esp_reset_reason_t
+var resetReasons = []string{"UNKNOWN", "POWERON", "EXT", "SW", "PANIC", "INT_WDT", "TASK_WDT", "WDT", "DEEPSLEEP", "BROWNOUT", "SDIO"}
+
+// resets that point at a hardware or firmware problem rather than a
+// deliberate restart
+var abnormalResets = map[string]bool{"PANIC": true, "INT_WDT": true, "TASK_WDT": true, "WDT": true, "BROWNOUT": true}
+
+// nodeDiagnostics is the last device report of a node
+type nodeDiagnostics struct {
+	Uptime      int64     `json:"uptime_seconds"`
+	FreeHeap    int64     `json:"free_heap_bytes"`
+	ResetReason string    `json:"reset_reason"`
+	Reported    time.Time `json:"reported"`
+	// boots seen since the server started, from the uptime going back
+	Reboots int64 `json:"reboots"`
+}
+
+// normalizeResetReason accepts "BROWNOUT", "ESP_RST_BROWNOUT" or the
+// numeric value 9 alike
+func normalizeResetReason(v string) string {
+	v = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(v)), "ESP_RST_")
+	if i, err := strconv.Atoi(v); err == nil && i >= 0 && i < len(resetReasons) {
+		return resetReasons[i]
+	}
+	return v
+}
+
+// observeDiagnostics stores a report of node, which counts as being seen,
+// and returns true when the report is the first one of a new boot
+func (s *nodeStore) observeDiagnostics(node string, d nodeDiagnostics) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.get(node)
+	n.LastSeen = d.Reported
+	booted := n.Diagnostics == nil || d.Uptime < n.Diagnostics.Uptime
+	if n.Diagnostics != nil {
+		d.Reboots = n.Diagnostics.Reboots
+		if booted {
+			d.Reboots++
+		}
+	}
+	n.Diagnostics = &d
+	return booted
+}
+
+// postDiagnostics records a device report: uptime, free heap and the cause
+// of the last reset. ESP32 brownouts and watchdog resets raise an event.
+func postDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	events := ctx.Value(key("events")).(*eventBus)
+
+	var body struct {
+		Node        string `json:"node"`
+		Uptime      *int64 `json:"uptime"`
+		FreeHeap    *int64 `json:"free_heap"`
+		ResetReason string `json:"reset_reason"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "400 - Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	} else {
+		body.Node = r.FormValue("node")
+		body.ResetReason = r.FormValue("reset_reason")
+		for name, dst := range map[string]**int64{"uptime": &body.Uptime, "free_heap": &body.FreeHeap} {
+			if v := r.FormValue(name); v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					http.Error(w, "400 - invalid "+name, http.StatusBadRequest)
+					return
+				}
+				*dst = &n
+			}
+		}
+	}
+	if body.Node == "" || body.Uptime == nil {
+		http.Error(w, "400 - node and uptime are required", http.StatusBadRequest)
+		return
+	}
+	if err := validNode(body.Node); err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	d := nodeDiagnostics{
+		Uptime:      *body.Uptime,
+		ResetReason: normalizeResetReason(body.ResetReason),
+		Reported:    time.Now(),
+	}
+	p := influxdb2.NewPointWithMeasurement("diagnostics").
+		AddTag("location", body.Node).
+		AddField("uptime", d.Uptime).
+		SetTime(d.Reported)
+	if body.FreeHeap != nil {
+		d.FreeHeap = *body.FreeHeap
+		p.AddField("free_heap", d.FreeHeap)
+	}
+	if d.ResetReason != "" {
+		p.AddField("reset_reason", d.ResetReason)
+	}
+
+	if t.writer.overloaded() {
+		t.usage.Throttled.Add(1)
+		writeOverloaded(w, ctx.Value(key("config")).(*config).RetryAfter)
+		return
+	}
+	if _, err := t.writer.write(ctx, nil, p); err != nil {
+		log.Println(err)
+		http.Error(w, "502 - Write failed", http.StatusBadGateway)
+		return
+	}
+
+	if t.nodes.observeDiagnostics(body.Node, d) && abnormalResets[d.ResetReason] {
+		events.emit(t, event{
+			Node:  body.Node,
+			Type:  "reset",
+			Title: "Abnormal reset",
+			Text:  fmt.Sprintf("node restarted after %s, up for %ds", d.ResetReason, d.Uptime),
+			Time:  d.Reported,
+		})
+	}
+
+	writeJSON(w, map[string]interface{}{"status": "ok"})
+}
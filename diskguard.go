@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Disk guard: every DISK_CHECK_INTERVAL the free space of the logs volume
+// and of the volume holding WRITE_QUEUE_PATH is checked. Below DISK_LOW_FREE
+// on either the per-request log lines (debug, rejected records, receipts)
+// are skipped; below DISK_MIN_FREE on the queue volume ingest that would
+// have to be buffered on disk is refused with 503 and Retry-After, nodes
+// keep their readings. Writes that reach InfluxDB right away go on.
+
+var errDiskFull = fmt.Errorf("disk almost full, not buffering: %w", errBufferFull)
+
+// set while the disk is low, read by detailf without locking
+var reducedLogging atomic.Bool
+
+// detailf logs per-request details unless the disk runs out of space
+func detailf(format string, args ...interface{}) {
+	if !reducedLogging.Load() {
+		log.Printf(format, args...)
+	}
+}
+
+// diskStatus is the last check of a volume
+type diskStatus struct {
+	Path       string  `json:"path"`
+	Purpose    string  `json:"purpose"`
+	FreeBytes  uint64  `json:"free_bytes"`
+	TotalBytes uint64  `json:"total_bytes"`
+	FreeRatio  float64 `json:"free_ratio"`
+	// ok, low or critical
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+type diskGuard struct {
+	low, min float64
+
+	mu     sync.Mutex
+	disks  []diskStatus
+	logged map[string]string
+
+	// the queue volume is below the minimum, see influxWriter.write
+	critical atomic.Bool
+}
+
+func newDiskGuard(cfg *config) *diskGuard {
+	g := &diskGuard{low: cfg.DiskLowFree, min: cfg.DiskMinFree, logged: make(map[string]string)}
+	g.disks = append(g.disks, diskStatus{Path: logDir, Purpose: "logs"})
+	if cfg.WriteQueuePath != "" {
+		g.disks = append(g.disks, diskStatus{Path: filepath.Dir(cfg.WriteQueuePath), Purpose: "write_queue"})
+	}
+	g.check()
+	return g
+}
+
+func (g *diskGuard) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		g.check()
+	}
+}
+
+// check measures every volume and switches logging and buffering
+func (g *diskGuard) check() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	reduce, critical := false, false
+	for i := range g.disks {
+		d := &g.disks[i]
+		free, total, err := diskSpace(d.Path)
+		d.Error = ""
+		if err != nil || total == 0 {
+			// an unknown volume is not held against the server
+			d.State = "ok"
+			d.Error = errString(err)
+			continue
+		}
+		d.FreeBytes, d.TotalBytes = free, total
+		d.FreeRatio = float64(free) / float64(total)
+		switch {
+		case d.FreeRatio < g.min:
+			d.State = "critical"
+		case d.FreeRatio < g.low:
+			d.State = "low"
+		default:
+			d.State = "ok"
+		}
+		if d.State != "ok" {
+			reduce = true
+			if d.Purpose == "write_queue" && d.State == "critical" {
+				critical = true
+			}
+		}
+		if g.logged[d.Purpose] != d.State {
+			if g.logged[d.Purpose] != "" || d.State != "ok" {
+				log.Printf("disk: %s volume (%s) %s, %.1f%% free\n", d.Purpose, d.Path, d.State, 100*d.FreeRatio)
+			}
+			g.logged[d.Purpose] = d.State
+		}
+	}
+	if reducedLogging.Swap(reduce) != reduce {
+		if reduce {
+			log.Println("disk: skipping per-request log lines until space is freed")
+		} else {
+			log.Println("disk: logging every request again")
+		}
+	}
+	if g.critical.Swap(critical) != critical {
+		if critical {
+			log.Println("disk: refusing ingest that would be buffered on disk")
+		} else {
+			log.Println("disk: buffering on disk again")
+		}
+	}
+}
+
+func (g *diskGuard) status() []diskStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([]diskStatus(nil), g.disks...)
+}
+
+func collectDisk(g *diskGuard) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		disks := g.status()
+		mw.family("sensor_disk_free_bytes", "gauge", "Free bytes of the volumes holding the logs and the write queue.")
+		for _, d := range disks {
+			mw.sample("sensor_disk_free_bytes", float64(d.FreeBytes), "purpose", d.Purpose)
+		}
+		mw.family("sensor_disk_total_bytes", "gauge", "Size of the volumes holding the logs and the write queue.")
+		for _, d := range disks {
+			mw.sample("sensor_disk_total_bytes", float64(d.TotalBytes), "purpose", d.Purpose)
+		}
+		reduced, refused := 0.0, 0.0
+		if reducedLogging.Load() {
+			reduced = 1
+		}
+		if g.critical.Load() {
+			refused = 1
+		}
+		mw.family("sensor_disk_reduced_logging", "gauge", "1 while per-request log lines are skipped for lack of space.")
+		mw.sample("sensor_disk_reduced_logging", reduced)
+		mw.family("sensor_disk_buffering_refused", "gauge", "1 while ingest that would be buffered on disk is refused.")
+		mw.sample("sensor_disk_buffering_refused", refused)
+	}
+}
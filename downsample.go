@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+)
+
+// downsampleTask is one stage of the chain raw → <bucket>_1m → <bucket>_1h,
+// an InfluxDB task aggregating the previous bucket into the next one
+type downsampleTask struct {
+	Tenant      string `json:"tenant"`
+	Name        string `json:"name"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Every       string `json:"every"`
+	ID          string `json:"id,omitempty"`
+	Status      string `json:"status,omitempty"`
+	// created, updated or unchanged after a sync
+	Action string `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// shortDuration formats d without zero units, e.g. "1h" instead of "1h0m0s"
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// downsamplePlan lists the tasks the configuration asks for
+func downsamplePlan(cfg *config, t *tenant) []downsampleTask {
+	var plan []downsampleTask
+	src := t.Bucket
+	for _, every := range cfg.DownsampleEvery {
+		dest := t.Bucket + "_" + shortDuration(every)
+		plan = append(plan, downsampleTask{
+			Tenant:      t.Name,
+			Name:        "downsample " + t.Bucket + " " + shortDuration(every),
+			Source:      src,
+			Destination: dest,
+			Every:       shortDuration(every),
+		})
+		src = dest
+	}
+	return plan
+}
+
+// downsampleFlux is the full task script, including the task options, so it
+// can be compared with the one stored in InfluxDB
+func downsampleFlux(cfg *config, t *tenant, task downsampleTask) string {
+	return fmt.Sprintf(`option task = {name: %s, every: %s}
+
+from(bucket: %s)
+  |> range(start: -task.every)
+  |> filter(fn: (r) => %s)
+  |> group(columns: ["_measurement", "_field", "location"])
+  |> aggregateWindow(every: task.every, fn: mean, createEmpty: false)
+  |> to(bucket: %s, org: %s)
+`, fluxString(task.Name), task.Every, fluxString(task.Source),
+		cfg.Schema.measurementFilter(), fluxString(task.Destination), fluxString(t.Org))
+}
+
+// retentionRules keeps data for d, forever at 0
+func retentionRules(d time.Duration) domain.RetentionRules {
+	if d == 0 {
+		return nil
+	}
+	expire := domain.RetentionRuleTypeExpire
+	return domain.RetentionRules{{EverySeconds: int64(d / time.Second), Type: &expire}}
+}
+
+// ensureBucket creates the destination bucket or updates its retention
+func ensureBucket(ctx context.Context, client influxdb2.Client, org *domain.Organization, name string, retention time.Duration) error {
+	buckets := client.BucketsAPI()
+	rules := retentionRules(retention)
+	b, err := buckets.FindBucketByName(ctx, name)
+	if err != nil {
+		_, err = buckets.CreateBucketWithName(ctx, org, name, rules...)
+		return err
+	}
+	var current int64
+	if len(b.RetentionRules) > 0 {
+		current = b.RetentionRules[0].EverySeconds
+	}
+	if current == int64(retention/time.Second) {
+		return nil
+	}
+	b.RetentionRules = rules
+	_, err = buckets.UpdateBucket(ctx, b)
+	return err
+}
+
+// syncDownsampling creates the buckets and tasks of one tenant, updating
+// tasks whose script differs from the configured one
+func syncDownsampling(ctx context.Context, cfg *config, client influxdb2.Client, t *tenant) ([]downsampleTask, error) {
+	org, err := client.OrganizationsAPI().FindOrganizationByName(ctx, t.Org)
+	if err != nil {
+		return nil, err
+	}
+	tasks := client.TasksAPI()
+
+	plan := downsamplePlan(cfg, t)
+	for i := range plan {
+		task := &plan[i]
+		var retention time.Duration
+		if i < len(cfg.DownsampleRetention) {
+			retention = cfg.DownsampleRetention[i]
+		}
+		if err := ensureBucket(ctx, client, org, task.Destination, retention); err != nil {
+			task.Error = err.Error()
+			continue
+		}
+
+		flux := downsampleFlux(cfg, t, *task)
+		found, err := tasks.FindTasks(ctx, &api.TaskFilter{Name: task.Name, OrgID: *org.Id})
+		if err != nil {
+			task.Error = err.Error()
+			continue
+		}
+		if len(found) == 0 {
+			created, err := tasks.CreateTaskByFlux(ctx, flux, *org.Id)
+			if err != nil {
+				task.Error = err.Error()
+				continue
+			}
+			task.ID, task.Status, task.Action = created.Id, taskStatus(created), "created"
+			continue
+		}
+
+		existing := found[0]
+		task.ID, task.Status, task.Action = existing.Id, taskStatus(&existing), "unchanged"
+		if existing.Flux != flux {
+			every := task.Every
+			existing.Flux, existing.Every, existing.Cron = flux, &every, nil
+			if _, err := tasks.UpdateTask(ctx, &existing); err != nil {
+				task.Error = err.Error()
+				continue
+			}
+			task.Action = "updated"
+		}
+	}
+	return plan, nil
+}
+
+func taskStatus(t *domain.Task) string {
+	if t.Status == nil {
+		return ""
+	}
+	return string(*t.Status)
+}
+
+// runDownsampling syncs the tasks of every tenant at startup; failures are
+// logged and do not keep the server from starting
+func runDownsampling(cfg *config, client influxdb2.Client, tenants *tenantRegistry) {
+	for _, t := range sortedTenants(tenants) {
+		plan, err := syncDownsampling(context.Background(), cfg, client, t)
+		if err != nil {
+			log.Printf("downsampling of %s: %s\n", t.Name, err)
+			continue
+		}
+		for _, task := range plan {
+			if task.Error != "" {
+				log.Printf("downsample task %q: %s\n", task.Name, task.Error)
+			} else if task.Action != "unchanged" {
+				log.Printf("downsample task %q %s\n", task.Name, task.Action)
+			}
+		}
+	}
+}
+
+// adminDownsample lists the configured downsampling tasks with their state
+// in InfluxDB (GET) or creates and updates them right away (POST)
+func adminDownsample(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	cfg := ctx.Value(key("config")).(*config)
+	reg := ctx.Value(key("tenants")).(*tenantRegistry)
+	client := ctx.Value(key("db")).(influxdb2.Client)
+	audit := ctx.Value(key("audit")).(*auditLog)
+
+	all := []downsampleTask{}
+	for _, t := range sortedTenants(reg) {
+		if r.Method == "GET" {
+			plan := downsamplePlan(cfg, t)
+			for i := range plan {
+				found, err := client.TasksAPI().FindTasks(ctx, &api.TaskFilter{Name: plan[i].Name, OrgName: t.Org})
+				if err != nil {
+					plan[i].Error = err.Error()
+				} else if len(found) > 0 {
+					plan[i].ID, plan[i].Status = found[0].Id, taskStatus(&found[0])
+				}
+			}
+			all = append(all, plan...)
+			continue
+		}
+
+		plan, err := syncDownsampling(ctx, cfg, client, t)
+		audit.record(r, "sync_downsampling", map[string]interface{}{
+			"tenant": t.Name,
+			"tasks":  plan,
+			"error":  errString(err),
+		})
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "502 - Sync failed", http.StatusBadGateway)
+			return
+		}
+		all = append(all, plan...)
+	}
+
+	writeJSON(w, map[string]interface{}{"tasks": all})
+}
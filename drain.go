@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Drain mode, for rolling deploys: POST /admin/drain fails the readiness
+// probe so the load balancer stops routing to the instance, turns new ingest
+// requests away with 503 and Retry-After so nodes keep their readings for
+// another instance, and flushes the write buffers. Retries of requests the
+// instance already took, recognized by their Idempotency-Key, are still
+// answered. GET /admin/drain reports when nothing is left to lose.
+
+type drainState struct {
+	mu sync.Mutex
+	// zero while not draining
+	since time.Time
+
+	inflight atomic.Int64
+}
+
+func (d *drainState) draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.since.IsZero()
+}
+
+// withDrain turns new ingest requests away while draining
+func withDrain(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		d := ctx.Value(key("drain")).(*drainState)
+		d.inflight.Add(1)
+		defer d.inflight.Add(-1)
+		if d.draining() && !isRetry(r) {
+			cfg := ctx.Value(key("config")).(*config)
+			w.Header().Set("Connection", "close")
+			writeDraining(w, cfg.RetryAfter)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// isRetry tells whether r repeats a request whose Idempotency-Key is known
+// for its node and body
+func isRetry(r *http.Request) bool {
+	k := idempotencyKey(r)
+	if k == "" {
+		return false
+	}
+	store := r.Context().Value(key("idempotency")).(*idempotencyStore)
+	return store.seen(k, ingestBodyOf(r.Context()).fingerprint())
+}
+
+// writeDraining answers like writeOverloaded, nodes post again later
+func writeDraining(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "503 - Server is draining, retry later", http.StatusServiceUnavailable)
+}
+
+// getReadyz is the readiness probe, failing while the server drains
+func getReadyz(w http.ResponseWriter, r *http.Request) {
+	d := r.Context().Value(key("drain")).(*drainState)
+	if d.draining() {
+		http.Error(w, "503 - Draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready"))
+}
+
+// adminDrain starts draining (POST), reports its progress (GET) and ends it
+// again (DELETE)
+func adminDrain(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	d := ctx.Value(key("drain")).(*drainState)
+	reg := ctx.Value(key("tenants")).(*tenantRegistry)
+	audit := ctx.Value(key("audit")).(*auditLog)
+
+	switch r.Method {
+	case "POST":
+		d.mu.Lock()
+		started := d.since.IsZero()
+		if started {
+			d.since = time.Now()
+		}
+		d.mu.Unlock()
+		if started {
+			log.Println("drain: started, new ingest requests are turned away")
+			audit.record(r, "drain", nil)
+			for _, t := range reg.all() {
+				go t.writer.flush()
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case "DELETE":
+		d.mu.Lock()
+		stopped := !d.since.IsZero()
+		d.since = time.Time{}
+		d.mu.Unlock()
+		if stopped {
+			log.Println("drain: canceled, accepting ingest requests again")
+			audit.record(r, "undrain", nil)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	d.mu.Lock()
+	since := d.since
+	d.mu.Unlock()
+	buffered := 0
+	breakers := 0
+	for _, t := range reg.all() {
+		s := t.writer.status()
+		buffered += s.Buffered
+		if s.OpenedAt != nil {
+			breakers++
+		}
+	}
+	inflight := d.inflight.Load()
+	res := map[string]interface{}{
+		"draining":          !since.IsZero(),
+		"since":             nil,
+		"inflight_requests": inflight,
+		"buffered_points":   buffered,
+		"open_breakers":     breakers,
+		"safe_to_stop":      !since.IsZero() && inflight == 0 && buffered == 0,
+	}
+	if !since.IsZero() {
+		res["since"] = since.UTC()
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Dry runs: an ingest request with X-Dry-Run: true, or any ingest request
+// when DRY_RUN is set, is parsed, validated and enriched like any other, but
+// answered with the points it would write instead of writing them. Nothing
+// about the node is recorded, so firmware can be tried against production
+// without leaving traces; derived points such as rates, SHM indicators and
+// peaks depend on that history and are left out.
+
+// dryRunPoint is a point as it would be written
+type dryRunPoint struct {
+	Measurement  string                 `json:"measurement"`
+	Tags         map[string]string      `json:"tags"`
+	Fields       map[string]interface{} `json:"fields"`
+	Time         time.Time              `json:"time"`
+	LineProtocol string                 `json:"line_protocol"`
+	// the receipt ID it would get, see receipt.go
+	ID string `json:"id"`
+}
+
+// isDryRun tells whether r is only to be tried
+func isDryRun(r *http.Request, cfg *config) bool {
+	if cfg.DryRun {
+		return true
+	}
+	v, _ := strconv.ParseBool(r.Header.Get("X-Dry-Run"))
+	return v
+}
+
+func dryRunPoints(node string, points []*write.Point, precision time.Duration) []dryRunPoint {
+	list := make([]dryRunPoint, 0, len(points))
+	for _, p := range points {
+		dp := dryRunPoint{
+			Measurement:  p.Name(),
+			Tags:         make(map[string]string),
+			Fields:       make(map[string]interface{}),
+			Time:         p.Time().UTC(),
+			LineProtocol: strings.TrimSuffix(write.PointToLineProtocol(p, precision), "\n"),
+			ID:           pointID(node, p, precision),
+		}
+		for _, t := range p.TagList() {
+			dp.Tags[t.Key] = t.Value
+		}
+		for _, f := range p.FieldList() {
+			dp.Fields[f.Key] = f.Value
+		}
+		list = append(list, dp)
+	}
+	return list
+}
+
+// peekClock returns what observeClock would estimate for offset, without
+// keeping it
+func (s *nodeStore) peekClock(node string, offset time.Duration) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.nodes[node]
+	if !ok || !n.clockKnown {
+		return offset
+	}
+	return n.clockOffset + (offset-n.clockOffset)/10
+}
@@ -0,0 +1,96 @@
+#!/bin/sh
+# End-to-end check of the write path: boots the server next to an ephemeral
+# InfluxDB, posts real payloads and asserts the resulting points, then stops
+# InfluxDB to check that the breaker opens, readings are buffered and nodes
+# are throttled, and that the buffer is written once it is back.
+set -eu
+
+cd "$(dirname "$0")"
+
+SERVER="http://127.0.0.1:18080"
+DB="http://127.0.0.1:18086"
+TOKEN="e2e-token"
+COMPOSE="docker compose -p server-skripsi-e2e"
+
+cleanup() {
+	$COMPOSE down -v >/dev/null 2>&1 || true
+}
+trap cleanup EXIT
+
+$COMPOSE up -d --build
+
+# wait for both services to accept requests
+for i in $(seq 1 60); do
+	if curl -fs "$DB/ping" >/dev/null && curl -fs "$SERVER/" >/dev/null; then
+		break
+	fi
+	sleep 1
+done
+
+fail() {
+	echo "FAIL: $1" >&2
+	$COMPOSE logs server >&2 || true
+	exit 1
+}
+
+# valid payload is accepted
+TS=$(date +%s)
+BODY=$(curl -fs -X POST "$SERVER/v1/data" --data-urlencode "node=e2e-node" --data-urlencode "data=$TS|55.5|27.25|0.1,0.2,9.8") ||
+	fail "valid payload was rejected"
+echo "$BODY" | grep -q '"status":"ok"' || fail "unexpected response: $BODY"
+
+# malformed payload is rejected
+CODE=$(curl -s -o /dev/null -w '%{http_code}' -X POST "$SERVER/api" --data-urlencode "node=e2e-node" --data-urlencode "data=garbage")
+[ "$CODE" = "400" ] || fail "malformed payload returned $CODE, want 400"
+
+query() {
+	curl -fs -X POST "$DB/api/v2/query?org=e2e" \
+		-H "Authorization: Token $TOKEN" \
+		-H "Content-Type: application/vnd.flux" \
+		-H "Accept: application/csv" \
+		--data "from(bucket: \"e2e\") |> range(start: 0) |> filter(fn: (r) => r.location == \"$NODE\" and r._measurement == \"$1\" and r._field == \"$2\") |> last()"
+}
+
+expect() {
+	query "$1" "$2" | grep -q ",$3," || fail "$1.$2 is not $3"
+}
+
+NODE=e2e-node
+expect air humidity 55.5
+expect air temperature 27.25
+expect accelerometer x 0.1
+expect accelerometer y 0.2
+expect accelerometer z 9.8
+
+deep() {
+	# answers 503 while InfluxDB is down
+	curl -s "$SERVER/healthz/deep" || true
+}
+
+# with InfluxDB gone the breaker opens and readings are buffered, every
+# payload is two points and the buffer throttles at WRITE_BUFFER_HIGH_WATER
+$COMPOSE stop db
+for i in 1 2 3 4; do
+	CODE=$(curl -s -o /dev/null -w '%{http_code}' -X POST "$SERVER/v1/data" --data-urlencode "node=e2e-buffered" --data-urlencode "data=$((TS + i))|4$i.5|27.25|0.1,0.2,9.8")
+	[ "$CODE" = "200" ] || fail "payload $i while InfluxDB is down returned $CODE, want 200"
+done
+deep | grep -q '"breaker":"open"' || fail "breaker did not open: $(deep)"
+deep | grep -q '"buffered_points":8' || fail "readings were not buffered: $(deep)"
+CODE=$(curl -s -o /dev/null -w '%{http_code}' -X POST "$SERVER/v1/data" --data-urlencode "node=e2e-buffered" --data-urlencode "data=$((TS + 5))|45.5|27.25|0.1,0.2,9.8")
+[ "$CODE" = "503" ] || fail "payload over the high water mark returned $CODE, want 503"
+
+# once InfluxDB is back a probe closes the breaker and flushes the buffer
+$COMPOSE start db
+for i in $(seq 1 60); do
+	if deep | grep -q '"breaker":"closed"' && deep | grep -q '"buffered_points":0'; then
+		break
+	fi
+	sleep 1
+done
+deep | grep -q '"buffered_points":0' || fail "buffer was not flushed: $(deep)"
+
+NODE=e2e-buffered
+expect air humidity 44.5
+expect accelerometer z 9.8
+
+echo "e2e: all checks passed"
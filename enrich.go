@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+)
+
+// tags the server sets itself, which rules may not override
+var enrichmentReserved = map[string]bool{
+	"location":          true,
+	"clock_corrected":   true,
+	"geohash":           true,
+	"backfill_conflict": true,
+	"zone":              true,
+}
+
+// enrichment adds tags to the points of a node at write time, see
+// ENRICHMENT_FILE. Rules apply in order, later ones overriding the tags of
+// earlier ones, and the registry entry of the node overrides them all. A nil
+// enrichment adds nothing.
+type enrichment struct {
+	rules []enrichmentRule
+	nodes map[string]map[string]string
+}
+
+type enrichmentRule struct {
+	// a glob like "bridge-*", or a regular expression when re is set
+	glob string
+	re   *regexp.Regexp
+	tags map[string]string
+}
+
+type enrichmentFile struct {
+	Rules []struct {
+		Match string            `json:"match"`
+		Regex string            `json:"regex"`
+		Tags  map[string]string `json:"tags"`
+	} `json:"rules"`
+	Nodes map[string]map[string]string `json:"nodes"`
+}
+
+func loadEnrichment(file string) (*enrichment, error) {
+	if file == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var decl enrichmentFile
+	if err := json.Unmarshal(raw, &decl); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+
+	e := &enrichment{nodes: make(map[string]map[string]string)}
+	for i, r := range decl.Rules {
+		rule := enrichmentRule{glob: r.Match, tags: r.Tags}
+		switch {
+		case (r.Match == "") == (r.Regex == ""):
+			return nil, fmt.Errorf("rule %d: expected either match or regex", i+1)
+		case r.Regex != "":
+			if rule.re, err = regexp.Compile("^(?:" + r.Regex + ")$"); err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i+1, err)
+			}
+		default:
+			if _, err := path.Match(r.Match, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid match %q", i+1, r.Match)
+			}
+		}
+		if err := checkEnrichmentTags(r.Tags); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		e.rules = append(e.rules, rule)
+	}
+	for node, tags := range decl.Nodes {
+		if err := checkEnrichmentTags(tags); err != nil {
+			return nil, fmt.Errorf("node %q: %w", node, err)
+		}
+		e.nodes[node] = tags
+	}
+	return e, nil
+}
+
+func checkEnrichmentTags(tags map[string]string) error {
+	for k, v := range tags {
+		if k == "" || v == "" {
+			return fmt.Errorf("tags need a name and a value")
+		}
+		if enrichmentReserved[k] {
+			return fmt.Errorf("tag %q is reserved", k)
+		}
+	}
+	return nil
+}
+
+func (r enrichmentRule) matches(node string) bool {
+	if r.re != nil {
+		return r.re.MatchString(node)
+	}
+	ok, _ := path.Match(r.glob, node)
+	return ok
+}
+
+// tags returns the tags of node, nil when no rule matches
+func (e *enrichment) tags(node string) map[string]string {
+	if e == nil {
+		return nil
+	}
+	var tags map[string]string
+	add := func(m map[string]string) {
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		for k, v := range m {
+			tags[k] = v
+		}
+	}
+	for _, r := range e.rules {
+		if r.matches(node) {
+			add(r.tags)
+		}
+	}
+	if m, ok := e.nodes[node]; ok {
+		add(m)
+	}
+	return tags
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alerts kept for the admin listing, the oldest acknowledged go first
+const alertHistory = 500
+
+// Escalation: events of ESCALATION_EVENTS become alerts. An alert notifies
+// the first contact of ESCALATION_CHAIN right away and the next one each
+// ESCALATION_AFTER it stays unacknowledged, until the chain ends or someone
+// acknowledges it at POST /admin/alerts/{id}/ack. Contacts are
+// "email:<address>", sent through SMTP_ADDR, or "webhook:<url>", which gets
+// the alert as JSON.
+//
+// With REDIS_URL the alerts are kept in Redis: the replica that raised an
+// alert notifies the first contact, the leader escalates, and any replica
+// lists and acknowledges them. Without it, or while Redis is unreachable, an
+// alert stays with the replica that raised it, which also escalates it.
+
+// alertContact is one step of the escalation chain
+type alertContact struct {
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+}
+
+// parseEscalationChain reads "email:ops@example.com,webhook:https://..."
+func parseEscalationChain(v string) ([]alertContact, error) {
+	var chain []alertContact
+	for _, entry := range splitList(v) {
+		kind, target, _ := strings.Cut(entry, ":")
+		if (kind != "email" && kind != "webhook") || target == "" {
+			return nil, fmt.Errorf("invalid ESCALATION_CHAIN: expected email:<address> or webhook:<url>, got %q", entry)
+		}
+		chain = append(chain, alertContact{kind, target})
+	}
+	return chain, nil
+}
+
+type alertNotification struct {
+	Contact alertContact `json:"contact"`
+	At      time.Time    `json:"at"`
+	Error   string       `json:"error,omitempty"`
+}
+
+type alert struct {
+	ID     string    `json:"id"`
+	Tenant string    `json:"tenant"`
+	Node   string    `json:"node"`
+	Type   string    `json:"type"`
+	Title  string    `json:"title"`
+	Text   string    `json:"text"`
+	Time   time.Time `json:"time"`
+	// contacts notified so far, in chain order
+	Notified []alertNotification `json:"notified"`
+	Acked    *time.Time          `json:"acked,omitempty"`
+	AckedBy  string              `json:"acked_by,omitempty"`
+
+	// kept in Redis rather than by this replica
+	shared bool
+}
+
+// clone copies a, the notifications included
+func (a *alert) clone() alert {
+	c := *a
+	c.Notified = append([]alertNotification(nil), a.Notified...)
+	return c
+}
+
+// due tells whether a waited ESCALATION_AFTER for its next contact
+func (a *alert) due(cfg *config) bool {
+	last := a.Notified[len(a.Notified)-1]
+	return a.Acked == nil && len(a.Notified) < len(cfg.EscalationChain) && time.Since(last.At) >= cfg.EscalationAfter
+}
+
+// alertStore holds the alerts of all tenants in memory, or in Redis
+type alertStore struct {
+	cfg  *config
+	http *http.Client
+	// alerts shared with the other replicas, see redis.go; the leader
+	// escalates them
+	shared *redisClient
+	leader *leaderElector
+
+	mu     sync.Mutex
+	alerts []*alert
+}
+
+func newAlertStore(cfg *config) *alertStore {
+	return &alertStore{cfg: cfg, http: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// raise turns ev into an alert when its type escalates
+func (s *alertStore) raise(t *tenant, ev event) {
+	if !contains(s.cfg.EscalationEvents, ev.Type) || len(s.cfg.EscalationChain) == 0 {
+		return
+	}
+	a := &alert{
+		ID:     newJobID(),
+		Tenant: t.Name,
+		Node:   ev.Node,
+		Type:   ev.Type,
+		Title:  ev.Title,
+		Text:   ev.Text,
+		Time:   ev.Time,
+	}
+	a.shared = s.shared != nil && s.storeShared(*a)
+	if !a.shared {
+		s.mu.Lock()
+		s.alerts = append(s.alerts, a)
+		s.prune()
+		s.mu.Unlock()
+	}
+	s.escalate(a)
+}
+
+// prune forgets the oldest acknowledged alerts beyond alertHistory
+func (s *alertStore) prune() {
+	excess := len(s.alerts) - alertHistory
+	if excess <= 0 {
+		return
+	}
+	kept := s.alerts[:0]
+	for _, a := range s.alerts {
+		if excess > 0 && a.Acked != nil {
+			excess--
+			continue
+		}
+		kept = append(kept, a)
+	}
+	s.alerts = kept
+}
+
+// escalate notifies the next contact of the chain of a. The caller must not
+// hold the lock.
+func (s *alertStore) escalate(a *alert) {
+	s.mu.Lock()
+	step := len(a.Notified)
+	contact := s.cfg.EscalationChain[step]
+	a.Notified = append(a.Notified, alertNotification{Contact: contact, At: time.Now()})
+	copied := a.clone()
+	s.mu.Unlock()
+	if a.shared {
+		s.storeShared(copied)
+	}
+
+	go func() {
+		err := s.notify(contact, copied)
+		if err != nil {
+			log.Printf("notifying %s:%s of alert %s: %s\n", contact.Kind, contact.Target, copied.ID, err)
+		}
+		s.mu.Lock()
+		a.Notified[step].Error = errString(err)
+		failed := a.clone()
+		s.mu.Unlock()
+		if a.shared && err != nil {
+			s.storeShared(failed)
+		}
+	}()
+}
+
+func (s *alertStore) notify(c alertContact, a alert) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	level := len(a.Notified)
+	switch c.Kind {
+	case "email":
+		var b strings.Builder
+		fmt.Fprintf(&b, "From: %s\r\n", s.cfg.ReportEmailFrom)
+		fmt.Fprintf(&b, "To: %s\r\n", c.Target)
+		fmt.Fprintf(&b, "Subject: [alert %d/%d] %s on %s (%s)\r\n", level, len(s.cfg.EscalationChain), a.Title, a.Node, a.Tenant)
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		fmt.Fprintf(&b, "%s\r\n\r\nTime: %s\r\nAlert: %s\r\n", a.Text, a.Time.Format(time.RFC3339), a.ID)
+		var auth smtp.Auth
+		if s.cfg.SMTPUser != "" {
+			host, _, _ := strings.Cut(s.cfg.SMTPAddr, ":")
+			auth = smtp.PlainAuth("", s.cfg.SMTPUser, s.cfg.SMTPPassword, host)
+		}
+		return smtp.SendMail(s.cfg.SMTPAddr, auth, s.cfg.ReportEmailFrom, []string{c.Target}, []byte(b.String()))
+	default:
+		body, err := json.Marshal(map[string]interface{}{"alert": a, "level": level})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", c.Target, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := s.http.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook answered %s", res.Status)
+		}
+		return nil
+	}
+}
+
+// watch escalates the alerts whose last notification is older than
+// ESCALATION_AFTER: those of this replica, and on the leader those in Redis
+func (s *alertStore) watch() {
+	for range time.Tick(15 * time.Second) {
+		var due []*alert
+		s.mu.Lock()
+		for _, a := range s.alerts {
+			if a.due(s.cfg) {
+				due = append(due, a)
+			}
+		}
+		s.mu.Unlock()
+		if s.shared != nil && s.leader.isLeader() {
+			shared := s.listShared()
+			for _, a := range shared {
+				if a.due(s.cfg) {
+					due = append(due, a)
+				}
+			}
+			s.pruneShared(shared)
+		}
+		for _, a := range due {
+			s.escalate(a)
+		}
+	}
+}
+
+// ack acknowledges an alert, stopping its escalation
+func (s *alertStore) ack(id, by string) (a alert, found bool, acked bool) {
+	if s.shared != nil {
+		if a, found, acked := s.ackShared(id, by); found {
+			return a, found, acked
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, al := range s.alerts {
+		if al.ID != id {
+			continue
+		}
+		if al.Acked != nil {
+			return *al, true, false
+		}
+		now := time.Now()
+		al.Acked, al.AckedBy = &now, by
+		return *al, true, true
+	}
+	return a, false, false
+}
+
+// list returns copies of the alerts, unacknowledged ones only when open
+func (s *alertStore) list(open bool) []alert {
+	var shared []*alert
+	if s.shared != nil {
+		shared = s.listShared()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []alert{}
+	for _, a := range append(shared, s.alerts...) {
+		if !open || a.Acked == nil {
+			list = append(list, a.clone())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+	return list
+}
+
+// adminAlerts lists the alerts (GET, ?open=true for unacknowledged ones);
+// POST /admin/alerts/{id}/ack acknowledges one
+func adminAlerts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	events := ctx.Value(key("events")).(*eventBus)
+	audit := ctx.Value(key("audit")).(*auditLog)
+
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/alerts"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+
+	switch {
+	case r.Method == "GET" && rest == "":
+		writeJSON(w, map[string]interface{}{"alerts": events.alerts.list(r.URL.Query().Get("open") == "true")})
+	case r.Method == "POST" && id != "" && action == "ack":
+		var req struct {
+			By string `json:"by"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "400 - Invalid JSON body", http.StatusBadRequest)
+				return
+			}
+		}
+		a, found, acked := events.alerts.ack(id, req.By)
+		if !found {
+			http.Error(w, "404 - Unknown alert", http.StatusNotFound)
+			return
+		}
+		if !acked {
+			http.Error(w, "409 - Alert already acknowledged", http.StatusConflict)
+			return
+		}
+		audit.record(r, "ack_alert", map[string]interface{}{
+			"tenant": a.Tenant,
+			"node":   a.Node,
+			"id":     a.ID,
+			"by":     a.AckedBy,
+		})
+		writeJSON(w, a)
+	default:
+		http.Error(w, "404 not found.", http.StatusNotFound)
+	}
+}
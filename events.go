@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// standard gravity, subtracted from the accelerometer magnitude
+const gravity = 9.80665
+
+// event is something detected by the server that should show up as a marker
+// on the dashboards
+type event struct {
+	Node  string
+	Type  string
+	Title string
+	Text  string
+	Time  time.Time
+}
+
+// eventBus publishes detected events as annotations: always as points of the
+// "annotations" measurement in the tenant's bucket, and through the Grafana
+// HTTP API when configured. In Grafana the measurement can be used directly
+// as an annotation query:
+//
+//	from(bucket: "G-Connect")
+//	  |> range(start: v.timeRangeStart, stop: v.timeRangeStop)
+//	  |> filter(fn: (r) => r._measurement == "annotations" and r._field == "title")
+type eventBus struct {
+	cfg    *config
+	http   *http.Client
+	alerts *alertStore
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newEventBus(cfg *config) *eventBus {
+	return &eventBus{
+		cfg:    cfg,
+		http:   &http.Client{Timeout: 10 * time.Second},
+		alerts: newAlertStore(cfg),
+		last:   make(map[string]time.Time),
+	}
+}
+
+// emit publishes ev unless the same event type of the node was published
+// within the cooldown
+func (b *eventBus) emit(t *tenant, ev event) {
+	k := t.Name + "\x00" + ev.Node + "\x00" + ev.Type
+	b.mu.Lock()
+	if last, ok := b.last[k]; ok && ev.Time.Sub(last) < b.cfg.EventCooldown {
+		b.mu.Unlock()
+		return
+	}
+	b.last[k] = ev.Time
+	b.mu.Unlock()
+
+	// during maintenance the event is only recorded, see maintenance.go
+	if mw := t.maintenance.active(ev.Node, ev.Time); mw != "" {
+		log.Printf("event %s on %s during maintenance %s: %s\n", ev.Type, ev.Node, mw, ev.Text)
+		go b.publish(t, ev, mw)
+		return
+	}
+	log.Printf("event %s on %s: %s\n", ev.Type, ev.Node, ev.Text)
+	if contains(b.cfg.BurstEvents, ev.Type) {
+		requestBurst(t, b.cfg, ev)
+	}
+	b.alerts.raise(t, ev)
+	go b.publish(t, ev, "")
+}
+
+// publish writes the annotation of ev, tagged with the maintenance window it
+// happened in, and posts it to Grafana outside of maintenance
+func (b *eventBus) publish(t *tenant, ev event, maintenance string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	p := influxdb2.NewPointWithMeasurement("annotations").
+		AddTag("location", ev.Node).
+		AddTag("type", ev.Type).
+		AddField("title", ev.Title).
+		AddField("text", ev.Text).
+		SetTime(ev.Time)
+	if maintenance != "" {
+		p.AddTag("maintenance", maintenance)
+	}
+	if _, err := t.writer.write(ctx, nil, p); err != nil {
+		log.Printf("writing annotation: %s\n", err)
+	}
+
+	if b.cfg.GrafanaURL != "" && maintenance == "" {
+		if err := b.postGrafana(ctx, t, ev); err != nil {
+			log.Printf("posting Grafana annotation: %s\n", err)
+		}
+	}
+}
+
+func (b *eventBus) postGrafana(ctx context.Context, t *tenant, ev event) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"time": ev.Time.UnixMilli(),
+		"tags": []string{ev.Type, ev.Node, t.Name},
+		"text": ev.Title + ": " + ev.Text,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", b.cfg.GrafanaURL+"/api/annotations", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+b.cfg.GrafanaToken)
+
+	res, err := b.http.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("grafana answered %s", res.Status)
+	}
+	return nil
+}
+
+// detectVibration emits an event when the acceleration magnitude of rd
+// deviates from gravity by more than the configured threshold
+func (b *eventBus) detectVibration(t *tenant, node string, rd reading) {
+	if b.cfg.VibrationThreshold <= 0 {
+		return
+	}
+	x, okX := rd.Values["x"]
+	y, okY := rd.Values["y"]
+	z, okZ := rd.Values["z"]
+	if !okX || !okY || !okZ {
+		return
+	}
+	magnitude := math.Sqrt(x*x + y*y + z*z)
+	if dev := math.Abs(magnitude - gravity); dev > b.cfg.VibrationThreshold {
+		b.emit(t, event{
+			Node:  node,
+			Type:  "vibration",
+			Title: "Vibration event",
+			Text:  fmt.Sprintf("acceleration %.2f m/s² deviates %.2f m/s² from gravity", magnitude, dev),
+			Time:  rd.Time,
+		})
+	}
+}
+
+// watchOutages emits an event whenever a node goes offline or comes back.
+// Only the leader emits them, the other replicas keep track of the online
+// state to take over where it left off.
+func (b *eventBus) watchOutages(tenants *tenantRegistry, leader *leaderElector) {
+	for range time.Tick(30 * time.Second) {
+		for _, t := range tenants.all() {
+			transitions := t.nodes.onlineTransitions()
+			if !leader.isLeader() {
+				continue
+			}
+			for _, tr := range transitions {
+				ev := event{Node: tr.node, Time: time.Now()}
+				if tr.online {
+					ev.Type, ev.Title, ev.Text = "online", "Node online", tr.node+" is sending data again"
+				} else {
+					ev.Type, ev.Title, ev.Text = "outage", "Node offline", fmt.Sprintf("no data from %s for %s", tr.node, nodeOfflineAfter)
+				}
+				b.emit(t, ev)
+			}
+		}
+	}
+}
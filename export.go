@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"time"
+)
+
+// runExports archives every day's raw readings of all tenants as gzipped
+// CSV to S3, shortly after the day ended, since InfluxDB only keeps 90 days
+func runExports(cfg *config, tenants *tenantRegistry, s3 *s3Client, leader *leaderElector) {
+	runDaily(cfg.ExportDelay, leader, func(day time.Time) {
+		for _, t := range sortedTenants(tenants) {
+			for _, measurement := range cfg.Schema.measurementNames() {
+				if err := exportDay(context.Background(), cfg, t, s3, measurement, day); err != nil {
+					log.Printf("export %s/%s %s failed: %s\n", t.Name, measurement, day.Format("2006-01-02"), err)
+				}
+			}
+		}
+	})
+}
+
+// exportDay uploads one measurement of one UTC day as
+// <prefix><tenant>/<measurement>/<yyyy-mm-dd>.csv.gz
+func exportDay(ctx context.Context, cfg *config, t *tenant, s3 *s3Client, measurement string, day time.Time) error {
+	fields := cfg.Schema.Measurements[measurement]
+	flux := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %s)
+  |> group(columns: ["_measurement", "_field", "location"])
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group()
+  |> sort(columns: ["location", "_time"])`,
+		fluxString(t.Bucket), day.Format(time.RFC3339), day.Add(24*time.Hour).Format(time.RFC3339), fluxString(measurement))
+
+	result, err := t.queryApi.Query(ctx, flux)
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	cw := csv.NewWriter(gz)
+	cw.Write(append([]string{"time", "node"}, fields...))
+	rows := 0
+	for result.Next() {
+		rec := result.Record()
+		node, _ := rec.ValueByKey("location").(string)
+		line := []string{rec.Time().Format(time.RFC3339Nano), node}
+		for _, f := range fields {
+			line = append(line, csvValue(rec.ValueByKey(f)))
+		}
+		cw.Write(line)
+		rows++
+	}
+	if result.Err() != nil {
+		return result.Err()
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	objectKey := fmt.Sprintf("%s%s/%s/%s.csv.gz", cfg.ExportS3Prefix, t.Name, measurement, day.Format("2006-01-02"))
+	if err := s3.put(ctx, objectKey, "application/gzip", buf.Bytes()); err != nil {
+		return err
+	}
+	log.Printf("exported %d rows to %s\n", rows, objectKey)
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+var formatMediaTypes = map[string]string{
+	"application/json":     formatJSON,
+	"text/csv":             formatCSV,
+	"application/x-ndjson": formatNDJSON,
+	"application/ndjson":   formatNDJSON,
+}
+
+// responseFormat picks the output format of a read endpoint from the format
+// query parameter or the Accept header, defaulting to JSON. ok is false when
+// the client only accepts formats we cannot produce.
+func responseFormat(r *http.Request) (format string, ok bool) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		switch f {
+		case formatJSON, formatCSV, formatNDJSON:
+			return f, true
+		}
+		return "", false
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return formatJSON, true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		if f, ok := formatMediaTypes[mediaType]; ok {
+			return f, true
+		}
+		if mediaType == "*/*" || mediaType == "application/*" {
+			return formatJSON, true
+		}
+		if mediaType == "text/*" {
+			return formatCSV, true
+		}
+	}
+	return "", false
+}
+
+// writeCSV writes rows as CSV with a header line of the given columns
+func writeCSV(w http.ResponseWriter, columns []string, rows []map[string]interface{}) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write(columns)
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, c := range columns {
+			record[i] = csvValue(row[c])
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Println(err)
+	}
+}
+
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// writeNDJSON writes one JSON object per line, flushing as it goes
+func writeNDJSON(w http.ResponseWriter, rows []map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for i, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			log.Println(err)
+			return
+		}
+		if flusher != nil && i%100 == 99 {
+			flusher.Flush()
+		}
+	}
+}
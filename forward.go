@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// forwardBatch is the body POSTed to a forwarding destination
+type forwardBatch struct {
+	Tenant   string    `json:"tenant"`
+	Node     string    `json:"node"`
+	Readings []reading `json:"readings"`
+}
+
+// forwarder re-POSTs written readings to one downstream HTTP endpoint. Every
+// destination has its own queue and worker, so a slow or failing one only
+// ever drops its own batches.
+type forwarder struct {
+	url     string
+	name    string
+	retries int
+	http    *http.Client
+	queue   chan forwardBatch
+
+	sent    atomic.Int64
+	failed  atomic.Int64
+	dropped atomic.Int64
+}
+
+// forwarders are the configured destinations, see FORWARD_URLS
+type forwarders []*forwarder
+
+func newForwarders(cfg *config) (forwarders, error) {
+	var fs forwarders
+	for _, dest := range cfg.ForwardURLs {
+		u, err := url.Parse(dest)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid FORWARD_URLS: %q is not an http(s) URL", dest)
+		}
+		fs = append(fs, &forwarder{
+			url:     dest,
+			name:    u.Redacted(),
+			retries: cfg.ForwardRetries,
+			http:    &http.Client{Timeout: cfg.ForwardTimeout},
+			queue:   make(chan forwardBatch, cfg.ForwardQueueSize),
+		})
+	}
+	return fs, nil
+}
+
+// forward queues the readings of node for every destination, dropping them
+// for destinations whose queue is full
+func (fs forwarders) forward(t *tenant, node string, readings ...reading) {
+	if len(readings) == 0 {
+		return
+	}
+	b := forwardBatch{Tenant: t.Name, Node: node, Readings: readings}
+	for _, f := range fs {
+		select {
+		case f.queue <- b:
+		default:
+			f.dropped.Add(1)
+		}
+	}
+}
+
+// run posts queued batches, retrying network errors and 5xx answers with a
+// growing delay; other answers are final
+func (f *forwarder) run() {
+	for b := range f.queue {
+		body, err := json.Marshal(b)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		delay := time.Second
+		for attempt := 0; ; attempt++ {
+			retry, err := f.post(body)
+			if err == nil {
+				f.sent.Add(1)
+				break
+			}
+			if !retry || attempt >= f.retries {
+				log.Printf("forward to %s: %s, dropping %d readings\n", f.name, err, len(b.Readings))
+				f.failed.Add(1)
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+func (f *forwarder) post(body []byte) (retry bool, err error) {
+	res, err := f.http.Post(f.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return res.StatusCode >= 500, fmt.Errorf("status %s", res.Status)
+	}
+	return false, nil
+}
+
+func collectForwarders(fs forwarders) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		mw.family("sensor_forward_batches_total", "counter", "Batches of readings forwarded to downstream endpoints by result.")
+		for _, f := range fs {
+			mw.sample("sensor_forward_batches_total", float64(f.sent.Load()), "destination", f.name, "result", "sent")
+			mw.sample("sensor_forward_batches_total", float64(f.failed.Load()), "destination", f.name, "result", "failed")
+			mw.sample("sensor_forward_batches_total", float64(f.dropped.Load()), "destination", f.name, "result", "dropped")
+		}
+		mw.family("sensor_forward_queued_batches", "gauge", "Batches waiting to be forwarded.")
+		for _, f := range fs {
+			mw.sample("sensor_forward_queued_batches", float64(len(f.queue)), "destination", f.name)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fragments: LoRa frames carry about 51 bytes, less than a full reading, so
+// a node may split a payload over several requests sharing a message ID,
+// "msg", each with its index "frag", counting from 0, and the count
+// "frags". The fragments wait here until all of them arrived, then the
+// joined payload is ingested like a whole one, decryption and checksum
+// included. A message not complete within FRAGMENT_TIMEOUT is dropped.
+
+const (
+	maxFragments = 64
+	// messages in reassembly per tenant
+	maxFragmentMessages = 10000
+)
+
+var messageIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var (
+	messageIDRule = fieldRule{name: "msg", maxLen: 32, pattern: messageIDPattern, chars: "letters, digits, '_' and '-'"}
+	fragRule      = fieldRule{name: "frag", integer: true, min: 0, max: maxFragments - 1}
+	fragsRule     = fieldRule{name: "frags", integer: true, min: 1, max: maxFragments}
+)
+
+// fragmentStatus tells a node how far its message got
+type fragmentStatus struct {
+	Message  string `json:"message"`
+	Received int    `json:"received"`
+	Total    int    `json:"total"`
+}
+
+type fragmentedMessage struct {
+	parts    []string
+	received int
+	started  time.Time
+	// joined already, fragments sent again are only acknowledged
+	done bool
+}
+
+// fragmentStore reassembles the fragmented messages of a tenant
+type fragmentStore struct {
+	timeout time.Duration
+
+	mu       sync.Mutex
+	messages map[string]*fragmentedMessage
+
+	completed atomic.Int64
+	expired   atomic.Int64
+}
+
+func newFragmentStore(timeout time.Duration) *fragmentStore {
+	return &fragmentStore{timeout: timeout, messages: make(map[string]*fragmentedMessage)}
+}
+
+// add keeps fragment index of total of message msg of node. It returns the
+// joined payload once the last fragment arrived, the empty string before.
+func (s *fragmentStore) add(node, msg string, index, total int, data string) (string, fragmentStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.expire(now)
+	k := node + "\x00" + msg
+	m, ok := s.messages[k]
+	if !ok {
+		if len(s.messages) >= maxFragmentMessages {
+			return "", fragmentStatus{}, fmt.Errorf("too many fragmented messages in progress")
+		}
+		m = &fragmentedMessage{parts: make([]string, total), started: now}
+		s.messages[k] = m
+	}
+	status := fragmentStatus{Message: msg, Total: len(m.parts)}
+	if total != len(m.parts) || index >= total {
+		return "", status, fmt.Errorf("fragment %d of %d does not fit message %s of %d fragments", index, total, msg, len(m.parts))
+	}
+	if m.done {
+		status.Received = total
+		return "", status, nil
+	}
+	if m.parts[index] == "" {
+		m.received++
+	}
+	// a fragment sent again replaces the first copy
+	m.parts[index] = data
+	status.Received = m.received
+	if m.received < total {
+		return "", status, nil
+	}
+	m.done = true
+	s.completed.Add(1)
+	return strings.Join(m.parts, ""), status, nil
+}
+
+// expire drops the messages older than the timeout. s.mu must be held.
+func (s *fragmentStore) expire(now time.Time) {
+	for k, m := range s.messages {
+		if now.Sub(m.started) < s.timeout {
+			continue
+		}
+		delete(s.messages, k)
+		if !m.done {
+			s.expired.Add(1)
+			node, msg, _ := strings.Cut(k, "\x00")
+			log.Printf("fragments: dropping message %s of node %s with %d of %d fragments\n", msg, node, m.received, len(m.parts))
+		}
+	}
+}
+
+// reassemble adds the fragment of body, which needs all of msg, frag and
+// frags
+func reassemble(t *tenant, node string, body *ingestBody) (string, fragmentStatus, error) {
+	if body.Msg == "" || body.Frag == "" || body.Frags == "" {
+		return "", fragmentStatus{}, errors.New("fragments need msg, frag and frags")
+	}
+	if body.Data == "" {
+		return "", fragmentStatus{}, errors.New("empty fragment")
+	}
+	index, _ := strconv.Atoi(body.Frag)
+	total, _ := strconv.Atoi(body.Frags)
+	return t.fragments.add(node, body.Msg, index, total, body.Data)
+}
+
+func collectFragments(reg *tenantRegistry) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		mw.family("sensor_fragmented_messages_total", "counter", "Fragmented payloads by whether they were reassembled or timed out.")
+		for _, t := range sortedTenants(reg) {
+			mw.sample("sensor_fragmented_messages_total", float64(t.fragments.completed.Load()), "tenant", t.Name, "result", "completed")
+			mw.sample("sensor_fragmented_messages_total", float64(t.fragments.expired.Load()), "tenant", t.Name, "result", "expired")
+		}
+	}
+}
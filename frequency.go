@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// frequencyTrack follows the dominant frequency of one SHM field of a node
+// against its baseline, the mean over the first FREQUENCY_BASELINE_WINDOWS
+// windows since the server started. A lasting shift of the natural frequency
+// is the damage criterion of the structure.
+type frequencyTrack struct {
+	BaselineHz   float64 `json:"baseline_hz"`
+	CurrentHz    float64 `json:"current_hz"`
+	ShiftPercent float64 `json:"shift_percent"`
+	// windows folded into the baseline, it is fixed once it reaches
+	// FREQUENCY_BASELINE_WINDOWS
+	BaselineWindows int `json:"baseline_windows"`
+}
+
+// trackFrequency folds the dominant frequencies of a full SHM window into the
+// tracks of node and returns the tracks of the fields whose baseline is fixed
+func (s *nodeStore) trackFrequency(node string, res *shmResult, baselineWindows int) map[string]frequencyTrack {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.get(node)
+	// a new map, copies of the node status keep the old one
+	tracks := make(map[string]frequencyTrack)
+	for f, tr := range n.Frequencies {
+		tracks[f] = tr
+	}
+	fixed := make(map[string]frequencyTrack)
+	for f, ind := range res.Indicators {
+		if ind.DominantFrequency <= 0 {
+			continue
+		}
+		tr := tracks[f]
+		tr.CurrentHz = ind.DominantFrequency
+		if tr.BaselineWindows < baselineWindows {
+			tr.BaselineHz += (ind.DominantFrequency - tr.BaselineHz) / float64(tr.BaselineWindows+1)
+			tr.BaselineWindows++
+		} else {
+			tr.ShiftPercent = (tr.CurrentHz - tr.BaselineHz) / tr.BaselineHz * 100
+			fixed[f] = tr
+		}
+		tracks[f] = tr
+	}
+	n.Frequencies = tracks
+	return fixed
+}
+
+// frequencies returns the frequency tracks of node, which are not modified
+// afterwards
+func (s *nodeStore) frequencies(node string) map[string]frequencyTrack {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if n, ok := s.nodes[node]; ok {
+		return n.Frequencies
+	}
+	return nil
+}
+
+// observeFrequencies tracks the natural frequencies of a full SHM window,
+// adds their shifts to the point p of the window and raises a frequency_shift
+// event for shifts beyond FREQUENCY_SHIFT_PERCENT
+func observeFrequencies(t *tenant, cfg *config, events *eventBus, node string, res *shmResult, p *write.Point) {
+	tracks := t.nodes.trackFrequency(node, res, cfg.FrequencyBaselineWindows)
+	for _, f := range cfg.SHMFields {
+		tr, ok := tracks[f]
+		if !ok {
+			continue
+		}
+		p.AddField(f+"_frequency_shift_pct", tr.ShiftPercent)
+		if cfg.FrequencyShiftPercent > 0 && math.Abs(tr.ShiftPercent) > cfg.FrequencyShiftPercent {
+			events.emit(t, event{
+				Node:  node,
+				Type:  "frequency_shift",
+				Title: "Natural frequency shift of " + f,
+				Text:  fmt.Sprintf("dominant frequency of %s is %.2f Hz, %+.1f%% from the baseline of %.2f Hz", f, tr.CurrentHz, tr.ShiftPercent, tr.BaselineHz),
+				Time:  res.Start,
+			})
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	lp "github.com/influxdata/line-protocol"
+)
+
+// upstreamWriter stands in for the InfluxDB write API when the server runs
+// as an edge gateway (GATEWAY_UPSTREAM): points are posted as gzipped line
+// protocol to /v1/gateway of the central server. The tenant writer buffers
+// them and flushes in batches every GATEWAY_FLUSH_INTERVAL, so the gateway
+// keeps accepting readings through WAN outages until its buffer fills.
+type upstreamWriter struct {
+	url    string
+	apiKey string
+	http   *http.Client
+}
+
+func newUpstreamWriter(cfg *config, apiKey string) *upstreamWriter {
+	return &upstreamWriter{
+		url:    cfg.GatewayUpstream + apiPrefix + "/gateway",
+		apiKey: apiKey,
+		http:   &http.Client{},
+	}
+}
+
+func (u *upstreamWriter) WritePoint(ctx context.Context, points ...*write.Point) error {
+	lines := make([]string, len(points))
+	for i, p := range points {
+		lines[i] = write.PointToLineProtocol(p, time.Nanosecond)
+	}
+	return u.WriteRecord(ctx, lines...)
+}
+
+func (u *upstreamWriter) WriteRecord(ctx context.Context, lines ...string) error {
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	for _, line := range lines {
+		io.WriteString(zw, strings.TrimSuffix(line, "\n")+"\n")
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Content-Encoding", "gzip")
+	if u.apiKey != "" {
+		req.Header.Set("X-API-Key", u.apiKey)
+	}
+	res, err := u.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("upstream answered %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// EnableBatching is a no-op, the tenant writer batches
+func (u *upstreamWriter) EnableBatching() {}
+
+func (u *upstreamWriter) Flush(ctx context.Context) error {
+	return nil
+}
+
+// pingUpstream checks that the central server answers, for the health checks
+// of a gateway
+func pingUpstream(ctx context.Context, upstream string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", upstream+"/healthz", nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("upstream answered %s", res.Status)
+	}
+	return true, nil
+}
+
+// parseLineProtocol reads points written with nanosecond timestamps, keeping
+// the types of the fields
+func parseLineProtocol(r io.Reader) ([]*write.Point, error) {
+	var points []*write.Point
+	parser := lp.NewStreamParser(r)
+	for {
+		m, err := parser.Next()
+		if errors.Is(err, lp.EOF) {
+			return points, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", parser.LineNumber(), err)
+		}
+		tags := make(map[string]string)
+		for _, tag := range m.TagList() {
+			tags[tag.Key] = tag.Value
+		}
+		fields := make(map[string]interface{})
+		for _, f := range m.FieldList() {
+			fields[f.Key] = f.Value
+		}
+		points = append(points, write.NewPoint(m.Name(), tags, fields, m.Time()))
+	}
+}
+
+// postGateway receives the batches of edge gateways: line protocol with
+// nanosecond timestamps, optionally gzipped. The points were parsed and
+// checked at the site and are written as they are. Rejecting a batch makes
+// the gateway keep it and send it again.
+func postGateway(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+
+	if t.writer.overloaded() {
+		t.usage.Throttled.Add(1)
+		writeOverloaded(w, cfg.RetryAfter)
+		return
+	}
+	if mt, err := mediaType(r); err != nil {
+		writeBodyError(w, err)
+		return
+	} else if mt != "text/plain" {
+		writeBodyError(w, &bodyError{http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported Content-Type %q, expected text/plain", mt)})
+		return
+	}
+
+	// the batch is limited before and after decompression
+	body := http.MaxBytesReader(w, r.Body, cfg.GatewayMaxBytes)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			writeBodyError(w, &bodyError{http.StatusBadRequest, "invalid gzip body: " + err.Error()})
+			return
+		}
+		defer zr.Close()
+		body = http.MaxBytesReader(w, zr, cfg.GatewayMaxBytes)
+	default:
+		writeBodyError(w, &bodyError{http.StatusUnsupportedMediaType, "unsupported Content-Encoding " + r.Header.Get("Content-Encoding")})
+		return
+	}
+
+	points, err := parseLineProtocol(body)
+	if err != nil {
+		if tooLarge(err) {
+			err = &bodyError{http.StatusRequestEntityTooLarge, fmt.Sprintf("batch larger than %d bytes", cfg.GatewayMaxBytes)}
+		}
+		writeBodyError(w, err)
+		return
+	}
+	nodes := make(map[string]int64)
+	for _, p := range points {
+		node := ""
+		for _, tag := range p.TagList() {
+			if tag.Key == "location" {
+				node = tag.Value
+			}
+		}
+		if node != "" {
+			if err := validNode(node); err != nil {
+				writeBodyError(w, &bodyError{http.StatusBadRequest, err.Error()})
+				return
+			}
+		}
+		nodes[node]++
+	}
+
+	count := func(add func(c *ingestCounts, n int64)) {
+		for node, n := range nodes {
+			n := n
+			t.stats.add(node, func(c *ingestCounts) { add(c, n) })
+		}
+	}
+	count(func(c *ingestCounts, n int64) { c.Received.Add(n); c.Parsed.Add(n) })
+	written := func() {
+		count(func(c *ingestCounts, n int64) { c.Written.Add(n) })
+		for node := range nodes {
+			t.cache.invalidate(node)
+		}
+	}
+	if _, err := t.writer.write(ctx, written, points...); err != nil {
+		count(func(c *ingestCounts, n int64) { c.Dropped.Add(n) })
+		if errors.Is(err, errWriteRejected) {
+			writeRejected(w, err)
+			return
+		}
+		if !errors.Is(err, errBufferFull) {
+			log.Printf("gateway batch canceled: %s\n", err)
+			return
+		}
+		log.Println(err)
+		t.usage.Throttled.Add(1)
+		writeOverloaded(w, cfg.RetryAfter)
+		return
+	}
+	t.usage.Readings.Add(int64(len(points)))
+	writeJSON(w, map[string]interface{}{"status": "ok", "points": len(points)})
+}
@@ -3,13 +3,19 @@ module github.com/RianWardanaPutra/server-skripsi
 go 1.19
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/graph-gophers/graphql-go v1.5.0
 	github.com/influxdata/influxdb-client-go/v2 v2.12.1
+	github.com/influxdata/line-protocol v0.0.0-20200327222509-2487e7298839
 	github.com/joho/godotenv v1.4.0
+	go.etcd.io/bbolt v1.3.8
+	golang.org/x/net v0.8.0
 )
 
 require (
 	github.com/deepmap/oapi-codegen v1.8.2 // indirect
-	github.com/influxdata/line-protocol v0.0.0-20200327222509-2487e7298839 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	golang.org/x/net v0.0.0-20210119194325-5f4716e94777 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/sys v0.6.0 // indirect
 )
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Graphite plaintext listener for collectors that only speak Graphite, like
+// collectd's write_graphite: each line "metric.path value timestamp" is
+// mapped by the first template of GRAPHITE_FILE whose filter matches the
+// path. A template names the role of every path segment, e.g.
+// "_.node.measurement.field*" for collectd.<host>.<plugin>.<type>: "node",
+// "measurement" and "field" (joined with "_" when repeated), "_" to skip and
+// any other word for a tag; a trailing "*" takes the remaining segments, if
+// any, and a missing field is "value". Without a file every path is read as
+// "node.measurement.field*". Lines are written in batches, at least every
+// second.
+
+const (
+	graphiteDefaultTemplate = "node.measurement.field*"
+	graphiteBatchSize       = 1000
+	graphiteFlushInterval   = time.Second
+	// a connection silent for this long is closed
+	graphiteIdleTimeout = 10 * time.Minute
+)
+
+type graphiteTemplate struct {
+	// glob of the leading path segments, every path when empty
+	Filter   string            `json:"filter"`
+	Template string            `json:"template"`
+	Tenant   string            `json:"tenant"`
+	Tags     map[string]string `json:"tags"`
+
+	filter []string
+	parts  []string
+	// the last part takes the remaining segments
+	greedy bool
+}
+
+type graphiteFile struct {
+	Templates []*graphiteTemplate `json:"templates"`
+}
+
+// loadGraphiteTemplates reads the templates of path, the default one when
+// path is empty
+func loadGraphiteTemplates(path string) ([]*graphiteTemplate, error) {
+	file := graphiteFile{Templates: []*graphiteTemplate{{Template: graphiteDefaultTemplate}}}
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		file.Templates = nil
+		if err := json.Unmarshal(raw, &file); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		if len(file.Templates) == 0 {
+			return nil, fmt.Errorf("%s: no templates", path)
+		}
+	}
+	for i, t := range file.Templates {
+		if err := t.compile(); err != nil {
+			return nil, fmt.Errorf("template %d (%q): %w", i, t.Template, err)
+		}
+	}
+	return file.Templates, nil
+}
+
+func (t *graphiteTemplate) compile() error {
+	if t.Filter != "" {
+		t.filter = strings.Split(t.Filter, ".")
+		for _, f := range t.filter {
+			if _, err := path.Match(f, ""); err != nil {
+				return fmt.Errorf("invalid filter %q", t.Filter)
+			}
+		}
+	}
+	t.parts = strings.Split(t.Template, ".")
+	last := len(t.parts) - 1
+	if strings.HasSuffix(t.parts[last], "*") {
+		t.parts[last] = strings.TrimSuffix(t.parts[last], "*")
+		t.greedy = true
+	}
+	var node, measurement bool
+	for _, p := range t.parts {
+		switch p {
+		case "":
+			return errors.New("empty segment")
+		case "node":
+			node = true
+		case "measurement":
+			measurement = true
+		}
+	}
+	if !node || !measurement {
+		return errors.New("node and measurement are required")
+	}
+	return nil
+}
+
+func (t *graphiteTemplate) matches(segments []string) bool {
+	if len(t.filter) > len(segments) {
+		return false
+	}
+	for i, f := range t.filter {
+		if ok, _ := path.Match(f, segments[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// apply splits segments into the node, measurement, field and tags
+func (t *graphiteTemplate) apply(segments []string) (node, measurement, field string, tags map[string]string, err error) {
+	fixed := len(t.parts)
+	if t.greedy {
+		// the last part may take no segment at all
+		fixed--
+	}
+	if len(segments) < fixed || (!t.greedy && len(segments) > fixed) {
+		return "", "", "", nil, fmt.Errorf("%d segments for template %q", len(segments), t.Template)
+	}
+	roles := make(map[string][]string)
+	for i, p := range t.parts[:fixed] {
+		roles[p] = append(roles[p], segments[i])
+	}
+	if t.greedy {
+		last := t.parts[fixed]
+		roles[last] = append(roles[last], segments[fixed:]...)
+	}
+	node = strings.Join(roles["node"], "_")
+	measurement = strings.Join(roles["measurement"], "_")
+	field = strings.Join(roles["field"], "_")
+	if field == "" {
+		field = "value"
+	}
+	tags = make(map[string]string)
+	for k, v := range t.Tags {
+		tags[k] = v
+	}
+	for role, values := range roles {
+		switch {
+		case role == "node", role == "measurement", role == "field", role == "_", len(values) == 0:
+		default:
+			tags[role] = strings.Join(values, "_")
+		}
+	}
+	return node, measurement, field, tags, nil
+}
+
+// graphiteListener accepts collector connections and writes their lines
+type graphiteListener struct {
+	cfg       *config
+	templates []*graphiteTemplate
+	tenants   []*tenant
+
+	mu      sync.Mutex
+	batches map[*tenant][]*write.Point
+
+	stored, unmatched, invalid, dropped atomic.Int64
+}
+
+func newGraphiteListener(cfg *config, reg *tenantRegistry) (*graphiteListener, error) {
+	g := &graphiteListener{cfg: cfg, templates: cfg.GraphiteTemplates, batches: make(map[*tenant][]*write.Point)}
+	for _, t := range cfg.GraphiteTemplates {
+		tn := reg.byName(t.Tenant)
+		if tn == nil {
+			return nil, fmt.Errorf("graphite template %q: unknown tenant %q", t.Template, t.Tenant)
+		}
+		g.tenants = append(g.tenants, tn)
+	}
+	return g, nil
+}
+
+// listen accepts connections on addr until the server stops
+func (g *graphiteListener) listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("graphite: listening on %s\n", addr)
+	go func() {
+		for range time.Tick(graphiteFlushInterval) {
+			g.flush()
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("graphite: %s\n", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			go g.serve(conn)
+		}
+	}()
+	return nil
+}
+
+func (g *graphiteListener) serve(conn net.Conn) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(graphiteIdleTimeout))
+		if !sc.Scan() {
+			break
+		}
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if err := g.line(line); err != nil {
+			detailf("graphite: %s: %q\n", err, line)
+		}
+	}
+	var ne net.Error
+	if err := sc.Err(); err != nil && !(errors.As(err, &ne) && ne.Timeout()) {
+		log.Printf("graphite: %s: %s\n", conn.RemoteAddr(), err)
+	}
+}
+
+// line adds the point of a line to the batch of its tenant
+func (g *graphiteListener) line(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		g.invalid.Add(1)
+		return errors.New("expected path, value and timestamp")
+	}
+	// Graphite 1.1 tags follow the path, "path;tag=value;..."
+	metric, extra, _ := strings.Cut(fields[0], ";")
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		g.invalid.Add(1)
+		return errors.New("invalid value")
+	}
+	at := time.Now()
+	if len(fields) == 3 && fields[2] != "-1" && fields[2] != "N" {
+		ts, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || ts <= 0 {
+			g.invalid.Add(1)
+			return errors.New("invalid timestamp")
+		}
+		at = time.Unix(0, int64(ts*1e9))
+	}
+
+	segments := strings.Split(metric, ".")
+	for i, t := range g.templates {
+		if !t.matches(segments) {
+			continue
+		}
+		node, measurement, field, tags, err := t.apply(segments)
+		if err == nil {
+			err = validNode(node)
+		}
+		if err != nil {
+			g.invalid.Add(1)
+			return err
+		}
+		if extra != "" {
+			for _, kv := range strings.Split(extra, ";") {
+				if k, v, ok := strings.Cut(kv, "="); ok && k != "" && v != "" {
+					tags[k] = v
+				}
+			}
+		}
+		p := g.cfg.Schema.newPoint(measurement, node, at)
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if !hasTag(p, k) {
+				p.AddTag(k, tags[k])
+			}
+		}
+		p.AddField(field, value)
+		g.add(g.tenants[i], p)
+		return nil
+	}
+	g.unmatched.Add(1)
+	return errors.New("no template matches")
+}
+
+func (g *graphiteListener) add(t *tenant, p *write.Point) {
+	g.mu.Lock()
+	g.batches[t] = append(g.batches[t], p)
+	full := len(g.batches[t]) >= graphiteBatchSize
+	g.mu.Unlock()
+	if full {
+		g.flush()
+	}
+}
+
+// flush writes the batches collected so far
+func (g *graphiteListener) flush() {
+	g.mu.Lock()
+	batches := g.batches
+	g.batches = make(map[*tenant][]*write.Point)
+	g.mu.Unlock()
+
+	for t, points := range batches {
+		nodes := make(map[string][]*write.Point)
+		for _, p := range points {
+			for _, tag := range p.TagList() {
+				if tag.Key == "location" {
+					nodes[tag.Value] = append(nodes[tag.Value], p)
+				}
+			}
+		}
+		for node, ps := range nodes {
+			t.maintenance.label(node, ps)
+		}
+		written := func() {
+			for node := range nodes {
+				t.cache.invalidate(node)
+			}
+		}
+		if _, err := t.writer.write(context.Background(), written, points...); err != nil {
+			g.dropped.Add(int64(len(points)))
+			log.Printf("graphite: %d points of tenant %q dropped: %s\n", len(points), t.Name, err)
+			continue
+		}
+		g.stored.Add(int64(len(points)))
+		t.usage.Readings.Add(int64(len(points)))
+	}
+}
+
+func collectGraphite(g *graphiteListener) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		mw.family("sensor_graphite_lines_total", "counter", "Graphite lines received by outcome.")
+		mw.sample("sensor_graphite_lines_total", float64(g.stored.Load()), "result", "stored")
+		mw.sample("sensor_graphite_lines_total", float64(g.unmatched.Load()), "result", "unmatched")
+		mw.sample("sensor_graphite_lines_total", float64(g.invalid.Load()), "result", "invalid")
+		mw.sample("sensor_graphite_lines_total", float64(g.dropped.Load()), "result", "dropped")
+	}
+}
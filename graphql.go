@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// the read API as one graph, so the dashboard fetches exactly what it shows
+// in a single request. Times are RFC3339, or durations relative to now like
+// the query parameters of the REST endpoints.
+const graphqlSchemaSource = `
+schema {
+	query: Query
+}
+
+scalar Time
+
+type Query {
+	nodes(lowBattery: Boolean = false): [Node!]!
+	node(id: String!): Node!
+	zones: [Zone!]!
+	zone(name: String!): Zone
+	measurements: [Measurement!]!
+}
+
+type Measurement {
+	name: String!
+	fields: [String!]!
+}
+
+type Node {
+	id: String!
+	online: Boolean!
+	lastSeen: Time
+	zone: String
+	batteryVoltage: Float
+	rssi: Float
+	lowBattery: Boolean!
+	clockOffsetSeconds: Float!
+	# the last reading received since the server started
+	latest: Reading
+	# stored readings of one measurement, the means of each window with every
+	readings(measurement: String, start: String = "-1h", stop: String, every: String, limit: Int): [Reading!]!
+	# count, min, max and mean of every field
+	stats(start: String = "-1h", stop: String): [FieldStats!]!
+}
+
+type Zone {
+	name: String!
+	type: String
+	nodes: [Node!]!
+	stats(start: String = "-1h", stop: String): [FieldStats!]!
+}
+
+type Reading {
+	time: Time!
+	values: [Value!]!
+	value(field: String!): Float
+}
+
+type Value {
+	field: String!
+	value: Float!
+}
+
+type FieldStats {
+	measurement: String!
+	field: String!
+	count: Int!
+	min: Float!
+	max: Float!
+	mean: Float!
+}
+`
+
+var graphqlSchema = graphql.MustParseSchema(graphqlSchemaSource, &gqlQuery{})
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+func serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphqlRequest
+	switch r.Method {
+	case "GET":
+		q := r.URL.Query()
+		req.Query = q.Get("query")
+		req.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				http.Error(w, "400 - invalid variables", http.StatusBadRequest)
+				return
+			}
+		}
+	case "POST":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "400 - Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	if req.Query == "" {
+		http.Error(w, "400 - query is required", http.StatusBadRequest)
+		return
+	}
+
+	// errors are part of the response, next to the data that resolved
+	writeJSON(w, graphqlSchema.Exec(r.Context(), req.Query, req.OperationName, req.Variables))
+}
+
+type gqlQuery struct{}
+
+func (*gqlQuery) Nodes(ctx context.Context, args struct{ LowBattery bool }) []*gqlNode {
+	t := ctx.Value(key("tenant")).(*tenant)
+	scope := requestScope(ctx)
+	var nodes []*gqlNode
+	for _, n := range t.nodes.list() {
+		if scope.allows(n.Node) && (!args.LowBattery || n.LowBattery) {
+			nodes = append(nodes, &gqlNode{n})
+		}
+	}
+	return nodes
+}
+
+// Node also resolves nodes not seen since the server started, whose readings
+// may still be stored. Nodes outside the scope resolve the same way, their
+// queries come back empty.
+func (*gqlQuery) Node(ctx context.Context, args struct{ ID string }) *gqlNode {
+	t := ctx.Value(key("tenant")).(*tenant)
+	if !requestScope(ctx).allows(args.ID) {
+		return &gqlNode{nodeStatus{Node: args.ID}}
+	}
+	for _, n := range t.nodes.list() {
+		if n.Node == args.ID {
+			return &gqlNode{n}
+		}
+	}
+	return &gqlNode{nodeStatus{Node: args.ID}}
+}
+
+func (*gqlQuery) Zones(ctx context.Context) []*gqlZone {
+	cfg := ctx.Value(key("config")).(*config)
+	var list []*gqlZone
+	for _, z := range cfg.Schema.Zones.list() {
+		if z = scopedZone(ctx, z); z != nil {
+			list = append(list, &gqlZone{z})
+		}
+	}
+	return list
+}
+
+func (*gqlQuery) Zone(ctx context.Context, args struct{ Name string }) *gqlZone {
+	cfg := ctx.Value(key("config")).(*config)
+	if z, ok := cfg.Schema.Zones.get(args.Name); ok && scopedZone(ctx, z) != nil {
+		return &gqlZone{scopedZone(ctx, z)}
+	}
+	return nil
+}
+
+func (*gqlQuery) Measurements(ctx context.Context) []*gqlMeasurement {
+	cfg := ctx.Value(key("config")).(*config)
+	var list []*gqlMeasurement
+	for _, m := range cfg.Schema.measurementNames() {
+		list = append(list, &gqlMeasurement{m, cfg.Schema.Measurements[m]})
+	}
+	return list
+}
+
+type gqlMeasurement struct {
+	name   string
+	fields []string
+}
+
+func (m *gqlMeasurement) Name() string     { return m.name }
+func (m *gqlMeasurement) Fields() []string { return m.fields }
+
+type gqlNode struct {
+	status nodeStatus
+}
+
+func (n *gqlNode) ID() string                  { return n.status.Node }
+func (n *gqlNode) Online() bool                { return n.status.Online }
+func (n *gqlNode) BatteryVoltage() *float64    { return n.status.Battery }
+func (n *gqlNode) Rssi() *float64              { return n.status.RSSI }
+func (n *gqlNode) LowBattery() bool            { return n.status.LowBattery }
+func (n *gqlNode) ClockOffsetSeconds() float64 { return n.status.ClockOffset }
+
+func (n *gqlNode) LastSeen() *graphql.Time {
+	if n.status.LastSeen.IsZero() {
+		return nil
+	}
+	return &graphql.Time{Time: n.status.LastSeen}
+}
+
+func (n *gqlNode) Zone(ctx context.Context) *string {
+	cfg := ctx.Value(key("config")).(*config)
+	if z := cfg.Schema.Zones.of(n.status.Node); z != "" {
+		return &z
+	}
+	return nil
+}
+
+func (n *gqlNode) Latest() *gqlReading {
+	if n.status.Latest.Time.IsZero() {
+		return nil
+	}
+	return &gqlReading{n.status.Latest}
+}
+
+func (n *gqlNode) Readings(ctx context.Context, args struct {
+	Measurement *string
+	Start       string
+	Stop        *string
+	Every       *string
+	Limit       *int32
+}) ([]*gqlReading, error) {
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+
+	measurement := cfg.Schema.primary().Measurement
+	if args.Measurement != nil {
+		measurement = *args.Measurement
+	}
+	if _, ok := cfg.Schema.Measurements[measurement]; !ok {
+		return nil, errors.New("unknown measurement")
+	}
+	start, stop, err := graphqlRange(args.Start, args.Stop)
+	if err != nil {
+		return nil, err
+	}
+	var every time.Duration
+	if args.Every != nil {
+		if every, err = time.ParseDuration(*args.Every); err != nil || every < time.Second {
+			return nil, errors.New("invalid every")
+		}
+	}
+	limit := cfg.QueryDefaultLimit
+	if args.Limit != nil {
+		if limit = int(*args.Limit); limit < 1 {
+			return nil, errors.New("invalid limit")
+		}
+	}
+	if limit > cfg.QueryMaxLimit {
+		limit = cfg.QueryMaxLimit
+	}
+
+	rds, err := queryReadings(ctx, t, n.status.Node, measurement, start, stop, every, limit, 0)
+	if err != nil {
+		return nil, err
+	}
+	readings := make([]*gqlReading, len(rds))
+	for i := range rds {
+		readings[i] = &gqlReading{rds[i]}
+	}
+	return readings, nil
+}
+
+func (n *gqlNode) Stats(ctx context.Context, args struct {
+	Start string
+	Stop  *string
+}) ([]*gqlFieldStats, error) {
+	return graphqlStats(ctx, "r.location == "+fluxString(n.status.Node), args.Start, args.Stop)
+}
+
+type gqlZone struct {
+	z *zone
+}
+
+func (z *gqlZone) Name() string { return z.z.Name }
+
+func (z *gqlZone) Type() *string {
+	if z.z.Type == "" {
+		return nil
+	}
+	return &z.z.Type
+}
+
+func (z *gqlZone) Nodes(ctx context.Context) []*gqlNode {
+	t := ctx.Value(key("tenant")).(*tenant)
+	known := make(map[string]nodeStatus)
+	for _, n := range t.nodes.list() {
+		known[n.Node] = n
+	}
+	nodes := make([]*gqlNode, len(z.z.Nodes))
+	for i, id := range z.z.Nodes {
+		status, ok := known[id]
+		if !ok {
+			status = nodeStatus{Node: id}
+		}
+		nodes[i] = &gqlNode{status}
+	}
+	return nodes
+}
+
+func (z *gqlZone) Stats(ctx context.Context, args struct {
+	Start string
+	Stop  *string
+}) ([]*gqlFieldStats, error) {
+	return graphqlStats(ctx, "r.zone == "+fluxString(z.z.Name), args.Start, args.Stop)
+}
+
+type gqlReading struct {
+	rd reading
+}
+
+func (r *gqlReading) Time() graphql.Time { return graphql.Time{Time: r.rd.Time} }
+
+func (r *gqlReading) Values() []*gqlValue {
+	var values []*gqlValue
+	for f, v := range r.rd.Values {
+		values = append(values, &gqlValue{f, v})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].field < values[j].field })
+	return values
+}
+
+func (r *gqlReading) Value(args struct{ Field string }) *float64 {
+	if v, ok := r.rd.Values[args.Field]; ok {
+		return &v
+	}
+	return nil
+}
+
+type gqlValue struct {
+	field string
+	value float64
+}
+
+func (v *gqlValue) Field() string  { return v.field }
+func (v *gqlValue) Value() float64 { return v.value }
+
+type gqlFieldStats struct {
+	measurement, field string
+	stats              fieldStats
+}
+
+func (s *gqlFieldStats) Measurement() string { return s.measurement }
+func (s *gqlFieldStats) Field() string       { return s.field }
+func (s *gqlFieldStats) Count() int32        { return int32(s.stats.Count) }
+func (s *gqlFieldStats) Min() float64        { return s.stats.Min }
+func (s *gqlFieldStats) Max() float64        { return s.stats.Max }
+func (s *gqlFieldStats) Mean() float64       { return s.stats.Mean }
+
+func graphqlStats(ctx context.Context, predicate string, startArg string, stopArg *string) ([]*gqlFieldStats, error) {
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+	start, stop, err := graphqlRange(startArg, stopArg)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := queryFieldStats(ctx, t, cfg.Schema, predicate, start, stop)
+	if err != nil {
+		return nil, err
+	}
+	var list []*gqlFieldStats
+	for _, m := range cfg.Schema.measurementNames() {
+		for _, f := range cfg.Schema.Measurements[m] {
+			list = append(list, &gqlFieldStats{m, f, *fields[m][f]})
+		}
+	}
+	return list, nil
+}
+
+func graphqlRange(startArg string, stopArg *string) (start, stop time.Time, err error) {
+	now := time.Now()
+	if start, err = parseTimeParam(startArg, now.Add(-time.Hour)); err != nil {
+		return start, stop, errors.New("invalid start")
+	}
+	stop = now
+	if stopArg != nil {
+		if stop, err = parseTimeParam(*stopArg, now); err != nil {
+			return start, stop, errors.New("invalid stop")
+		}
+	}
+	if !stop.After(start) {
+		return start, stop, errors.New("invalid stop")
+	}
+	return start, stop, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// getHealthz is the liveness probe, answering as long as the server runs
+func getHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// getDeepHealth checks the dependencies of the server for monitoring: it is
+// "down" with 503 when InfluxDB is unreachable and "degraded" when the logs
+// volume falls below DISK_MIN_FREE, the disk guard found a volume low or
+// writes are short-circuited to the buffer. A
+// gateway reports the central server as "upstream" instead of InfluxDB.
+func getDeepHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	client := ctx.Value(key("db")).(influxdb2.Client)
+	reg := ctx.Value(key("tenants")).(*tenantRegistry)
+	jobs := ctx.Value(key("backfill")).(*backfillJobs)
+	cfg := ctx.Value(key("config")).(*config)
+
+	status := "ok"
+
+	influx := map[string]interface{}{"reachable": true}
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	started := time.Now()
+	var ok bool
+	var err error
+	if cfg.GatewayUpstream != "" {
+		ok, err = pingUpstream(pingCtx, cfg.GatewayUpstream)
+	} else {
+		ok, err = client.Ping(pingCtx)
+	}
+	cancel()
+	influx["latency_ms"] = float64(time.Since(started).Microseconds()) / 1000
+	if !ok {
+		influx["reachable"] = false
+		influx["error"] = errString(err)
+		status = "down"
+	}
+
+	disk := map[string]interface{}{"path": logDir}
+	if free, total, err := diskSpace(logDir); err != nil {
+		disk["error"] = err.Error()
+	} else {
+		disk["free_bytes"] = free
+		disk["total_bytes"] = total
+		if total > 0 {
+			ratio := float64(free) / float64(total)
+			disk["free_ratio"] = ratio
+			if ratio < cfg.DiskMinFree && status == "ok" {
+				status = "degraded"
+			}
+		}
+	}
+
+	var disks []diskStatus
+	if guard, _ := ctx.Value(key("disk")).(*diskGuard); guard != nil {
+		disks = guard.status()
+		for _, d := range disks {
+			if d.State != "ok" && status == "ok" {
+				status = "degraded"
+			}
+		}
+	}
+
+	var lastWrite *time.Time
+	buffered := 0
+	tenants := []map[string]interface{}{}
+	for _, t := range sortedTenants(reg) {
+		writer := t.writer.status()
+		buffered += writer.Buffered
+		if writer.OpenedAt != nil && status == "ok" {
+			status = "degraded"
+		}
+		entry := map[string]interface{}{"name": t.Name, "last_write": nil, "writer": writer}
+		if ns := t.usage.LastWrite.Load(); ns > 0 {
+			tw := time.Unix(0, ns).UTC()
+			entry["last_write"] = tw
+			if lastWrite == nil || tw.After(*lastWrite) {
+				lastWrite = &tw
+			}
+		}
+		tenants = append(tenants, entry)
+	}
+	dependency := "influxdb"
+	if cfg.GatewayUpstream != "" {
+		dependency = "upstream"
+	}
+	health := map[string]interface{}{
+		"status": status,
+		"disk":   disk,
+		"disks":  disks,
+		"queue": map[string]interface{}{
+			"backlog":         jobs.pending() + buffered,
+			"buffered_points": buffered,
+		},
+		"last_write": lastWrite,
+		"tenants":    tenants,
+	}
+	health[dependency] = influx
+	if lastWrite != nil {
+		health["last_write_age_seconds"] = time.Since(*lastWrite).Seconds()
+	}
+
+	if status == "down" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, health)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// observeHeartbeat marks node as seen without a reading
+func (s *nodeStore) observeHeartbeat(node string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.get(node)
+	n.LastSeen = at
+	n.LastHeartbeat = &at
+}
+
+// configVersion hashes the settings a node has to match to be understood:
+// the record layout, the default timestamp unit, whether its clock is
+// ignored and the JSON keys it may send. A node seeing a new version knows
+// its payload format changed on the server.
+func configVersion(cfg *config, node string) string {
+	h := fnv.New64a()
+	for _, f := range cfg.Schema.Fields {
+		fmt.Fprintf(h, "%s:%s:%t|", f.Measurement, f.Name, f.Optional)
+	}
+	fmt.Fprintf(h, "%s|%t|", cfg.TimestampPrecision, cfg.serverTime(node))
+	if allowed, ok := cfg.JSONFields.nodes[node]; ok {
+		keys := make([]string, 0, len(allowed))
+		for k := range allowed {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprint(h, keys)
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// postHeartbeat lets nodes in power-save mode check in cheaply: it only
+// updates the last seen time, takes command acknowledgements and answers
+// with what the node should act on
+func postHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+
+	mt, err := mediaType(r)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	var body struct {
+		Node string   `json:"node"`
+		Ack  []string `json:"ack"`
+	}
+	if mt == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "400 - Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	} else {
+		body.Node = r.FormValue("node")
+		body.Ack = requestAcks(r)
+	}
+	if err := validNode(body.Node); err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	t.nodes.observeHeartbeat(body.Node, now)
+
+	resp := map[string]interface{}{
+		"status":         "ok",
+		"server_time":    now.UTC(),
+		"config_version": configVersion(cfg, body.Node),
+		"commands":       t.commands.exchange(body.Node, body.Ack),
+	}
+	// a check-in carries no data to adapt the interval to
+	if interval := t.nodes.reportInterval(body.Node); cfg.AdaptiveInterval > 0 && interval > 0 {
+		resp["interval"] = int(interval / time.Second)
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Home Assistant integration, both ways. Home Assistant posts entity states
+// to /v1/integrations/homeassistant, e.g. from a rest_command with the
+// payload "{{ trigger.to_state | tojson }}": each state object, or a list of
+// them, is stored in the field value of HA_MEASUREMENT, tagged with the
+// entity_id, its domain and unit, for the node of the node query parameter
+// or HA_NODE. With HA_DISCOVERY the fields of every node published to MQTT
+// are announced once as retained MQTT discovery configs under
+// HA_DISCOVERY_PREFIX, so they show up as sensors of a device per node that
+// follow MQTT_LATEST_TOPIC, or MQTT_TOPIC when it is disabled.
+
+// haState is a state object as serialized by Home Assistant
+type haState struct {
+	EntityID    string                 `json:"entity_id"`
+	State       string                 `json:"state"`
+	Attributes  map[string]interface{} `json:"attributes"`
+	LastUpdated string                 `json:"last_updated"`
+}
+
+// states Home Assistant reports instead of a value, and those of binary
+// entities, stored as 1 and 0
+var (
+	haMissingStates = map[string]bool{"unavailable": true, "unknown": true, "": true}
+	haBinaryStates  = map[string]float64{
+		"on": 1, "off": 0, "true": 1, "false": 0,
+		"open": 1, "closed": 0, "home": 1, "not_home": 0,
+	}
+)
+
+// value is the state as a number
+func (s haState) value() (float64, error) {
+	state := strings.ToLower(strings.TrimSpace(s.State))
+	if haMissingStates[state] {
+		return 0, fmt.Errorf("%s is %q", s.EntityID, s.State)
+	}
+	if v, ok := haBinaryStates[state]; ok {
+		return v, nil
+	}
+	v, err := strconv.ParseFloat(state, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("%s: state %q is not a number", s.EntityID, s.State)
+	}
+	return v, nil
+}
+
+// point is the point of s for node, taken now unless it has last_updated
+func (s haState) point(cfg *config, node string, now time.Time) (*write.Point, error) {
+	domain, _, ok := strings.Cut(s.EntityID, ".")
+	if !ok || domain == "" {
+		return nil, fmt.Errorf("invalid entity_id %q", s.EntityID)
+	}
+	v, err := s.value()
+	if err != nil {
+		return nil, err
+	}
+	at := now
+	if s.LastUpdated != "" {
+		if at, err = time.Parse(time.RFC3339Nano, s.LastUpdated); err != nil {
+			return nil, fmt.Errorf("%s: invalid last_updated %q", s.EntityID, s.LastUpdated)
+		}
+	}
+	p := cfg.Schema.newPoint(cfg.HAMeasurement, node, at).
+		AddTag("entity_id", s.EntityID).
+		AddTag("domain", domain)
+	if unit, ok := s.Attributes["unit_of_measurement"].(string); ok && unit != "" {
+		p.AddTag("unit", unit)
+	}
+	return p.AddField("value", v), nil
+}
+
+// postHomeAssistant stores the states Home Assistant posts
+func postHomeAssistant(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+
+	node := r.URL.Query().Get("node")
+	if node == "" {
+		node = cfg.HANode
+	}
+	if err := validNode(node); err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		http.Error(w, "400 - Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	// a state object or a list of them
+	var states []haState
+	var err error
+	if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '[' {
+		err = json.Unmarshal(raw, &states)
+	} else {
+		states = make([]haState, 1)
+		err = json.Unmarshal(raw, &states[0])
+	}
+	if err != nil {
+		http.Error(w, "400 - expected a state object or a list of them", http.StatusBadRequest)
+		return
+	}
+
+	var points []*write.Point
+	var rejected []recordError
+	now := time.Now()
+	for i, s := range states {
+		p, err := s.point(cfg, node, now)
+		if err != nil {
+			rejected = append(rejected, recordError{Index: i, Reason: err.Error()})
+			continue
+		}
+		points = append(points, p)
+	}
+	for _, e := range rejected {
+		detailf("Error: homeassistant state %d: %s\n", e.Index, e.Reason)
+	}
+
+	result := ingestResult{Status: "ok", Accepted: len(points), Rejected: len(rejected), Errors: rejected}
+	if len(points) == 0 {
+		result.Status = "rejected"
+		writeIngestResult(w, http.StatusBadRequest, result)
+		return
+	}
+	if len(rejected) > 0 {
+		result.Status = "partial"
+	}
+	t.maintenance.label(node, points)
+	written := func() { t.cache.invalidate(node) }
+	if _, err := t.writer.write(ctx, written, points...); err != nil {
+		if errors.Is(err, errWriteRejected) {
+			writeRejected(w, err)
+			return
+		}
+		if !errors.Is(err, errBufferFull) {
+			log.Printf("homeassistant ingest canceled: %s\n", err)
+			return
+		}
+		log.Println(err)
+		t.usage.Throttled.Add(1)
+		writeOverloaded(w, cfg.RetryAfter)
+		return
+	}
+	t.usage.Readings.Add(int64(len(points)))
+	writeIngestResult(w, http.StatusOK, result)
+}
+
+// haSensorClasses are the device class and unit of fields Home Assistant
+// knows how to show, named as in the default SENSOR_SCHEMA
+var haSensorClasses = map[string][2]string{
+	"temperature": {"temperature", "°C"},
+	"humidity":    {"humidity", "%"},
+	"pressure":    {"pressure", "hPa"},
+	"battery":     {"voltage", "V"},
+	"rssi":        {"signal_strength", "dBm"},
+	"lux":         {"illuminance", "lx"},
+}
+
+// haDiscovery remembers which fields were announced since the start
+type haDiscovery struct {
+	prefix string
+
+	mu        sync.Mutex
+	announced map[string]bool
+}
+
+func newHADiscovery(cfg *config) *haDiscovery {
+	return &haDiscovery{prefix: cfg.HADiscoveryPrefix, announced: make(map[string]bool)}
+}
+
+// haID turns a name into the letters, digits, _ and - Home Assistant allows
+// in IDs
+func haID(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// announce queues the discovery configs of the fields of rd not announced
+// yet, before the reading itself is published
+func (d *haDiscovery) announce(p *mqttPublisher, t *tenant, node string, rd reading) {
+	if d == nil {
+		return
+	}
+	var fields []string
+	d.mu.Lock()
+	for field := range rd.Values {
+		if !d.announced[t.Name+"/"+node+"/"+field] {
+			fields = append(fields, field)
+		}
+	}
+	d.mu.Unlock()
+	if len(fields) == 0 {
+		return
+	}
+	sort.Strings(fields)
+
+	device := "server_skripsi_" + haID(t.Name+"_"+node)
+	for _, field := range fields {
+		config := map[string]interface{}{
+			"name":           field,
+			"unique_id":      device + "_" + haID(field),
+			"object_id":      haID(node + "_" + field),
+			"state_topic":    p.stateTopic(t, node),
+			"value_template": fmt.Sprintf("{{ value_json[%q] }}", field),
+			"state_class":    "measurement",
+			"device": map[string]interface{}{
+				"identifiers":  []string{device},
+				"name":         node,
+				"manufacturer": "server-skripsi",
+				"model":        "sensor node",
+			},
+		}
+		if class, ok := haSensorClasses[field]; ok {
+			config["device_class"] = class[0]
+			config["unit_of_measurement"] = class[1]
+		}
+		payload, err := json.Marshal(config)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		topic := fmt.Sprintf("%s/sensor/%s/%s/config", d.prefix, device, haID(field))
+		if p.enqueue(mqttMessage{topic: topic, payload: payload, retained: true}) {
+			d.mu.Lock()
+			d.announced[t.Name+"/"+node+"/"+field] = true
+			d.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyStore remembers the responses to recent requests carrying an
+// Idempotency-Key, so retries of the same submission are not written twice.
+// Keys are scoped to the tenant and node of a request and remember a hash of
+// its body, a key reused for another payload is refused.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[string]*idempotentResponse
+	// keys shared with other instances, see redis.go
+	shared *redisClient
+}
+
+type idempotentResponse struct {
+	done    bool
+	expires time.Time
+	// fingerprint of the request body, see ingestBody.fingerprint
+	hash   string
+	status int
+	header http.Header
+	body   []byte
+}
+
+func newIdempotencyStore(ttl time.Duration, max int) *idempotencyStore {
+	return &idempotencyStore{
+		ttl:     ttl,
+		max:     max,
+		entries: make(map[string]*idempotentResponse),
+	}
+}
+
+// begin reserves k for a new request with the body hash, or returns the
+// entry of k, done or still in flight, when one exists. Without either the
+// entry is in an unknown state.
+func (s *idempotencyStore) begin(k, hash string) (res *idempotentResponse, reserved bool) {
+	if s.shared != nil {
+		if res, reserved, handled := s.beginShared(k, hash); handled {
+			return res, reserved
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if e, found := s.entries[k]; found && now.Before(e.expires) {
+		return e, false
+	}
+
+	if len(s.entries) >= s.max {
+		s.evict(now)
+	}
+	s.entries[k] = &idempotentResponse{expires: now.Add(s.ttl), hash: hash}
+	return nil, true
+}
+
+// seen tells whether a request with k and the body hash was taken and not
+// yet forgotten
+func (s *idempotencyStore) seen(k, hash string) bool {
+	s.mu.Lock()
+	e, found := s.entries[k]
+	s.mu.Unlock()
+	if found && time.Now().Before(e.expires) {
+		return e.hash == hash
+	}
+	if s.shared != nil {
+		seen, _ := s.seenShared(k, hash)
+		return seen
+	}
+	return false
+}
+
+// finish stores the response of a reserved key, or releases the key when the
+// response should not be replayed or nothing was answered
+func (s *idempotencyStore) finish(k, hash string, rec *responseRecorder) {
+	s.mu.Lock()
+	e, local := s.entries[k]
+	if !local && s.shared != nil {
+		// reserved in Redis by begin
+		s.mu.Unlock()
+		s.finishShared(k, hash, rec)
+		return
+	}
+	defer s.mu.Unlock()
+	if !local {
+		return
+	}
+	// server errors are worth retrying, and so is a request that ended
+	// without an answer, e.g. because the client hung up mid-write
+	if rec.status == 0 || rec.status >= 500 {
+		delete(s.entries, k)
+		return
+	}
+	e.done = true
+	e.status = rec.status
+	e.header = ownHeaders(rec.Header(), replayedHeaders)
+	e.body = rec.body.Bytes()
+}
+
+// replayedHeaders are the headers of an ingest response set by the handler,
+// the middleware sets the others, such as X-Request-ID, on every response
+var replayedHeaders = []string{"Content-Type", "X-Content-Type-Options"}
+
+// ownHeaders copies the headers of names from h
+func ownHeaders(h http.Header, names []string) http.Header {
+	own := make(http.Header, len(names))
+	for _, name := range names {
+		if values := h.Values(name); len(values) > 0 {
+			own[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+	}
+	return own
+}
+
+// evict drops expired entries, and the oldest one if the store is still full.
+// s.mu must be held.
+func (s *idempotencyStore) evict(now time.Time) {
+	var oldest string
+	for k, e := range s.entries {
+		if !now.Before(e.expires) {
+			delete(s.entries, k)
+		} else if oldest == "" || e.expires.Before(s.entries[oldest].expires) {
+			oldest = k
+		}
+	}
+	if len(s.entries) >= s.max && oldest != "" {
+		delete(s.entries, oldest)
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotencyKey scopes the Idempotency-Key of an ingest request to its
+// tenant and node, it is "" without a key or before the body is decoded
+func idempotencyKey(r *http.Request) string {
+	idemKey := r.Header.Get("Idempotency-Key")
+	body, _ := r.Context().Value(key("ingestBody")).(*ingestBody)
+	if idemKey == "" || body == nil {
+		return ""
+	}
+	t := r.Context().Value(key("tenant")).(*tenant)
+	return t.Name + "\x00" + body.Node + "\x00" + idemKey
+}
+
+// fingerprint hashes the decoded values of b, so a retry matches however its
+// form or multipart encoding was laid out
+func (b *ingestBody) fingerprint() string {
+	raw, _ := json.Marshal(b)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// withIdempotency replays the original response for repeated requests with
+// the same Idempotency-Key of the same tenant and node, it runs on the body
+// decoded by withIngestValidation
+func withIdempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		k := idempotencyKey(r)
+		// a dry run must not be replayed for the real request
+		if k == "" || isDryRun(r, r.Context().Value(key("config")).(*config)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		store := r.Context().Value(key("idempotency")).(*idempotencyStore)
+		hash := ingestBodyOf(r.Context()).fingerprint()
+
+		res, reserved := store.begin(k, hash)
+		switch {
+		case reserved:
+			rec := &responseRecorder{ResponseWriter: w}
+			defer store.finish(k, hash, rec)
+			next.ServeHTTP(rec, r)
+		case res != nil && res.hash != hash:
+			http.Error(w, "422 - Idempotency-Key was already used for another payload", http.StatusUnprocessableEntity)
+		case res == nil || !res.done:
+			http.Error(w, "409 - A request with this Idempotency-Key is in progress", http.StatusConflict)
+		default:
+			for name, values := range res.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(res.status)
+			w.Write(res.body)
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+	s := newIdempotencyStore(time.Hour, 10)
+	if _, reserved := s.begin("k", "h1"); !reserved {
+		t.Fatal("first begin did not reserve the key")
+	}
+	if res, reserved := s.begin("k", "h1"); reserved || res == nil || res.done {
+		t.Fatalf("begin in flight = %+v, %v, want the pending entry", res, reserved)
+	}
+
+	w := httptest.NewRecorder()
+	w.Header().Set("X-Request-ID", "first")
+	rec := &responseRecorder{ResponseWriter: w}
+	rec.Header().Set("Content-Type", "application/json")
+	rec.Write([]byte(`{"status":"ok"}`))
+	s.finish("k", "h1", rec)
+
+	res, reserved := s.begin("k", "h1")
+	if reserved || res == nil || !res.done || res.hash != "h1" || res.status != http.StatusOK {
+		t.Fatalf("begin after finish = %+v, %v, want the stored response", res, reserved)
+	}
+	// the middleware sets the request ID of every response
+	if want := (http.Header{"Content-Type": {"application/json"}}); !reflect.DeepEqual(res.header, want) {
+		t.Errorf("stored header = %v, want %v", res.header, want)
+	}
+	if !s.seen("k", "h1") || s.seen("k", "h2") || s.seen("other", "h1") {
+		t.Error("seen does not match the key and the body hash")
+	}
+
+	// server errors are released for a retry
+	if _, reserved := s.begin("failed", "h"); !reserved {
+		t.Fatal("begin did not reserve the key")
+	}
+	rec = &responseRecorder{ResponseWriter: httptest.NewRecorder()}
+	rec.WriteHeader(http.StatusServiceUnavailable)
+	s.finish("failed", "h", rec)
+	if _, reserved := s.begin("failed", "h"); !reserved {
+		t.Error("key of a 503 was not released")
+	}
+}
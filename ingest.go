@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+func postSensorData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	received := time.Now()
+
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	trace := traceOf(ctx)
+
+	cfg := ctx.Value(key("config")).(*config)
+	events := ctx.Value(key("events")).(*eventBus)
+	mq := ctx.Value(key("mqtt")).(*mqttPublisher)
+	forward := ctx.Value(key("forwarders")).(forwarders)
+	// nothing is written or recorded, see dryrun.go
+	dryRun := isDryRun(r, cfg)
+
+	// rather than accepting data that cannot be persisted, ask the node to
+	// keep it while InfluxDB catches up
+	if !dryRun && t.writer.overloaded() {
+		t.usage.Throttled.Add(1)
+		writeOverloaded(w, cfg.RetryAfter)
+		return
+	}
+
+	// boards without a fixed layout send JSON, the others form encoded or
+	// plain text records; the values are checked by ingestRules
+	body := ingestBodyOf(ctx)
+	node := body.Node
+
+	// nodes may declare the unit of their timestamp, otherwise the
+	// configured default applies
+	unit := cfg.TimestampPrecision
+	if p := body.Precision; p != "" {
+		var err error
+		if unit, err = parsePrecision(p); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+	}
+
+	if node == "" {
+		node = "unknown"
+	}
+	trace.setNode(node)
+	trace.phase("decode")
+
+	if body.Seq != "" && !dryRun {
+		seq, _ := strconv.ParseInt(body.Seq, 10, 64)
+		t.nodes.observeSequence(node, seq)
+	}
+
+	// JSON cannot be sealed, see payloadcrypt.go
+	if body.JSON != nil && payloadKeyOf(ctx) != nil {
+		http.Error(w, "400 - "+errCleartextPayload.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var readings []reading
+	var indices []int
+	var rejected []recordError
+	var ignored []string
+	if body.JSON != nil {
+		readings, indices, rejected, ignored = parseJSONRecords(ctx, *body.JSON, node, cfg.JSONFields, unit)
+	} else {
+		payload := body.Data
+		if body.Msg != "" || body.Frag != "" || body.Frags != "" {
+			joined, status, err := reassemble(t, node, body)
+			if err != nil {
+				log.Printf("Error: %s\n", err)
+				http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if joined == "" {
+				writeIngestResult(w, http.StatusAccepted, ingestResult{Status: "fragment", Fragments: &status})
+				return
+			}
+			payload = joined
+		}
+		raw, err := openPayload(ctx, node, payload)
+		if err != nil {
+			log.Printf("Error: %s\n", err)
+			http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		raw, err = verifyChecksum(raw, cfg.RequirePayloadCRC)
+		if err != nil {
+			log.Printf("Error: %s\n", err)
+			if !dryRun && err != errChecksumMissing {
+				t.nodes.countCorrupted(node)
+			}
+			http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		replacer := strings.NewReplacer(" ", "", "\t", "", "\n", "", "\r", "", "\x00", "")
+		version, data, err := payloadVersion(replacer.Replace(raw))
+		if err != nil {
+			log.Printf("Error: %s\n", err)
+			http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !dryRun {
+			t.nodes.observeVersion(node, version)
+		}
+		if err := checkRecordCount(strings.Count(strings.TrimSuffix(data, ";"), ";") + 1); err != nil {
+			http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		readings, indices, rejected = parseRecords(ctx, data, cfg.Schema, unit, payloadParsers[version])
+	}
+	trace.phase("parse")
+	// a node that hung up gets no answer and sends the payload again
+	if ctx.Err() != nil {
+		log.Printf("ingest canceled: %s\n", ctx.Err())
+		return
+	}
+	result := ingestResult{Rejected: len(rejected), Errors: rejected, IgnoredFields: ignored}
+	for _, e := range rejected {
+		detailf("Error: record %d: %s\n", e.Index, e.Reason)
+	}
+	if !dryRun {
+		t.nodes.countRecords(node, len(readings), len(rejected))
+		t.stats.add(node, func(c *ingestCounts) {
+			c.Received.Add(int64(len(readings) + len(rejected)))
+			c.Parsed.Add(int64(len(readings)))
+			c.Rejected.Add(int64(len(rejected)))
+		})
+	}
+	if len(readings) == 0 {
+		result.Status = "rejected"
+		writeIngestResult(w, http.StatusBadRequest, result)
+		return
+	}
+
+	// nodes without a clock send 0 or are configured to always use the
+	// receive time, shifted back by the age of buffered readings
+	serverTime := func(rd reading) bool {
+		return rd.Time.Equal(time.Unix(0, 0)) || cfg.serverTime(node)
+	}
+	ages, err := readingAges(body.Age, len(readings)+len(rejected), unit, cfg.MaxReadingAge)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	// the time a reading was taken at, by its own age or, for a single age,
+	// by the age of the newest reading
+	taken := func(i int) time.Time {
+		if len(ages) == 1 {
+			return received.Add(-ages[0])
+		}
+		return received.Add(-ages[indices[i]])
+	}
+	stamped := 0
+	for i := range readings {
+		if !serverTime(readings[i]) {
+			readings[i].Time = cfg.deviceTime(node, readings[i].Time)
+		} else {
+			stamped++
+		}
+	}
+	// buffered records would all get the same receive time and overwrite
+	// each other
+	if stamped > 1 && len(ages) == 1 {
+		writeBodyError(w, fmt.Errorf("%d records use the receive time, age must list one age per record", stamped))
+		return
+	}
+
+	// track how far the node clock is off using the newest reading, which is
+	// the one closest to the receive time, and optionally correct it
+	var offset time.Duration
+	if last := len(readings) - 1; !serverTime(readings[last]) && dryRun {
+		offset = t.nodes.peekClock(node, taken(last).Sub(readings[last].Time))
+	} else if !serverTime(readings[last]) {
+		offset = t.nodes.observeClock(node, taken(last).Sub(readings[last].Time))
+	}
+	correct := cfg.ClockCorrection && (offset > cfg.ClockDriftThreshold || offset < -cfg.ClockDriftThreshold)
+
+	// records sharing a timestamp at the write precision would overwrite
+	// each other, keep the first
+	seen := make(map[int64]bool)
+	var points []*write.Point
+	var stored []reading
+	for i := range readings {
+		rd := &readings[i]
+		corrected := false
+		if serverTime(*rd) {
+			rd.Time = taken(i)
+		} else if correct {
+			rd.Time = rd.Time.Add(offset)
+			corrected = true
+		}
+
+		at := rd.Time.Truncate(cfg.WritePrecision).UnixNano()
+		if seen[at] {
+			result.Duplicates++
+			result.DuplicateIndices = append(result.DuplicateIndices, indices[i])
+			continue
+		}
+		seen[at] = true
+		result.Accepted++
+		stored = append(stored, *rd)
+		recordPoints := cfg.Schema.points(node, *rd, corrected, cfg.receivedAt(received))
+		points = append(points, recordPoints...)
+		if dryRun {
+			continue
+		}
+		result.Receipts = append(result.Receipts, pointReceipts(node, indices[i], recordPoints, cfg.WritePrecision)...)
+		observeReading(t, cfg, events, node, *rd, received)
+		if p := observeRate(t, cfg, events, node, *rd); p != nil {
+			points = append(points, p)
+		}
+		if p := observeSHM(t, cfg, events, node, *rd); p != nil {
+			points = append(points, p)
+		}
+		points = append(points, observePeak(t, cfg, events, node, *rd)...)
+	}
+
+	t.maintenance.label(node, points)
+	if dryRun {
+		result.Status = "dry_run"
+		result.Points = dryRunPoints(node, points, cfg.WritePrecision)
+		writeIngestResult(w, http.StatusOK, result)
+		return
+	}
+	t.stats.add(node, func(c *ingestCounts) { c.Duplicates.Add(int64(result.Duplicates)) })
+
+	// while InfluxDB is down the points wait in the local buffer
+	accepted := int64(result.Accepted)
+	receipts := result.Receipts
+	written := func() {
+		logStored(node, receipts)
+		t.stats.add(node, func(c *ingestCounts) { c.Written.Add(accepted) })
+		t.cache.invalidate(node)
+		mq.publish(t, node, stored...)
+		forward.forward(t, node, stored...)
+	}
+	trace.phase("prepare")
+	_, err = t.writer.write(ctx, written, points...)
+	trace.phase("write")
+	if err != nil {
+		t.stats.add(node, func(c *ingestCounts) { c.Dropped.Add(accepted) })
+		if errors.Is(err, errWriteRejected) {
+			writeRejected(w, err)
+			return
+		}
+		if !errors.Is(err, errBufferFull) {
+			log.Printf("ingest canceled: %s\n", err)
+			return
+		}
+		log.Println(err)
+		t.usage.Throttled.Add(1)
+		writeOverloaded(w, cfg.RetryAfter)
+		return
+	}
+	t.usage.Readings.Add(int64(result.Accepted))
+
+	t.nodes.update(node, readings[len(readings)-1])
+	result.Commands = t.commands.exchange(node, requestAcks(r))
+	result.Interval = int(adaptInterval(t, cfg, node, received) / time.Second)
+
+	result.Status = "ok"
+	if result.Rejected > 0 {
+		result.Status = "partial"
+	}
+	writeIngestResult(w, http.StatusOK, result)
+}
+
+// observeReading runs the checks of every accepted reading: data quality,
+// detected events and device health
+func observeReading(t *tenant, cfg *config, events *eventBus, node string, rd reading, received time.Time) {
+	t.nodes.observeQuality(node, rd, received, cfg)
+	events.detectVibration(t, node, rd)
+	if t.nodes.observeBattery(node, rd, cfg.LowBatteryVoltage) {
+		events.lowBattery(t, node, rd)
+	}
+}
+
+// ingestResult tells a node which of its records were stored, so it knows
+// what to retry and what to drop from its buffer
+type ingestResult struct {
+	Status           string        `json:"status"`
+	Accepted         int           `json:"accepted"`
+	Rejected         int           `json:"rejected"`
+	Duplicates       int           `json:"duplicates"`
+	Errors           []recordError `json:"errors,omitempty"`
+	DuplicateIndices []int         `json:"duplicate_indices,omitempty"`
+	// JSON keys the node is not allowed to send
+	IgnoredFields []string `json:"ignored_fields,omitempty"`
+	// progress of a fragmented payload, see fragments.go
+	Fragments *fragmentStatus `json:"fragments,omitempty"`
+	// queued for the node, see commands.go
+	Commands []pendingCommand `json:"commands,omitempty"`
+	// seconds until the node should report next, see adaptive.go
+	Interval int `json:"interval,omitempty"`
+	// IDs of the points stored for the accepted records, see receipt.go
+	Receipts []pointReceipt `json:"receipts,omitempty"`
+	// what would have been written, dry runs only
+	Points []dryRunPoint `json:"points,omitempty"`
+}
+
+func writeIngestResult(w http.ResponseWriter, status int, result ingestResult) {
+	msg, err := json.Marshal(result)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Something bad happened!"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(msg)
+}
@@ -0,0 +1,213 @@
+//go:build integration
+
+// The write path booted through newServer against a fake InfluxDB, run with
+// go test -tags integration. e2e/run.sh covers the same against a real one.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeInflux stands in for the InfluxDB HTTP API, keeping the line protocol
+// written to it and answering 503 while it is down
+type fakeInflux struct {
+	mu    sync.Mutex
+	down  bool
+	lines []string
+}
+
+func (f *fakeInflux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		http.Error(w, `{"code":"unavailable","message":"down"}`, http.StatusServiceUnavailable)
+		return
+	}
+	switch r.URL.Path {
+	case "/ping":
+		w.WriteHeader(http.StatusNoContent)
+	case "/health":
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"name":"influxdb","status":"pass"}`)
+	case "/api/v2/write":
+		if r.URL.Query().Get("bucket") != "it" {
+			http.Error(w, `{"code":"not found","message":"bucket not found"}`, http.StatusNotFound)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.lines = append(f.lines, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeInflux) setDown(down bool) {
+	f.mu.Lock()
+	f.down = down
+	f.mu.Unlock()
+}
+
+// written returns the lines written for node that contain all of want
+func (f *fakeInflux) written(node string, want ...string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var found []string
+next:
+	for _, l := range f.lines {
+		if !strings.Contains(l, "location="+node) {
+			continue
+		}
+		for _, w := range want {
+			if !strings.Contains(l, w) {
+				continue next
+			}
+		}
+		found = append(found, l)
+	}
+	return found
+}
+
+// bootServer runs newServer against db the way serve does
+func bootServer(t *testing.T, db *httptest.Server, env map[string]string) *httptest.Server {
+	t.Helper()
+	t.Cleanup(db.Close)
+	dir := t.TempDir()
+	base := map[string]string{
+		"INFLUXDB_TOKEN": "it-token",
+		"URL_DB":         db.URL,
+		"ORG_NAME":       "it",
+		"BUCKET_NAME":    "it",
+		"AUDIT_LOG":      filepath.Join(dir, "audit.log"),
+	}
+	for k, v := range env {
+		base[k] = v
+	}
+	cfg, err := loadConfig(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newInfluxClient(cfg)
+	t.Cleanup(client.Close)
+	server, err := newServer("127.0.0.1:0", cfg, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the handlers find their dependencies in the base context of server
+	s := httptest.NewUnstartedServer(nil)
+	s.Config = server
+	s.Start()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func postForm(t *testing.T, s *httptest.Server, path, node, data string) (int, string) {
+	t.Helper()
+	res, err := http.PostForm(s.URL+path, url.Values{"node": {node}, "data": {data}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+func deepHealth(t *testing.T, s *httptest.Server) string {
+	t.Helper()
+	res, err := http.Get(s.URL + "/healthz/deep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestIntegrationWritePath(t *testing.T) {
+	db := &fakeInflux{}
+	s := bootServer(t, httptest.NewServer(db), nil)
+	ts := time.Now().Unix()
+
+	code, body := postForm(t, s, apiPrefix+"/data", "it-node", fmt.Sprintf("%d|55.5|27.25|0.1,0.2,9.8", ts))
+	if code != http.StatusOK || !strings.Contains(body, `"status":"ok"`) {
+		t.Fatalf("valid payload = %d %s", code, body)
+	}
+	for _, want := range [][]string{
+		{"air,", "humidity=55.5", "temperature=27.25"},
+		{"accelerometer,", "x=0.1", "y=0.2", "z=9.8"},
+	} {
+		if lines := db.written("it-node", want...); len(lines) != 1 {
+			t.Errorf("points with %v = %q, want one", want, lines)
+		}
+	}
+
+	// the deprecated endpoint deployed nodes still post to, some with the
+	// values in the query and no Content-Type
+	if code, body := postForm(t, s, "/api", "it-node", "garbage"); code != http.StatusBadRequest {
+		t.Errorf("malformed payload = %d %s, want 400", code, body)
+	}
+	q := url.Values{"node": {"it-query"}, "data": {fmt.Sprintf("%d|56.5|27.25|0.1,0.2,9.8", ts)}}
+	res, err := http.Post(s.URL+"/api?"+q.Encode(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || len(db.written("it-query", "humidity=56.5")) != 1 {
+		t.Errorf("query without a Content-Type = %s, want the reading written", res.Status)
+	}
+
+	if code, body := postForm(t, s, apiPrefix+"/data", "it-node", strings.Repeat("x", 2<<20)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body over INGEST_MAX_BYTES = %d %s, want 413", code, body)
+	}
+}
+
+func TestIntegrationBreakerAndBuffer(t *testing.T) {
+	db := &fakeInflux{}
+	s := bootServer(t, httptest.NewServer(db), map[string]string{
+		"BREAKER_FAILURES":        "1",
+		"BREAKER_PROBE":           "100ms",
+		"WRITE_BUFFER_SIZE":       "10",
+		"WRITE_BUFFER_HIGH_WATER": "8",
+	})
+	ts := time.Now().Unix()
+
+	// with InfluxDB gone the breaker opens and readings are buffered, every
+	// payload is two points and the buffer throttles at the high water mark
+	db.setDown(true)
+	for i := 1; i <= 4; i++ {
+		if code, body := postForm(t, s, apiPrefix+"/data", "it-buffered", fmt.Sprintf("%d|4%d.5|27.25|0.1,0.2,9.8", ts+int64(i), i)); code != http.StatusOK {
+			t.Fatalf("payload %d while InfluxDB is down = %d %s, want 200", i, code, body)
+		}
+	}
+	if h := deepHealth(t, s); !strings.Contains(h, `"breaker":"open"`) || !strings.Contains(h, `"buffered_points":8`) {
+		t.Fatalf("deep health with InfluxDB down = %s, want an open breaker and 8 buffered points", h)
+	}
+	if code, body := postForm(t, s, apiPrefix+"/data", "it-buffered", fmt.Sprintf("%d|45.5|27.25|0.1,0.2,9.8", ts+5)); code != http.StatusServiceUnavailable {
+		t.Errorf("payload over the high water mark = %d %s, want 503", code, body)
+	}
+
+	// once InfluxDB is back a probe closes the breaker and flushes the buffer
+	db.setDown(false)
+	deadline := time.Now().Add(10 * time.Second)
+	for h := deepHealth(t, s); !strings.Contains(h, `"breaker":"closed"`) || !strings.Contains(h, `"buffered_points":0`); h = deepHealth(t, s) {
+		if time.Now().After(deadline) {
+			t.Fatalf("buffer was not flushed: %s", h)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for i := 1; i <= 4; i++ {
+		if lines := db.written("it-buffered", fmt.Sprintf("humidity=4%d.5", i)); len(lines) != 1 {
+			t.Errorf("buffered payload %d written as %q, want one point", i, lines)
+		}
+	}
+}
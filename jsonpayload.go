@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jsonFields maps the keys of JSON payloads to schema fields and limits which
+// keys each node may send, see JSON_FIELDS_FILE
+type jsonFields struct {
+	// JSON key to schema field name
+	keys map[string]string
+	// allowed keys per node, nodes without an entry may send every key
+	nodes map[string]map[string]bool
+}
+
+type jsonFieldsFile struct {
+	Fields map[string]struct {
+		Measurement string   `json:"measurement"`
+		Field       string   `json:"field"`
+		Min         *float64 `json:"min"`
+		Max         *float64 `json:"max"`
+	} `json:"fields"`
+	Nodes map[string][]string `json:"nodes"`
+}
+
+// loadJSONFields accepts every schema field under its own name, plus the
+// fields declared in path, which are added to the schema
+func loadJSONFields(path string, schema *sensorSchema) (*jsonFields, error) {
+	jf := &jsonFields{keys: make(map[string]string), nodes: make(map[string]map[string]bool)}
+	for _, f := range schema.Fields {
+		jf.keys[f.Name] = f.Name
+	}
+	if path == "" {
+		return jf, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file jsonFieldsFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for k, decl := range file.Fields {
+		if jsonReserved[k] {
+			return nil, fmt.Errorf("field %q: the key is reserved", k)
+		}
+		name := decl.Field
+		if name == "" {
+			name = k
+		}
+		if _, ok := schema.field(name); !ok {
+			if decl.Measurement == "" {
+				return nil, fmt.Errorf("field %q: measurement is required", k)
+			}
+			f := sensorField{Measurement: decl.Measurement, Name: name, Optional: true}
+			if decl.Min != nil && decl.Max != nil {
+				f.Range = &valueRange{*decl.Min, *decl.Max}
+			}
+			schema.addField(f)
+		}
+		jf.keys[k] = name
+	}
+	for node, keys := range file.Nodes {
+		jf.nodes[node] = make(map[string]bool)
+		for _, k := range keys {
+			if _, ok := jf.keys[k]; !ok {
+				return nil, fmt.Errorf("node %q: unknown field %q", node, k)
+			}
+			jf.nodes[node][k] = true
+		}
+	}
+	return jf, nil
+}
+
+func (jf *jsonFields) allowed(node string, k string) bool {
+	if keys, ok := jf.nodes[node]; ok {
+		return keys[k]
+	}
+	_, ok := jf.keys[k]
+	return ok
+}
+
+// keys of a JSON record that are not sensor values
+var jsonReserved = map[string]bool{"node": true, "time": true, "precision": true, "seq": true, "records": true}
+
+// jsonPayload is either one record, {"node": "n1", "time": 1700000000,
+// "humidity": 40.5}, or several under "records" sharing node and precision
+type jsonPayload struct {
+	Node      string                       `json:"node"`
+	Precision string                       `json:"precision"`
+	Seq       json.Number                  `json:"seq"`
+	Records   []map[string]json.RawMessage `json:"records"`
+}
+
+// decodeJSONPayload reads the node, the precision and sequence number if
+// declared and the records of a JSON payload
+func decodeJSONPayload(body io.Reader) (jsonPayload, error) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return jsonPayload{}, fmt.Errorf("invalid JSON body: %w", err)
+	}
+	var p jsonPayload
+	for k, dst := range map[string]interface{}{"node": &p.Node, "precision": &p.Precision, "seq": &p.Seq, "records": &p.Records} {
+		if v, ok := raw[k]; ok {
+			if err := json.Unmarshal(v, dst); err != nil {
+				return p, fmt.Errorf("invalid %s", k)
+			}
+		}
+	}
+	if _, ok := raw["records"]; !ok {
+		p.Records = []map[string]json.RawMessage{raw}
+	}
+	return p, checkRecordCount(len(p.Records))
+}
+
+// parseJSONRecords converts the records of a payload into readings, in the
+// same shape parseRecords returns. Keys the node may not send are ignored
+// and returned.
+func parseJSONRecords(ctx context.Context, p jsonPayload, node string, jf *jsonFields, unit time.Duration) (readings []reading, indices []int, rejected []recordError, ignored []string) {
+	skipped := make(map[string]bool)
+	for i, record := range p.Records {
+		if ctx.Err() != nil {
+			break
+		}
+		rd, err := parseJSONRecord(record, node, jf, unit, skipped)
+		if err != nil {
+			rejected = append(rejected, recordError{Index: i, Reason: err.Error()})
+			continue
+		}
+		readings = append(readings, rd)
+		indices = append(indices, i)
+	}
+	for k := range skipped {
+		ignored = append(ignored, k)
+	}
+	sort.Strings(ignored)
+	return readings, indices, rejected, ignored
+}
+
+func parseJSONRecord(record map[string]json.RawMessage, node string, jf *jsonFields, unit time.Duration, skipped map[string]bool) (rd reading, err error) {
+	var ts int64
+	if v, ok := record["time"]; ok {
+		if err := json.Unmarshal(v, &ts); err != nil {
+			return rd, errors.New("invalid timestamp")
+		}
+	}
+	if rd.Time, err = epochTime(ts, unit); err != nil {
+		return rd, err
+	}
+	rd.Values = make(map[string]float64)
+	for k, v := range record {
+		if jsonReserved[k] {
+			continue
+		}
+		if !jf.allowed(node, k) {
+			skipped[k] = true
+			continue
+		}
+		f, ok, err := inferNumber(v)
+		if err != nil {
+			return rd, fmt.Errorf("invalid %s: %s", k, err)
+		}
+		if ok {
+			rd.Values[jf.keys[k]] = f
+		}
+	}
+	if len(rd.Values) == 0 {
+		return rd, errors.New("no known fields")
+	}
+	debugf("Time: %s, Values: %v\n", rd.Time.Format(time.RFC3339Nano), rd.Values)
+	return rd, nil
+}
+
+// inferNumber applies the type rules of JSON values: numbers are taken as
+// is, strings holding a number are parsed, booleans become 1 or 0 and null
+// means the value is missing. Anything else is rejected.
+func inferNumber(raw json.RawMessage) (float64, bool, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return 0, false, err
+	}
+	var f float64
+	switch v := v.(type) {
+	case nil:
+		return 0, false, nil
+	case float64:
+		f = v
+	case bool:
+		if v {
+			f = 1
+		}
+	case string:
+		var err error
+		if f, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+			return 0, false, errors.New("not a number")
+		}
+	default:
+		return 0, false, errors.New("not a number")
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false, errors.New("not a finite number")
+	}
+	return f, true, nil
+}
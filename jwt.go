@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// jwtClaims are the claims of the HS256 tokens the server accepts in place of
+// an API key
+type jwtClaims struct {
+	Subject string `json:"sub"`
+	Role    string `json:"role"`
+	// tenant name, the default tenant when empty
+	Tenant    string `json:"tenant,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+	// session of a dashboard login, see sessions.go
+	SessionID string `json:"sid,omitempty"`
+	// nodes, and zones of nodes, the token may read, see scope.go
+	Nodes []string `json:"nodes,omitempty"`
+	Zones []string `json:"zones,omitempty"`
+}
+
+// looksLikeJWT tells tokens apart from API keys
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// tokenAlgorithm reads the alg of the header of a JWT, empty when malformed
+func tokenAlgorithm(token string) string {
+	header, _, _ := strings.Cut(token, ".")
+	raw, err := base64.RawURLEncoding.DecodeString(header)
+	if err != nil {
+		return ""
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	json.Unmarshal(raw, &h)
+	return h.Alg
+}
+
+// verifyJWT checks the signature and expiry of an HS256 token signed with
+// secret and returns its claims
+func verifyJWT(secret, token string) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed token")
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errors.New("malformed token")
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return claims, errors.New("unsupported token algorithm")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return claims, errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errors.New("malformed token")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.New("malformed token")
+	}
+	if claims.ExpiresAt == 0 || time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errors.New("token expired")
+	}
+	return claims, nil
+}
+
+// signJWT issues an HS256 token with the given claims
+func signJWT(secret string, claims jwtClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) +
+		"." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
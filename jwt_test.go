@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the HS256 example of RFC 7515, appendix A.1
+const (
+	rfc7515Key   = "AyM1SysPpbyDfgZld3umj1qzKObwVMkoqQ-EstJQLr_T-1qS0gZH75aKtMN3Yj0iPS4hcgUuTwjAzZr1Z9CAow"
+	rfc7515Token = "eyJ0eXAiOiJKV1QiLA0KICJhbGciOiJIUzI1NiJ9" +
+		".eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ" +
+		".dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+func TestVerifyJWTExample(t *testing.T) {
+	raw, err := base64.RawURLEncoding.DecodeString(rfc7515Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := string(raw)
+
+	// the signature holds, the token expired in 2011
+	if _, err := verifyJWT(secret, rfc7515Token); err == nil || err.Error() != "token expired" {
+		t.Errorf("verifyJWT of the RFC 7515 example = %v, want token expired", err)
+	}
+	if _, err := verifyJWT("another secret", rfc7515Token); err == nil || err.Error() != "invalid token signature" {
+		t.Errorf("verifyJWT with another secret = %v, want invalid token signature", err)
+	}
+	tampered := strings.Replace(rfc7515Token, ".eyJpc3MiOiJqb2Ui", ".eyJpc3MiOiJqb2Ki", 1)
+	if _, err := verifyJWT(secret, tampered); err == nil || err.Error() != "invalid token signature" {
+		t.Errorf("verifyJWT of a tampered payload = %v, want invalid token signature", err)
+	}
+}
+
+func TestSignJWT(t *testing.T) {
+	claims := jwtClaims{Subject: "lab-1", Role: "device", Tenant: "campus", ExpiresAt: time.Now().Add(time.Hour).Unix(), Nodes: []string{"lab-1"}}
+	token, err := signJWT("secret", claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !looksLikeJWT(token) || tokenAlgorithm(token) != "HS256" {
+		t.Errorf("signJWT = %q, not an HS256 token", token)
+	}
+	got, err := verifyJWT("secret", token)
+	if err != nil {
+		t.Fatalf("verifyJWT: %v", err)
+	}
+	if got.Subject != claims.Subject || got.Role != claims.Role || got.Tenant != claims.Tenant || got.ExpiresAt != claims.ExpiresAt || len(got.Nodes) != 1 {
+		t.Errorf("verifyJWT = %+v, want %+v", got, claims)
+	}
+
+	expired, _ := signJWT("secret", jwtClaims{Subject: "lab-1", Role: "device", ExpiresAt: time.Now().Add(-time.Second).Unix()})
+	if _, err := verifyJWT("secret", expired); err == nil {
+		t.Error("verifyJWT of an expired token succeeded")
+	}
+	forever, _ := signJWT("secret", jwtClaims{Subject: "lab-1", Role: "device"})
+	if _, err := verifyJWT("secret", forever); err == nil {
+		t.Error("verifyJWT of a token without exp succeeded")
+	}
+}
+
+func TestVerifyJWTAlgorithm(t *testing.T) {
+	tests := []struct {
+		token string
+		alg   string
+	}{
+		// alg none must not pass for a signed token
+		{"eyJhbGciOiJub25lIn0.eyJzdWIiOiJ4In0.", "none"},
+		{"eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiJ4In0.c2ln", "RS256"},
+		{"not base64.eyJzdWIiOiJ4In0.c2ln", ""},
+	}
+	for _, tt := range tests {
+		if got := tokenAlgorithm(tt.token); got != tt.alg {
+			t.Errorf("tokenAlgorithm(%q) = %q, want %q", tt.token, got, tt.alg)
+		}
+		if _, err := verifyJWT("secret", tt.token); err == nil {
+			t.Errorf("verifyJWT(%q) succeeded", tt.token)
+		}
+	}
+	if looksLikeJWT("a-plain-api-key") {
+		t.Error("an API key looks like a JWT")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+)
+
+// measurement holding the leases of the replicas
+const leaseMeasurement = "server_lease"
+
+// leaderElector picks one replica to run the scheduled jobs when several
+// run behind a load balancer. The leader renews a lease by writing a point
+// to InfluxDB every third of LEADER_LEASE, with the time it took the lease
+// as "since". Once the lease expired every replica claims it the same way;
+// of the claims seen within the last lease, the one with the earliest since
+// wins, so replicas claiming together agree on the winner and the others
+// stop. A nil elector, election being off, always leads.
+type leaderElector struct {
+	id    string
+	lease time.Duration
+	query api.QueryAPI
+	write api.WriteAPIBlocking
+	flux  string
+
+	mu      sync.Mutex
+	leading bool
+	since   time.Time
+	elected chan struct{}
+}
+
+type leaseClaim struct {
+	holder string
+	since  int64
+}
+
+func newLeaderElector(cfg *config, client influxdb2.Client) *leaderElector {
+	return &leaderElector{
+		id:    cfg.ReplicaID,
+		lease: cfg.LeaderLease,
+		query: client.QueryAPI(cfg.Org),
+		write: client.WriteAPIBlocking(cfg.Org, cfg.LeaderBucket),
+		flux: fmt.Sprintf(`from(bucket: %s)
+  |> range(start: -%dms)
+  |> filter(fn: (r) => r._measurement == %q)
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`,
+			fluxString(cfg.LeaderBucket), cfg.LeaderLease.Milliseconds(), leaseMeasurement),
+		elected: make(chan struct{}),
+	}
+}
+
+// isLeader reports whether this replica currently holds the lease
+func (l *leaderElector) isLeader() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leading
+}
+
+// await blocks until this replica leads for the first time, for jobs that
+// only run once at startup
+func (l *leaderElector) await() {
+	if l != nil {
+		<-l.elected
+	}
+}
+
+func (l *leaderElector) run() {
+	first := true
+	for {
+		leading, err := l.round()
+		if err != nil {
+			// without InfluxDB no lease can be checked, step down so two
+			// replicas never both run the jobs
+			log.Printf("leader election: %s\n", err)
+			leading = false
+		}
+
+		l.mu.Lock()
+		if leading != l.leading {
+			if leading {
+				log.Printf("leader election: %s is the leader\n", l.id)
+			} else {
+				log.Printf("leader election: %s stepped down\n", l.id)
+			}
+		}
+		l.leading = leading
+		l.mu.Unlock()
+		if leading && first {
+			close(l.elected)
+			first = false
+		}
+		time.Sleep(l.lease / 3)
+	}
+}
+
+// round renews or claims the lease when it is free or ours, then checks
+// which claim won
+func (l *leaderElector) round() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.lease/3)
+	defer cancel()
+
+	claims, err := l.claims(ctx)
+	if err != nil {
+		return false, err
+	}
+	holder := winner(claims)
+	if holder.holder != "" && holder.holder != l.id {
+		l.since = time.Time{}
+		return false, nil
+	}
+	if holder.holder == "" || l.since.IsZero() {
+		l.since = time.Now()
+	}
+
+	p := influxdb2.NewPointWithMeasurement(leaseMeasurement).
+		AddField("holder", l.id).
+		AddField("since", l.since.UnixNano()).
+		SetTime(time.Now())
+	if err := l.write.WritePoint(ctx, p); err != nil {
+		return false, err
+	}
+	if claims, err = l.claims(ctx); err != nil {
+		return false, err
+	}
+	if winner(claims).holder != l.id {
+		l.since = time.Time{}
+		return false, nil
+	}
+	return true, nil
+}
+
+func (l *leaderElector) claims(ctx context.Context) ([]leaseClaim, error) {
+	result, err := l.query.Query(ctx, l.flux)
+	if err != nil {
+		return nil, err
+	}
+	var claims []leaseClaim
+	for result.Next() {
+		holder, _ := result.Record().ValueByKey("holder").(string)
+		since, _ := result.Record().ValueByKey("since").(int64)
+		claims = append(claims, leaseClaim{holder, since})
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+	return claims, nil
+}
+
+// winner is the claim with the earliest since, the zero claim when the lease
+// expired
+func winner(claims []leaseClaim) leaseClaim {
+	var best leaseClaim
+	for _, c := range claims {
+		if c.holder == "" {
+			continue
+		}
+		if best.holder == "" || c.since < best.since || (c.since == best.since && c.holder < best.holder) {
+			best = c
+		}
+	}
+	return best
+}
+
+func collectLeader(l *leaderElector) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		leading := 0.0
+		if l.isLeader() {
+			leading = 1
+		}
+		mw.family("sensor_replica_leader", "gauge", "1 while this replica runs the scheduled jobs.")
+		mw.sample("sensor_replica_leader", leading, "replica", l.id)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Link quality: the ingest requests of every node are timed and counted
+// with the attempt number firmware sends in X-Attempt, 1 for the first try,
+// and the backhaul it names in X-Transport, e.g. wifi or lora. Every
+// LINK_QUALITY_INTERVAL the figures of each node that posted are written as
+// a link_quality point tagged with the transport, next to the share of its
+// records that failed to parse, so backhauls can be compared over time.
+
+const linkQualityMeasurement = "link_quality"
+
+// attempt numbers above this are taken as garbage
+const maxAttempt = 1000
+
+// linkQuality is the running total of the ingest requests of a node
+type linkQuality struct {
+	Transport string `json:"transport,omitempty"`
+	Requests  int64  `json:"requests"`
+	// attempts beyond the first as reported in X-Attempt
+	Retries int64 `json:"retries"`
+	// answered with an error status
+	Failed int64 `json:"failed"`
+	// moving average of the time to answer a request
+	LatencyMS    float64 `json:"latency_ms"`
+	MaxLatencyMS float64 `json:"max_latency_ms"`
+}
+
+// linkWindow collects the requests of a node since the last point
+type linkWindow struct {
+	requests, retries, failed int64
+	latency, maxLatency       time.Duration
+	// record counters of the node when the window began
+	parsed, rejected int64
+}
+
+// withLinkQuality times the ingest requests of the node next names on the
+// request trace
+func withLinkQuality(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		node := traceOf(r.Context()).nodeName()
+		if node == "" {
+			return
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		attempt, err := strconv.Atoi(r.Header.Get("X-Attempt"))
+		if err != nil || attempt < 1 || attempt > maxAttempt {
+			attempt = 1
+		}
+		transport := strings.ToLower(r.Header.Get("X-Transport"))
+		if len(transport) > 32 || !nodePattern.MatchString(transport) {
+			transport = ""
+		}
+		t := r.Context().Value(key("tenant")).(*tenant)
+		t.nodes.observeLink(node, transport, attempt, rec.status >= 400, time.Since(start))
+	}
+}
+
+func (s *nodeStore) observeLink(node, transport string, attempt int, failed bool, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.get(node)
+	// list hands out the pointer, so the totals are replaced, not changed
+	var lq linkQuality
+	if n.LinkQuality != nil {
+		lq = *n.LinkQuality
+	}
+	ms := float64(latency) / float64(time.Millisecond)
+	if lq.Requests == 0 {
+		lq.LatencyMS = ms
+	} else {
+		lq.LatencyMS += (ms - lq.LatencyMS) / 10
+	}
+	if ms > lq.MaxLatencyMS {
+		lq.MaxLatencyMS = ms
+	}
+	if transport != "" {
+		lq.Transport = transport
+	}
+	lq.Requests++
+	lq.Retries += int64(attempt - 1)
+	win := &n.link
+	win.requests++
+	win.retries += int64(attempt - 1)
+	if failed {
+		lq.Failed++
+		win.failed++
+	}
+	win.latency += latency
+	if latency > win.maxLatency {
+		win.maxLatency = latency
+	}
+	n.LinkQuality = &lq
+}
+
+// linkPoints returns a link_quality point for every node that posted since
+// the last call and starts their next window
+func (s *nodeStore) linkPoints(now time.Time) []*write.Point {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var points []*write.Point
+	for _, n := range s.nodes {
+		win := n.link
+		if win.requests == 0 {
+			continue
+		}
+		n.link = linkWindow{parsed: n.recordsParsed, rejected: n.recordsRejected}
+		records := n.recordsParsed - win.parsed + n.recordsRejected - win.rejected
+		rejected := n.recordsRejected - win.rejected
+		p := influxdb2.NewPointWithMeasurement(linkQualityMeasurement).
+			AddTag("location", n.Node).
+			AddField("requests", win.requests).
+			AddField("retries", win.retries).
+			AddField("failed", win.failed).
+			AddField("latency_mean_ms", float64(win.latency)/float64(win.requests)/float64(time.Millisecond)).
+			AddField("latency_max_ms", float64(win.maxLatency)/float64(time.Millisecond)).
+			AddField("records", records).
+			AddField("rejected_records", rejected).
+			SetTime(now)
+		if n.LinkQuality.Transport != "" {
+			p.AddTag("transport", n.LinkQuality.Transport)
+		}
+		if records > 0 {
+			p.AddField("error_rate", float64(rejected)/float64(records))
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+// runLinkQuality writes the link_quality points of every tenant each
+// interval
+func runLinkQuality(interval time.Duration, reg *tenantRegistry) {
+	for now := range time.Tick(interval) {
+		for _, t := range reg.all() {
+			points := t.nodes.linkPoints(now)
+			if len(points) == 0 {
+				continue
+			}
+			if _, err := t.writer.write(context.Background(), nil, points...); err != nil {
+				log.Printf("link quality of tenant %q: %s\n", t.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log files: the server logs to logs/<date>.log, a new file every local day.
+// The directory is created when missing, and on every new file all but the
+// newest LOG_FILES_KEEP are removed, including those of the older scheme
+// named after the start time of the server.
+
+const (
+	logDir        = "logs"
+	logFileLayout = "2006-01-02"
+)
+
+// dailyLog is the output of the log package, switching files at midnight
+type dailyLog struct {
+	dir  string
+	keep int
+
+	mu  sync.Mutex
+	day string
+	f   *os.File
+}
+
+func openDailyLog(dir string, keep int) (*dailyLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &dailyLog{dir: dir, keep: keep}
+	if err := l.open(time.Now().Format(logFileLayout)); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *dailyLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if day := time.Now().Format(logFileLayout); day != l.day {
+		// the log package is locked while writing, so errors go to stderr;
+		// lines keep going to the old file rather than being lost
+		if err := l.open(day); err != nil {
+			fmt.Fprintf(os.Stderr, "log: %s\n", err)
+		}
+	}
+	return l.f.Write(p)
+}
+
+func (l *dailyLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Close()
+}
+
+// open switches to the file of day and prunes the old ones
+func (l *dailyLog) open(day string) error {
+	f, err := os.OpenFile(filepath.Join(l.dir, day+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f, l.day = f, day
+	if l.keep > 0 {
+		if err := pruneLogFiles(l.dir, l.keep); err != nil {
+			fmt.Fprintf(os.Stderr, "log: pruning %s: %s\n", l.dir, err)
+		}
+	}
+	return nil
+}
+
+// pruneLogFiles removes all but the newest keep log files in dir, files
+// other than <date>... .log, like the audit log, are left alone
+func pruneLogFiles(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".log") || len(name) < len(logFileLayout) {
+			continue
+		}
+		if _, err := time.Parse(logFileLayout, name[:len(logFileLayout)]); err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) <= keep {
+		return nil
+	}
+	// dates sort by name, an old start-time file before the daily file
+	sort.Strings(names)
+	for _, name := range names[:len(names)-keep] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
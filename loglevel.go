@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log levels: LOG_LEVEL is info, the default, or debug, which adds the
+// payload and values of every record parsed. During an incident an admin can
+// switch to debug through /admin/loglevel for a while; the level returns to
+// LOG_LEVEL when the time is up, or on restart.
+
+const (
+	levelInfo int32 = iota
+	levelDebug
+)
+
+var logLevelNames = map[string]int32{"info": levelInfo, "debug": levelDebug}
+
+const (
+	defaultLogLevelDuration = 15 * time.Minute
+	maxLogLevelDuration     = 24 * time.Hour
+)
+
+// the level in effect, read by every debugf without locking
+var currentLogLevel atomic.Int32
+
+func debugf(format string, args ...interface{}) {
+	if currentLogLevel.Load() >= levelDebug && !reducedLogging.Load() {
+		log.Printf("debug: "+format, args...)
+	}
+}
+
+func logLevelName(level int32) string {
+	for name, l := range logLevelNames {
+		if l == level {
+			return name
+		}
+	}
+	return fmt.Sprint(level)
+}
+
+// logLevelControl is the configured level and a temporary override of it
+type logLevelControl struct {
+	configured int32
+
+	mu    sync.Mutex
+	until time.Time
+	reset *time.Timer
+}
+
+func newLogLevelControl(name string) *logLevelControl {
+	c := &logLevelControl{configured: logLevelNames[name]}
+	currentLogLevel.Store(c.configured)
+	return c
+}
+
+// override sets level until d has passed
+func (c *logLevelControl) override(level int32, d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reset != nil {
+		c.reset.Stop()
+	}
+	currentLogLevel.Store(level)
+	c.until = time.Now().Add(d)
+	c.reset = time.AfterFunc(d, c.restore)
+	return c.until
+}
+
+// restore returns to the configured level
+func (c *logLevelControl) restore() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reset != nil {
+		c.reset.Stop()
+		c.reset = nil
+	}
+	if currentLogLevel.Swap(c.configured) != c.configured {
+		log.Printf("log level back to %s\n", logLevelName(c.configured))
+	}
+	c.until = time.Time{}
+}
+
+func (c *logLevelControl) status() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := map[string]interface{}{
+		"level":      logLevelName(currentLogLevel.Load()),
+		"configured": logLevelName(c.configured),
+	}
+	if !c.until.IsZero() {
+		status["until"] = c.until
+	}
+	return status
+}
+
+// adminLogLevel shows the log level (GET), changes it for a while (POST
+// {"level": "debug", "duration": "30m"}) or restores LOG_LEVEL (DELETE)
+func adminLogLevel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c := ctx.Value(key("loglevel")).(*logLevelControl)
+	audit := ctx.Value(key("audit")).(*auditLog)
+
+	switch r.Method {
+	case "POST":
+		var body struct {
+			Level    string `json:"level"`
+			Duration string `json:"duration"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "400 - invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		level, ok := logLevelNames[body.Level]
+		if !ok {
+			http.Error(w, "400 - level must be info or debug", http.StatusBadRequest)
+			return
+		}
+		d := defaultLogLevelDuration
+		if body.Duration != "" {
+			var err error
+			if d, err = time.ParseDuration(body.Duration); err != nil || d <= 0 || d > maxLogLevelDuration {
+				http.Error(w, fmt.Sprintf("400 - duration must be positive and at most %s", maxLogLevelDuration), http.StatusBadRequest)
+				return
+			}
+		}
+		until := c.override(level, d)
+		log.Printf("log level set to %s until %s\n", body.Level, until.Format(time.RFC3339))
+		audit.record(r, "log_level", map[string]interface{}{"level": body.Level, "until": until})
+	case "DELETE":
+		c.restore()
+		audit.record(r, "log_level", map[string]interface{}{"level": logLevelName(c.configured)})
+	}
+	writeJSON(w, c.status())
+}
@@ -4,168 +4,446 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
-	"time"
+	"sync/atomic"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
-	"github.com/influxdata/influxdb-client-go/v2/api"
-	"github.com/joho/godotenv"
 )
 
 type key string
 
 func main() {
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && (args[0] == "help" || args[0] == "-h" || args[0] == "--help") {
+		usage()
+		return
+	}
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	c := findCommand(name)
+	if c == nil {
+		usage()
+		os.Exit(2)
+	}
+	if err := c.run(args); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	startTime := time.Now().Local().String()
+// serve runs the server, logging to a file per day in logs/
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Parse(args)
 
-	f, err := os.OpenFile("logs/"+startTime+".log", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	cfg, err := loadEnvConfig()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer f.Close()
-
-	log.SetOutput(f)
 
-	// fetch env data
-	var env map[string]string
-	env, err = godotenv.Read()
+	f, err := openDailyLog(logDir, cfg.LogFilesKeep)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer f.Close()
 
-	TOKEN_DB := env["INFLUXDB_TOKEN"]
-	URL_DB := env["URL_DB"]
-	ORG_NAME := env["ORG_NAME"]
-	BUCKET_NAME := env["BUCKET_NAME"]
+	log.SetOutput(f)
 
-	client := influxdb2.NewClient(URL_DB, TOKEN_DB)
+	client := newInfluxClient(cfg)
 	defer client.Close()
 
-	// use blocking (synchronous) api to write to db
-	writeApi := client.WriteAPIBlocking(ORG_NAME, BUCKET_NAME)
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", getRoot)
-	mux.HandleFunc("/api", postSensorData)
+	logConfig(cfg, ":8080")
+	// a gateway does not write to InfluxDB itself
+	if cfg.StartupWait > 0 && cfg.GatewayUpstream == "" {
+		// InfluxDB started along with the server may take a while to answer,
+		// accept requests only once it does or the wait is over
+		if !waitForInfluxDB(client.Ping, cfg.StartupWait) {
+			log.Printf("InfluxDB not reachable after %s, starting anyway, writes are buffered until it answers\n", cfg.StartupWait)
+		}
+	}
+	if cfg.Bootstrap && cfg.GatewayUpstream == "" {
+		if err := bootstrap(cfg, client); err != nil {
+			return err
+		}
+	}
+	if cfg.SelfTest && cfg.GatewayUpstream == "" {
+		if err := selfTest(cfg, client); err != nil {
+			return err
+		}
+	}
 
-	var db key = "db"
-	var write key = "writeApi"
+	server, err := newServer(":8080", cfg, client)
+	if err != nil {
+		return err
+	}
 
-	ctx := context.Background()
-	server := &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
-		BaseContext: func(_ net.Listener) context.Context {
-			ctx = context.WithValue(ctx, db, client)
-			ctx = context.WithValue(ctx, write, writeApi)
-			return ctx
-		},
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	// systemd only considers the service started once InfluxDB is reachable,
+	// a gateway is usable right away as it buffers while the upstream is away
+	ready := client.Ping
+	if cfg.GatewayUpstream != "" {
+		ready = func(context.Context) (bool, error) { return true, nil }
+	}
+	go notifyReady(ready, ln.Addr().(*net.TCPAddr))
+	if cfg.MDNS {
+		// discovery is a convenience, nodes with a configured URL still work
+		if m, err := newMDNSResponder(cfg.MDNSName, ln.Addr().(*net.TCPAddr).Port); err != nil {
+			log.Printf("mdns: not advertising: %s\n", err)
+		} else {
+			go m.run()
+		}
 	}
 
 	log.Println("Server started on port 8080")
-	err = server.ListenAndServe()
+	err = server.Serve(ln)
 
 	if errors.Is(err, http.ErrServerClosed) {
 		log.Println("Server closed under request")
-	} else {
-		log.Println("Server closed unexpectedly with error:")
-		log.Fatal(err)
+		return nil
 	}
+	log.Println("Server closed unexpectedly with error:")
+	return err
 }
 
-func getRoot(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.Error(w, "404 not found.", http.StatusNotFound)
-		return
+// newServer wires the handlers and the InfluxDB dependencies into an
+// http.Server, so the same setup can be booted by main or by the integration
+// tests built with -tags integration
+func newServer(addr string, cfg *config, client influxdb2.Client) (*http.Server, error) {
+	tenants, err := loadTenants(cfg, client)
+	if err != nil {
+		return nil, err
 	}
-	if r.Method != "GET" {
-		http.Error(w, "Method is not supported.", http.StatusNotFound)
-		return
+	audit, err := openAuditLog(cfg.AuditLog)
+	if err != nil {
+		return nil, err
 	}
-	w.Write([]byte("Welcome"))
-}
-
-func parseData(data string) (timestamp int64, hum float64, temp float64, x float64, y float64, z float64, err error) {
-	defer func() {
-		if recover() != nil {
-			err = errors.New("error parsing data")
+	users, err := loadUsers(cfg, tenants)
+	if err != nil {
+		return nil, err
+	}
+	var oidc *oidcProvider
+	if cfg.OIDCIssuer != "" {
+		if tenants.byName(cfg.OIDCTenant) == nil {
+			return nil, fmt.Errorf("invalid OIDC_TENANT: unknown tenant %q", cfg.OIDCTenant)
 		}
-	}()
+		oidc = newOIDCProvider(cfg)
+	}
 
-	log.Printf("incoming data: %s\n", data)
-	bodyArr := strings.Split(data, "|")
-	timestamp, _ = strconv.ParseInt(bodyArr[0], 10, 64)
-	hum, _ = strconv.ParseFloat(bodyArr[1], 64)
-	temp, _ = strconv.ParseFloat(bodyArr[2], 64)
-	acc := strings.Split(bodyArr[3], ",")
-	x, _ = strconv.ParseFloat(acc[0], 64)
-	y, _ = strconv.ParseFloat(acc[1], 64)
-	z, _ = strconv.ParseFloat(acc[2], 64)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", getRoot)
+	// drain and idempotency look up the Idempotency-Key by the decoded node
+	// and body
+	ingest := withLinkQuality(withIngestValidation(ingestRules, withDrain(withIdempotency(http.HandlerFunc(postSensorData)).ServeHTTP)))
+	handleAPI(mux, "/data", permIngest, ingest, "POST")
+	handleAPI(mux, "/stream", permIngest, withDrain(withValidation(streamRules, postStream)), "POST")
+	handleAPI(mux, "/health", permIngest, withDrain(postDiagnostics), "POST")
+	handleAPI(mux, "/heartbeat", permIngest, withDrain(postHeartbeat), "POST")
+	handleAPI(mux, "/burst", permIngest, withDrain(postBurst), "POST")
+	handleAPI(mux, "/nodes", permRead, getNodes, "GET")
+	handleAPI(mux, "/nodes/", permRead, withQueryCache(nodeRoutes), "GET")
+	handleAPI(mux, "/zones", permRead, getZones, "GET")
+	handleAPI(mux, "/zones/", permRead, withQueryCache(zoneRoutes), "GET")
+	handleAPI(mux, "/readings", permRead, withValidation(nodeQueryRules, withQueryCache(getReadings)), "GET")
+	handleAPI(mux, "/track", permRead, withValidation(nodeQueryRules, withQueryCache(getTrack)), "GET")
+	handleAPI(mux, "/graphql", permRead, serveGraphQL, "GET", "POST")
+	handleAPI(mux, "/usage", permRead, getUsage, "GET")
+	handleAPI(mux, "/statsz", permRead, getStatsz, "GET")
+	handleAPI(mux, "/stats/rolling", permRead, withValidation(nodeQueryRules, withQueryCache(getRollingStats)), "GET")
+	handleAPI(mux, "/gateway", permIngest, withDrain(postGateway), "POST")
+	handleAPI(mux, "/integrations/homeassistant", permIngest, withDrain(postHomeAssistant), "POST")
+	// the path remote_write clients use for Cortex and Mimir
+	handle(mux, "/api/prom/write", withTenant(requirePermission(permIngest, withDrain(postPromWrite))), "POST")
+	handleAPI(mux, "/quality", permRead, getQuality, "GET")
+	handleAPI(mux, "/backfill", permOperate, postBackfill, "POST")
+	handleAPI(mux, "/backfill/", permRead, getBackfillJob, "GET")
+	handleAPI(mux, "/reports", permRead, getReports, "GET")
+	handleAPI(mux, "/reports/", permRead, getReport, "GET")
+	handleAPI(mux, "/sessions", permRead, getSessions, "GET")
+	handleAPI(mux, "/sessions/", permRead, getSessions, "DELETE")
+	// deployed nodes still post to the original endpoint
+	handle(mux, "/api", deprecated(apiPrefix+"/data", withTenant(requirePermission(permIngest, legacyForm(ingest)))), "POST")
+	handle(mux, "/admin/delete", withAdmin(http.HandlerFunc(postDelete)), "POST")
+	handle(mux, "/admin/audit", withAdmin(http.HandlerFunc(getAudit)), "GET")
+	handle(mux, "/admin/reports", withAdmin(http.HandlerFunc(postGenerateReport)), "POST")
+	handle(mux, "/admin/downsample", withAdmin(http.HandlerFunc(adminDownsample)), "GET", "POST")
+	handle(mux, "/admin/rollups", withAdmin(http.HandlerFunc(adminRollups)), "GET")
+	handle(mux, "/admin/alerts", withAdmin(http.HandlerFunc(adminAlerts)), "GET")
+	handle(mux, "/admin/alerts/", withAdmin(http.HandlerFunc(adminAlerts)), "POST")
+	handle(mux, "/admin/maintenance", withAdmin(http.HandlerFunc(adminMaintenance)), "GET", "POST")
+	handle(mux, "/admin/maintenance/", withAdmin(http.HandlerFunc(adminMaintenance)), "DELETE")
+	handle(mux, "/admin/commands", withAdmin(http.HandlerFunc(adminCommands)), "GET", "POST")
+	handle(mux, "/admin/commands/", withAdmin(http.HandlerFunc(adminCommands)), "DELETE")
+	handle(mux, "/admin/users", withAdmin(http.HandlerFunc(adminUsers)), "GET", "POST")
+	handle(mux, "/admin/users/", withAdmin(http.HandlerFunc(adminUsers)), "DELETE")
+	handle(mux, "/admin/sessions", withAdmin(http.HandlerFunc(adminSessions)), "GET", "DELETE")
+	handle(mux, "/admin/sessions/", withAdmin(http.HandlerFunc(adminSessions)), "DELETE")
+	handle(mux, "/admin/drain", withAdmin(http.HandlerFunc(adminDrain)), "GET", "POST", "DELETE")
+	handle(mux, "/admin/loglevel", withAdmin(http.HandlerFunc(adminLogLevel)), "GET", "POST", "DELETE")
+	handle(mux, "/login", http.HandlerFunc(serveLogin), "GET", "POST")
+	handle(mux, "/login/oidc", http.HandlerFunc(getOIDCLogin), "GET")
+	handle(mux, "/login/oidc/callback", http.HandlerFunc(getOIDCCallback), "GET")
+	handle(mux, "/logout", http.HandlerFunc(postLogout), "POST")
+	handle(mux, "/metrics", withMonitoring(http.HandlerFunc(getMetrics)), "GET")
+	handle(mux, "/healthz", http.HandlerFunc(getHealthz), "GET")
+	handle(mux, "/healthz/deep", withMonitoring(http.HandlerFunc(getDeepHealth)), "GET")
+	handle(mux, "/readyz", http.HandlerFunc(getReadyz), "GET")
+	handle(mux, apiPrefix+"/time", http.HandlerFunc(getTime), "GET")
+	handle(mux, "/api/time", deprecated(apiPrefix+"/time", http.HandlerFunc(getTime)), "GET")
+	handle(mux, "/openapi.json", http.HandlerFunc(getOpenAPI), "GET")
+	handle(mux, "/docs", http.HandlerFunc(getDocs), "GET")
+	mux.Handle("/dashboard/", withDashboardLogin(dashboardHandler()))
+	mux.Handle("/dashboard", http.RedirectHandler("/dashboard/", http.StatusMovedPermanently))
 
-	log.Printf("Timestamp: %d, Humidity: %f, Temperature: %f, Accelerometer: %f, %f, %f\n", timestamp, hum, temp, x, y, z)
+	var db key = "db"
+	var conf key = "config"
+	var tenantsKey key = "tenants"
+	var idempotency key = "idempotency"
+	var metricsKey key = "metrics"
+	var auditKey key = "audit"
+	var backfill key = "backfill"
+	var eventsKey key = "events"
+	var mqttKey key = "mqtt"
+	var forwardKey key = "forwarders"
+	var rollupsKey key = "rollups"
+	var usersKey key = "users"
+	var oidcKey key = "oidc"
+	var drainKey key = "drain"
+	var logLevelKey key = "loglevel"
+	var diskKey key = "disk"
+
+	var leader *leaderElector
+	if cfg.LeaderElection {
+		leader = newLeaderElector(cfg, client)
+		go leader.run()
+	}
 
-	return timestamp, hum, temp, x, y, z, nil
-}
+	if cfg.ExportS3Bucket != "" {
+		s3, err := newS3Client(cfg.ExportS3Endpoint, cfg.ExportS3Region, cfg.ExportS3Bucket,
+			cfg.ExportS3AccessKey, cfg.ExportS3SecretKey, cfg.ExportS3PathStyle)
+		if err != nil {
+			return nil, err
+		}
+		go runExports(cfg, tenants, s3, leader)
+	}
 
-func postSensorData(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/api" {
-		http.Error(w, "404 not found.", http.StatusNotFound)
-		return
+	if cfg.WriteQueuePath != "" {
+		queue, err := openWriteQueue(cfg.WriteQueuePath)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tenants.all() {
+			if err := t.writer.persist(queue, t.Name); err != nil {
+				return nil, err
+			}
+		}
 	}
-	if r.Method != "POST" {
-		http.Error(w, "Method is not supported.", http.StatusNotFound)
-		return
+	var guard *diskGuard
+	if cfg.DiskCheckInterval > 0 {
+		guard = newDiskGuard(cfg)
+		go guard.run(cfg.DiskCheckInterval)
+		for _, t := range tenants.all() {
+			t.writer.diskFull = &guard.critical
+		}
+	}
+	for _, t := range tenants.all() {
+		go t.writer.run()
 	}
 
-	ctx := r.Context()
-	writeApi := ctx.Value(key("writeApi")).(api.WriteAPIBlocking)
+	events := newEventBus(cfg)
+	events.alerts.leader = leader
 
-	data := r.FormValue("data")
-	node := r.FormValue("node")
+	if len(cfg.ReportPeriods) > 0 {
+		go runReports(cfg, tenants, leader)
+	}
 
-	if node == "" {
-		node = "unknown"
+	if len(cfg.DownsampleEvery) > 0 {
+		go func() {
+			// replicas would race creating the same tasks
+			leader.await()
+			runDownsampling(cfg, client, tenants)
+		}()
 	}
-	replacer := strings.NewReplacer(" ", "", "\t", "", "\n", "", "\r", "", "\x00", "")
 
-	data = replacer.Replace(data)
+	var ru *rollups
+	if len(cfg.Rollups) > 0 || cfg.RawRetention > 0 {
+		ru = newRollups(cfg, client, tenants, leader)
+		go ru.run(tenants)
+	}
 
-	var timestamp, hum, temp, x, y, z, err = parseData(data)
+	var mq *mqttPublisher
+	if cfg.MQTTBroker != "" {
+		mq = newMQTTPublisher(cfg)
+		go mq.run()
+	}
 
+	forward, err := newForwarders(cfg)
 	if err != nil {
-		log.Printf("Error: %s\n", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("400 - Bad request data"))
-		return
+		return nil, err
+	}
+	for _, f := range forward {
+		go f.run()
+	}
+	sink := &pollSink{cfg: cfg, events: events, mq: mq, forward: forward, leader: leader}
+	modbus, err := newModbusPollers(cfg.ModbusDevices, tenants, sink)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range modbus {
+		go p.run()
+	}
+	opcua, err := newOPCUASubscribers(cfg.OPCUAServers, tenants, sink)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range opcua {
+		go s.run()
+	}
+	var graphite *graphiteListener
+	if cfg.GraphiteListen != "" {
+		if graphite, err = newGraphiteListener(cfg, tenants); err != nil {
+			return nil, err
+		}
+		if err := graphite.listen(cfg.GraphiteListen); err != nil {
+			return nil, err
+		}
+	}
+	var statsd *statsdListener
+	if cfg.StatsdListen != "" {
+		if statsd, err = newStatsdListener(cfg, tenants); err != nil {
+			return nil, err
+		}
+		if err := statsd.listen(cfg.StatsdListen); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.LinkQualityInterval > 0 {
+		go runLinkQuality(cfg.LinkQualityInterval, tenants)
+	}
+	var shadow *shadowWriter
+	if cfg.ShadowBucket != "" {
+		shadow = newShadowWriter(cfg)
+		for _, t := range tenants.all() {
+			t.writer.shadow = shadow
+		}
+		go shadow.run()
+	}
+
+	idem := newIdempotencyStore(cfg.IdempotencyTTL, cfg.IdempotencyMaxKeys)
+	if cfg.RedisURL != "" {
+		shared, err := newRedisClient(cfg.RedisURL, cfg.RedisPrefix)
+		if err != nil {
+			return nil, err
+		}
+		idem.shared = shared
+		events.alerts.shared = shared
+		for _, t := range tenants.all() {
+			if t.writer.dedup != nil {
+				t.writer.dedup.shared, t.writer.dedup.namespace = shared, t.Name
+			}
+			t.nodes.shared, t.nodes.namespace = shared, t.Name
+		}
+	}
+	// the leader evaluates outages and escalates, from the state in Redis
+	// when it is shared
+	go events.watchOutages(tenants, leader)
+	if len(cfg.EscalationChain) > 0 {
+		go events.alerts.watch()
 	}
 
-	p1 := influxdb2.NewPointWithMeasurement("air").
-		AddTag("location", node).
-		AddField("humidity", hum).
-		AddField("temperature", temp).
-		SetTime(time.Unix(timestamp, 0))
+	panics := new(atomic.Int64)
+	metrics := newMetricsRegistry()
+	metrics.register(collectPanics(panics))
+	metrics.register(collectQuality(tenants))
+	metrics.register(collectBattery(tenants))
+	metrics.register(collectSequence(tenants))
+	metrics.register(collectFragments(tenants))
+	metrics.register(collectWriters(tenants))
+	metrics.register(collectIngest(tenants))
+	metrics.register(collectQueryCache(tenants))
+	if mq != nil {
+		metrics.register(collectMQTT(mq))
+	}
+	if guard != nil {
+		metrics.register(collectDisk(guard))
+	}
+	if leader != nil {
+		metrics.register(collectLeader(leader))
+	}
+	if len(forward) > 0 {
+		metrics.register(collectForwarders(forward))
+	}
+	if len(modbus) > 0 {
+		metrics.register(collectModbus(modbus))
+	}
+	if len(opcua) > 0 {
+		metrics.register(collectOPCUA(opcua))
+	}
+	if graphite != nil {
+		metrics.register(collectGraphite(graphite))
+	}
+	if statsd != nil {
+		metrics.register(collectStatsd(statsd))
+	}
+	if shadow != nil {
+		metrics.register(collectShadow(shadow))
+	}
 
-	p2 := influxdb2.NewPointWithMeasurement("accelerometer").
-		AddTag("location", node).
-		AddField("x", x).
-		AddField("y", y).
-		AddField("z", z).
-		SetTime(time.Unix(timestamp, 0))
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, db, client)
+	ctx = context.WithValue(ctx, conf, cfg)
+	ctx = context.WithValue(ctx, tenantsKey, tenants)
+	ctx = context.WithValue(ctx, metricsKey, metrics)
+	ctx = context.WithValue(ctx, auditKey, audit)
+	ctx = context.WithValue(ctx, backfill, newBackfillJobs())
+	ctx = context.WithValue(ctx, eventsKey, events)
+	ctx = context.WithValue(ctx, mqttKey, mq)
+	ctx = context.WithValue(ctx, forwardKey, forward)
+	ctx = context.WithValue(ctx, rollupsKey, ru)
+	ctx = context.WithValue(ctx, usersKey, users)
+	ctx = context.WithValue(ctx, oidcKey, oidc)
+	ctx = context.WithValue(ctx, drainKey, &drainState{})
+	ctx = context.WithValue(ctx, logLevelKey, newLogLevelControl(cfg.LogLevel))
+	ctx = context.WithValue(ctx, diskKey, guard)
+	ctx = context.WithValue(ctx, idempotency, idem)
+	return &http.Server{
+		Addr:    addr,
+		Handler: withAPIVersion(withRequestTrace(cfg, withServerTime(withRecovery(panics, withCORS(cfg, mux))))),
+		BaseContext: func(_ net.Listener) context.Context {
+			return ctx
+		},
+	}, nil
+}
 
-	if err := writeApi.WritePoint(context.Background(), p1, p2); err != nil {
-		log.Println(err)
+func getRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
 	}
+	w.Write([]byte("Welcome"))
+}
 
-	if msg, err := json.Marshal(map[string]string{"status": "ok"}); err != nil {
+// writeJSON marshals v and writes it as the response body
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	msg, err := json.Marshal(v)
+	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("500 - Something bad happened!"))
-	} else {
-		w.Write(msg)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(msg)
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// ended maintenance windows are kept this long for the admin listing
+const maintenanceHistory = 7 * 24 * time.Hour
+
+// maintenanceWindow silences the alerts of one node, or of every node of the
+// tenant when Node is empty, from Start to End. Data is still ingested, its
+// points tagged with the id of the window as maintenance, and events still
+// become annotations, but they do not reach Grafana, alerts or bursts.
+type maintenanceWindow struct {
+	ID      string    `json:"id"`
+	Node    string    `json:"node,omitempty"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func (mw *maintenanceWindow) covers(node string, at time.Time) bool {
+	return (mw.Node == "" || mw.Node == node) && !at.Before(mw.Start) && at.Before(mw.End)
+}
+
+// maintenanceStore holds the maintenance windows of a tenant in memory
+type maintenanceStore struct {
+	mu      sync.RWMutex
+	windows []*maintenanceWindow
+}
+
+func newMaintenanceStore() *maintenanceStore {
+	return &maintenanceStore{}
+}
+
+func (s *maintenanceStore) add(mw maintenanceWindow) maintenanceWindow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mw.ID = newJobID()
+	mw.Created = time.Now()
+	kept := s.windows[:0]
+	for _, w := range s.windows {
+		if time.Since(w.End) < maintenanceHistory {
+			kept = append(kept, w)
+		}
+	}
+	s.windows = append(kept, &mw)
+	return mw
+}
+
+// remove ends a window early by forgetting it
+func (s *maintenanceStore) remove(id string) (maintenanceWindow, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, w := range s.windows {
+		if w.ID == id {
+			s.windows = append(s.windows[:i], s.windows[i+1:]...)
+			return *w, true
+		}
+	}
+	return maintenanceWindow{}, false
+}
+
+// active returns the id of a window covering node at the given time, empty
+// when there is none
+func (s *maintenanceStore) active(node string, at time.Time) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, w := range s.windows {
+		if w.covers(node, at) {
+			return w.ID
+		}
+	}
+	return ""
+}
+
+// label tags the points of node written during a window
+func (s *maintenanceStore) label(node string, points []*write.Point) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.windows) == 0 {
+		return
+	}
+	for _, p := range points {
+		for _, w := range s.windows {
+			if w.covers(node, p.Time()) {
+				p.AddTag("maintenance", w.ID)
+				break
+			}
+		}
+	}
+}
+
+func (s *maintenanceStore) list() []maintenanceWindow {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []maintenanceWindow{}
+	for _, w := range s.windows {
+		list = append(list, *w)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	return list
+}
+
+// adminMaintenance lists (GET) and schedules (POST) the maintenance windows
+// of a tenant; DELETE /admin/maintenance/{id} removes one
+func adminMaintenance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	reg := ctx.Value(key("tenants")).(*tenantRegistry)
+	audit := ctx.Value(key("audit")).(*auditLog)
+
+	t := reg.byName(r.URL.Query().Get("tenant"))
+	if t == nil {
+		http.Error(w, "404 - Unknown tenant", http.StatusNotFound)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/maintenance"), "/")
+
+	switch {
+	case r.Method == "GET" && id == "":
+		writeJSON(w, map[string]interface{}{"windows": t.maintenance.list()})
+	case r.Method == "POST" && id == "":
+		var req struct {
+			Node   string `json:"node"`
+			Start  string `json:"start"`
+			End    string `json:"end"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "400 - Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if req.Node != "" {
+			if err := validNode(req.Node); err != nil {
+				http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		now := time.Now()
+		start, err := parseTimeParam(req.Start, now)
+		if err != nil {
+			http.Error(w, "400 - invalid start", http.StatusBadRequest)
+			return
+		}
+		end, err := parseTimeParam(req.End, time.Time{})
+		if err != nil || !end.After(start) || !end.After(now) {
+			http.Error(w, "400 - end must be a future time after start, e.g. \"2h\"", http.StatusBadRequest)
+			return
+		}
+		mw := t.maintenance.add(maintenanceWindow{Node: req.Node, Start: start, End: end, Reason: req.Reason})
+		audit.record(r, "schedule_maintenance", map[string]interface{}{
+			"tenant": t.Name,
+			"id":     mw.ID,
+			"node":   mw.Node,
+			"start":  mw.Start,
+			"end":    mw.End,
+			"reason": mw.Reason,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		msg, _ := json.Marshal(mw)
+		w.Write(msg)
+	case r.Method == "DELETE" && id != "":
+		mw, ok := t.maintenance.remove(id)
+		if !ok {
+			http.Error(w, "404 - Unknown maintenance window", http.StatusNotFound)
+			return
+		}
+		audit.record(r, "remove_maintenance", map[string]interface{}{
+			"tenant": t.Name,
+			"id":     mw.ID,
+			"node":   mw.Node,
+		})
+		writeJSON(w, mw)
+	default:
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Zeroconf: with MDNS set the server advertises itself on the local network
+// as an instance of _sensorserver._tcp, so nodes can look up the ingest URL
+// instead of having it built into the firmware of each site. The instance
+// points to the server's host name and port, its TXT record carries the
+// ingest path and API version.
+
+const (
+	mdnsService = "_sensorserver._tcp.local."
+	mdnsTTL     = 120
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+type mdnsResponder struct {
+	conn     *net.UDPConn
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+	txt      []string
+}
+
+// newMDNSResponder joins the mDNS group for the service on port, named
+// after the host unless name is set
+func newMDNSResponder(name string, port int) (*mdnsResponder, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	hostname = strings.TrimSuffix(strings.SplitN(hostname, ".", 2)[0], ".")
+	if name == "" {
+		name = hostname
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, err
+	}
+	m := &mdnsResponder{conn: conn, port: uint16(port), txt: []string{"path=" + apiPrefix + "/data", "version=" + apiVersion}}
+	// a dot would split the instance label
+	if m.instance, err = dnsmessage.NewName(strings.ReplaceAll(name, ".", "-") + "." + mdnsService); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if m.host, err = dnsmessage.NewName(hostname + ".local."); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// run announces the service and answers queries for it
+func (m *mdnsResponder) run() {
+	log.Printf("mdns: advertising %s at %s:%d\n", m.instance, m.host, m.port)
+	go func() {
+		// announced twice as RFC 6762 asks, a second apart
+		for i := 0; i < 2; i++ {
+			m.send(m.answer(0, nil), mdnsGroup)
+			time.Sleep(time.Second)
+		}
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("mdns: %s\n", err)
+			return
+		}
+		var p dnsmessage.Parser
+		header, err := p.Start(buf[:n])
+		if err != nil || header.Response {
+			continue
+		}
+		questions, err := p.AllQuestions()
+		if err != nil {
+			continue
+		}
+		var asked []dnsmessage.Question
+		for _, q := range questions {
+			if m.answers(q) {
+				asked = append(asked, q)
+			}
+		}
+		if len(asked) == 0 {
+			continue
+		}
+		// queries from ports other than 5353 are one-shot and answered by
+		// unicast, repeating the ID and the questions
+		if src.Port != mdnsGroup.Port {
+			m.send(m.answer(header.ID, asked), src)
+		} else {
+			m.send(m.answer(0, nil), mdnsGroup)
+		}
+	}
+}
+
+// answers tells whether q asks for one of the records of the service
+func (m *mdnsResponder) answers(q dnsmessage.Question) bool {
+	name := strings.ToLower(q.Name.String())
+	switch {
+	case name == mdnsService:
+		return q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL
+	case name == strings.ToLower(m.instance.String()):
+		return q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeTXT || q.Type == dnsmessage.TypeALL
+	case name == strings.ToLower(m.host.String()):
+		return q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL
+	}
+	return false
+}
+
+// answer builds a response with every record of the service, the address
+// records of the host from its interfaces
+func (m *mdnsResponder) answer(id uint16, questions []dnsmessage.Question) []byte {
+	service, _ := dnsmessage.NewName(mdnsService)
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	for _, q := range questions {
+		b.Question(q)
+	}
+	b.StartAnswers()
+	// class IN, the top bit tells caches to replace what they hold
+	flush := dnsmessage.Class(0x8000) | dnsmessage.ClassINET
+	b.PTRResource(dnsmessage.ResourceHeader{Name: service, Class: dnsmessage.ClassINET, TTL: mdnsTTL}, dnsmessage.PTRResource{PTR: m.instance})
+	b.SRVResource(dnsmessage.ResourceHeader{Name: m.instance, Class: flush, TTL: mdnsTTL}, dnsmessage.SRVResource{Target: m.host, Port: m.port})
+	b.TXTResource(dnsmessage.ResourceHeader{Name: m.instance, Class: flush, TTL: mdnsTTL}, dnsmessage.TXTResource{TXT: m.txt})
+	for _, ip := range localIPv4s() {
+		var a dnsmessage.AResource
+		copy(a.A[:], ip)
+		b.AResource(dnsmessage.ResourceHeader{Name: m.host, Class: flush, TTL: mdnsTTL}, a)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		log.Printf("mdns: %s\n", err)
+	}
+	return msg
+}
+
+func (m *mdnsResponder) send(msg []byte, to *net.UDPAddr) {
+	if msg == nil {
+		return
+	}
+	if _, err := m.conn.WriteToUDP(msg, to); err != nil {
+		log.Printf("mdns: %s\n", err)
+	}
+}
+
+// localIPv4s returns the IPv4 addresses of the interfaces that are up,
+// other than loopback
+func localIPv4s() []net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				ips = append(ips, ipnet.IP.To4())
+			}
+		}
+	}
+	return ips
+}
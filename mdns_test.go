@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testResponder(t *testing.T) *mdnsResponder {
+	t.Helper()
+	m := &mdnsResponder{port: 8080, txt: []string{"path=/v1/data", "version=1"}}
+	var err error
+	if m.instance, err = dnsmessage.NewName("lab-gw." + mdnsService); err != nil {
+		t.Fatal(err)
+	}
+	if m.host, err = dnsmessage.NewName("lab-gw.local."); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMDNSAnswers(t *testing.T) {
+	m := testResponder(t)
+	// a one-shot query as RFC 1035 lays it out: ID 0x1234, one question for
+	// the PTR records (12) of _sensorserver._tcp.local in class IN
+	query := mustHex(t, "1234 0000 0001 0000 0000 0000"+
+		"0d 5f73656e736f72736572766572 04 5f746370 05 6c6f63616c 00"+
+		"000c 0001")
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	questions, err := p.AllQuestions()
+	if err != nil || len(questions) != 1 {
+		t.Fatalf("questions = %v, %v", questions, err)
+	}
+	if header.ID != 0x1234 || !m.answers(questions[0]) {
+		t.Fatalf("query %+v for %v is not answered", header, questions[0])
+	}
+
+	tests := []struct {
+		name string
+		typ  dnsmessage.Type
+		want bool
+	}{
+		{"_sensorserver._tcp.local.", dnsmessage.TypePTR, true},
+		{"_sensorserver._tcp.local.", dnsmessage.TypeSRV, false},
+		{"lab-gw._sensorserver._tcp.local.", dnsmessage.TypeSRV, true},
+		{"LAB-GW._sensorserver._tcp.local.", dnsmessage.TypeTXT, true},
+		{"lab-gw.local.", dnsmessage.TypeA, true},
+		{"lab-gw.local.", dnsmessage.TypeAAAA, false},
+		{"lab-gw.local.", dnsmessage.TypeALL, true},
+		{"_http._tcp.local.", dnsmessage.TypePTR, false},
+	}
+	for _, tt := range tests {
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(tt.name), Type: tt.typ, Class: dnsmessage.ClassINET}
+		if got := m.answers(q); got != tt.want {
+			t.Errorf("answers(%s %s) = %v, want %v", tt.name, tt.typ, got, tt.want)
+		}
+	}
+
+	var r dnsmessage.Parser
+	res, err := r.Start(m.answer(header.ID, questions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != 0x1234 || !res.Response || !res.Authoritative {
+		t.Errorf("response header = %+v", res)
+	}
+	if echoed, err := r.AllQuestions(); err != nil || !reflect.DeepEqual(echoed, questions) {
+		t.Errorf("response questions = %v, %v, want %v", echoed, err, questions)
+	}
+	answers, err := r.AllAnswers()
+	if err != nil || len(answers) < 3 {
+		t.Fatalf("answers = %v, %v", answers, err)
+	}
+	ptr, ok := answers[0].Body.(*dnsmessage.PTRResource)
+	if !ok || ptr.PTR != m.instance {
+		t.Errorf("first answer = %v, want a PTR to %s", answers[0], m.instance)
+	}
+	srv, ok := answers[1].Body.(*dnsmessage.SRVResource)
+	if !ok || srv.Target != m.host || srv.Port != 8080 || answers[1].Header.Class != dnsmessage.Class(0x8000)|dnsmessage.ClassINET {
+		t.Errorf("second answer = %v, want a cache flushing SRV to %s:8080", answers[1], m.host)
+	}
+	txt, ok := answers[2].Body.(*dnsmessage.TXTResource)
+	if !ok || !reflect.DeepEqual(txt.TXT, m.txt) {
+		t.Errorf("third answer = %v, want the TXT %v", answers[2], m.txt)
+	}
+	for _, a := range answers[3:] {
+		if _, ok := a.Body.(*dnsmessage.AResource); !ok || a.Header.Name != m.host {
+			t.Errorf("answer %v is not an A record of %s", a, m.host)
+		}
+	}
+}
+
+func TestMDNSAnnouncement(t *testing.T) {
+	m := testResponder(t)
+	var r dnsmessage.Parser
+	res, err := r.Start(m.answer(0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	questions, _ := r.AllQuestions()
+	if res.ID != 0 || !res.Response || len(questions) != 0 {
+		t.Errorf("announcement header = %+v with questions %v, want ID 0 without questions", res, questions)
+	}
+}
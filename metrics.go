@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricsRegistry renders the Prometheus text exposition format from
+// collectors that report the current values of each subsystem on scrape
+type metricsRegistry struct {
+	mu         sync.Mutex
+	collectors []func(mw *metricWriter)
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{}
+}
+
+func (m *metricsRegistry) register(collect func(mw *metricWriter)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, collect)
+}
+
+// metricWriter writes metric families, each sample after the family header
+type metricWriter struct {
+	w io.Writer
+}
+
+// family starts a metric family of the given type (counter, gauge, ...)
+func (mw *metricWriter) family(name string, typ string, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one value of name with labels given as name, value pairs
+func (mw *metricWriter) sample(name string, value float64, labels ...string) {
+	io.WriteString(mw.w, name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+		}
+		io.WriteString(mw.w, "{"+strings.Join(pairs, ",")+"}")
+	}
+	io.WriteString(mw.w, " "+strconv.FormatFloat(value, 'g', -1, 64)+"\n")
+}
+
+// histogram counts observations in cumulative buckets of upper bounds
+type histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write writes the _bucket, _sum and _count samples of name, the family
+// header must have been written before
+func (h *histogram) write(mw *metricWriter, name string, labels ...string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	labels = labels[:len(labels):len(labels)]
+	for i, b := range h.bounds {
+		mw.sample(name+"_bucket", float64(counts[i]), append(labels, "le", strconv.FormatFloat(b, 'g', -1, 64))...)
+	}
+	mw.sample(name+"_bucket", float64(count), append(labels, "le", "+Inf")...)
+	mw.sample(name+"_sum", sum, labels...)
+	mw.sample(name+"_count", float64(count), labels...)
+}
+
+// withMonitoring guards the endpoints showing the usage, nodes and write
+// state of every tenant: they take METRICS_TOKEN or ADMIN_TOKEN as a bearer
+// token, or a principal that may read, an admin when there are tenants
+func withMonitoring(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := r.Context().Value(key("config")).(*config)
+		reg := r.Context().Value(key("tenants")).(*tenantRegistry)
+		token := bearerToken(r)
+		for _, t := range []string{cfg.MetricsToken, cfg.AdminToken} {
+			if t != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		p, _, err := authenticate(r, cfg, reg)
+		if err != nil {
+			challengeBasic(w, cfg)
+			http.Error(w, "401 - "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		perm := permRead
+		if reg.single == nil {
+			perm = permAdmin
+		}
+		if !p.can(perm) && p.anonymous {
+			challengeBasic(w, cfg)
+			http.Error(w, "401 - Credentials required", http.StatusUnauthorized)
+			return
+		}
+		if !p.can(perm) {
+			http.Error(w, fmt.Sprintf("403 - Role %s may not %s", p.Role, perm), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	m := r.Context().Value(key("metrics")).(*metricsRegistry)
+	m.mu.Lock()
+	collectors := append([]func(mw *metricWriter){}, m.collectors...)
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := &metricWriter{w: w}
+	for _, collect := range collectors {
+		collect(mw)
+	}
+}
+
+// sortedTenants returns the tenants ordered by name for stable output
+func sortedTenants(reg *tenantRegistry) []*tenant {
+	tenants := reg.all()
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Name < tenants[j].Name })
+	return tenants
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Modbus TCP polling for transmitters that only speak Modbus: every device of
+// MODBUS_FILE is read on its own interval, holding or input registers mapped
+// to schema fields, and each poll is stored as a reading of the device's node
+// taken at the server's time. Fields the schema lacks are added like those of
+// JSON_FIELDS_FILE, with a measurement.
+
+const (
+	modbusTimeout         = 5 * time.Second
+	modbusDefaultInterval = 10 * time.Second
+	// registers of one read request, as the protocol allows
+	modbusMaxRegisters = 125
+)
+
+// modbusRegister maps one value of a device to a schema field
+type modbusRegister struct {
+	Field       string `json:"field"`
+	Measurement string `json:"measurement"`
+	Address     uint16 `json:"address"`
+	// "holding", the default, or "input"
+	Table string `json:"table"`
+	// uint16, the default, int16, uint32, int32 or float32
+	Type string `json:"type"`
+	// 32 bit values send the high word first unless swap_words is set
+	SwapWords bool     `json:"swap_words"`
+	Scale     *float64 `json:"scale"`
+	Offset    float64  `json:"offset"`
+}
+
+type modbusDevice struct {
+	Node      string           `json:"node"`
+	Address   string           `json:"address"`
+	Unit      uint8            `json:"unit"`
+	Interval  string           `json:"interval"`
+	Tenant    string           `json:"tenant"`
+	Registers []modbusRegister `json:"registers"`
+
+	interval time.Duration
+}
+
+type modbusFile struct {
+	Devices []*modbusDevice `json:"devices"`
+}
+
+// words the value of r spans
+func (r modbusRegister) words() uint16 {
+	if r.Type == "" || r.Type == "uint16" || r.Type == "int16" {
+		return 1
+	}
+	return 2
+}
+
+func (r modbusRegister) function() byte {
+	if r.Table == "input" {
+		return 4
+	}
+	return 3
+}
+
+// value decodes the words of r
+func (r modbusRegister) value(words []uint16) float64 {
+	var v float64
+	hi, lo := uint32(words[0]), uint32(0)
+	if len(words) > 1 {
+		lo = uint32(words[1])
+		if r.SwapWords {
+			hi, lo = lo, hi
+		}
+	}
+	switch r.Type {
+	case "", "uint16":
+		v = float64(words[0])
+	case "int16":
+		v = float64(int16(words[0]))
+	case "uint32":
+		v = float64(hi<<16 | lo)
+	case "int32":
+		v = float64(int32(hi<<16 | lo))
+	case "float32":
+		v = float64(math.Float32frombits(hi<<16 | lo))
+	}
+	scale := 1.0
+	if r.Scale != nil {
+		scale = *r.Scale
+	}
+	return v*scale + r.Offset
+}
+
+// loadModbusDevices reads the devices of path and adds their fields to the
+// schema
+func loadModbusDevices(path string, schema *sensorSchema) ([]*modbusDevice, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file modbusFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	nodes := make(map[string]bool)
+	for i, d := range file.Devices {
+		if !nodePattern.MatchString(d.Node) {
+			return nil, fmt.Errorf("device %d: invalid node %q", i, d.Node)
+		}
+		if nodes[d.Node] {
+			return nil, fmt.Errorf("device %q: node listed twice", d.Node)
+		}
+		nodes[d.Node] = true
+		if _, _, err := net.SplitHostPort(d.Address); err != nil {
+			return nil, fmt.Errorf("device %q: address must be host:port", d.Node)
+		}
+		d.interval = modbusDefaultInterval
+		if d.Interval != "" {
+			if d.interval, err = time.ParseDuration(d.Interval); err != nil || d.interval <= 0 {
+				return nil, fmt.Errorf("device %q: invalid interval %q", d.Node, d.Interval)
+			}
+		}
+		if len(d.Registers) == 0 {
+			return nil, fmt.Errorf("device %q: no registers", d.Node)
+		}
+		for _, r := range d.Registers {
+			switch r.Type {
+			case "", "uint16", "int16", "uint32", "int32", "float32":
+			default:
+				return nil, fmt.Errorf("device %q: field %q: unknown type %q", d.Node, r.Field, r.Type)
+			}
+			if r.Table != "" && r.Table != "holding" && r.Table != "input" {
+				return nil, fmt.Errorf("device %q: field %q: table must be holding or input", d.Node, r.Field)
+			}
+			if _, ok := schema.field(r.Field); ok {
+				continue
+			}
+			if r.Field == "" || r.Measurement == "" {
+				return nil, fmt.Errorf("device %q: field %q is not in the schema, measurement is required", d.Node, r.Field)
+			}
+			schema.addField(sensorField{Measurement: r.Measurement, Name: r.Field, Optional: true})
+		}
+	}
+	return file.Devices, nil
+}
+
+// modbusPoller reads one device
+type modbusPoller struct {
+	device *modbusDevice
+	tenant *tenant
+	sink   *pollSink
+
+	conn net.Conn
+	txID uint16
+	// last poll failed, so only the recovery is logged
+	failing bool
+
+	polls, failures atomic.Int64
+}
+
+// modbusPollers are the pollers of every device, for the metrics
+type modbusPollers []*modbusPoller
+
+func newModbusPollers(devices []*modbusDevice, reg *tenantRegistry, sink *pollSink) (modbusPollers, error) {
+	var pollers modbusPollers
+	for _, d := range devices {
+		t := reg.byName(d.Tenant)
+		if t == nil {
+			return nil, fmt.Errorf("modbus device %q: unknown tenant %q", d.Node, d.Tenant)
+		}
+		pollers = append(pollers, &modbusPoller{device: d, tenant: t, sink: sink})
+	}
+	return pollers, nil
+}
+
+func (p *modbusPoller) run() {
+	log.Printf("modbus: polling %s at %s every %s\n", p.device.Node, p.device.Address, p.device.interval)
+	for range time.Tick(p.device.interval) {
+		if !p.sink.active() {
+			continue
+		}
+		p.polls.Add(1)
+		err := p.poll()
+		if err != nil {
+			p.failures.Add(1)
+			if !p.failing {
+				log.Printf("modbus: polling %s: %s\n", p.device.Node, err)
+			}
+		} else if p.failing {
+			log.Printf("modbus: polling %s again\n", p.device.Node)
+		}
+		p.failing = err != nil
+	}
+}
+
+// poll reads every register of the device and stores them as one reading
+func (p *modbusPoller) poll() error {
+	if p.conn == nil {
+		conn, err := net.DialTimeout("tcp", p.device.Address, modbusTimeout)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+	}
+	rd := reading{Values: make(map[string]float64, len(p.device.Registers))}
+	for _, span := range modbusSpans(p.device.Registers) {
+		words, err := p.read(span.function, span.start, span.count)
+		if err != nil {
+			// the next poll starts over on a new connection
+			p.conn.Close()
+			p.conn = nil
+			return fmt.Errorf("reading %d registers at %d: %w", span.count, span.start, err)
+		}
+		for _, r := range span.registers {
+			off := r.Address - span.start
+			rd.Values[r.Field] = r.value(words[off : off+r.words()])
+		}
+	}
+	rd.Time = time.Now()
+	return p.sink.store(context.Background(), p.tenant, p.device.Node, rd)
+}
+
+// modbusSpan is one read request covering neighbouring registers
+type modbusSpan struct {
+	function     byte
+	start, count uint16
+	registers    []modbusRegister
+}
+
+// modbusSpans groups the registers into as few reads as fit the protocol
+func modbusSpans(registers []modbusRegister) []modbusSpan {
+	sorted := append([]modbusRegister(nil), registers...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].function() != sorted[j].function() {
+			return sorted[i].function() < sorted[j].function()
+		}
+		return sorted[i].Address < sorted[j].Address
+	})
+	var spans []modbusSpan
+	for _, r := range sorted {
+		end := uint32(r.Address) + uint32(r.words())
+		if n := len(spans); n > 0 && spans[n-1].function == r.function() && end-uint32(spans[n-1].start) <= modbusMaxRegisters {
+			s := &spans[n-1]
+			if c := uint16(end - uint32(s.start)); c > s.count {
+				s.count = c
+			}
+			s.registers = append(s.registers, r)
+			continue
+		}
+		spans = append(spans, modbusSpan{function: r.function(), start: r.Address, count: r.words(), registers: []modbusRegister{r}})
+	}
+	return spans
+}
+
+var modbusExceptions = map[byte]string{
+	1:  "illegal function",
+	2:  "illegal data address",
+	3:  "illegal data value",
+	4:  "server device failure",
+	6:  "server device busy",
+	10: "gateway path unavailable",
+	11: "gateway target device failed to respond",
+}
+
+// read sends a read holding (3) or input (4) registers request
+func (p *modbusPoller) read(function byte, start, count uint16) ([]uint16, error) {
+	p.txID++
+	req := make([]byte, 12)
+	binary.BigEndian.PutUint16(req[0:], p.txID)
+	// protocol 0, then the length of what follows the length
+	binary.BigEndian.PutUint16(req[4:], 6)
+	req[6] = p.device.Unit
+	req[7] = function
+	binary.BigEndian.PutUint16(req[8:], start)
+	binary.BigEndian.PutUint16(req[10:], count)
+
+	p.conn.SetDeadline(time.Now().Add(modbusTimeout))
+	if _, err := p.conn.Write(req); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(p.conn, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint16(header[4:])
+	if length < 3 || length > 256 {
+		return nil, fmt.Errorf("invalid response length %d", length)
+	}
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(p.conn, pdu); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(header[0:]) != p.txID {
+		return nil, errors.New("response to another request")
+	}
+	if pdu[0] == function|0x80 {
+		if msg, ok := modbusExceptions[pdu[1]]; ok {
+			return nil, fmt.Errorf("exception %d, %s", pdu[1], msg)
+		}
+		return nil, fmt.Errorf("exception %d", pdu[1])
+	}
+	if pdu[0] != function || int(pdu[1]) != 2*int(count) || len(pdu) < 2+int(pdu[1]) {
+		return nil, errors.New("malformed response")
+	}
+	words := make([]uint16, count)
+	for i := range words {
+		words[i] = binary.BigEndian.Uint16(pdu[2+2*i:])
+	}
+	return words, nil
+}
+
+func collectModbus(pollers modbusPollers) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		mw.family("sensor_modbus_polls_total", "counter", "Modbus polls by device and outcome.")
+		for _, p := range pollers {
+			failed := p.failures.Load()
+			mw.sample("sensor_modbus_polls_total", float64(p.polls.Load()-failed), "node", p.device.Node, "result", "ok")
+			mw.sample("sensor_modbus_polls_total", float64(failed), "node", p.device.Node, "result", "error")
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// modbusServer answers the one request it expects on a pipe with response,
+// both without the transaction ID
+func modbusServer(t *testing.T, request, response []byte) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer server.Close()
+		req := make([]byte, 2+len(request))
+		if _, err := io.ReadFull(server, req); err != nil {
+			return
+		}
+		if !bytes.Equal(req[2:], request) {
+			t.Errorf("request = % X, want % X", req[2:], request)
+			return
+		}
+		server.Write(append(req[:2:2], response...))
+	}()
+	return client
+}
+
+func TestModbusRead(t *testing.T) {
+	// the read holding registers example of the Modbus application protocol
+	// specification: registers 108 to 110 hold 555, 0 and 100
+	request := mustHex(t, "0000 0006 11 03 006B 0003")
+	tests := []struct {
+		name     string
+		response string
+		want     []uint16
+		wantErr  string
+	}{
+		{"registers", "0000 0009 11 03 06 022B 0000 0064", []uint16{555, 0, 100}, ""},
+		{"exception", "0000 0003 11 83 02", nil, "exception 2, illegal data address"},
+		{"unknown exception", "0000 0003 11 83 07", nil, "exception 7"},
+		{"short count", "0000 0007 11 03 04 022B 0000", nil, "malformed response"},
+		{"invalid length", "0000 0001 11", nil, "invalid response length 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &modbusPoller{device: &modbusDevice{Unit: 0x11}, conn: modbusServer(t, request, mustHex(t, tt.response))}
+			got, err := p.read(3, 0x6B, 3)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("read error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("read = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModbusRegisterValue(t *testing.T) {
+	scale := 0.1
+	tests := []struct {
+		reg   modbusRegister
+		words []uint16
+		want  float64
+	}{
+		{modbusRegister{}, []uint16{555}, 555},
+		{modbusRegister{Type: "int16"}, []uint16{0xFFFE}, -2},
+		{modbusRegister{Type: "int16", Scale: &scale, Offset: -40}, []uint16{0x0271}, 22.5},
+		{modbusRegister{Type: "uint32"}, []uint16{0x0001, 0x0002}, 65538},
+		{modbusRegister{Type: "uint32", SwapWords: true}, []uint16{0x0002, 0x0001}, 65538},
+		{modbusRegister{Type: "int32"}, []uint16{0xFFFF, 0xFFFF}, -1},
+		// IEEE 754: 0x41200000 is 10, 0xC0490FDB is -pi as float32
+		{modbusRegister{Type: "float32"}, []uint16{0x4120, 0x0000}, 10},
+		{modbusRegister{Type: "float32", SwapWords: true}, []uint16{0x0000, 0x4120}, 10},
+		{modbusRegister{Type: "float32"}, []uint16{0xC049, 0x0FDB}, float64(float32(-3.14159265))},
+	}
+	for _, tt := range tests {
+		got := tt.reg.value(tt.words)
+		if diff := got - tt.want; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("%+v.value(%04X) = %v, want %v", tt.reg, tt.words, got, tt.want)
+		}
+	}
+}
+
+func TestModbusSpans(t *testing.T) {
+	registers := []modbusRegister{
+		{Field: "a", Address: 10},
+		{Field: "b", Address: 11, Type: "float32"},
+		{Field: "c", Address: 0, Table: "input"},
+		{Field: "d", Address: 200},
+		{Field: "e", Address: 5},
+	}
+	type span struct {
+		function     byte
+		start, count uint16
+	}
+	var got []span
+	for _, s := range modbusSpans(registers) {
+		got = append(got, span{s.function, s.start, s.count})
+	}
+	// 5 to 12 fit one read, 200 is past the 125 registers a read may span
+	want := []span{{3, 5, 8}, {3, 200, 1}, {4, 0, 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("modbusSpans = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// readings waiting to be published before new ones are dropped
+const mqttQueueSize = 10000
+
+// mqttMessage is a reading on its way to the broker
+type mqttMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+// mqttPublisher publishes written readings to an MQTT broker so displays and
+// actuators can follow live data without querying InfluxDB. Messages are
+// sent from a queue, ingest never waits for the broker; while it is
+// unreachable the client reconnects and readings beyond the queue are
+// dropped. A nil publisher publishes nothing.
+//
+// The newest reading of each node is also published retained to the latest
+// topic, so consumers get the current values as soon as they subscribe.
+type mqttPublisher struct {
+	client      mqtt.Client
+	topic       string
+	latestTopic string
+	qos         byte
+	queue       chan mqttMessage
+	// announces the fields of nodes to Home Assistant, see homeassistant.go
+	discovery *haDiscovery
+
+	mu sync.Mutex
+	// time of the reading last published to the latest topic, by tenant
+	// and node, so late readings do not replace newer ones
+	latest map[string]time.Time
+
+	published atomic.Int64
+	dropped   atomic.Int64
+}
+
+func newMQTTPublisher(cfg *config) *mqttPublisher {
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.MQTTBroker).
+		SetClientID(cfg.MQTTClientID).
+		SetUsername(cfg.MQTTUsername).
+		SetPassword(cfg.MQTTPassword).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10 * time.Second).
+		SetOnConnectHandler(func(mqtt.Client) {
+			log.Printf("mqtt: connected to %s\n", cfg.MQTTBroker)
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("mqtt: connection lost: %s\n", err)
+		})
+
+	p := &mqttPublisher{
+		client:      mqtt.NewClient(opts),
+		topic:       cfg.MQTTTopic,
+		latestTopic: cfg.MQTTLatestTopic,
+		qos:         byte(cfg.MQTTQoS),
+		queue:       make(chan mqttMessage, mqttQueueSize),
+		latest:      make(map[string]time.Time),
+	}
+	if cfg.HADiscovery {
+		p.discovery = newHADiscovery(cfg)
+	}
+	// with connect retry the token only completes once connected, run
+	// publishes the queue meanwhile
+	p.client.Connect()
+	return p
+}
+
+// topicFor fills the {tenant} and {node} placeholders of the topic
+func (p *mqttPublisher) topicFor(t *tenant, node string) string {
+	return fillTopic(p.topic, t, node)
+}
+
+// stateTopic is where the current values of node are found, the retained
+// latest topic unless it is disabled
+func (p *mqttPublisher) stateTopic(t *tenant, node string) string {
+	if p.latestTopic != "" {
+		return fillTopic(p.latestTopic, t, node)
+	}
+	return p.topicFor(t, node)
+}
+
+func fillTopic(topic string, t *tenant, node string) string {
+	return strings.NewReplacer("{tenant}", t.Name, "{node}", node).Replace(topic)
+}
+
+// publish queues the readings of node, one message each, and the newest of
+// them to the latest topic
+func (p *mqttPublisher) publish(t *tenant, node string, readings ...reading) {
+	if p == nil {
+		return
+	}
+	topic := p.topicFor(t, node)
+	var newest *reading
+	for i, rd := range readings {
+		p.discovery.announce(p, t, node, rd)
+		payload, err := json.Marshal(rd)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		p.enqueue(mqttMessage{topic: topic, payload: payload})
+		if newest == nil || rd.Time.After(newest.Time) {
+			newest = &readings[i]
+		}
+	}
+	if p.latestTopic != "" && newest != nil {
+		p.publishLatest(t, node, *newest)
+	}
+}
+
+// publishLatest queues rd retained to the latest topic of node unless a
+// newer reading was published there
+func (p *mqttPublisher) publishLatest(t *tenant, node string, rd reading) {
+	k := t.Name + "/" + node
+	p.mu.Lock()
+	if last, ok := p.latest[k]; ok && rd.Time.Before(last) {
+		p.mu.Unlock()
+		return
+	}
+	p.latest[k] = rd.Time
+	p.mu.Unlock()
+
+	payload, err := json.Marshal(rd)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	p.enqueue(mqttMessage{topic: fillTopic(p.latestTopic, t, node), payload: payload, retained: true})
+}
+
+// enqueue queues m unless the queue is full
+func (p *mqttPublisher) enqueue(m mqttMessage) bool {
+	select {
+	case p.queue <- m:
+		return true
+	default:
+		p.dropped.Add(1)
+		return false
+	}
+}
+
+// run sends queued messages to the broker
+func (p *mqttPublisher) run() {
+	for m := range p.queue {
+		token := p.client.Publish(m.topic, p.qos, m.retained, m.payload)
+		if p.qos > 0 && !token.WaitTimeout(30*time.Second) {
+			log.Printf("mqtt: publish to %s timed out\n", m.topic)
+			p.dropped.Add(1)
+			continue
+		}
+		if err := token.Error(); err != nil {
+			log.Printf("mqtt: publish to %s: %s\n", m.topic, err)
+			p.dropped.Add(1)
+			continue
+		}
+		p.published.Add(1)
+	}
+}
+
+func collectMQTT(p *mqttPublisher) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		mw.family("sensor_mqtt_published_total", "counter", "Readings published to the MQTT broker.")
+		mw.sample("sensor_mqtt_published_total", float64(p.published.Load()))
+		mw.family("sensor_mqtt_dropped_total", "counter", "Readings not published because the queue was full or the broker failed.")
+		mw.sample("sensor_mqtt_dropped_total", float64(p.dropped.Load()))
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a node is considered offline when nothing was received for this long
+const nodeOfflineAfter = 5 * time.Minute
+
+type nodeStatus struct {
+	Node     string    `json:"node"`
+	LastSeen time.Time `json:"last_seen"`
+	Online   bool      `json:"online"`
+	Latest   reading   `json:"latest"`
+	// smoothed difference between receive time and node timestamps,
+	// positive when the node clock is behind
+	ClockOffset float64 `json:"clock_offset_seconds"`
+	// last device health values, see battery.go
+	Battery    *float64 `json:"battery_voltage,omitempty"`
+	RSSI       *float64 `json:"rssi,omitempty"`
+	LowBattery bool     `json:"low_battery"`
+	// format of the last payload, see payload.go
+	PayloadVersion int `json:"payload_version,omitempty"`
+	// frames that failed their checksum, see checksum.go
+	CorruptedFrames int64 `json:"corrupted_frames,omitempty"`
+	// last report to the diagnostics endpoint, see diagnostics.go
+	Diagnostics *nodeDiagnostics `json:"diagnostics,omitempty"`
+	// last check-in without data, see heartbeat.go
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	// last derived rates of change per minute, see rates.go
+	Rates map[string]float64 `json:"rates_per_minute,omitempty"`
+	// seconds between reports the node was last told, see adaptive.go
+	ReportInterval int `json:"report_interval_seconds,omitempty"`
+	// indicators of the last full SHM window, see shm.go
+	SHM *shmResult `json:"shm,omitempty"`
+	// natural frequencies of SHM_FIELDS against their baseline, see
+	// frequency.go
+	Frequencies map[string]frequencyTrack `json:"natural_frequencies,omitempty"`
+	// loss statistics of numbered submissions, see sequence.go
+	Sequence *sequenceStats `json:"sequence,omitempty"`
+	// ingest requests since the server started, see linkquality.go
+	LinkQuality *linkQuality `json:"link_quality,omitempty"`
+
+	clockOffset time.Duration
+	clockKnown  bool
+
+	// parsed and rejected records since the server started
+	recordsParsed   int64
+	recordsRejected int64
+
+	quality nodeQuality
+	// ingest requests since the last link_quality point
+	link linkWindow
+
+	// reading the next rates are derived against
+	rateBase reading
+	// readings of the current SHM window
+	shm shmWindow
+	// recent accelerometer samples and the peak capture in progress
+	peak peakCapture
+}
+
+// nodeStore keeps the last reading received from every node in memory
+type nodeStore struct {
+	mu    sync.RWMutex
+	nodes map[string]*nodeStatus
+
+	// latest readings shared with other instances under the tenant
+	// namespace, see redis.go
+	shared    *redisClient
+	namespace string
+
+	// online state of every node last seen by the outage watcher, also of
+	// the nodes only other instances heard of
+	outages map[string]*onlineState
+}
+
+type onlineState struct {
+	reported    bool
+	wasReported bool
+}
+
+func newNodeStore() *nodeStore {
+	return &nodeStore{nodes: make(map[string]*nodeStatus), outages: make(map[string]*onlineState)}
+}
+
+func (s *nodeStore) update(node string, rd reading) {
+	now := time.Now()
+	s.mu.Lock()
+	n := s.get(node)
+	n.LastSeen = now
+	n.Latest = rd
+	s.mu.Unlock()
+
+	if s.shared != nil {
+		s.publishLatest(node, now, rd)
+	}
+}
+
+// observeVersion remembers the payload format of node, to tell which nodes
+// still run old firmware
+func (s *nodeStore) observeVersion(node string, version int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.get(node).PayloadVersion = version
+}
+
+// get returns the entry of node, creating it if needed. s.mu must be held.
+func (s *nodeStore) get(node string) *nodeStatus {
+	n, ok := s.nodes[node]
+	if !ok {
+		n = &nodeStatus{Node: node}
+		s.nodes[node] = n
+	}
+	return n
+}
+
+// observeClock folds one measured clock offset of node into its moving
+// average and returns the new estimate, smoothing out network latency
+func (s *nodeStore) observeClock(node string, offset time.Duration) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.get(node)
+	if !n.clockKnown {
+		n.clockOffset = offset
+		n.clockKnown = true
+	} else {
+		n.clockOffset += (offset - n.clockOffset) / 10
+	}
+	n.ClockOffset = n.clockOffset.Seconds()
+	return n.clockOffset
+}
+
+// observeRate returns the rates of change per minute of fields between the
+// previous reading of node and rd, and keeps rd as the next base. Readings
+// out of order are skipped, readings more than maxGap apart start over.
+func (s *nodeStore) observeRate(node string, rd reading, fields []string, maxGap time.Duration) map[string]float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.get(node)
+	base := n.rateBase
+	if !rd.Time.After(base.Time) {
+		return nil
+	}
+	n.rateBase = rd
+	dt := rd.Time.Sub(base.Time)
+	if base.Time.IsZero() || dt > maxGap {
+		return nil
+	}
+
+	rates := make(map[string]float64)
+	for _, f := range fields {
+		v, ok := rd.Values[f]
+		prev, okPrev := base.Values[f]
+		if ok && okPrev {
+			rates[f] = (v - prev) / dt.Minutes()
+		}
+	}
+	if len(rates) > 0 {
+		n.Rates = rates
+	}
+	return rates
+}
+
+// countRecords adds the outcome of parsing one payload of node
+func (s *nodeStore) countRecords(node string, parsed int, rejected int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.get(node)
+	n.recordsParsed += int64(parsed)
+	n.recordsRejected += int64(rejected)
+}
+
+// records returns the parsed and rejected record counts of node
+func (s *nodeStore) records(node string) (parsed int64, rejected int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if n, ok := s.nodes[node]; ok {
+		return n.recordsParsed, n.recordsRejected
+	}
+	return 0, 0
+}
+
+type onlineTransition struct {
+	node   string
+	online bool
+}
+
+// onlineTransitions returns the nodes that went offline or came back online
+// since the previous call, by when any instance last heard from them
+func (s *nodeStore) onlineTransitions() []onlineTransition {
+	lastSeen := make(map[string]time.Time)
+	if s.shared != nil {
+		for node, sl := range s.sharedLatest() {
+			lastSeen[node] = sl.LastSeen
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, n := range s.nodes {
+		if n.LastSeen.After(lastSeen[n.Node]) {
+			lastSeen[n.Node] = n.LastSeen
+		}
+	}
+	var list []onlineTransition
+	for node, seen := range lastSeen {
+		if seen.IsZero() {
+			continue
+		}
+		st, ok := s.outages[node]
+		if !ok {
+			st = &onlineState{}
+			s.outages[node] = st
+		}
+		online := time.Since(seen) < nodeOfflineAfter
+		if online != st.reported {
+			st.reported = online
+			// a node seen for the first time is not an outage recovery
+			if online && !st.wasReported {
+				st.wasReported = true
+				continue
+			}
+			st.wasReported = true
+			list = append(list, onlineTransition{node, online})
+		}
+	}
+	return list
+}
+
+// list returns a snapshot of all known nodes sorted by name
+func (s *nodeStore) list() []nodeStatus {
+	var shared map[string]sharedLatest
+	if s.shared != nil {
+		shared = s.sharedLatest()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]nodeStatus, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		status := *n
+		// the node last reported to another instance
+		if sl, ok := shared[n.Node]; ok && sl.LastSeen.After(status.LastSeen) {
+			status.LastSeen = sl.LastSeen
+			status.Latest = reading{Time: sl.Time, Values: sl.Values}
+		}
+		delete(shared, n.Node)
+		status.Online = time.Since(status.LastSeen) < nodeOfflineAfter
+		list = append(list, status)
+	}
+	// and the nodes only other instances heard of
+	for node, sl := range shared {
+		list = append(list, nodeStatus{
+			Node:     node,
+			LastSeen: sl.LastSeen,
+			Online:   time.Since(sl.LastSeen) < nodeOfflineAfter,
+			Latest:   reading{Time: sl.Time, Values: sl.Values},
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Node < list[j].Node })
+	return list
+}
+
+func getNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	format, ok := responseFormat(r)
+	if !ok {
+		http.Error(w, "406 - Supported formats are json, csv and ndjson", http.StatusNotAcceptable)
+		return
+	}
+
+	t := r.Context().Value(key("tenant")).(*tenant)
+	cfg := r.Context().Value(key("config")).(*config)
+	scope := requestScope(r.Context())
+	lowBattery := r.URL.Query().Get("low_battery") == "true"
+	nodes := []nodeStatus{}
+	for _, n := range t.nodes.list() {
+		if scope.allows(n.Node) && (!lowBattery || n.LowBattery) {
+			nodes = append(nodes, n)
+		}
+	}
+
+	// dashboards poll this endpoint, let them skip unchanged responses
+	if notModified(w, r, format, nodes) {
+		return
+	}
+
+	if format == formatJSON {
+		writeJSON(w, map[string]interface{}{"nodes": nodes})
+		return
+	}
+
+	// flat rows for the tabular formats
+	columns := []string{"node", "online", "last_seen", "clock_offset_seconds", "battery_voltage", "rssi", "low_battery", "time"}
+	for _, f := range cfg.Schema.Fields {
+		if !contains(columns, f.Name) {
+			columns = append(columns, f.Name)
+		}
+	}
+	rows := make([]map[string]interface{}, len(nodes))
+	for i, n := range nodes {
+		rows[i] = map[string]interface{}{}
+		for name, v := range n.Latest.Values {
+			rows[i][name] = v
+		}
+		rows[i]["node"] = n.Node
+		rows[i]["online"] = n.Online
+		rows[i]["last_seen"] = n.LastSeen
+		rows[i]["clock_offset_seconds"] = n.ClockOffset
+		rows[i]["low_battery"] = n.LowBattery
+		rows[i]["time"] = n.Latest.Time
+		if n.Battery != nil {
+			rows[i]["battery_voltage"] = *n.Battery
+		}
+		if n.RSSI != nil {
+			rows[i]["rssi"] = *n.RSSI
+		}
+	}
+	if format == formatCSV {
+		writeCSV(w, columns, rows)
+	} else {
+		writeNDJSON(w, rows)
+	}
+}
+
+// notModified sets the ETag and Last-Modified headers of a node listing and
+// answers 304 when the client already has this version
+func notModified(w http.ResponseWriter, r *http.Request, format string, nodes []nodeStatus) bool {
+	h := fnv.New64a()
+	io.WriteString(h, format)
+	var lastModified time.Time
+	for _, n := range nodes {
+		fmt.Fprintf(h, "|%s,%d,%t", n.Node, n.LastSeen.UnixNano(), n.Online)
+		if n.LastSeen.After(lastModified) {
+			lastModified = n.LastSeen
+		}
+	}
+	etag := fmt.Sprintf(`"%x"`, h.Sum64())
+
+	w.Header().Set("ETag", etag)
+	// always revalidate, the listing changes with every post
+	w.Header().Set("Cache-Control", "no-cache")
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			if tag = strings.TrimSpace(tag); tag == etag || tag == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.IsZero() {
+		if !lastModified.Truncate(time.Second).After(ims) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
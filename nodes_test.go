@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOnlineTransitions(t *testing.T) {
+	s := newNodeStore()
+	s.update("n1", reading{})
+	// a node seen for the first time is not an outage recovery
+	if got := s.onlineTransitions(); len(got) != 0 {
+		t.Fatalf("transitions of a new node = %v, want none", got)
+	}
+
+	s.nodes["n1"].LastSeen = time.Now().Add(-nodeOfflineAfter)
+	if got, want := s.onlineTransitions(), []onlineTransition{{"n1", false}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("transitions of a silent node = %v, want %v", got, want)
+	}
+	if got := s.onlineTransitions(); len(got) != 0 {
+		t.Errorf("outage reported again: %v", got)
+	}
+
+	s.update("n1", reading{})
+	if got, want := s.onlineTransitions(), []onlineTransition{{"n1", true}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("transitions of a returning node = %v, want %v", got, want)
+	}
+}
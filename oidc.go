@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a login at the provider has to finish within this time
+const oidcLoginTimeout = 10 * time.Minute
+
+// the cookie holding the state and nonce of a login in progress, which ties
+// the callback to the browser that started the login
+const oidcLoginCookie = "oidc_login"
+
+// Single sign-on: with OIDC_ISSUER set, GET /login/oidc sends dashboard users
+// to the provider and /login/oidc/callback starts a session for them, like a
+// password login does. ID tokens of the provider are also accepted as bearer
+// tokens of the API. The groups of OIDC_GROUPS_CLAIM map to roles through
+// OIDC_ROLE_GROUPS, the most privileged role wins.
+
+// parseRoleGroups reads "lab-admins=admin,lab-staff=operator"
+func parseRoleGroups(v string) (map[string]string, error) {
+	groups := make(map[string]string)
+	for _, entry := range splitList(v) {
+		group, role, _ := strings.Cut(entry, "=")
+		if group == "" || !validRole(role) {
+			return nil, fmt.Errorf("invalid OIDC_ROLE_GROUPS: expected group=role, got %q", entry)
+		}
+		groups[group] = role
+	}
+	return groups, nil
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider talks to the identity provider of OIDC_ISSUER
+type oidcProvider struct {
+	cfg  *config
+	http *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	fetched   time.Time
+}
+
+func newOIDCProvider(cfg *config) *oidcProvider {
+	return &oidcProvider{
+		cfg:  cfg,
+		http: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (o *oidcProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := o.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// discover reads the provider configuration once
+func (o *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	o.mu.Lock()
+	d := o.discovery
+	o.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+	d = &oidcDiscovery{}
+	if err := o.getJSON(ctx, strings.TrimSuffix(o.cfg.OIDCIssuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != o.cfg.OIDCIssuer {
+		return nil, fmt.Errorf("provider reports issuer %q instead of %q", d.Issuer, o.cfg.OIDCIssuer)
+	}
+	o.mu.Lock()
+	o.discovery = d
+	o.mu.Unlock()
+	return d, nil
+}
+
+// signingKey returns the key kid of the provider, reloading the key set for
+// unknown ids at most once a minute
+func (o *oidcProvider) signingKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	o.mu.Lock()
+	k, ok := o.keys[kid]
+	stale := time.Since(o.fetched) > time.Minute
+	o.mu.Unlock()
+	if ok {
+		return k, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	d, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range set.Keys {
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if jwk.Kty != "RSA" || errN != nil || errE != nil {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	o.mu.Lock()
+	o.keys, o.fetched = keys, time.Now()
+	o.mu.Unlock()
+	if k, ok := keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// idClaims are the claims read from ID tokens, the groups are looked up by
+// OIDC_GROUPS_CLAIM
+type idClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	ExpiresAt         int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	PreferredUsername string          `json:"preferred_username"`
+	Email             string          `json:"email"`
+
+	raw map[string]interface{}
+}
+
+func (c *idClaims) name() string {
+	switch {
+	case c.PreferredUsername != "":
+		return c.PreferredUsername
+	case c.Email != "":
+		return c.Email
+	}
+	return c.Subject
+}
+
+func (c *idClaims) hasAudience(aud string) bool {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == aud
+	}
+	var many []string
+	json.Unmarshal(c.Audience, &many)
+	return contains(many, aud)
+}
+
+// groupsClaim reads the groups claim of raw, a list or a single string
+func groupsClaim(raw map[string]interface{}, name string) []string {
+	switch v := raw[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var groups []string
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// role maps groups to the most privileged role, OIDC_DEFAULT_ROLE when none
+// matches
+func (o *oidcProvider) role(groups []string) string {
+	role := o.cfg.OIDCDefaultRole
+	for _, g := range groups {
+		if r, ok := o.cfg.OIDCRoleGroups[g]; ok && len(rolePermissions[r]) > len(rolePermissions[role]) {
+			role = r
+		}
+	}
+	return role
+}
+
+// verify checks the RS256 signature, issuer, audience and expiry of an ID
+// token, and its nonce unless empty
+func (o *oidcProvider) verify(ctx context.Context, token, nonce string) (*idClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	var h struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "RS256" {
+		return nil, errors.New("unsupported token algorithm")
+	}
+	pub, err := o.signingKey(ctx, h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	claims := &idClaims{}
+	if json.Unmarshal(payload, claims) != nil || json.Unmarshal(payload, &claims.raw) != nil {
+		return nil, errors.New("malformed token")
+	}
+	switch {
+	case claims.Issuer != o.cfg.OIDCIssuer:
+		return nil, errors.New("token of another issuer")
+	case !claims.hasAudience(o.cfg.OIDCClientID):
+		return nil, errors.New("token of another client")
+	case claims.ExpiresAt == 0 || time.Now().Unix() >= claims.ExpiresAt:
+		return nil, errors.New("token expired")
+	case nonce != "" && claims.Nonce != nonce:
+		return nil, errors.New("token of another login")
+	}
+	return claims, nil
+}
+
+// principal turns a bearer ID token into the principal of a request
+func (o *oidcProvider) principal(ctx context.Context, token string) (*principal, error) {
+	claims, err := o.verify(ctx, token, "")
+	if err != nil {
+		return nil, err
+	}
+	role := o.role(groupsClaim(claims.raw, o.cfg.OIDCGroupsClaim))
+	if role == "" {
+		return nil, errors.New("no role for the groups of the token")
+	}
+	return &principal{Name: claims.name(), Role: role}, nil
+}
+
+// getOIDCLogin redirects to the login page of the provider
+func getOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	o, _ := r.Context().Value(key("oidc")).(*oidcProvider)
+	if o == nil {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+	d, err := o.discover(r.Context())
+	if err != nil {
+		log.Printf("oidc: %s\n", err)
+		http.Error(w, "502 - Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// kept by the browser only, so logins that are never finished cost
+	// nothing; Lax, as the provider redirects back from another site
+	state, nonce := newJobID()+newJobID(), newJobID()+newJobID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    state + "." + nonce,
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.cfg.OIDCClientID},
+		"redirect_uri":  {o.cfg.OIDCRedirectURL},
+		"scope":         {strings.Join(o.cfg.OIDCScopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// getOIDCCallback exchanges the code of a finished login for the ID token
+// and starts a session with the role of its groups
+func getOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	cfg := ctx.Value(key("config")).(*config)
+	users := ctx.Value(key("users")).(*userStore)
+	o, _ := ctx.Value(key("oidc")).(*oidcProvider)
+	if o == nil {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "401 - Login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+	// the login can only be finished by the browser that started it
+	var state, nonce string
+	if c, err := r.Cookie(oidcLoginCookie); err == nil {
+		state, nonce, _ = strings.Cut(c.Value, ".")
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookie,
+		Path:     "/login/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if state == "" || nonce == "" || subtle.ConstantTimeCompare([]byte(state), []byte(q.Get("state"))) != 1 {
+		http.Error(w, "400 - Unknown or expired login, start again at /login/oidc", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := o.exchange(ctx, q.Get("code"), nonce)
+	if err != nil {
+		log.Printf("oidc: %s\n", err)
+		http.Error(w, "401 - Login failed", http.StatusUnauthorized)
+		return
+	}
+	role := o.role(groupsClaim(claims.raw, cfg.OIDCGroupsClaim))
+	if role == "" {
+		http.Error(w, "403 - None of your groups has access", http.StatusForbidden)
+		return
+	}
+	u := &user{Username: claims.name(), Role: role, Tenant: cfg.OIDCTenant}
+	if _, _, err := startSession(w, r, cfg, users, u); err != nil {
+		http.Error(w, "500 - Something bad happened!", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/dashboard/", http.StatusSeeOther)
+}
+
+// exchange redeems a code at the token endpoint and verifies the ID token.
+// Groups missing from the token are read from the userinfo endpoint.
+func (o *oidcProvider) exchange(ctx context.Context, code, nonce string) (*idClaims, error) {
+	d, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {o.cfg.OIDCRedirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.cfg.OIDCClientID), url.QueryEscape(o.cfg.OIDCClientSecret))
+	res, err := o.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var tokens struct {
+		IDToken     string `json:"id_token"`
+		AccessToken string `json:"access_token"`
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint answered %s", res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	claims, err := o.verify(ctx, tokens.IDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := claims.raw[o.cfg.OIDCGroupsClaim]; !ok && d.UserinfoEndpoint != "" && tokens.AccessToken != "" {
+		req, err := http.NewRequestWithContext(ctx, "GET", d.UserinfoEndpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		res, err := o.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		var info map[string]interface{}
+		if res.StatusCode == http.StatusOK && json.NewDecoder(res.Body).Decode(&info) == nil && info["sub"] == claims.Subject {
+			claims.raw[o.cfg.OIDCGroupsClaim] = info[o.cfg.OIDCGroupsClaim]
+		}
+	}
+	return claims, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the RS256 example of RFC 7515, appendix A.2, and the modulus of its key
+const (
+	rfc7515RSAModulus = "ofgWCuLjybRlzo0tZWJjNiuSfb4p4fAkd_wWJcyQoTbji9k0l8W26mPddxHmfHQp-Vaw-4qPCJrcS2mJPMEzP1Pt0Bm4d4QlL-yRT-SFd2lZS-pCgNMsD1W_YpRPEwOWvG6b32690r2jZ47soMZo9wGzjb_7OMg0LOL-bSf63kpaSHSXndS5z5rexMdbBYUsLA9e-KXBdQOS-UTo7WTBEMa2R2CapHg665xsmtdVMTBQY4uDZlxvb3qCo5ZwKh9kG4LT6_I5IhlJH7aGhyxXFvUK-DWNmoudF8NAco9_h9iaGNj8q2ethFkMLs91kzk2PAcDTW9gb54h4FRWyuXpoQ"
+	rfc7515RSAToken   = "eyJhbGciOiJSUzI1NiJ9" +
+		".eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ" +
+		".cC4hiUPoj9Eetdgtv3hF80EGrhuB__dzERat0XF9g2VtQgr9PJbu3XOiZj5RZmh7AAuHIm4Bh-0Qc_lF5YKt_O8W2Fp5jujGbds9uJdbF9CUAr7t1dnZcAcQjbKBYNX4BAynRFdiuB--f_nZLgrnbyTyWzO75vRK5h6xBArLIARNPvkSjtQBMHlb1L07Qe7K0GarZRmB_eSN9383LcOLn6_dO--xi12jzDwusC-eOkHWEsqtFZESc6BfI7noOPqvhJ1phCnvWh6IeYI2w9QOYEUipUTI8np6LbgGY9Fs98rqVt5AXLIhWkWywlVmtVrBp0igcN_IoypGlUPQGe77Rw"
+)
+
+// testProvider serves the discovery document and key set of an issuer
+// signing with key, which also carries the RFC 7515 key without an id
+func testProvider(t *testing.T, key *rsa.PrivateKey) *oidcProvider {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(oidcDiscovery{Issuer: srv.URL, JWKSURI: srv.URL + "/keys"})
+		case "/keys":
+			e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+				{"kty": "RSA", "kid": "", "n": rfc7515RSAModulus, "e": "AQAB"},
+				{"kty": "RSA", "kid": "test", "n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()), "e": e},
+				{"kty": "EC", "kid": "ec"},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return newOIDCProvider(&config{
+		OIDCIssuer:      srv.URL,
+		OIDCClientID:    "sensor-server",
+		OIDCGroupsClaim: "groups",
+		OIDCRoleGroups:  map[string]string{"lab-admins": "admin", "lab-staff": "operator"},
+		OIDCDefaultRole: "viewer",
+	})
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCVerifyExample(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := testProvider(t, key)
+	// issued by joe, the key set stays that of the test provider
+	o.discovery = &oidcDiscovery{Issuer: "joe", JWKSURI: o.cfg.OIDCIssuer + "/keys"}
+	o.cfg.OIDCIssuer = "joe"
+
+	// the signature holds, the example has no audience
+	if _, err := o.verify(context.Background(), rfc7515RSAToken, ""); err == nil || err.Error() != "token of another client" {
+		t.Errorf("verify of the RFC 7515 example = %v, want token of another client", err)
+	}
+	tampered := strings.Replace(rfc7515RSAToken, ".cC4hiUPoj9", ".cC4hiUPoj8", 1)
+	if _, err := o.verify(context.Background(), tampered, ""); err == nil || err.Error() != "invalid token signature" {
+		t.Errorf("verify of a tampered signature = %v, want invalid token signature", err)
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := testProvider(t, key)
+	iss := o.cfg.OIDCIssuer
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := func(edit func(c map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{"iss": iss, "sub": "u1", "aud": "sensor-server", "exp": exp, "nonce": "n1", "email": "u1@example.com"}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		nonce   string
+		wantErr string
+	}{
+		{"valid", signRS256(t, key, "test", claims(nil)), "n1", ""},
+		{"nonce not checked", signRS256(t, key, "test", claims(nil)), "", ""},
+		{"audience list", signRS256(t, key, "test", claims(func(c map[string]interface{}) { c["aud"] = []string{"other", "sensor-server"} })), "n1", ""},
+		{"another login", signRS256(t, key, "test", claims(nil)), "n2", "token of another login"},
+		{"another client", signRS256(t, key, "test", claims(func(c map[string]interface{}) { c["aud"] = "other" })), "", "token of another client"},
+		{"another issuer", signRS256(t, key, "test", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example" })), "", "token of another issuer"},
+		{"expired", signRS256(t, key, "test", claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() })), "", "token expired"},
+		{"another key", signRS256(t, other, "test", claims(nil)), "", "invalid token signature"},
+		{"unknown key", signRS256(t, key, "gone", claims(nil)), "", `unknown signing key "gone"`},
+		{"HS256", rfc7515Token, "", "unsupported token algorithm"},
+		{"malformed", "a.b", "", "malformed token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := o.verify(context.Background(), tt.token, tt.nonce)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("verify: %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Fatalf("verify error = %v, want %s", err, tt.wantErr)
+			case tt.wantErr == "" && c.name() != "u1@example.com":
+				t.Errorf("name = %q, want u1@example.com", c.name())
+			}
+		})
+	}
+}
+
+func TestOIDCPrincipal(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := testProvider(t, key)
+	tests := []struct {
+		groups interface{}
+		role   string
+	}{
+		{nil, "viewer"},
+		{"lab-staff", "operator"},
+		{[]string{"lab-staff", "lab-admins", "visitors"}, "admin"},
+		{[]string{"visitors"}, "viewer"},
+	}
+	for _, tt := range tests {
+		c := map[string]interface{}{"iss": o.cfg.OIDCIssuer, "sub": "u1", "preferred_username": "ana", "aud": "sensor-server", "exp": time.Now().Add(time.Hour).Unix()}
+		if tt.groups != nil {
+			c["groups"] = tt.groups
+		}
+		p, err := o.principal(context.Background(), signRS256(t, key, "test", c))
+		if err != nil {
+			t.Fatalf("principal for groups %v: %v", tt.groups, err)
+		}
+		if p.Name != "ana" || p.Role != tt.role {
+			t.Errorf("principal for groups %v = %s as %s, want ana as %s", tt.groups, p.Name, p.Role, tt.role)
+		}
+	}
+
+	o.cfg.OIDCDefaultRole = ""
+	c := map[string]interface{}{"iss": o.cfg.OIDCIssuer, "sub": "u1", "aud": "sensor-server", "exp": time.Now().Add(time.Hour).Unix()}
+	if _, err := o.principal(context.Background(), signRS256(t, key, "test", c)); err == nil {
+		t.Error("principal without a role succeeded")
+	}
+}
+
+func TestParseRoleGroups(t *testing.T) {
+	groups, err := parseRoleGroups("lab-admins=admin, lab-staff=operator")
+	if err != nil || groups["lab-admins"] != "admin" || groups["lab-staff"] != "operator" {
+		t.Errorf("parseRoleGroups = %v, %v", groups, err)
+	}
+	for _, v := range []string{"lab-admins", "=admin", "lab-admins=root"} {
+		if _, err := parseRoleGroups(v); err == nil {
+			t.Errorf("parseRoleGroups(%q) succeeded", v)
+		}
+	}
+}
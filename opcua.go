@@ -0,0 +1,1087 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// OPC UA subscriptions for PLC-instrumented rigs: the server opens a session
+// to every endpoint of OPCUA_FILE, subscribes to the value of its configured
+// node IDs and stores each change as a field of the endpoint's node, at the
+// source timestamp the PLC gave it. Only the binary protocol with security
+// policy None and anonymous login is spoken, so the PLC network should be
+// trusted. Sessions are reopened from scratch when they fail and before the
+// secure channel would expire.
+
+const (
+	opcuaSecurityNone     = "http://opcfoundation.org/UA/SecurityPolicy#None"
+	opcuaDefaultPort      = "4840"
+	opcuaDefaultInterval  = time.Second
+	opcuaRetry            = 5 * time.Second
+	opcuaTimeout          = 10 * time.Second
+	opcuaKeepAliveCount   = 10
+	opcuaChannelLifetime  = time.Hour
+	opcuaSessionTimeout   = time.Minute
+	opcuaMaxMessageLength = 1 << 24
+)
+
+// binary encoding IDs, namespace 0, of the structures exchanged
+const (
+	opcuaServiceFault                 = 397
+	opcuaAnonymousIdentityToken       = 321
+	opcuaOpenSecureChannelRequest     = 446
+	opcuaOpenSecureChannelResponse    = 449
+	opcuaCreateSessionRequest         = 461
+	opcuaCreateSessionResponse        = 464
+	opcuaActivateSessionRequest       = 467
+	opcuaActivateSessionResponse      = 470
+	opcuaCloseSessionRequest          = 473
+	opcuaCloseSessionResponse         = 476
+	opcuaCreateMonitoredItemsRequest  = 751
+	opcuaCreateMonitoredItemsResponse = 754
+	opcuaCreateSubscriptionRequest    = 787
+	opcuaCreateSubscriptionResponse   = 790
+	opcuaDataChangeNotification       = 811
+	opcuaPublishRequest               = 826
+	opcuaPublishResponse              = 829
+)
+
+// the Value attribute of a node
+const opcuaAttributeValue uint32 = 13
+
+var opcuaStatusNames = map[uint32]string{
+	0x800A0000: "BadTimeout",
+	0x801F0000: "BadUserAccessDenied",
+	0x80200000: "BadIdentityTokenInvalid",
+	0x80250000: "BadSessionIdInvalid",
+	0x80330000: "BadNodeIdInvalid",
+	0x80340000: "BadNodeIdUnknown",
+	0x80350000: "BadAttributeIdInvalid",
+	0x80550000: "BadSecurityPolicyRejected",
+	0x80560000: "BadTooManySessions",
+}
+
+func opcuaStatus(code uint32) string {
+	if name, ok := opcuaStatusNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("status 0x%08X", code)
+}
+
+// bad status codes have the top bit set, uncertain ones are kept
+func opcuaBad(code uint32) bool {
+	return code&0x80000000 != 0
+}
+
+type opcuaItem struct {
+	NodeID      string `json:"node_id"`
+	Field       string `json:"field"`
+	Measurement string `json:"measurement"`
+
+	encoded []byte
+}
+
+type opcuaServer struct {
+	Endpoint string `json:"endpoint"`
+	Node     string `json:"node"`
+	Tenant   string `json:"tenant"`
+	// publishing interval of the subscription
+	Interval string      `json:"interval"`
+	Items    []opcuaItem `json:"items"`
+
+	address  string
+	interval time.Duration
+}
+
+type opcuaFile struct {
+	Servers []*opcuaServer `json:"servers"`
+}
+
+// loadOPCUAServers reads the endpoints of path and adds their fields to the
+// schema
+func loadOPCUAServers(path string, schema *sensorSchema) ([]*opcuaServer, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file opcuaFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i, s := range file.Servers {
+		if !nodePattern.MatchString(s.Node) {
+			return nil, fmt.Errorf("server %d: invalid node %q", i, s.Node)
+		}
+		u, err := url.Parse(s.Endpoint)
+		if err != nil || u.Scheme != "opc.tcp" || u.Hostname() == "" {
+			return nil, fmt.Errorf("server %q: endpoint must be opc.tcp://host[:port][/path]", s.Node)
+		}
+		port := u.Port()
+		if port == "" {
+			port = opcuaDefaultPort
+		}
+		s.address = net.JoinHostPort(u.Hostname(), port)
+		s.interval = opcuaDefaultInterval
+		if s.Interval != "" {
+			if s.interval, err = time.ParseDuration(s.Interval); err != nil || s.interval <= 0 {
+				return nil, fmt.Errorf("server %q: invalid interval %q", s.Node, s.Interval)
+			}
+		}
+		if len(s.Items) == 0 {
+			return nil, fmt.Errorf("server %q: no items", s.Node)
+		}
+		for j := range s.Items {
+			it := &s.Items[j]
+			if it.encoded, err = parseNodeID(it.NodeID); err != nil {
+				return nil, fmt.Errorf("server %q: node ID %q: %w", s.Node, it.NodeID, err)
+			}
+			if _, ok := schema.field(it.Field); ok {
+				continue
+			}
+			if it.Field == "" || it.Measurement == "" {
+				return nil, fmt.Errorf("server %q: field %q is not in the schema, measurement is required", s.Node, it.Field)
+			}
+			schema.addField(sensorField{Measurement: it.Measurement, Name: it.Field, Optional: true})
+		}
+	}
+	return file.Servers, nil
+}
+
+// parseNodeID encodes a node ID in the string notation, e.g. "i=2258",
+// "ns=2;s=Rig.Load", "ns=3;g=<guid>" or "ns=1;b=<base64>"
+func parseNodeID(s string) ([]byte, error) {
+	var ns uint64
+	if strings.HasPrefix(s, "ns=") {
+		i := strings.IndexByte(s, ';')
+		if i < 0 {
+			return nil, errors.New("expected ns=<index>;<id>")
+		}
+		var err error
+		if ns, err = strconv.ParseUint(s[3:i], 10, 16); err != nil {
+			return nil, errors.New("invalid namespace index")
+		}
+		s = s[i+1:]
+	}
+	if len(s) < 2 || s[1] != '=' {
+		return nil, errors.New("expected i=, s=, g= or b=")
+	}
+	var e opcuaEncoder
+	id := s[2:]
+	switch s[0] {
+	case 'i':
+		n, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, errors.New("invalid numeric identifier")
+		}
+		e.numericNodeID(uint16(ns), uint32(n))
+	case 's':
+		e.u8(0x03)
+		e.u16(uint16(ns))
+		e.str(id)
+	case 'g':
+		raw, err := parseGUID(id)
+		if err != nil {
+			return nil, err
+		}
+		e.u8(0x04)
+		e.u16(uint16(ns))
+		e.b = append(e.b, raw...)
+	case 'b':
+		raw, err := base64.StdEncoding.DecodeString(id)
+		if err != nil {
+			return nil, errors.New("invalid base64 identifier")
+		}
+		e.u8(0x05)
+		e.u16(uint16(ns))
+		e.byteString(raw)
+	default:
+		return nil, errors.New("expected i=, s=, g= or b=")
+	}
+	return e.b, nil
+}
+
+// parseGUID encodes a GUID, the first three groups little endian
+func parseGUID(s string) ([]byte, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 || len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return nil, errors.New("invalid GUID")
+	}
+	raw := make([]byte, 16)
+	d1, err1 := strconv.ParseUint(parts[0], 16, 32)
+	d2, err2 := strconv.ParseUint(parts[1], 16, 16)
+	d3, err3 := strconv.ParseUint(parts[2], 16, 16)
+	d4, err4 := strconv.ParseUint(parts[3]+parts[4], 16, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return nil, errors.New("invalid GUID")
+	}
+	binary.LittleEndian.PutUint32(raw[0:], uint32(d1))
+	binary.LittleEndian.PutUint16(raw[4:], uint16(d2))
+	binary.LittleEndian.PutUint16(raw[6:], uint16(d3))
+	binary.BigEndian.PutUint64(raw[8:], d4)
+	return raw, nil
+}
+
+// opcuaSubscriber keeps the subscription of one endpoint
+type opcuaSubscriber struct {
+	server *opcuaServer
+	tenant *tenant
+	sink   *pollSink
+	// last session failed, so only the recovery is logged
+	failing bool
+
+	values, failures atomic.Int64
+}
+
+type opcuaSubscribers []*opcuaSubscriber
+
+func newOPCUASubscribers(servers []*opcuaServer, reg *tenantRegistry, sink *pollSink) (opcuaSubscribers, error) {
+	var subs opcuaSubscribers
+	for _, s := range servers {
+		t := reg.byName(s.Tenant)
+		if t == nil {
+			return nil, fmt.Errorf("opc ua server %q: unknown tenant %q", s.Node, s.Tenant)
+		}
+		subs = append(subs, &opcuaSubscriber{server: s, tenant: t, sink: sink})
+	}
+	return subs, nil
+}
+
+func (s *opcuaSubscriber) run() {
+	log.Printf("opcua: subscribing to %d items of %s for %s\n", len(s.server.Items), s.server.Endpoint, s.server.Node)
+	for {
+		if !s.sink.active() {
+			time.Sleep(opcuaRetry)
+			continue
+		}
+		if err := s.session(); err != nil {
+			s.failures.Add(1)
+			if !s.failing {
+				log.Printf("opcua: %s: %s\n", s.server.Endpoint, err)
+			}
+			s.failing = true
+			time.Sleep(opcuaRetry)
+		}
+	}
+}
+
+// session subscribes and stores the changes until the connection fails, the
+// replica stops leading or the secure channel is due for renewal
+func (s *opcuaSubscriber) session() error {
+	c, err := dialOPCUA(s.server.address, s.server.Endpoint)
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+	if err := c.openSession(); err != nil {
+		return err
+	}
+	subscription, handles, err := c.subscribe(s.server)
+	if err != nil {
+		return err
+	}
+	if s.failing {
+		log.Printf("opcua: %s: subscribed again\n", s.server.Endpoint)
+		s.failing = false
+	}
+
+	renew := time.Now().Add(c.lifetime * 3 / 4)
+	wait := s.server.interval*opcuaKeepAliveCount + opcuaTimeout
+	var acks []uint32
+	for time.Now().Before(renew) && s.sink.active() {
+		changes, seq, err := c.publish(subscription, acks, wait)
+		if err != nil {
+			return err
+		}
+		acks = acks[:0]
+		if seq != 0 {
+			acks = append(acks, seq)
+		}
+		s.store(changes, handles)
+	}
+	c.closeSession()
+	return nil
+}
+
+// opcuaChange is a new value of the item with a client handle
+type opcuaChange struct {
+	handle uint32
+	value  float64
+	at     time.Time
+}
+
+// store writes the changes of a notification, one reading per timestamp
+func (s *opcuaSubscriber) store(changes []opcuaChange, handles map[uint32]*opcuaItem) {
+	byTime := make(map[int64]*reading)
+	var times []int64
+	for _, ch := range changes {
+		it, ok := handles[ch.handle]
+		if !ok {
+			continue
+		}
+		at := ch.at.UnixNano()
+		rd := byTime[at]
+		if rd == nil {
+			rd = &reading{Time: ch.at, Values: make(map[string]float64)}
+			byTime[at] = rd
+			times = append(times, at)
+		}
+		rd.Values[it.Field] = ch.value
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	for _, at := range times {
+		rd := byTime[at]
+		s.values.Add(int64(len(rd.Values)))
+		if err := s.sink.store(context.Background(), s.tenant, s.server.Node, *rd); err != nil {
+			log.Printf("opcua: storing %s: %s\n", s.server.Node, err)
+		}
+	}
+}
+
+func collectOPCUA(subs opcuaSubscribers) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		mw.family("sensor_opcua_values_total", "counter", "Value changes received from OPC UA servers.")
+		for _, s := range subs {
+			mw.sample("sensor_opcua_values_total", float64(s.values.Load()), "node", s.server.Node)
+		}
+		mw.family("sensor_opcua_session_failures_total", "counter", "OPC UA sessions that failed to open or broke off.")
+		for _, s := range subs {
+			mw.sample("sensor_opcua_session_failures_total", float64(s.failures.Load()), "node", s.server.Node)
+		}
+	}
+}
+
+// opcuaConn is a secure channel, with security None, and the session on it
+type opcuaConn struct {
+	conn     net.Conn
+	endpoint string
+
+	channel   uint32
+	token     uint32
+	seq       uint32
+	request   uint32
+	lifetime  time.Duration
+	authToken []byte
+}
+
+// dialOPCUA connects and exchanges hello and acknowledge
+func dialOPCUA(address, endpoint string) (*opcuaConn, error) {
+	conn, err := net.DialTimeout("tcp", address, opcuaTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &opcuaConn{conn: conn, endpoint: endpoint, authToken: []byte{0, 0}}
+	var e opcuaEncoder
+	e.u32(0) // protocol version
+	e.u32(65536)
+	e.u32(65536)
+	e.u32(opcuaMaxMessageLength)
+	e.u32(0) // any number of chunks
+	e.str(endpoint)
+	if err := c.writeChunk("HEL", e.b); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	typ, _, err := c.readChunk(opcuaTimeout)
+	if err == nil && typ != "ACK" {
+		err = fmt.Errorf("expected ACK, got %s", typ)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := c.openChannel(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *opcuaConn) writeChunk(typ string, body []byte) error {
+	msg := make([]byte, 8, 8+len(body))
+	copy(msg, typ)
+	msg[3] = 'F'
+	binary.LittleEndian.PutUint32(msg[4:], uint32(8+len(body)))
+	msg = append(msg, body...)
+	c.conn.SetWriteDeadline(time.Now().Add(opcuaTimeout))
+	_, err := c.conn.Write(msg)
+	return err
+}
+
+// readChunk reads one chunk and returns its type and what follows the header
+func (c *opcuaConn) readChunk(timeout time.Duration) (string, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return "", nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[4:])
+	if size < 8 || size > opcuaMaxMessageLength {
+		return "", nil, fmt.Errorf("invalid chunk size %d", size)
+	}
+	body := make([]byte, size-8)
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		return "", nil, err
+	}
+	typ := string(header[:3])
+	if typ == "ERR" {
+		r := opcuaDecoder{b: body}
+		code := r.u32()
+		reason := r.str()
+		return "", nil, fmt.Errorf("server error %s: %s", opcuaStatus(code), reason)
+	}
+	if header[3] == 'A' {
+		return "", nil, errors.New("server aborted the message")
+	}
+	if header[3] == 'C' {
+		typ = "C" + typ
+	}
+	return typ, body, nil
+}
+
+// requestHeader writes the fields every request starts with
+func (c *opcuaConn) requestHeader(e *opcuaEncoder, timeout time.Duration) {
+	e.b = append(e.b, c.authToken...)
+	e.dateTime(time.Now())
+	e.u32(c.request) // request handle
+	e.u32(0)         // no diagnostics
+	e.str("")
+	e.u32(uint32(timeout / time.Millisecond))
+	e.b = append(e.b, 0, 0, 0) // no additional header
+}
+
+// openChannel issues a secure channel with security None
+func (c *opcuaConn) openChannel() error {
+	c.request++
+	c.seq++
+	var e opcuaEncoder
+	e.u32(0) // no channel yet
+	e.str(opcuaSecurityNone)
+	e.byteString(nil) // no certificate
+	e.byteString(nil) // no thumbprint
+	e.u32(c.seq)
+	e.u32(c.request)
+	e.numericNodeID(0, opcuaOpenSecureChannelRequest)
+	c.requestHeader(&e, opcuaTimeout)
+	e.u32(0) // client protocol version
+	e.u32(0) // issue
+	e.u32(1) // security mode None
+	e.byteString([]byte{})
+	e.u32(uint32(opcuaChannelLifetime / time.Millisecond))
+	if err := c.writeChunk("OPN", e.b); err != nil {
+		return err
+	}
+	typ, body, err := c.readChunk(opcuaTimeout)
+	if err != nil {
+		return err
+	}
+	if typ != "OPN" {
+		return fmt.Errorf("expected OPN, got %s", typ)
+	}
+	r := opcuaDecoder{b: body}
+	r.u32() // channel ID
+	r.str() // security policy
+	r.byteString()
+	r.byteString()
+	r.u32() // sequence number
+	r.u32() // request ID
+	if err := r.response(opcuaOpenSecureChannelResponse); err != nil {
+		return err
+	}
+	r.u32() // server protocol version
+	c.channel = r.u32()
+	c.token = r.u32()
+	r.dateTime()
+	c.lifetime = time.Duration(r.u32()) * time.Millisecond
+	if c.lifetime <= 0 {
+		c.lifetime = opcuaChannelLifetime
+	}
+	return r.err
+}
+
+// call sends a request on the channel and returns the decoder of its
+// response, past the response header
+func (c *opcuaConn) call(request, response uint32, timeout time.Duration, fields func(e *opcuaEncoder)) (*opcuaDecoder, error) {
+	c.request++
+	c.seq++
+	var e opcuaEncoder
+	e.u32(c.channel)
+	e.u32(c.token)
+	e.u32(c.seq)
+	e.u32(c.request)
+	e.numericNodeID(0, request)
+	c.requestHeader(&e, timeout)
+	fields(&e)
+	if err := c.writeChunk("MSG", e.b); err != nil {
+		return nil, err
+	}
+	// the body of a message split over chunks is joined
+	var body []byte
+	for {
+		typ, chunk, err := c.readChunk(timeout + opcuaTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if typ != "MSG" && typ != "CMSG" {
+			return nil, fmt.Errorf("expected MSG, got %s", typ)
+		}
+		if len(chunk) < 16 {
+			return nil, errors.New("short message")
+		}
+		if binary.LittleEndian.Uint32(chunk[12:]) != c.request {
+			return nil, errors.New("response to another request")
+		}
+		body = append(body, chunk[16:]...)
+		if typ == "MSG" {
+			break
+		}
+	}
+	r := &opcuaDecoder{b: body}
+	if err := r.response(response); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// openSession creates and activates an anonymous session
+func (c *opcuaConn) openSession() error {
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+	r, err := c.call(opcuaCreateSessionRequest, opcuaCreateSessionResponse, opcuaTimeout, func(e *opcuaEncoder) {
+		// client description
+		e.str("urn:server-skripsi")
+		e.str("urn:server-skripsi")
+		e.u8(0x02)
+		e.str("server-skripsi")
+		e.u32(1) // client
+		e.str("")
+		e.str("")
+		e.i32(-1)
+
+		e.str("") // server URI
+		e.str(c.endpoint)
+		e.str("server-skripsi")
+		e.byteString(nonce)
+		e.byteString(nil)
+		e.f64(float64(opcuaSessionTimeout / time.Millisecond))
+		e.u32(0) // any response size
+	})
+	if err != nil {
+		return fmt.Errorf("creating session: %w", err)
+	}
+	r.nodeID() // session ID
+	start := r.off
+	r.nodeID()
+	token := append([]byte(nil), r.b[start:r.off]...)
+	r.f64()
+	r.byteString()
+	r.byteString()
+	policy := r.anonymousPolicy()
+	if r.err != nil {
+		return fmt.Errorf("creating session: %w", r.err)
+	}
+	c.authToken = token
+
+	_, err = c.call(opcuaActivateSessionRequest, opcuaActivateSessionResponse, opcuaTimeout, func(e *opcuaEncoder) {
+		e.str("") // no client signature
+		e.byteString(nil)
+		e.i32(-1) // no software certificates
+		e.i32(-1) // no locales
+		var token opcuaEncoder
+		token.str(policy)
+		e.numericNodeID(0, opcuaAnonymousIdentityToken)
+		e.u8(0x01)
+		e.byteString(token.b)
+		e.str("") // no token signature
+		e.byteString(nil)
+	})
+	if err != nil {
+		return fmt.Errorf("activating session: %w", err)
+	}
+	return nil
+}
+
+// closeSession ends the session and its subscription, errors are of no
+// consequence as the connection is dropped next
+func (c *opcuaConn) closeSession() {
+	c.call(opcuaCloseSessionRequest, opcuaCloseSessionResponse, opcuaTimeout, func(e *opcuaEncoder) {
+		e.u8(1) // delete subscriptions
+	})
+}
+
+// subscribe creates the subscription and the monitored items of the
+// values of s; items the server refuses are logged and left out
+func (c *opcuaConn) subscribe(s *opcuaServer) (uint32, map[uint32]*opcuaItem, error) {
+	r, err := c.call(opcuaCreateSubscriptionRequest, opcuaCreateSubscriptionResponse, opcuaTimeout, func(e *opcuaEncoder) {
+		e.f64(float64(s.interval) / float64(time.Millisecond))
+		e.u32(3 * opcuaKeepAliveCount) // lifetime count
+		e.u32(opcuaKeepAliveCount)
+		e.u32(0) // any notifications per publish
+		e.u8(1)  // publishing enabled
+		e.u8(0)  // priority
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("creating subscription: %w", err)
+	}
+	subscription := r.u32()
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+
+	r, err = c.call(opcuaCreateMonitoredItemsRequest, opcuaCreateMonitoredItemsResponse, opcuaTimeout, func(e *opcuaEncoder) {
+		e.u32(subscription)
+		e.u32(2) // source and server timestamps
+		e.i32(int32(len(s.Items)))
+		for i, it := range s.Items {
+			e.b = append(e.b, it.encoded...)
+			e.u32(opcuaAttributeValue)
+			e.str("") // index range
+			e.u16(0)  // default data encoding
+			e.str("")
+			e.u32(2) // reporting
+			e.u32(uint32(i + 1))
+			e.f64(-1) // sample at the publishing interval
+			e.b = append(e.b, 0, 0, 0)
+			e.u32(10) // queue size
+			e.u8(1)   // discard oldest
+		}
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("creating monitored items: %w", err)
+	}
+	handles := make(map[uint32]*opcuaItem)
+	n := int(r.i32())
+	for i := 0; i < n && r.err == nil; i++ {
+		status := r.u32()
+		r.u32() // monitored item ID
+		r.f64()
+		r.u32()
+		r.extensionObject()
+		if i >= len(s.Items) {
+			continue
+		}
+		if opcuaBad(status) {
+			log.Printf("opcua: %s: cannot monitor %s: %s\n", s.Endpoint, s.Items[i].NodeID, opcuaStatus(status))
+			continue
+		}
+		handles[uint32(i+1)] = &s.Items[i]
+	}
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	if len(handles) == 0 {
+		return 0, nil, errors.New("no item could be monitored")
+	}
+	return subscription, handles, nil
+}
+
+// publish waits for the next notification of the subscription,
+// acknowledging the sequence numbers acks, and returns its value changes
+// with its sequence number, 0 for keep-alives
+func (c *opcuaConn) publish(subscription uint32, acks []uint32, wait time.Duration) ([]opcuaChange, uint32, error) {
+	r, err := c.call(opcuaPublishRequest, opcuaPublishResponse, wait, func(e *opcuaEncoder) {
+		e.i32(int32(len(acks)))
+		for _, seq := range acks {
+			e.u32(subscription)
+			e.u32(seq)
+		}
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("publish: %w", err)
+	}
+	r.u32() // subscription ID
+	for n := r.i32(); n > 0 && r.err == nil; n-- {
+		r.u32() // available sequence numbers
+	}
+	r.u8() // more notifications
+	seq := r.u32()
+	published := r.dateTime()
+	var changes []opcuaChange
+	n := int(r.i32())
+	if n <= 0 {
+		// a keep-alive
+		seq = 0
+	}
+	for i := 0; i < n && r.err == nil; i++ {
+		typeID, body := r.extensionObject()
+		if typeID != opcuaDataChangeNotification {
+			continue
+		}
+		d := opcuaDecoder{b: body}
+		items := int(d.i32())
+		for j := 0; j < items && d.err == nil; j++ {
+			handle := d.u32()
+			v, ok, status, source, server := d.dataValue()
+			if !ok || opcuaBad(status) {
+				continue
+			}
+			at := source
+			if at.IsZero() {
+				at = server
+			}
+			if at.IsZero() {
+				at = published
+			}
+			changes = append(changes, opcuaChange{handle: handle, value: v, at: at})
+		}
+		if d.err != nil {
+			return nil, 0, fmt.Errorf("publish: %w", d.err)
+		}
+	}
+	if r.err != nil {
+		return nil, 0, fmt.Errorf("publish: %w", r.err)
+	}
+	return changes, seq, nil
+}
+
+// opcuaEncoder appends values in the OPC UA binary encoding
+type opcuaEncoder struct {
+	b []byte
+}
+
+func (e *opcuaEncoder) u8(v byte)    { e.b = append(e.b, v) }
+func (e *opcuaEncoder) u16(v uint16) { e.b = binary.LittleEndian.AppendUint16(e.b, v) }
+func (e *opcuaEncoder) u32(v uint32) { e.b = binary.LittleEndian.AppendUint32(e.b, v) }
+func (e *opcuaEncoder) i32(v int32)  { e.u32(uint32(v)) }
+func (e *opcuaEncoder) f64(v float64) {
+	e.b = binary.LittleEndian.AppendUint64(e.b, math.Float64bits(v))
+}
+
+// str writes a string, the empty string as null
+func (e *opcuaEncoder) str(s string) {
+	if s == "" {
+		e.i32(-1)
+		return
+	}
+	e.i32(int32(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *opcuaEncoder) byteString(b []byte) {
+	if b == nil {
+		e.i32(-1)
+		return
+	}
+	e.i32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// opcuaEpoch is the start of OPC UA time, in 100 ns ticks before the Unix
+// epoch
+const opcuaEpoch = 116444736000000000
+
+func (e *opcuaEncoder) dateTime(t time.Time) {
+	e.b = binary.LittleEndian.AppendUint64(e.b, uint64(t.UnixNano()/100+opcuaEpoch))
+}
+
+// numericNodeID writes a numeric node ID in the shortest form
+func (e *opcuaEncoder) numericNodeID(ns uint16, id uint32) {
+	switch {
+	case ns == 0 && id < 256:
+		e.u8(0x00)
+		e.u8(byte(id))
+	case ns < 256 && id < 65536:
+		e.u8(0x01)
+		e.u8(byte(ns))
+		e.u16(uint16(id))
+	default:
+		e.u8(0x02)
+		e.u16(ns)
+		e.u32(id)
+	}
+}
+
+// opcuaDecoder reads values in the OPC UA binary encoding; reading past the
+// end sets err and yields zero values
+type opcuaDecoder struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *opcuaDecoder) next(n int) []byte {
+	if r.err != nil || n < 0 || r.off+n > len(r.b) {
+		if r.err == nil {
+			r.err = errors.New("truncated message")
+		}
+		return make([]byte, n)
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *opcuaDecoder) u8() byte     { return r.next(1)[0] }
+func (r *opcuaDecoder) u16() uint16  { return binary.LittleEndian.Uint16(r.next(2)) }
+func (r *opcuaDecoder) u32() uint32  { return binary.LittleEndian.Uint32(r.next(4)) }
+func (r *opcuaDecoder) i32() int32   { return int32(r.u32()) }
+func (r *opcuaDecoder) u64() uint64  { return binary.LittleEndian.Uint64(r.next(8)) }
+func (r *opcuaDecoder) f64() float64 { return math.Float64frombits(r.u64()) }
+
+func (r *opcuaDecoder) byteString() []byte {
+	n := r.i32()
+	if n < 0 {
+		return nil
+	}
+	if int(n) > len(r.b) {
+		r.err = errors.New("truncated message")
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func (r *opcuaDecoder) str() string {
+	return string(r.byteString())
+}
+
+func (r *opcuaDecoder) strings() {
+	for n := r.i32(); n > 0 && r.err == nil; n-- {
+		r.str()
+	}
+}
+
+func (r *opcuaDecoder) dateTime() time.Time {
+	ticks := int64(r.u64())
+	if ticks <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, (ticks-opcuaEpoch)*100)
+}
+
+// nodeID reads a node ID, or an expanded one, and returns its numeric
+// identifier, 0 for other kinds
+func (r *opcuaDecoder) nodeID() uint32 {
+	mask := r.u8()
+	var id uint32
+	switch mask & 0x0F {
+	case 0x00:
+		id = uint32(r.u8())
+	case 0x01:
+		r.u8()
+		id = uint32(r.u16())
+	case 0x02:
+		r.u16()
+		id = r.u32()
+	case 0x03, 0x05:
+		r.u16()
+		r.byteString()
+	case 0x04:
+		r.u16()
+		r.next(16)
+	default:
+		r.err = fmt.Errorf("invalid node ID encoding 0x%02X", mask)
+	}
+	if mask&0x80 != 0 {
+		r.str() // namespace URI
+	}
+	if mask&0x40 != 0 {
+		r.u32() // server index
+	}
+	return id
+}
+
+func (r *opcuaDecoder) localizedText() {
+	mask := r.u8()
+	if mask&0x01 != 0 {
+		r.str()
+	}
+	if mask&0x02 != 0 {
+		r.str()
+	}
+}
+
+func (r *opcuaDecoder) diagnosticInfo() {
+	mask := r.u8()
+	for bit := byte(0x01); bit <= 0x08; bit <<= 1 {
+		if mask&bit != 0 {
+			r.i32()
+		}
+	}
+	if mask&0x10 != 0 {
+		r.str()
+	}
+	if mask&0x20 != 0 {
+		r.u32()
+	}
+	if mask&0x40 != 0 && r.err == nil {
+		r.diagnosticInfo()
+	}
+}
+
+// extensionObject returns the type and the encoded body of an extension
+// object
+func (r *opcuaDecoder) extensionObject() (uint32, []byte) {
+	typeID := r.nodeID()
+	switch r.u8() {
+	case 0x00:
+		return typeID, nil
+	case 0x01, 0x02:
+		return typeID, r.byteString()
+	}
+	r.err = errors.New("invalid extension object encoding")
+	return 0, nil
+}
+
+// response reads the type and the header of a response, failing on a
+// service fault or a bad service result
+func (r *opcuaDecoder) response(want uint32) error {
+	typeID := r.nodeID()
+	r.u64() // timestamp
+	r.u32() // request handle
+	result := r.u32()
+	r.diagnosticInfo()
+	r.strings()
+	r.extensionObject()
+	if r.err != nil {
+		return r.err
+	}
+	if typeID == opcuaServiceFault || opcuaBad(result) {
+		return errors.New(opcuaStatus(result))
+	}
+	if typeID != want {
+		return fmt.Errorf("unexpected response type %d", typeID)
+	}
+	return nil
+}
+
+// anonymousPolicy reads the endpoint descriptions of a create session
+// response and returns the policy ID of anonymous logins on an endpoint
+// without security
+func (r *opcuaDecoder) anonymousPolicy() string {
+	policy := "anonymous"
+	for n := r.i32(); n > 0 && r.err == nil; n-- {
+		r.str() // endpoint URL
+		r.str() // application URI
+		r.str() // product URI
+		r.localizedText()
+		r.u32() // application type
+		r.str() // gateway
+		r.str() // discovery profile
+		r.strings()
+		r.byteString() // certificate
+		mode := r.u32()
+		r.str() // security policy
+		for t := r.i32(); t > 0 && r.err == nil; t-- {
+			id := r.str()
+			tokenType := r.u32()
+			r.str()
+			r.str()
+			r.str()
+			// anonymous tokens of an endpoint with security mode None
+			if mode == 1 && tokenType == 0 && id != "" {
+				policy = id
+			}
+		}
+		r.str() // transport profile
+		r.u8()  // security level
+	}
+	return policy
+}
+
+// dataValue reads a data value and returns its value when it is a number
+func (r *opcuaDecoder) dataValue() (v float64, ok bool, status uint32, source, server time.Time) {
+	mask := r.u8()
+	if mask&0x01 != 0 {
+		v, ok = r.variant()
+	}
+	if mask&0x02 != 0 {
+		status = r.u32()
+	}
+	if mask&0x04 != 0 {
+		source = r.dateTime()
+	}
+	if mask&0x10 != 0 {
+		r.u16()
+	}
+	if mask&0x08 != 0 {
+		server = r.dateTime()
+	}
+	if mask&0x20 != 0 {
+		r.u16()
+	}
+	return
+}
+
+// variant reads a variant and returns its value when it is a scalar number
+// or boolean
+func (r *opcuaDecoder) variant() (float64, bool) {
+	mask := r.u8()
+	typ := mask & 0x3F
+	if mask&0x80 == 0 {
+		return r.scalar(typ)
+	}
+	for n := r.i32(); n > 0 && r.err == nil; n-- {
+		r.scalar(typ)
+	}
+	if mask&0x40 != 0 {
+		for n := r.i32(); n > 0 && r.err == nil; n-- {
+			r.i32()
+		}
+	}
+	return 0, false
+}
+
+func (r *opcuaDecoder) scalar(typ byte) (float64, bool) {
+	switch typ {
+	case 1:
+		return float64(r.u8() & 1), true
+	case 2:
+		return float64(int8(r.u8())), true
+	case 3:
+		return float64(r.u8()), true
+	case 4:
+		return float64(int16(r.u16())), true
+	case 5:
+		return float64(r.u16()), true
+	case 6:
+		return float64(r.i32()), true
+	case 7:
+		return float64(r.u32()), true
+	case 8:
+		return float64(int64(r.u64())), true
+	case 9:
+		return float64(r.u64()), true
+	case 10:
+		return float64(math.Float32frombits(r.u32())), true
+	case 11:
+		return r.f64(), true
+	case 12, 15, 16:
+		r.byteString()
+	case 13:
+		r.u64()
+	case 14:
+		r.next(16)
+	case 17:
+		r.nodeID()
+	case 19:
+		r.u32()
+	case 20:
+		r.u16()
+		r.str()
+	case 21:
+		r.localizedText()
+	case 22:
+		r.extensionObject()
+	default:
+		r.err = fmt.Errorf("unsupported variant type %d", typ)
+	}
+	return 0, false
+}
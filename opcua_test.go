@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestParseNodeID(t *testing.T) {
+	// the node ID and GUID encoding examples of OPC UA part 6
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"i=72", "00 48"},
+		{"ns=5;i=1025", "01 05 0104"},
+		{"ns=300;i=5", "02 2C01 05000000"},
+		{"i=70000", "02 0000 70110100"},
+		{"ns=1;s=Hot水", "03 0100 06000000 486F74E6B0B4"},
+		{"ns=1;g=72962B91-FA75-4AE6-8D28-B404DC7DAF63", "04 0100 912B9672 75FA E64A 8D28B404DC7DAF63"},
+		{"ns=2;b=AQID", "05 0200 03000000 010203"},
+	}
+	for _, tt := range tests {
+		got, err := parseNodeID(tt.id)
+		if err != nil {
+			t.Errorf("parseNodeID(%q): %v", tt.id, err)
+			continue
+		}
+		if want := mustHex(t, tt.want); !bytes.Equal(got, want) {
+			t.Errorf("parseNodeID(%q) = % X, want % X", tt.id, got, want)
+		}
+	}
+	for _, id := range []string{"", "72", "x=1", "ns=1", "ns=70000;i=1", "i=-1", "ns=1;g=72962B91-FA75-4AE6-8D28", "ns=1;b=!"} {
+		if _, err := parseNodeID(id); err == nil {
+			t.Errorf("parseNodeID(%q) succeeded", id)
+		}
+	}
+}
+
+func TestOPCUANodeIDRoundTrip(t *testing.T) {
+	for _, id := range []string{"i=72", "ns=5;i=1025", "ns=300;i=5", "ns=1;s=Hot水", "ns=1;g=72962B91-FA75-4AE6-8D28-B404DC7DAF63"} {
+		raw, err := parseNodeID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// with a trailing byte to tell the end of the ID is found
+		r := &opcuaDecoder{b: append(raw, 0xAA)}
+		r.nodeID()
+		if r.err != nil || r.u8() != 0xAA {
+			t.Errorf("nodeID of %q did not read % X to its end, %v", id, raw, r.err)
+		}
+	}
+	r := &opcuaDecoder{b: mustHex(t, "01 05 0104")}
+	if got := r.nodeID(); got != 1025 {
+		t.Errorf("nodeID = %d, want 1025", got)
+	}
+	// expanded, with a namespace URI and a server index
+	r = &opcuaDecoder{b: mustHex(t, "C0 48 03000000 75726E 02000000")}
+	if got := r.nodeID(); got != 72 || r.err != nil || r.off != len(r.b) {
+		t.Errorf("expanded nodeID = %d, %v, read %d of %d bytes", got, r.err, r.off, len(r.b))
+	}
+}
+
+func TestOPCUADateTime(t *testing.T) {
+	tests := []struct {
+		t     time.Time
+		ticks string
+	}{
+		// 100 ns ticks since 1601-01-01
+		{time.Unix(0, 0), "00803E D5DEB19D01"},
+		{time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC), "00006DC6 4717DA01"},
+	}
+	for _, tt := range tests {
+		var e opcuaEncoder
+		e.dateTime(tt.t)
+		if want := mustHex(t, tt.ticks); !bytes.Equal(e.b, want) {
+			t.Errorf("dateTime(%s) = % X, want % X", tt.t, e.b, want)
+		}
+		r := &opcuaDecoder{b: e.b}
+		if got := r.dateTime(); !got.Equal(tt.t) {
+			t.Errorf("dateTime of % X = %s, want %s", e.b, got, tt.t)
+		}
+	}
+	r := &opcuaDecoder{b: make([]byte, 8)}
+	if got := r.dateTime(); !got.IsZero() {
+		t.Errorf("dateTime of 0 ticks = %s, want the zero time", got)
+	}
+}
+
+func TestOPCUADataValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		want   float64
+		ok     bool
+		status uint32
+	}{
+		{"double", "01 0B 0000000000403540", 21.25, true, 0},
+		{"float", "01 0A 0000AA41", 21.25, true, 0},
+		{"int16", "01 04 FEFF", -2, true, 0},
+		{"boolean", "01 01 01", 1, true, 0},
+		{"string", "01 0C 02000000 6869", 0, false, 0},
+		{"array", "01 86 02000000 01000000 02000000", 0, false, 0},
+		{"bad status", "02 00000380", 0, false, 0x80030000},
+		{"timestamps", "0D 0B 000000000000F03F 00803ED5DEB19D01 00803ED5DEB19D01", 1, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &opcuaDecoder{b: mustHex(t, tt.value)}
+			v, ok, status, _, _ := r.dataValue()
+			if r.err != nil || r.off != len(r.b) {
+				t.Fatalf("dataValue read %d of %d bytes: %v", r.off, len(r.b), r.err)
+			}
+			if v != tt.want || ok != tt.ok || status != tt.status {
+				t.Errorf("dataValue = %v, %v, %08X, want %v, %v, %08X", v, ok, status, tt.want, tt.ok, tt.status)
+			}
+		})
+	}
+
+	r := &opcuaDecoder{b: mustHex(t, "01 0B 0000")}
+	if r.dataValue(); r.err == nil {
+		t.Error("dataValue of a truncated double succeeded")
+	}
+}
+
+func TestOPCUAStrings(t *testing.T) {
+	var e opcuaEncoder
+	e.str("")
+	e.str("opc.tcp://plc:4840")
+	e.byteString(nil)
+	e.byteString([]byte{1, 2})
+	r := &opcuaDecoder{b: e.b}
+	if s := r.str(); s != "" {
+		t.Errorf("null string = %q", s)
+	}
+	if s := r.str(); s != "opc.tcp://plc:4840" {
+		t.Errorf("string = %q", s)
+	}
+	if b := r.byteString(); b != nil {
+		t.Errorf("null byte string = % X", b)
+	}
+	if b := r.byteString(); !bytes.Equal(b, []byte{1, 2}) || r.err != nil {
+		t.Errorf("byte string = % X, %v", b, r.err)
+	}
+
+	r = &opcuaDecoder{b: mustHex(t, "FFFFFF7F 00")}
+	if r.byteString(); r.err == nil {
+		t.Error("byte string longer than the message succeeded")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reading is one record of a node, its values keyed by schema field name
+type reading struct {
+	Time   time.Time
+	Values map[string]float64
+}
+
+// MarshalJSON flattens the values next to the time, e.g.
+// {"time": ..., "humidity": 40.5, "temperature": 21.3}
+func (rd reading) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(rd.Values)+1)
+	for name, v := range rd.Values {
+		m[name] = v
+	}
+	m["time"] = rd.Time
+	return json.Marshal(m)
+}
+
+// parsePrecision maps a precision name to the duration of one epoch tick
+func parsePrecision(v string) (time.Duration, error) {
+	switch v {
+	case "s":
+		return time.Second, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "us", "µs":
+		return time.Microsecond, nil
+	case "ns":
+		return time.Nanosecond, nil
+	}
+	return 0, fmt.Errorf("unknown precision %q", v)
+}
+
+// epochTime converts an epoch timestamp counted in units of unit. Points are
+// written with nanosecond precision, so sub-second readings of a burst stay
+// distinct. Timestamps past the range of time.Duration in unit would wrap
+// around, and are rejected as invalid.
+func epochTime(ts int64, unit time.Duration) (time.Time, error) {
+	if limit := math.MaxInt64 / int64(unit); ts > limit || ts < -limit {
+		return time.Time{}, errors.New("invalid timestamp")
+	}
+	return time.Unix(0, 0).Add(time.Duration(ts) * unit), nil
+}
+
+// readingAges converts the age value of a payload of n records, one age of
+// the newest record or one per record in their order, counted in units of
+// unit. Ages older than max, when set, or past the range of time.Duration
+// are rejected.
+func readingAges(v string, n int, unit, max time.Duration) ([]time.Duration, error) {
+	if v == "" {
+		return []time.Duration{0}, nil
+	}
+	values := strings.Split(v, ",")
+	if len(values) != 1 && len(values) != n {
+		return nil, fmt.Errorf("age lists %d ages for %d records, send one or one per record", len(values), n)
+	}
+	limit := math.MaxInt64 / int64(unit)
+	if max > 0 && int64(max/unit) < limit {
+		limit = int64(max / unit)
+	}
+	ages := make([]time.Duration, len(values))
+	for i, s := range values {
+		age, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || age < 0 {
+			return nil, fmt.Errorf("invalid age %q", s)
+		}
+		if age > limit {
+			return nil, fmt.Errorf("age %s is older than the %s a reading may be held", s, time.Duration(limit)*unit)
+		}
+		ages[i] = time.Duration(age) * unit
+	}
+	return ages, nil
+}
+
+func parseData(data string, schema *sensorSchema, unit time.Duration) (rd reading, err error) {
+	debugf("incoming data: %s\n", data)
+	bodyArr := strings.Split(data, "|")
+	if len(bodyArr) < schema.required+1 {
+		return rd, fmt.Errorf("expected %d fields separated by '|', got %d", schema.required+1, len(bodyArr))
+	}
+	timestamp, err := strconv.ParseInt(bodyArr[0], 10, 64)
+	if err != nil {
+		return rd, errors.New("invalid timestamp")
+	}
+	if rd.Values, err = schema.parseValues(bodyArr[1:]); err != nil {
+		return rd, err
+	}
+	if rd.Time, err = epochTime(timestamp, unit); err != nil {
+		return rd, err
+	}
+
+	debugf("Time: %s, Values: %v\n", rd.Time.Format(time.RFC3339Nano), rd.Values)
+
+	return rd, nil
+}
+
+// recordError tells a node which record of its payload was rejected and why
+type recordError struct {
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+// most records of one payload, and the longest data value, which leaves
+// room for sealed and checksummed records
+const (
+	maxRecords = 1000
+	maxDataLen = 256 * maxRecords
+)
+
+// checkRecordCount rejects payloads of more than maxRecords records, all of
+// which would be parsed and answered in one request
+func checkRecordCount(n int) error {
+	if n > maxRecords {
+		return fmt.Errorf("payload has %d records, at most %d are accepted", n, maxRecords)
+	}
+	return nil
+}
+
+// parseRecords parses a payload of one or more readings separated by ';', as
+// sent by nodes flushing their buffer after a reconnect. Records that fail to
+// parse are reported instead of failing the whole payload. parse is the
+// record parser of the payload version, see payloadParsers.
+func parseRecords(ctx context.Context, data string, schema *sensorSchema, unit time.Duration, parse recordParser) (readings []reading, indices []int, rejected []recordError) {
+	for i, record := range strings.Split(strings.TrimSuffix(data, ";"), ";") {
+		// the node hung up, the caller drops the partial result
+		if ctx.Err() != nil {
+			break
+		}
+		rd, err := parse(record, schema, unit)
+		if err != nil {
+			rejected = append(rejected, recordError{Index: i, Reason: err.Error()})
+			continue
+		}
+		readings = append(readings, rd)
+		indices = append(indices, i)
+	}
+	return readings, indices, rejected
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadingAges(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		age  string
+		n    int
+		unit time.Duration
+		max  time.Duration
+		want []time.Duration
+	}{
+		{"", 3, time.Second, day, []time.Duration{0}},
+		{"90", 3, time.Second, day, []time.Duration{90 * time.Second}},
+		{"20,10,0", 3, time.Second, day, []time.Duration{20 * time.Second, 10 * time.Second, 0}},
+		{"1500", 1, time.Millisecond, day, []time.Duration{1500 * time.Millisecond}},
+		{"86400", 1, time.Second, day, []time.Duration{day}},
+		// without a maximum only the range of time.Duration applies
+		{"9223372036", 1, time.Second, 0, []time.Duration{9223372036 * time.Second}},
+	}
+	for _, tt := range tests {
+		got, err := readingAges(tt.age, tt.n, tt.unit, tt.max)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readingAges(%q, %d) = %v, %v, want %v", tt.age, tt.n, got, err, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		age string
+		n   int
+		max time.Duration
+	}{
+		{"20,10", 3, day},
+		{"86401", 1, day},
+		{"-1", 1, day},
+		{"x", 1, day},
+		// age*unit would wrap around to a time in the 19th century
+		{"9007199254740992", 1, 0},
+		{"9223372037", 1, 0},
+	} {
+		if got, err := readingAges(tt.age, tt.n, time.Second, tt.max); err == nil {
+			t.Errorf("readingAges(%q, %d) = %v, want an error", tt.age, tt.n, got)
+		}
+	}
+}
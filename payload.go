@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordParser turns one record of a payload version into a reading
+type recordParser func(data string, schema *sensorSchema, unit time.Duration) (reading, error)
+
+// payloadParsers knows every payload format nodes in the field still send,
+// parseRecords splits a payload into the records they parse. Version 1 has
+// no prefix and positional groups, see parseData. A new firmware format gets
+// the next number and a parser here; the existing ones stay so old nodes
+// keep working.
+var payloadParsers = map[int]recordParser{
+	1: parseData,
+	2: parseDataV2,
+}
+
+// payloadVersion splits the "v<N>:" prefix off a payload, which is
+// version 1 without one
+func payloadVersion(data string) (int, string, error) {
+	if !strings.HasPrefix(data, "v") {
+		return 1, data, nil
+	}
+	prefix, body, ok := strings.Cut(data[1:], ":")
+	version, err := strconv.Atoi(prefix)
+	if !ok || err != nil {
+		return 0, "", errors.New("invalid payload version prefix")
+	}
+	if _, ok := payloadParsers[version]; !ok {
+		return version, "", fmt.Errorf("unsupported payload version %d", version)
+	}
+	return version, body, nil
+}
+
+// parseDataV2 parses a record that names its values, so boards only send
+// the fields they have: "v2:1700000000|humidity=40.5,temperature=21.3,lux=300".
+// Records are separated by ';' like in version 1.
+func parseDataV2(data string, schema *sensorSchema, unit time.Duration) (rd reading, err error) {
+	debugf("incoming data: %s\n", data)
+	ts, pairs, ok := strings.Cut(data, "|")
+	if !ok {
+		return rd, errors.New("expected timestamp|field=value,...")
+	}
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return rd, errors.New("invalid timestamp")
+	}
+	if rd.Time, err = epochTime(timestamp, unit); err != nil {
+		return rd, err
+	}
+	rd.Values = make(map[string]float64)
+	for _, pair := range strings.Split(pairs, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return rd, fmt.Errorf("expected field=value, got %q", pair)
+		}
+		if _, known := schema.field(name); !known {
+			return rd, fmt.Errorf("unknown field %q", name)
+		}
+		if rd.Values[name], err = parseValue(name, value); err != nil {
+			return rd, err
+		}
+	}
+	for _, f := range schema.Fields {
+		if _, ok := rd.Values[f.Name]; !ok && !f.Optional {
+			return rd, fmt.Errorf("missing %s", f.Name)
+		}
+	}
+	debugf("Time: %s, Values: %v\n", rd.Time.Format(time.RFC3339Nano), rd.Values)
+	return rd, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Payload encryption, for nodes that cannot do TLS: a device key of
+// ACCESS_KEYS_FILE may carry a payload_key, 32, 48 or 64 hex digits for
+// AES-128, -192 or -256 in GCM mode. Its payloads are then sent as
+// "enc:" and the base64 of a 12 byte nonce followed by the sealed payload
+// text, with the node name as additional data so a payload cannot be
+// replayed for another node. The server opens it before the checksum check
+// and parsing, and rejects cleartext payloads of such a key. Every payload
+// needs a fresh nonce.
+
+const encryptedPrefix = "enc:"
+
+// newPayloadCipher parses the payload_key of an access key
+func newPayloadCipher(hexKey string) (cipher.AEAD, error) {
+	raw, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, errors.New("payload_key must be hex")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, errors.New("payload_key must be 32, 48 or 64 hex digits")
+	}
+	return cipher.NewGCM(block)
+}
+
+var errCleartextPayload = errors.New("payload must be encrypted with the payload key of this device")
+
+// payloadKeyOf returns the payload key of the principal of ctx, nil when it
+// sends cleartext
+func payloadKeyOf(ctx context.Context) cipher.AEAD {
+	if p, _ := ctx.Value(key("principal")).(*principal); p != nil {
+		return p.payloadKey
+	}
+	return nil
+}
+
+// openPayload returns the text of a payload of node, decrypting it with the
+// payload key of the principal of ctx
+func openPayload(ctx context.Context, node, payload string) (string, error) {
+	aead := payloadKeyOf(ctx)
+	sealed := strings.TrimSpace(payload)
+	encrypted := strings.HasPrefix(sealed, encryptedPrefix)
+	sealed = strings.TrimPrefix(sealed, encryptedPrefix)
+	switch {
+	case !encrypted && aead == nil:
+		return payload, nil
+	case !encrypted:
+		return "", errCleartextPayload
+	case aead == nil:
+		return "", errors.New("encrypted payload, but this device has no payload key")
+	}
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		if raw, err = base64.RawURLEncoding.DecodeString(sealed); err != nil {
+			return "", errors.New("encrypted payload is not base64")
+		}
+	}
+	if len(raw) < aead.NonceSize()+aead.Overhead() {
+		return "", errors.New("encrypted payload too short")
+	}
+	nonce, ciphertext := raw[:aead.NonceSize()], raw[aead.NonceSize():]
+	text, err := aead.Open(nil, nonce, ciphertext, []byte(node))
+	if err != nil {
+		return "", errors.New("encrypted payload failed verification")
+	}
+	return string(text), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// mustHex decodes s, spaces may group its bytes
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// test case 4 of the GCM specification (McGrew and Viega), a 96 bit IV with
+// additional data, which is the node name of a payload
+const (
+	gcmKey        = "feffe9928665731c6d6a8f9467308308"
+	gcmIV         = "cafebabefacedbaddecaf888"
+	gcmPlaintext  = "d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a72" + "1c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b39"
+	gcmAAD        = "feedfacedeadbeeffeedfacedeadbeefabaddad2"
+	gcmCiphertext = "42831ec2217774244b7221b784d0d49ce3aa212f2c02a4e035c17e2329aca12e" + "21d514b25466931c7d8f6a5aac84aa051ba30b396a0aac973d58e091"
+	gcmTag        = "5bc94fbc3221a5db94fae95ae7121a47"
+)
+
+func TestOpenPayload(t *testing.T) {
+	aead, err := newPayloadCipher(gcmKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), key("principal"), &principal{payloadKey: aead})
+	node := string(mustHex(t, gcmAAD))
+	sealed := mustHex(t, gcmIV+gcmCiphertext+gcmTag)
+	std := encryptedPrefix + base64.StdEncoding.EncodeToString(sealed)
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		node    string
+		payload string
+		want    string
+		wantErr bool
+	}{
+		{"standard base64", node, std, string(mustHex(t, gcmPlaintext)), false},
+		{"url base64", node, encryptedPrefix + base64.RawURLEncoding.EncodeToString(sealed), string(mustHex(t, gcmPlaintext)), false},
+		{"surrounding space", node, " " + std + "\n", string(mustHex(t, gcmPlaintext)), false},
+		{"another node", "node-2", std, "", true},
+		{"tampered tag", node, encryptedPrefix + base64.StdEncoding.EncodeToString(tampered), "", true},
+		{"too short", node, encryptedPrefix + base64.StdEncoding.EncodeToString(sealed[:27]), "", true},
+		{"not base64", node, encryptedPrefix + "!!", "", true},
+		{"cleartext", node, "1700000000|40.5|21.3", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := openPayload(ctx, tt.node, tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("openPayload error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("openPayload = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenPayloadWithoutKey(t *testing.T) {
+	ctx := context.WithValue(context.Background(), key("principal"), &principal{})
+	if got, err := openPayload(ctx, "node-1", "1700000000|40.5|21.3"); err != nil || got != "1700000000|40.5|21.3" {
+		t.Errorf("openPayload of cleartext = %q, %v", got, err)
+	}
+	if _, err := openPayload(ctx, "node-1", encryptedPrefix+"AAAA"); err == nil {
+		t.Error("openPayload of an encrypted payload without a key succeeded")
+	}
+}
+
+func TestNewPayloadCipher(t *testing.T) {
+	for _, k := range []string{"", "zz", "00112233", gcmKey + "00"} {
+		if _, err := newPayloadCipher(k); err == nil {
+			t.Errorf("newPayloadCipher(%q) succeeded", k)
+		}
+	}
+	for _, k := range []string{gcmKey, gcmKey + "feffe9928665731c", gcmKey + gcmKey} {
+		if _, err := newPayloadCipher(k); err != nil {
+			t.Errorf("newPayloadCipher(%q): %v", k, err)
+		}
+	}
+}
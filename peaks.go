@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// peakMeasurement holds captured peak acceleration events at full
+// resolution, one point per sample tagged with the trigger time as capture
+const peakMeasurement = "peak_captures"
+
+// peakMaxSamples bounds the samples kept per node, whatever the rate
+const peakMaxSamples = 4096
+
+// peakCapture keeps the recent accelerometer samples of one node, and the
+// samples of a capture in progress
+type peakCapture struct {
+	recent []reading
+	// trigger of the capture in progress, zero when there is none
+	trigger  time.Time
+	peak     float64
+	captured []reading
+}
+
+// peakEvent is a finished capture
+type peakEvent struct {
+	Trigger time.Time
+	Peak    float64
+	Samples []reading
+}
+
+// accelerationDeviation returns how far the acceleration magnitude of rd is
+// from gravity, false when rd has no accelerometer values
+func accelerationDeviation(rd reading) (float64, bool) {
+	x, okX := rd.Values["x"]
+	y, okY := rd.Values["y"]
+	z, okZ := rd.Values["z"]
+	if !okX || !okY || !okZ {
+		return 0, false
+	}
+	return math.Abs(math.Sqrt(x*x+y*y+z*z) - gravity), true
+}
+
+// observePeak adds rd to the recent samples of node. A deviation beyond
+// PEAK_THRESHOLD starts a capture with the PEAK_PRE_TRIGGER samples before
+// it, which is returned as points once a sample past PEAK_POST_TRIGGER
+// arrives.
+func observePeak(t *tenant, cfg *config, events *eventBus, node string, rd reading) []*write.Point {
+	if cfg.PeakThreshold <= 0 {
+		return nil
+	}
+	ev := t.nodes.observePeak(node, rd, cfg.PeakThreshold, cfg.PeakPreTrigger, cfg.PeakPostTrigger)
+	if ev == nil {
+		return nil
+	}
+
+	events.emit(t, event{
+		Node:  node,
+		Type:  "peak_capture",
+		Title: "Peak acceleration captured",
+		Text:  fmt.Sprintf("acceleration deviated up to %.2f m/s² from gravity, %d samples stored", ev.Peak, len(ev.Samples)),
+		Time:  ev.Trigger,
+	})
+	capture := ev.Trigger.UTC().Format(time.RFC3339Nano)
+	points := make([]*write.Point, 0, len(ev.Samples))
+	for _, s := range ev.Samples {
+		dev, _ := accelerationDeviation(s)
+		p := cfg.Schema.newPoint(peakMeasurement, node, s.Time)
+		p.AddTag("capture", capture)
+		p.AddField("x", s.Values["x"])
+		p.AddField("y", s.Values["y"])
+		p.AddField("z", s.Values["z"])
+		p.AddField("deviation", dev)
+		p.AddField("offset_seconds", s.Time.Sub(ev.Trigger).Seconds())
+		points = append(points, p)
+	}
+	return points
+}
+
+// observePeak runs the capture of node, see observePeak above
+func (s *nodeStore) observePeak(node string, rd reading, threshold float64, pre, post time.Duration) *peakEvent {
+	dev, ok := accelerationDeviation(rd)
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := &s.get(node).peak
+	if n := len(c.recent); n > 0 && !rd.Time.After(c.recent[n-1].Time) {
+		return nil
+	}
+
+	var ev *peakEvent
+	if !c.trigger.IsZero() && rd.Time.Sub(c.trigger) > post {
+		ev = &peakEvent{Trigger: c.trigger, Peak: c.peak, Samples: c.captured}
+		c.trigger, c.peak, c.captured = time.Time{}, 0, nil
+	}
+
+	c.recent = append(c.recent, rd)
+	drop := 0
+	for drop < len(c.recent)-1 && (rd.Time.Sub(c.recent[drop].Time) > pre || len(c.recent)-drop > peakMaxSamples) {
+		drop++
+	}
+	c.recent = append(c.recent[:0], c.recent[drop:]...)
+
+	switch {
+	case !c.trigger.IsZero():
+		if len(c.captured) < peakMaxSamples {
+			c.captured = append(c.captured, rd)
+		}
+		if dev > c.peak {
+			c.peak = dev
+		}
+	case dev > threshold:
+		c.trigger, c.peak = rd.Time, dev
+		c.captured = append([]reading(nil), c.recent...)
+	}
+	return ev
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// pollSink stores the readings the server fetches itself from devices that
+// cannot post, over Modbus or OPC UA, through the same checks and writes as
+// ingest. Polling runs on the leader only, replicas would store every
+// reading twice.
+type pollSink struct {
+	cfg     *config
+	events  *eventBus
+	mq      *mqttPublisher
+	forward forwarders
+	leader  *leaderElector
+}
+
+// active tells whether this replica polls
+func (s *pollSink) active() bool {
+	return s.leader.isLeader()
+}
+
+// store writes rd of node like an ingested record with the server's clock
+func (s *pollSink) store(ctx context.Context, t *tenant, node string, rd reading) error {
+	cfg := s.cfg
+	received := time.Now()
+	t.stats.add(node, func(c *ingestCounts) { c.Received.Add(1) })
+	if err := checkFinite(rd); err != nil {
+		t.stats.add(node, func(c *ingestCounts) { c.Rejected.Add(1) })
+		t.nodes.countRecords(node, 0, 1)
+		return err
+	}
+	t.stats.add(node, func(c *ingestCounts) { c.Parsed.Add(1) })
+	t.nodes.countRecords(node, 1, 0)
+
+	points := cfg.Schema.points(node, rd, false, cfg.receivedAt(received))
+	receipts := pointReceipts(node, 0, points, cfg.WritePrecision)
+	observeReading(t, cfg, s.events, node, rd, received)
+	if p := observeRate(t, cfg, s.events, node, rd); p != nil {
+		points = append(points, p)
+	}
+	if p := observeSHM(t, cfg, s.events, node, rd); p != nil {
+		points = append(points, p)
+	}
+	points = append(points, observePeak(t, cfg, s.events, node, rd)...)
+	t.maintenance.label(node, points)
+
+	written := func() {
+		logStored(node, receipts)
+		t.stats.add(node, func(c *ingestCounts) { c.Written.Add(1) })
+		t.cache.invalidate(node)
+		s.mq.publish(t, node, rd)
+		s.forward.forward(t, node, rd)
+	}
+	if _, err := t.writer.write(ctx, written, points...); err != nil {
+		t.stats.add(node, func(c *ingestCounts) { c.Dropped.Add(1) })
+		return err
+	}
+	t.usage.Readings.Add(1)
+	t.nodes.update(node, rd)
+	return nil
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Prometheus remote_write: gateways that run a Prometheus agent push their
+// series to /api/prom/write as a snappy compressed protobuf WriteRequest.
+// Each sample becomes a point of the measurement PROM_WRITE_PREFIX plus the
+// metric name with the sample in the field value; the PROM_NODE_LABEL label
+// is the node, tagged like the readings of a sensor, the other labels are
+// tags. NaN samples, Prometheus' stale markers, are skipped. Only the 1.0
+// protocol is understood; exemplars, histograms and metadata are ignored.
+
+// the largest body accepted, compressed and decompressed
+const (
+	promWriteMaxBytes   = 16 << 20
+	promWriteMaxDecoded = 64 << 20
+)
+
+// promSeries is a TimeSeries of a WriteRequest
+type promSeries struct {
+	labels  map[string]string
+	samples []promSample
+}
+
+type promSample struct {
+	value float64
+	// milliseconds since the epoch
+	timestamp int64
+}
+
+// postPromWrite stores the samples of a remote_write request
+func postPromWrite(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+
+	if enc := r.Header.Get("Content-Encoding"); enc != "snappy" {
+		http.Error(w, "415 - remote_write bodies are snappy compressed", http.StatusUnsupportedMediaType)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); strings.Contains(ct, "io.prometheus.write.v2") {
+		http.Error(w, "415 - only remote_write 1.0 is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	compressed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, promWriteMaxBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("413 - body larger than %d bytes", promWriteMaxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	body, err := snappyDecode(compressed, promWriteMaxDecoded)
+	if err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := decodeWriteRequest(body)
+	if err != nil {
+		http.Error(w, "400 - invalid WriteRequest: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	points, byNode, rejected := promPoints(cfg, series)
+	var nodes []string
+	for node, ps := range byNode {
+		t.maintenance.label(node, ps)
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	if len(rejected) > 0 {
+		detailf("Error: remote_write: %d series rejected, first: %s\n", len(rejected), rejected[0].Reason)
+	}
+
+	result := ingestResult{Status: "ok", Accepted: len(points), Rejected: len(rejected), Errors: rejected}
+	if len(points) == 0 && len(rejected) > 0 {
+		// Prometheus retries 5xx only, a request it cannot fix is dropped
+		result.Status = "rejected"
+		writeIngestResult(w, http.StatusBadRequest, result)
+		return
+	}
+	if len(rejected) > 0 {
+		result.Status = "partial"
+	}
+	if len(points) > 0 {
+		written := func() {
+			for _, node := range nodes {
+				t.cache.invalidate(node)
+			}
+		}
+		if _, err := t.writer.write(ctx, written, points...); err != nil {
+			if errors.Is(err, errWriteRejected) {
+				writeRejected(w, err)
+				return
+			}
+			if !errors.Is(err, errBufferFull) {
+				log.Printf("remote_write canceled: %s\n", err)
+				return
+			}
+			log.Println(err)
+			t.usage.Throttled.Add(1)
+			writeOverloaded(w, cfg.RetryAfter)
+			return
+		}
+		t.usage.Readings.Add(int64(len(points)))
+	}
+	writeIngestResult(w, http.StatusOK, result)
+}
+
+// promPoints converts series into points, grouped by node as well, and the
+// series it cannot store; Index is the position of a series in the request
+func promPoints(cfg *config, series []promSeries) ([]*write.Point, map[string][]*write.Point, []recordError) {
+	var points []*write.Point
+	byNode := make(map[string][]*write.Point)
+	var rejected []recordError
+	for i, s := range series {
+		name := s.labels["__name__"]
+		node := s.labels[cfg.PromNodeLabel]
+		switch {
+		case name == "":
+			rejected = append(rejected, recordError{Index: i, Reason: "series without __name__"})
+			continue
+		case node == "":
+			rejected = append(rejected, recordError{Index: i, Reason: fmt.Sprintf("%s: no %s label for the node", name, cfg.PromNodeLabel)})
+			continue
+		}
+		if err := validNode(node); err != nil {
+			rejected = append(rejected, recordError{Index: i, Reason: fmt.Sprintf("%s: %s", name, err)})
+			continue
+		}
+		var keys []string
+		for k := range s.labels {
+			if k != "__name__" && k != cfg.PromNodeLabel {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, sample := range s.samples {
+			if math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+				continue
+			}
+			p := cfg.Schema.newPoint(cfg.PromWritePrefix+name, node, time.UnixMilli(sample.timestamp))
+			for _, k := range keys {
+				// the tags of the node win over a label of the same name
+				if !hasTag(p, k) {
+					p.AddTag(k, s.labels[k])
+				}
+			}
+			p.AddField("value", sample.value)
+			points = append(points, p)
+			byNode[node] = append(byNode[node], p)
+		}
+	}
+	return points, byNode, rejected
+}
+
+func hasTag(p *write.Point, name string) bool {
+	for _, tag := range p.TagList() {
+		if tag.Key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeWriteRequest reads the series of a prometheus.WriteRequest
+func decodeWriteRequest(b []byte) ([]promSeries, error) {
+	var series []promSeries
+	d := protoDecoder{b: b}
+	for !d.done() {
+		field, wire, err := d.key()
+		if err != nil {
+			return nil, err
+		}
+		if field != 1 || wire != protoBytes {
+			if err := d.skip(wire); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		msg, err := d.bytes()
+		if err != nil {
+			return nil, err
+		}
+		s, err := decodeTimeSeries(msg)
+		if err != nil {
+			return nil, fmt.Errorf("series %d: %w", len(series), err)
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+func decodeTimeSeries(b []byte) (promSeries, error) {
+	s := promSeries{labels: make(map[string]string)}
+	d := protoDecoder{b: b}
+	for !d.done() {
+		field, wire, err := d.key()
+		if err != nil {
+			return s, err
+		}
+		if (field != 1 && field != 2) || wire != protoBytes {
+			if err := d.skip(wire); err != nil {
+				return s, err
+			}
+			continue
+		}
+		msg, err := d.bytes()
+		if err != nil {
+			return s, err
+		}
+		if field == 1 {
+			name, value, err := decodeLabel(msg)
+			if err != nil {
+				return s, err
+			}
+			s.labels[name] = value
+		} else {
+			sample, err := decodeSample(msg)
+			if err != nil {
+				return s, err
+			}
+			s.samples = append(s.samples, sample)
+		}
+	}
+	return s, nil
+}
+
+func decodeLabel(b []byte) (string, string, error) {
+	var name, value string
+	d := protoDecoder{b: b}
+	for !d.done() {
+		field, wire, err := d.key()
+		if err != nil {
+			return "", "", err
+		}
+		if (field != 1 && field != 2) || wire != protoBytes {
+			if err := d.skip(wire); err != nil {
+				return "", "", err
+			}
+			continue
+		}
+		v, err := d.bytes()
+		if err != nil {
+			return "", "", err
+		}
+		if field == 1 {
+			name = string(v)
+		} else {
+			value = string(v)
+		}
+	}
+	return name, value, nil
+}
+
+func decodeSample(b []byte) (promSample, error) {
+	var s promSample
+	d := protoDecoder{b: b}
+	for !d.done() {
+		field, wire, err := d.key()
+		if err != nil {
+			return s, err
+		}
+		switch {
+		case field == 1 && wire == protoFixed64:
+			v, err := d.fixed64()
+			if err != nil {
+				return s, err
+			}
+			s.value = math.Float64frombits(v)
+		case field == 2 && wire == protoVarint:
+			v, err := d.varint()
+			if err != nil {
+				return s, err
+			}
+			s.timestamp = int64(v)
+		default:
+			if err := d.skip(wire); err != nil {
+				return s, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("truncated message")
+
+// protoDecoder reads the fields of a protobuf message in order
+type protoDecoder struct {
+	b []byte
+}
+
+func (d *protoDecoder) done() bool {
+	return len(d.b) == 0
+}
+
+func (d *protoDecoder) varint() (uint64, error) {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		return 0, errProtoTruncated
+	}
+	d.b = d.b[n:]
+	return v, nil
+}
+
+func (d *protoDecoder) key() (int, int, error) {
+	k, err := d.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(k >> 3), int(k & 7), nil
+}
+
+func (d *protoDecoder) fixed64() (uint64, error) {
+	if len(d.b) < 8 {
+		return 0, errProtoTruncated
+	}
+	v := binary.LittleEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v, nil
+}
+
+func (d *protoDecoder) bytes() ([]byte, error) {
+	n, err := d.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.b)) {
+		return nil, errProtoTruncated
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v, nil
+}
+
+// skip passes over a field of a type the decoder does not read
+func (d *protoDecoder) skip(wire int) error {
+	var err error
+	switch wire {
+	case protoVarint:
+		_, err = d.varint()
+	case protoFixed64:
+		_, err = d.fixed64()
+	case protoBytes:
+		_, err = d.bytes()
+	case protoFixed32:
+		if len(d.b) < 4 {
+			return errProtoTruncated
+		}
+		d.b = d.b[4:]
+	default:
+		return fmt.Errorf("unsupported wire type %d", wire)
+	}
+	return err
+}
+
+// snappyDecode decompresses a snappy block, the format of remote_write
+// bodies (not the framed stream format), of at most limit bytes
+func snappyDecode(src []byte, limit int) ([]byte, error) {
+	errCorrupt := errors.New("corrupt snappy block")
+	n, k := binary.Uvarint(src)
+	if k <= 0 {
+		return nil, errCorrupt
+	}
+	if n > uint64(limit) {
+		return nil, fmt.Errorf("body decompresses to more than %d bytes", limit)
+	}
+	src = src[k:]
+	dst := make([]byte, 0, n)
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			// literal, lengths above 60 follow the tag in 1 to 4 bytes
+			length = int(tag>>2) + 1
+			src = src[1:]
+			if length > 60 {
+				extra := length - 60
+				if len(src) < extra {
+					return nil, errCorrupt
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				length++
+				src = src[extra:]
+			}
+			if length <= 0 || length > len(src) || len(dst)+length > int(n) {
+				return nil, errCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, errCorrupt
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, errCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, errCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(n) {
+			return nil, errCorrupt
+		}
+		// copies may overlap what they append, e.g. a run of one byte
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if len(dst) != int(n) {
+		return nil, errCorrupt
+	}
+	return dst, nil
+}
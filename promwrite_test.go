@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSnappyDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		block string
+		want  string
+	}{
+		{"empty", "00", ""},
+		{"literal", "09205769 6b697065 646961", "Wikipedia"},
+		// the example of the Wikipedia article on snappy: a literal of 67
+		// bytes with its length in an extra byte, a 1 byte offset copy and
+		// a short literal
+		{"wikipedia", "51 f042" +
+			"57696b697065646961206973206120667265652c20776562" +
+			"2d62617365642c20636f6c6c61626f7261746976652c206d" +
+			"756c74696c696e6775616c20656e6379636c6f" +
+			"093f 1c70726f6a6563742e",
+			"Wikipedia is a free, web-based, collaborative, multilingual encyclopedia project."},
+		{"overlapping copy", "0804616209 02", "abababab"},
+		{"2 byte offset copy", "080c616263640e0400", "abcdabcd"},
+		{"4 byte offset copy", "080c616263640f04000000", "abcdabcd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := snappyDecode(mustHex(t, tt.block), 1<<20)
+			if err != nil {
+				t.Fatalf("snappyDecode: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("snappyDecode = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnappyDecodeCorrupt(t *testing.T) {
+	tests := []struct {
+		name  string
+		block string
+		limit int
+	}{
+		{"no length", "", 100},
+		{"shorter than declared", "020061", 100},
+		{"longer than declared", "0104 6161", 100},
+		{"offset past the start", "0804616209 03", 100},
+		{"zero offset", "0804616209 00", 100},
+		{"truncated copy", "04046162 09", 100},
+		{"truncated literal", "0a246162", 100},
+		{"over the limit", "09205769 6b697065 646961", 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := snappyDecode(mustHex(t, tt.block), tt.limit); err == nil {
+				t.Errorf("snappyDecode = %q, want an error", got)
+			}
+		})
+	}
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	// two series of a prometheus.WriteRequest, with the varint 150 of the
+	// protobuf encoding guide (08 96 01) and a metadata entry in between,
+	// which are skipped
+	req := mustHex(t, "0a410a0e0a085f5f6e616d655f5f120275700a0b0a036a6f6212046e6f6465"+
+		"121009000000000000f03f1080d095ffbc31121009000000000000e03f1098c596ffbc31"+
+		"089601"+
+		"0a240a100a085f5f6e616d655f5f120474656d7012100900000000004035401080d095ffbc31"+
+		"1a020801")
+	want := []promSeries{
+		{
+			labels:  map[string]string{"__name__": "up", "job": "node"},
+			samples: []promSample{{1, 1700000000000}, {0.5, 1700000015000}},
+		},
+		{
+			labels:  map[string]string{"__name__": "temp"},
+			samples: []promSample{{21.25, 1700000000000}},
+		},
+	}
+	got, err := decodeWriteRequest(req)
+	if err != nil {
+		t.Fatalf("decodeWriteRequest: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decodeWriteRequest = %+v, want %+v", got, want)
+	}
+
+	// every prefix that cuts a field short is an error
+	for _, n := range []int{1, 2, 10, 40, 66} {
+		if _, err := decodeWriteRequest(req[:n]); err == nil {
+			t.Errorf("decodeWriteRequest of the first %d bytes succeeded", n)
+		}
+	}
+}
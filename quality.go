@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// readings stamped further in the future than this are timestamp anomalies
+const maxFutureSkew = time.Minute
+
+// nodeQuality counts the problems seen in the readings of one node
+type nodeQuality struct {
+	outOfRange         int64
+	timestampAnomalies int64
+	gaps               int64
+	lastTime           time.Time
+}
+
+type qualityReport struct {
+	Node string `json:"node"`
+	// percentage of records that parsed, were in range and correctly stamped
+	Score              float64 `json:"score"`
+	Records            int64   `json:"records"`
+	Malformed          int64   `json:"malformed"`
+	MalformedRate      float64 `json:"malformed_rate"`
+	OutOfRange         int64   `json:"out_of_range"`
+	TimestampAnomalies int64   `json:"timestamp_anomalies"`
+	Gaps               int64   `json:"gaps"`
+}
+
+type valueRange struct {
+	Min float64
+	Max float64
+}
+
+func (vr valueRange) contains(v float64) bool {
+	return v >= vr.Min && v <= vr.Max
+}
+
+// observeQuality checks one accepted reading of node for implausible
+// values, timestamps in the future or going backwards, and gaps
+func (s *nodeStore) observeQuality(node string, rd reading, received time.Time, cfg *config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := &s.get(node).quality
+	for name, v := range rd.Values {
+		if f, ok := cfg.Schema.field(name); ok && f.Range != nil && !f.Range.contains(v) {
+			q.outOfRange++
+			break
+		}
+	}
+
+	if rd.Time.After(received.Add(maxFutureSkew)) || (!q.lastTime.IsZero() && !rd.Time.After(q.lastTime)) {
+		q.timestampAnomalies++
+	} else {
+		if !q.lastTime.IsZero() && rd.Time.Sub(q.lastTime) > cfg.GapThreshold {
+			q.gaps++
+		}
+		q.lastTime = rd.Time
+	}
+}
+
+func (n *nodeStatus) qualityReport() qualityReport {
+	rep := qualityReport{
+		Node:               n.Node,
+		Records:            n.recordsParsed + n.recordsRejected,
+		Malformed:          n.recordsRejected,
+		OutOfRange:         n.quality.outOfRange,
+		TimestampAnomalies: n.quality.timestampAnomalies,
+		Gaps:               n.quality.gaps,
+		Score:              100,
+	}
+	if rep.Records > 0 {
+		rep.MalformedRate = float64(rep.Malformed) / float64(rep.Records)
+		bad := rep.Malformed + rep.OutOfRange + rep.TimestampAnomalies
+		if bad > rep.Records {
+			bad = rep.Records
+		}
+		rep.Score = 100 * float64(rep.Records-bad) / float64(rep.Records)
+	}
+	return rep
+}
+
+// quality returns the quality report of every node sorted by name
+func (s *nodeStore) quality() []qualityReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var list []qualityReport
+	for _, n := range s.nodes {
+		list = append(list, n.qualityReport())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Node < list[j].Node })
+	return list
+}
+
+// nodeQualityReport returns the report of one node, ok is false for unknown
+// nodes
+func (s *nodeStore) nodeQualityReport(node string) (qualityReport, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n, ok := s.nodes[node]
+	if !ok {
+		return qualityReport{}, false
+	}
+	return n.qualityReport(), true
+}
+
+func getQuality(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	t := r.Context().Value(key("tenant")).(*tenant)
+	scope := requestScope(r.Context())
+	reports := []qualityReport{}
+	for _, rep := range t.nodes.quality() {
+		if scope.allows(rep.Node) {
+			reports = append(reports, rep)
+		}
+	}
+	writeJSON(w, map[string]interface{}{"nodes": reports})
+}
+
+func getNodeQuality(w http.ResponseWriter, r *http.Request, node string) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	t := r.Context().Value(key("tenant")).(*tenant)
+	rep, ok := t.nodes.nodeQualityReport(node)
+	if !ok {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, rep)
+}
+
+// collectQuality exports the quality indicators of all nodes as metrics
+func collectQuality(reg *tenantRegistry) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		type row struct {
+			tenant string
+			rep    qualityReport
+		}
+		var rows []row
+		for _, t := range sortedTenants(reg) {
+			for _, rep := range t.nodes.quality() {
+				rows = append(rows, row{t.Name, rep})
+			}
+		}
+
+		families := []struct {
+			name, typ, help string
+			value           func(rep qualityReport) float64
+		}{
+			{"sensor_node_quality_score", "gauge", "Percentage of good records of a node.", func(rep qualityReport) float64 { return rep.Score }},
+			{"sensor_node_records_total", "counter", "Records received from a node.", func(rep qualityReport) float64 { return float64(rep.Records) }},
+			{"sensor_node_malformed_records_total", "counter", "Records of a node that failed to parse.", func(rep qualityReport) float64 { return float64(rep.Malformed) }},
+			{"sensor_node_out_of_range_total", "counter", "Readings of a node with values outside the plausible range.", func(rep qualityReport) float64 { return float64(rep.OutOfRange) }},
+			{"sensor_node_timestamp_anomalies_total", "counter", "Readings of a node stamped in the future or out of order.", func(rep qualityReport) float64 { return float64(rep.TimestampAnomalies) }},
+			{"sensor_node_gaps_total", "counter", "Gaps longer than GAP_THRESHOLD between readings of a node.", func(rep qualityReport) float64 { return float64(rep.Gaps) }},
+		}
+		for _, f := range families {
+			mw.family(f.name, f.typ, f.help)
+			for _, row := range rows {
+				mw.sample(f.name, f.value(row.rep), "tenant", row.tenant, "node", row.rep.Node)
+			}
+		}
+	}
+}
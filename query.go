@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fluxString quotes s as a flux string literal
+func fluxString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// parseTimeParam accepts either an RFC3339 time or a duration relative to now
+// (e.g. "-1h"), returning def when the parameter is empty
+func parseTimeParam(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// pageParams reads limit and offset, capping the limit at the configured
+// maximum so a single query cannot return unbounded results
+func pageParams(q url.Values, cfg *config) (limit int, offset int, err error) {
+	limit = cfg.QueryDefaultLimit
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			return 0, 0, errors.New("invalid limit")
+		}
+	}
+	if limit > cfg.QueryMaxLimit {
+		limit = cfg.QueryMaxLimit
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+	}
+	return limit, offset, nil
+}
+
+// timezoneParam reads tz, the timezone times are rendered in: an IANA name,
+// or "node" for the timezone of node in NODE_TIMEZONES. UTC by default.
+func timezoneParam(q url.Values, cfg *config, node string) (*time.Location, error) {
+	switch v := q.Get("tz"); v {
+	case "", "UTC":
+		return time.UTC, nil
+	case "node":
+		if node == "" {
+			return nil, errors.New("tz=node needs a node")
+		}
+		if loc, ok := cfg.NodeTimezones[node]; ok {
+			return loc, nil
+		}
+		return time.UTC, nil
+	default:
+		// Local would depend on the server
+		loc, err := time.LoadLocation(v)
+		if err != nil || v == "Local" {
+			return nil, errors.New("invalid tz")
+		}
+		return loc, nil
+	}
+}
+
+// queryFailed answers 502 for a failed query, unless the client went away and
+// canceled it, in which case there is nobody left to answer
+func queryFailed(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		log.Printf("query canceled: %s\n", r.Context().Err())
+		return
+	}
+	log.Println(err)
+	http.Error(w, "502 - Query failed", http.StatusBadGateway)
+}
+
+func getReadings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	format, ok := responseFormat(r)
+	if !ok {
+		http.Error(w, "406 - Supported formats are json, csv and ndjson", http.StatusNotAcceptable)
+		return
+	}
+
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+
+	q := r.URL.Query()
+	node := q.Get("node")
+	measurement := q.Get("measurement")
+	if measurement == "" {
+		measurement = cfg.Schema.primary().Measurement
+	}
+	if _, ok := cfg.Schema.Measurements[measurement]; node == "" || !ok {
+		http.Error(w, "400 - node and a known measurement are required", http.StatusBadRequest)
+		return
+	}
+	if !nodeInScope(w, r, node) {
+		return
+	}
+	// the resource of the node replaces this endpoint
+	w.Header().Set("Deprecation", "true")
+	w.Header().Add("Link", "<"+apiPrefix+"/nodes/"+url.PathEscape(node)+"/measurements/"+url.PathEscape(measurement)+`/readings>; rel="successor-version"`)
+
+	req, err := parseReadingsRequest(q, cfg, node, measurement)
+	if err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	readings, next, err := readingsPage(ctx, t, r, req)
+	if err != nil {
+		queryFailed(w, r, err)
+		return
+	}
+	if next != "" {
+		w.Header().Add("Link", "<"+next+`>; rel="next"`)
+	}
+
+	switch format {
+	case formatCSV:
+		writeCSV(w, append([]string{"time"}, req.fields...), readings)
+	case formatNDJSON:
+		writeNDJSON(w, readings)
+	default:
+		writeJSON(w, map[string]interface{}{
+			"node":        node,
+			"measurement": measurement,
+			"readings":    readings,
+			"limit":       req.limit,
+			"offset":      req.offset,
+			"next":        next,
+		})
+	}
+}
+
+// readingsRequest is a page of readings of one measurement of a node
+type readingsRequest struct {
+	node        string
+	measurement string
+	fields      []string
+	start, stop time.Time
+	// optionally downsample to one mean value per window
+	every         time.Duration
+	limit, offset int
+	loc           *time.Location
+}
+
+// parseReadingsRequest reads the range, window, page and timezone of a
+// readings query of a known measurement
+func parseReadingsRequest(q url.Values, cfg *config, node, measurement string) (readingsRequest, error) {
+	req := readingsRequest{node: node, measurement: measurement, fields: cfg.Schema.Measurements[measurement]}
+	now := time.Now()
+	var err error
+	if req.start, err = parseTimeParam(q.Get("start"), now.Add(-time.Hour)); err != nil {
+		return req, errors.New("invalid start")
+	}
+	if req.stop, err = parseTimeParam(q.Get("stop"), now); err != nil || !req.stop.After(req.start) {
+		return req, errors.New("invalid stop")
+	}
+	if req.limit, req.offset, err = pageParams(q, cfg); err != nil {
+		return req, err
+	}
+	if req.loc, err = timezoneParam(q, cfg, node); err != nil {
+		return req, err
+	}
+	if v := q.Get("every"); v != "" {
+		if req.every, err = time.ParseDuration(v); err != nil || req.every < time.Second {
+			return req, errors.New("invalid every")
+		}
+	}
+	return req, nil
+}
+
+// readingsPage queries a page of readings as rows of the measurement's
+// fields. next is the URL of the following page, empty on the last page.
+func readingsPage(ctx context.Context, t *tenant, r *http.Request, req readingsRequest) (rows []map[string]interface{}, next string, err error) {
+	// one row more than the page tells whether there is a next page
+	rds, err := queryReadings(ctx, t, req.node, req.measurement, req.start, req.stop, req.every, req.limit+1, req.offset)
+	if err != nil {
+		return nil, "", err
+	}
+	rows = []map[string]interface{}{}
+	for _, rd := range rds {
+		row := map[string]interface{}{"time": rd.Time.In(req.loc)}
+		for _, f := range req.fields {
+			if v, ok := rd.Values[f]; ok {
+				row[f] = v
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rows) > req.limit {
+		rows = rows[:req.limit]
+		// pin the range so later pages do not shift with a relative start
+		nq := r.URL.Query()
+		nq.Set("start", req.start.UTC().Format(time.RFC3339Nano))
+		nq.Set("stop", req.stop.UTC().Format(time.RFC3339Nano))
+		nq.Set("limit", strconv.Itoa(req.limit))
+		nq.Set("offset", strconv.Itoa(req.offset+req.limit))
+		next = r.URL.Path + "?" + nq.Encode()
+	}
+	return rows, next, nil
+}
+
+// queryReadings returns the readings of a measurement of node ordered by
+// time, the means of each window when every is set
+func queryReadings(ctx context.Context, t *tenant, node, measurement string, start, stop time.Time, every time.Duration, limit, offset int) ([]reading, error) {
+	// series are split by extra tags such as clock_corrected, merge them
+	// back into one table per field
+	flux := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %s and r.location == %s)
+  |> group(columns: ["_measurement", "_field", "location"])
+  |> sort(columns: ["_time"])`,
+		fluxString(t.Bucket), start.UTC().Format(time.RFC3339Nano), stop.UTC().Format(time.RFC3339Nano),
+		fluxString(measurement), fluxString(node))
+	if every > 0 {
+		flux += fmt.Sprintf("\n  |> aggregateWindow(every: %ds, fn: mean, createEmpty: false)", int64(every/time.Second))
+	}
+	flux += fmt.Sprintf(`
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group()
+  |> sort(columns: ["_time"])
+  |> limit(n: %d, offset: %d)`, limit, offset)
+
+	t.usage.Queries.Add(1)
+	result, err := t.queryApi.Query(ctx, scopeFlux(ctx, flux))
+	traceOf(ctx).phase("query")
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var readings []reading
+	for result.Next() {
+		rec := result.Record()
+		rd := reading{Time: rec.Time(), Values: make(map[string]float64)}
+		for k, v := range rec.Values() {
+			if f, ok := v.(float64); ok && !strings.HasPrefix(k, "_") {
+				rd.Values[k] = f
+			}
+		}
+		readings = append(readings, rd)
+	}
+	return readings, result.Err()
+}
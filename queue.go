@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	bolt "go.etcd.io/bbolt"
+)
+
+// writeQueue keeps the points waiting in the write buffers on disk
+// (WRITE_QUEUE_PATH), so they survive a crash or a deploy and are written
+// after the restart. Every tenant has a bucket of entries keyed by sequence,
+// each holding the time it was queued and the points as line protocol.
+type writeQueue struct {
+	db *bolt.DB
+}
+
+func openWriteQueue(path string) (*writeQueue, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening write queue %s: %w", path, err)
+	}
+	return &writeQueue{db: db}, nil
+}
+
+// queuedWrite is an entry of the queue
+type queuedWrite struct {
+	id     uint64
+	queued time.Time
+	points []*write.Point
+}
+
+// add stores points for tenant and returns the id of the entry
+func (q *writeQueue) add(tenant string, queued time.Time, points []*write.Point) (uint64, error) {
+	var value bytes.Buffer
+	binary.Write(&value, binary.BigEndian, queued.UnixNano())
+	for _, p := range points {
+		value.WriteString(write.PointToLineProtocol(p, time.Nanosecond))
+	}
+
+	var id uint64
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(tenant))
+		if err != nil {
+			return err
+		}
+		if id, err = b.NextSequence(); err != nil {
+			return err
+		}
+		return b.Put(queueKey(id), value.Bytes())
+	})
+	return id, err
+}
+
+// remove deletes the entries of tenant that were written or evicted
+func (q *writeQueue) remove(tenant string, ids ...uint64) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(tenant))
+		if b == nil {
+			return nil
+		}
+		for _, id := range ids {
+			if err := b.Delete(queueKey(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// load returns the entries of tenant in the order they were queued. Entries
+// that cannot be read any more are logged and deleted.
+func (q *writeQueue) load(tenant string) ([]queuedWrite, error) {
+	var entries []queuedWrite
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(tenant))
+		if b == nil {
+			return nil
+		}
+		// deleting while iterating would skip entries
+		var unreadable [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			id := binary.BigEndian.Uint64(k)
+			var points []*write.Point
+			var err error
+			if len(v) >= 8 {
+				points, err = parseLineProtocol(bytes.NewReader(v[8:]))
+			}
+			if len(v) < 8 || err != nil {
+				log.Printf("write queue: dropping unreadable entry %d of %s: %v\n", id, tenant, err)
+				unreadable = append(unreadable, k)
+				continue
+			}
+			queued := time.Unix(0, int64(binary.BigEndian.Uint64(v[:8])))
+			entries = append(entries, queuedWrite{id, queued, points})
+		}
+		for _, k := range unreadable {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (q *writeQueue) close() error {
+	return q.db.Close()
+}
+
+func queueKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// rateMeasurement holds the first derivatives of RATE_FIELDS, one field
+// "<field>_per_min" each, in units of the field per minute
+const rateMeasurement = "rate_of_change"
+
+// observeRate derives the rate of change of the RATE_FIELDS of rd against the
+// previous reading of node, raises a rate_of_change event for rates beyond
+// RATE_ALERTS and returns the point to store, nil when there is nothing to
+// derive. Readings further apart than GAP_THRESHOLD start over.
+func observeRate(t *tenant, cfg *config, events *eventBus, node string, rd reading) *write.Point {
+	if len(cfg.RateFields) == 0 {
+		return nil
+	}
+	rates := t.nodes.observeRate(node, rd, cfg.RateFields, cfg.GapThreshold)
+	if len(rates) == 0 {
+		return nil
+	}
+
+	p := cfg.Schema.newPoint(rateMeasurement, node, rd.Time)
+	for _, f := range cfg.RateFields {
+		rate, ok := rates[f]
+		if !ok {
+			continue
+		}
+		p.AddField(f+"_per_min", rate)
+		if limit, ok := cfg.RateAlerts[f]; ok && math.Abs(rate) > limit {
+			direction := "rose"
+			if rate < 0 {
+				direction = "fell"
+			}
+			events.emit(t, event{
+				Node:  node,
+				Type:  "rate_of_change",
+				Title: "Fast " + f + " change",
+				Text:  fmt.Sprintf("%s %s %.2f per minute, beyond %.2f", f, direction, math.Abs(rate), limit),
+				Time:  rd.Time,
+			})
+		}
+	}
+	return p
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Role-based access: every request acts as a principal with one role, and
+// every endpoint group needs a permission.
+//
+//	device    ingest
+//	viewer    read
+//	operator  ingest, read and operate (backfill)
+//	admin     everything, including the /admin endpoints
+//
+// Principals come from the accounts of BASIC_AUTH, from the ACCESS_KEYS_FILE
+// keys, from HS256 tokens signed with JWT_SECRET, also issued to the
+// dashboard users of users.go, from the ID tokens of the OIDC provider of
+// oidc.go, from the tenant keys of TENANTS_FILE, which act as operators, and
+// from the ADMIN_TOKEN. Without a tenants file, requests without a key act
+// with ANONYMOUS_ROLE.
+
+type permission string
+
+const (
+	permIngest  permission = "ingest"
+	permRead    permission = "read"
+	permOperate permission = "operate"
+	permAdmin   permission = "admin"
+)
+
+var rolePermissions = map[string][]permission{
+	"device":   {permIngest},
+	"viewer":   {permRead},
+	"operator": {permIngest, permRead, permOperate},
+	"admin":    {permIngest, permRead, permOperate, permAdmin},
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// principal is who a request acts as
+type principal struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	// session of a dashboard user, see sessions.go
+	Session string `json:"-"`
+	// requests without credentials, see ANONYMOUS_ROLE
+	anonymous bool
+	// nodes it may read, see scope.go
+	scope *nodeScope
+	// opens the payloads of a device, see payloadcrypt.go
+	payloadKey cipher.AEAD
+}
+
+func (p *principal) can(perm permission) bool {
+	for _, have := range rolePermissions[p.Role] {
+		if have == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// accessKey is an entry of ACCESS_KEYS_FILE
+type accessKey struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	Role string `json:"role"`
+	// tenant name, the default tenant when empty
+	Tenant string `json:"tenant"`
+	// nodes, and zones of nodes, the key may read, all when both are empty
+	Nodes []string `json:"nodes"`
+	Zones []string `json:"zones"`
+	// AES key of encrypted payloads in hex, see payloadcrypt.go
+	PayloadKey string `json:"payload_key"`
+
+	tenant     *tenant
+	scope      *nodeScope
+	payloadKey cipher.AEAD
+}
+
+// loadAccessKeys reads the role keys of ACCESS_KEYS_FILE into reg
+func loadAccessKeys(cfg *config, reg *tenantRegistry) error {
+	reg.keys = make(map[string]*accessKey)
+	if cfg.AccessKeysFile == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(cfg.AccessKeysFile)
+	if err != nil {
+		return err
+	}
+	var keys []*accessKey
+	if err := json.Unmarshal(raw, &keys); err != nil {
+		return fmt.Errorf("parsing %s: %w", cfg.AccessKeysFile, err)
+	}
+	for _, k := range keys {
+		if k.Name == "" || k.Key == "" || !validRole(k.Role) {
+			return fmt.Errorf("access key %q: name, key and a role of device, viewer, operator or admin are required", k.Name)
+		}
+		if _, ok := reg.keys[k.Key]; ok || reg.byKey[k.Key] != nil {
+			return fmt.Errorf("access key %q: duplicate key", k.Name)
+		}
+		if k.tenant = reg.byName(k.Tenant); k.tenant == nil {
+			return fmt.Errorf("access key %q: unknown tenant %q", k.Name, k.Tenant)
+		}
+		if k.scope, err = newNodeScope(cfg, k.Nodes, k.Zones); err != nil {
+			return fmt.Errorf("access key %q: %w", k.Name, err)
+		}
+		if k.PayloadKey != "" {
+			if k.payloadKey, err = newPayloadCipher(k.PayloadKey); err != nil {
+				return fmt.Errorf("access key %q: %w", k.Name, err)
+			}
+		}
+		reg.keys[k.Key] = k
+	}
+	return nil
+}
+
+// bearerToken returns the token of an Authorization: Bearer header
+func bearerToken(r *http.Request) string {
+	if v := r.Header.Get("Authorization"); strings.HasPrefix(v, "Bearer ") {
+		return strings.TrimPrefix(v, "Bearer ")
+	}
+	return ""
+}
+
+// authenticate finds the principal of a request and its tenant from, in
+// this order, basic auth credentials, a bearer token, an API key or a
+// dashboard session
+func authenticate(r *http.Request, cfg *config, reg *tenantRegistry) (*principal, *tenant, error) {
+	if p, ok, err := basicPrincipal(r, cfg); ok {
+		if err != nil {
+			return nil, nil, err
+		}
+		return p, reg.single, nil
+	}
+
+	token := bearerToken(r)
+	apiKey := requestAPIKey(r)
+	if token == "" && apiKey == "" {
+		token = sessionToken(r)
+	}
+	if o, _ := r.Context().Value(key("oidc")).(*oidcProvider); o != nil && token != "" && tokenAlgorithm(token) == "RS256" {
+		p, err := o.principal(r.Context(), token)
+		if err != nil {
+			return nil, nil, err
+		}
+		t := reg.byName(cfg.OIDCTenant)
+		if t == nil {
+			return nil, nil, fmt.Errorf("unknown OIDC_TENANT")
+		}
+		return p, t, nil
+	}
+	if token != "" && looksLikeJWT(token) {
+		if cfg.JWTSecret == "" {
+			return nil, nil, fmt.Errorf("tokens are not accepted")
+		}
+		claims, err := verifyJWT(cfg.JWTSecret, token)
+		if err != nil {
+			return nil, nil, err
+		}
+		t := reg.byName(claims.Tenant)
+		if t == nil || !validRole(claims.Role) {
+			return nil, nil, fmt.Errorf("invalid token claims")
+		}
+		scope, err := newNodeScope(cfg, claims.Nodes, claims.Zones)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid token claims")
+		}
+		if claims.SessionID != "" {
+			users := r.Context().Value(key("users")).(*userStore)
+			if !users.sessions.touch(claims.SessionID) {
+				return nil, nil, fmt.Errorf("session ended")
+			}
+		}
+		return &principal{Name: claims.Subject, Role: claims.Role, Session: claims.SessionID, scope: scope}, t, nil
+	}
+
+	if k, ok := reg.keys[apiKey]; ok {
+		return &principal{Name: k.Name, Role: k.Role, scope: k.scope, payloadKey: k.payloadKey}, k.tenant, nil
+	}
+	if reg.single != nil {
+		// a wrong key is an error, not a request without one
+		if apiKey != "" {
+			return nil, nil, fmt.Errorf("invalid API key")
+		}
+		if cfg.AnonymousRole == "" {
+			return nil, nil, fmt.Errorf("an API key is required")
+		}
+		return &principal{Name: "anonymous", Role: cfg.AnonymousRole, anonymous: true}, reg.single, nil
+	}
+	if t, ok := reg.byKey[apiKey]; ok {
+		return &principal{Name: t.Name, Role: "operator"}, t, nil
+	}
+	return nil, nil, fmt.Errorf("invalid API key")
+}
+
+// requirePermission rejects requests whose principal lacks perm, it runs
+// after withTenant
+func requirePermission(perm permission, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.Context().Value(key("principal")).(*principal)
+		if !p.can(perm) && p.anonymous {
+			challengeBasic(w, r.Context().Value(key("config")).(*config))
+			http.Error(w, "401 - Credentials required", http.StatusUnauthorized)
+			return
+		}
+		if !p.can(perm) {
+			http.Error(w, fmt.Sprintf("403 - Role %s may not %s", p.Role, perm), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withPrincipal stores p in the request context
+func withPrincipal(r *http.Request, p *principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), key("principal"), p))
+}
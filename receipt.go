@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Receipts: every point stored for a record is answered with an ID, the
+// first 16 hex digits of the SHA-256 of "<node>|<measurement>|<time>", time
+// in nanoseconds at the write precision. Node, measurement and time are the
+// key of a point in InfluxDB, so firmware can compute the ID of a reading it
+// sent and look it up in the log line written once the point is stored, or
+// in InfluxDB, when data is said to be missing.
+
+// pointReceipt identifies a stored point of the record at Index
+type pointReceipt struct {
+	Index       int       `json:"index"`
+	Measurement string    `json:"measurement"`
+	Time        time.Time `json:"time"`
+	ID          string    `json:"id"`
+}
+
+// pointID is the ID of p, a point of node
+func pointID(node string, p *write.Point, precision time.Duration) string {
+	at := p.Time().Truncate(precision).UnixNano()
+	sum := sha256.Sum256([]byte(node + "|" + p.Name() + "|" + strconv.FormatInt(at, 10)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// pointReceipts returns the receipts of the points of record index of node
+func pointReceipts(node string, index int, points []*write.Point, precision time.Duration) []pointReceipt {
+	receipts := make([]pointReceipt, 0, len(points))
+	for _, p := range points {
+		receipts = append(receipts, pointReceipt{
+			Index:       index,
+			Measurement: p.Name(),
+			Time:        p.Time().Truncate(precision).UTC(),
+			ID:          pointID(node, p, precision),
+		})
+	}
+	return receipts
+}
+
+// logStored records the IDs of points of node once they are in InfluxDB
+func logStored(node string, receipts []pointReceipt) {
+	if len(receipts) == 0 {
+		return
+	}
+	ids := make([]string, len(receipts))
+	for i, rc := range receipts {
+		ids[i] = rc.Measurement + ":" + rc.ID
+	}
+	detailf("stored %s: %s\n", node, strings.Join(ids, " "))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// withRecovery turns a panic of a handler into a 500 answer instead of a
+// dropped connection, and logs its stack with the request ID. Once the
+// handler has started the response only the log remains.
+func withRecovery(panics *atomic.Int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// the way for handlers to abort a response on purpose
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			panics.Add(1)
+			id := traceOf(r.Context()).requestID()
+			log.Printf("panic: id=%s method=%s path=%s: %v\n%s", id, r.Method, r.URL.Path, v, debug.Stack())
+			if rec.status != 0 {
+				return
+			}
+			body, _ := json.Marshal(map[string]resourceError{"error": {
+				Status:    http.StatusInternalServerError,
+				Message:   "internal server error",
+				RequestID: id,
+			}})
+			h := w.Header()
+			h.Del("Content-Length")
+			h.Del("Content-Encoding")
+			h.Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(body)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+func collectPanics(panics *atomic.Int64) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		mw.family("sensor_http_panics_total", "counter", "Requests whose handler panicked and that were answered with 500.")
+		mw.sample("sensor_http_panics_total", float64(panics.Load()))
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Shared state: with REDIS_URL the replicas of a deployment share the dedup
+// cache, the Idempotency-Key store, the latest reading of every node and the
+// alerts through Redis, so a retry or a duplicate landing on another instance
+// is caught all the same. Each of them falls back to its in-memory state while
+// Redis is unreachable. The throttling of ingest follows the local write
+// buffer and stays per instance.
+
+// redisClient speaks just enough RESP for the commands used here, over one
+// connection that is redialed after a failure
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	// prepended to every key, REDIS_PREFIX
+	prefix  string
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+	// last failure, requests use local state for a while after it instead
+	// of waiting for the dial timeout each
+	failed time.Time
+	// last time a failure was logged, to not log one per request
+	logged time.Time
+}
+
+// how long after a failure Redis is not asked
+const redisRetryAfter = 5 * time.Second
+
+var errRedisDown = errors.New("redis: unavailable")
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// newRedisClient parses redis://[:password@]host[:port][/db]
+func newRedisClient(rawURL, prefix string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid REDIS_URL: expected redis://[:password@]host[:port][/db]")
+	}
+	c := &redisClient{addr: u.Host, prefix: prefix, timeout: 2 * time.Second}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+		if c.password == "" {
+			c.password = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: database %q is not a number", db)
+		}
+	}
+	return c, nil
+}
+
+// key namespaces parts under the prefix
+func (c *redisClient) key(parts ...string) string {
+	return c.prefix + strings.Join(parts, ":")
+}
+
+// do runs one command
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	replies, err := c.pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(redisError); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
+
+// pipeline sends cmds at once and returns their replies in order; error
+// replies are returned as redisError values
+func (c *redisClient) pipeline(cmds [][]string) ([]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil && time.Since(c.failed) < redisRetryAfter {
+		return nil, errRedisDown
+	}
+	replies, err := c.exchange(cmds)
+	if err != nil {
+		c.failed = time.Now()
+		if c.conn != nil {
+			c.conn.Close()
+			c.conn = nil
+		}
+		if time.Since(c.logged) > time.Minute {
+			log.Printf("redis: %s, using local state\n", err)
+			c.logged = time.Now()
+		}
+	}
+	return replies, err
+}
+
+// exchange writes cmds and reads their replies, dialing first when needed.
+// c.mu must be held.
+func (c *redisClient) exchange(cmds [][]string) ([]interface{}, error) {
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	var sb strings.Builder
+	for _, args := range cmds {
+		writeRESP(&sb, args)
+	}
+	if _, err := io.WriteString(c.conn, sb.String()); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		reply, err := readRESP(c.rd)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// dial connects and authenticates. c.mu must be held.
+func (c *redisClient) dial() error {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return err
+	}
+	c.conn, c.rd = conn, bufio.NewReader(conn)
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) == 0 {
+		return nil
+	}
+	replies, err := c.exchange(setup)
+	if err != nil {
+		return err
+	}
+	for _, r := range replies {
+		if e, ok := r.(redisError); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func writeRESP(sb *strings.Builder, args []string) {
+	fmt.Fprintf(sb, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(sb, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+// readRESP reads one reply: a string, an int64, nil, a redisError or a
+// []interface{} of those
+func readRESP(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			if list[i], err = readRESP(rd); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// filterShared is filter against the keys in Redis, SET NX tells whether a
+// point is new. ok is false when Redis could not be asked.
+func (c *dedupCache) filterShared(points []*write.Point) (kept []*write.Point, duplicates int, ok bool) {
+	window := strconv.FormatInt(c.window.Milliseconds(), 10)
+	cmds := make([][]string, len(points))
+	for i, p := range points {
+		cmds[i] = []string{"SET", c.shared.key("dedup", c.namespace, c.key(p)), "1", "NX", "PX", window}
+	}
+	replies, err := c.shared.pipeline(cmds)
+	if err != nil {
+		return nil, 0, false
+	}
+	for i, p := range points {
+		if replies[i] == nil {
+			duplicates++
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept, duplicates, true
+}
+
+func (c *dedupCache) forgetShared(points []*write.Point) {
+	args := []string{"DEL"}
+	for _, p := range points {
+		args = append(args, c.shared.key("dedup", c.namespace, c.key(p)))
+	}
+	c.shared.do(args...)
+}
+
+// sharedResponse is an idempotentResponse as kept in Redis
+type sharedResponse struct {
+	Done   bool        `json:"done"`
+	Hash   string      `json:"hash"`
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// beginShared is begin against Redis: SET NX reserves k, otherwise the
+// stored entry is returned. handled is false when Redis could not be asked.
+func (s *idempotencyStore) beginShared(k, hash string) (res *idempotentResponse, reserved, handled bool) {
+	rk := s.shared.key("idempotency", k)
+	reservation, _ := json.Marshal(sharedResponse{Hash: hash})
+	reply, err := s.shared.do("SET", rk, string(reservation), "NX", "PX", strconv.FormatInt(s.ttl.Milliseconds(), 10))
+	if err != nil {
+		return nil, false, false
+	}
+	if reply != nil {
+		return nil, true, true
+	}
+	reply, err = s.shared.do("GET", rk)
+	if err != nil {
+		return nil, false, false
+	}
+	stored, _ := reply.(string)
+	var sr sharedResponse
+	if reply == nil || json.Unmarshal([]byte(stored), &sr) != nil {
+		// expired in between, or not ours to read
+		return nil, false, true
+	}
+	return &idempotentResponse{done: sr.Done, hash: sr.Hash, status: sr.Status, header: sr.Header, body: sr.Body}, false, true
+}
+
+func (s *idempotencyStore) finishShared(k, hash string, rec *responseRecorder) {
+	rk := s.shared.key("idempotency", k)
+	if rec.status == 0 || rec.status >= 500 {
+		s.shared.do("DEL", rk)
+		return
+	}
+	b, _ := json.Marshal(sharedResponse{Done: true, Hash: hash, Status: rec.status, Header: ownHeaders(rec.Header(), replayedHeaders), Body: rec.body.Bytes()})
+	// keeps the expiry of the reservation
+	s.shared.do("SET", rk, string(b), "XX", "KEEPTTL")
+}
+
+func (s *idempotencyStore) seenShared(k, hash string) (seen, ok bool) {
+	reply, err := s.shared.do("GET", s.shared.key("idempotency", k))
+	if err != nil {
+		return false, false
+	}
+	stored, _ := reply.(string)
+	var sr sharedResponse
+	if reply == nil || json.Unmarshal([]byte(stored), &sr) != nil {
+		return false, true
+	}
+	return sr.Hash == hash, true
+}
+
+// sharedLatest is the latest reading of a node as kept in the Redis hash of
+// its tenant
+type sharedLatest struct {
+	LastSeen time.Time          `json:"last_seen"`
+	Time     time.Time          `json:"time"`
+	Values   map[string]float64 `json:"values"`
+}
+
+func (s *nodeStore) publishLatest(node string, seen time.Time, rd reading) {
+	b, _ := json.Marshal(sharedLatest{LastSeen: seen, Time: rd.Time, Values: rd.Values})
+	s.shared.do("HSET", s.shared.key("latest", s.namespace), node, string(b))
+}
+
+// sharedLatest returns the latest readings other instances received, nil
+// when Redis could not be asked
+func (s *nodeStore) sharedLatest() map[string]sharedLatest {
+	reply, err := s.shared.do("HGETALL", s.shared.key("latest", s.namespace))
+	if err != nil {
+		return nil
+	}
+	fields := hashFields(reply)
+	latest := make(map[string]sharedLatest, len(fields))
+	for node, v := range fields {
+		var sl sharedLatest
+		if json.Unmarshal([]byte(v), &sl) == nil {
+			latest[node] = sl
+		}
+	}
+	return latest
+}
+
+// hashFields reads the reply of HGETALL
+func hashFields(reply interface{}) map[string]string {
+	pairs, _ := reply.([]interface{})
+	fields := make(map[string]string, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		k, _ := pairs[i].(string)
+		v, _ := pairs[i+1].(string)
+		fields[k] = v
+	}
+	return fields
+}
+
+// sharedAck acknowledges an alert in Redis. It is kept apart from the alert,
+// so an acknowledgement is never overwritten by the leader escalating it.
+type sharedAck struct {
+	At time.Time `json:"at"`
+	By string    `json:"by,omitempty"`
+}
+
+// storeShared writes a to Redis, reporting whether Redis took it
+func (s *alertStore) storeShared(a alert) bool {
+	a.Acked, a.AckedBy = nil, ""
+	b, _ := json.Marshal(a)
+	_, err := s.shared.do("HSET", s.shared.key("alerts"), a.ID, string(b))
+	return err == nil
+}
+
+// listShared returns the alerts in Redis with their acknowledgements, nil
+// when Redis could not be asked
+func (s *alertStore) listShared() []*alert {
+	replies, err := s.shared.pipeline([][]string{{"HGETALL", s.shared.key("alerts")}, {"HGETALL", s.shared.key("alerts", "acked")}})
+	if err != nil {
+		return nil
+	}
+	acks := hashFields(replies[1])
+	var list []*alert
+	for id, v := range hashFields(replies[0]) {
+		a := &alert{shared: true}
+		if json.Unmarshal([]byte(v), a) != nil || len(a.Notified) == 0 {
+			continue
+		}
+		var ack sharedAck
+		if raw, ok := acks[id]; ok && json.Unmarshal([]byte(raw), &ack) == nil {
+			a.Acked, a.AckedBy = &ack.At, ack.By
+		}
+		list = append(list, a)
+	}
+	return list
+}
+
+// ackShared is ack against Redis, HSETNX tells whether the alert was
+// acknowledged before. found is false for alerts not in Redis.
+func (s *alertStore) ackShared(id, by string) (a alert, found, acked bool) {
+	reply, err := s.shared.do("HGET", s.shared.key("alerts"), id)
+	stored, _ := reply.(string)
+	if err != nil || reply == nil || json.Unmarshal([]byte(stored), &a) != nil {
+		return a, false, false
+	}
+	ack := sharedAck{At: time.Now(), By: by}
+	b, _ := json.Marshal(ack)
+	if reply, err = s.shared.do("HSETNX", s.shared.key("alerts", "acked"), id, string(b)); err != nil {
+		return a, false, false
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return a, true, false
+	}
+	a.Acked, a.AckedBy, a.shared = &ack.At, ack.By, true
+	return a, true, true
+}
+
+// pruneShared forgets the oldest acknowledged alerts of list beyond
+// alertHistory, like prune
+func (s *alertStore) pruneShared(list []*alert) {
+	excess := len(list) - alertHistory
+	if excess <= 0 {
+		return
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	ids := []string{}
+	for _, a := range list {
+		if excess > 0 && a.Acked != nil {
+			excess--
+			ids = append(ids, a.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	s.shared.pipeline([][]string{
+		append([]string{"HDEL", s.shared.key("alerts")}, ids...),
+		append([]string{"HDEL", s.shared.key("alerts", "acked")}, ids...),
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteRESP(t *testing.T) {
+	// the request example of the RESP specification
+	var sb strings.Builder
+	writeRESP(&sb, []string{"LLEN", "mylist"})
+	if got, want := sb.String(), "*2\r\n$4\r\nLLEN\r\n$6\r\nmylist\r\n"; got != want {
+		t.Errorf("writeRESP = %q, want %q", got, want)
+	}
+	sb.Reset()
+	writeRESP(&sb, []string{"SET", "k", ""})
+	if got, want := sb.String(), "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n"; got != want {
+		t.Errorf("writeRESP with an empty argument = %q, want %q", got, want)
+	}
+}
+
+func TestReadRESP(t *testing.T) {
+	// the reply examples of the RESP specification
+	tests := []struct {
+		reply string
+		want  interface{}
+	}{
+		{"+OK\r\n", "OK"},
+		{"-ERR unknown command 'foobar'\r\n", redisError("ERR unknown command 'foobar'")},
+		{":1000\r\n", int64(1000)},
+		{"$6\r\nfoobar\r\n", "foobar"},
+		{"$0\r\n\r\n", ""},
+		{"$-1\r\n", nil},
+		{"*0\r\n", []interface{}{}},
+		{"*2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n", []interface{}{"foo", "bar"}},
+		{"*3\r\n:1\r\n:2\r\n:3\r\n", []interface{}{int64(1), int64(2), int64(3)}},
+		{"*-1\r\n", nil},
+		{"*2\r\n*3\r\n:1\r\n:2\r\n:3\r\n*2\r\n+Foo\r\n-Bar\r\n", []interface{}{
+			[]interface{}{int64(1), int64(2), int64(3)},
+			[]interface{}{"Foo", redisError("Bar")},
+		}},
+		// a bulk string may hold a line break
+		{"$4\r\na\r\nb\r\n", "a\r\nb"},
+	}
+	for _, tt := range tests {
+		got, err := readRESP(bufio.NewReader(strings.NewReader(tt.reply)))
+		if err != nil {
+			t.Errorf("readRESP(%q): %v", tt.reply, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readRESP(%q) = %#v, want %#v", tt.reply, got, tt.want)
+		}
+	}
+	for _, reply := range []string{"", "\r\n", "?x\r\n", ":x\r\n", "$6\r\nfoo\r\n", "*2\r\n:1\r\n"} {
+		if got, err := readRESP(bufio.NewReader(strings.NewReader(reply))); err == nil {
+			t.Errorf("readRESP(%q) = %#v, want an error", reply, got)
+		}
+	}
+}
+
+func TestNewRedisClient(t *testing.T) {
+	tests := []struct {
+		url      string
+		addr     string
+		password string
+		db       int
+	}{
+		{"redis://cache", "cache:6379", "", 0},
+		{"redis://cache:6380/2", "cache:6380", "", 2},
+		{"redis://:s3cret@cache", "cache:6379", "s3cret", 0},
+		{"redis://s3cret@cache/1", "cache:6379", "s3cret", 1},
+	}
+	for _, tt := range tests {
+		c, err := newRedisClient(tt.url, "sensor:")
+		if err != nil {
+			t.Errorf("newRedisClient(%q): %v", tt.url, err)
+			continue
+		}
+		if c.addr != tt.addr || c.password != tt.password || c.db != tt.db {
+			t.Errorf("newRedisClient(%q) = %s, %q, %d, want %s, %q, %d", tt.url, c.addr, c.password, c.db, tt.addr, tt.password, tt.db)
+		}
+		if k := c.key("dedup", "t1"); k != "sensor:dedup:t1" {
+			t.Errorf("key = %q", k)
+		}
+	}
+	for _, url := range []string{"", "http://cache", "redis://", "redis://cache/x"} {
+		if _, err := newRedisClient(url, ""); err == nil {
+			t.Errorf("newRedisClient(%q) succeeded", url)
+		}
+	}
+}
+
+func TestRedisPipeline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// AUTH and SELECT on connecting, then the pipelined commands at once
+	exchanges := [][2]string{
+		{"*2\r\n$4\r\nAUTH\r\n$2\r\npw\r\n*2\r\n$6\r\nSELECT\r\n$1\r\n3\r\n", "+OK\r\n+OK\r\n"},
+		{"*5\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\n1\r\n$2\r\nNX\r\n$2\r\nPX\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", "$-1\r\n$1\r\n1\r\n"},
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, ex := range exchanges {
+			got := make([]byte, len(ex[0]))
+			if _, err := io.ReadFull(conn, got); err != nil || string(got) != ex[0] {
+				t.Errorf("commands = %q, %v, want %q", got, err, ex[0])
+				return
+			}
+			io.WriteString(conn, ex[1])
+		}
+	}()
+
+	c, err := newRedisClient("redis://:pw@"+ln.Addr().String()+"/3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies, err := c.pipeline([][]string{{"SET", "k", "1", "NX", "PX"}, {"GET", "k"}})
+	if err != nil {
+		t.Fatalf("pipeline: %v", err)
+	}
+	if !reflect.DeepEqual(replies, []interface{}{nil, "1"}) {
+		t.Errorf("pipeline = %#v", replies)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// report summarizes the readings of every node of a tenant over one period
+type report struct {
+	ID        string       `json:"id"`
+	Tenant    string       `json:"tenant"`
+	Period    string       `json:"period"`
+	Start     time.Time    `json:"start"`
+	Stop      time.Time    `json:"stop"`
+	Generated time.Time    `json:"generated"`
+	Nodes     []nodeReport `json:"nodes"`
+}
+
+type nodeReport struct {
+	Node   string                 `json:"node"`
+	Fields map[string]*fieldStats `json:"fields"`
+	// share of GAP_THRESHOLD windows of the period with at least one reading
+	Uptime float64 `json:"uptime"`
+	// readings with a value outside the configured plausible range
+	Anomalies int64 `json:"anomalies"`
+}
+
+var reportPeriods = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// postGenerateReport builds a report of the period that ended at the last
+// midnight UTC right away, without waiting for the schedule
+func postGenerateReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	cfg := ctx.Value(key("config")).(*config)
+	reg := ctx.Value(key("tenants")).(*tenantRegistry)
+	audit := ctx.Value(key("audit")).(*auditLog)
+
+	period := r.URL.Query().Get("period")
+	length, ok := reportPeriods[period]
+	if !ok {
+		http.Error(w, "400 - period must be daily or weekly", http.StatusBadRequest)
+		return
+	}
+	t := reg.byName(r.URL.Query().Get("tenant"))
+	if t == nil {
+		http.Error(w, "400 - Unknown tenant", http.StatusBadRequest)
+		return
+	}
+
+	stop := time.Now().UTC().Truncate(24 * time.Hour)
+	rep, err := generateReport(ctx, cfg, t, period, stop.Add(-length), stop)
+	audit.record(r, "generate_report", map[string]interface{}{
+		"tenant": t.Name,
+		"period": period,
+		"error":  errString(err),
+	})
+	if err != nil {
+		queryFailed(w, r, err)
+		return
+	}
+	if err := saveReport(cfg.ReportsDir, rep); err != nil {
+		log.Println(err)
+		http.Error(w, "500 - Something bad happened!", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, rep)
+}
+
+// runReports generates the configured daily and weekly reports, the weekly
+// ones on Mondays
+func runReports(cfg *config, tenants *tenantRegistry, leader *leaderElector) {
+	runDaily(cfg.ReportDelay, leader, func(day time.Time) {
+		stop := day.Add(24 * time.Hour)
+		for _, period := range cfg.ReportPeriods {
+			if period == "weekly" && stop.Weekday() != time.Monday {
+				continue
+			}
+			for _, t := range sortedTenants(tenants) {
+				rep, err := generateReport(context.Background(), cfg, t, period, stop.Add(-reportPeriods[period]), stop)
+				if err != nil {
+					log.Printf("%s report of %s failed: %s\n", period, t.Name, err)
+					continue
+				}
+				if err := saveReport(cfg.ReportsDir, rep); err != nil {
+					log.Printf("saving report %s: %s\n", rep.ID, err)
+				}
+				if cfg.SMTPAddr != "" && len(cfg.ReportEmailTo) > 0 {
+					if err := emailReport(cfg, rep); err != nil {
+						log.Printf("emailing report %s: %s\n", rep.ID, err)
+					}
+				}
+			}
+		}
+	})
+}
+
+func generateReport(ctx context.Context, cfg *config, t *tenant, period string, start, stop time.Time) (*report, error) {
+	anomalies := "false"
+	var filters []string
+	for _, f := range cfg.Schema.Fields {
+		if f.Range != nil {
+			filters = append(filters, fmt.Sprintf(`(r._field == %s and (r._value < %g or r._value > %g))`,
+				fluxString(f.Name), f.Range.Min, f.Range.Max))
+		}
+	}
+	if len(filters) > 0 {
+		anomalies = strings.Join(filters, " or ")
+	}
+
+	flux := fmt.Sprintf(`data = from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => %s)
+  |> group(columns: ["_measurement", "_field", "location"])
+
+data |> count() |> yield(name: "count")
+data |> min() |> yield(name: "min")
+data |> max() |> yield(name: "max")
+data |> mean() |> yield(name: "mean")
+data
+  |> filter(fn: (r) => r._field == %s)
+  |> aggregateWindow(every: %ds, fn: count, createEmpty: false)
+  |> count()
+  |> yield(name: "windows")
+data
+  |> filter(fn: (r) => %s)
+  |> group(columns: ["location"])
+  |> count()
+  |> yield(name: "anomalies")`,
+		fluxString(t.Bucket), start.Format(time.RFC3339), stop.Format(time.RFC3339), cfg.Schema.measurementFilter(),
+		fluxString(cfg.Schema.primary().Name), int64(cfg.GapThreshold/time.Second), anomalies)
+
+	result, err := t.queryApi.Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	nodes := make(map[string]*nodeReport)
+	get := func(node string) *nodeReport {
+		n, ok := nodes[node]
+		if !ok {
+			n = &nodeReport{Node: node, Fields: make(map[string]*fieldStats)}
+			nodes[node] = n
+		}
+		return n
+	}
+	windows := float64(stop.Sub(start) / cfg.GapThreshold)
+
+	for result.Next() {
+		rec := result.Record()
+		node, _ := rec.ValueByKey("location").(string)
+		n := get(node)
+
+		switch rec.Result() {
+		case "windows":
+			count, _ := rec.Value().(int64)
+			n.Uptime = float64(count) / windows
+			continue
+		case "anomalies":
+			n.Anomalies, _ = rec.Value().(int64)
+			continue
+		}
+
+		name := rec.Measurement() + "." + rec.Field()
+		fs, ok := n.Fields[name]
+		if !ok {
+			fs = &fieldStats{}
+			n.Fields[name] = fs
+		}
+		if rec.Result() == "count" {
+			fs.Count, _ = rec.Value().(int64)
+			continue
+		}
+		v, _ := rec.Value().(float64)
+		switch rec.Result() {
+		case "min":
+			fs.Min = v
+		case "max":
+			fs.Max = v
+		case "mean":
+			fs.Mean = v
+		}
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	rep := &report{
+		ID:        fmt.Sprintf("%s-%s-%s", t.Name, period, start.Format("2006-01-02")),
+		Tenant:    t.Name,
+		Period:    period,
+		Start:     start,
+		Stop:      stop,
+		Generated: time.Now(),
+		Nodes:     []nodeReport{},
+	}
+	for _, n := range nodes {
+		rep.Nodes = append(rep.Nodes, *n)
+	}
+	sort.Slice(rep.Nodes, func(i, j int) bool { return rep.Nodes[i].Node < rep.Nodes[j].Node })
+	return rep, nil
+}
+
+func saveReport(dir string, rep *report) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, rep.ID+".json"), raw, 0644)
+}
+
+func loadReport(dir string, id string) (*report, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, filepath.Base(id)+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var rep report
+	if err := json.Unmarshal(raw, &rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// emailReport sends a plain text summary of rep to the configured recipients
+func emailReport(cfg *config, rep *report) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", cfg.ReportEmailFrom)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(cfg.ReportEmailTo, ", "))
+	fmt.Fprintf(&b, "Subject: Sensor %s report %s (%s)\r\n", rep.Period, rep.Start.Format("2006-01-02"), rep.Tenant)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "Period: %s - %s\r\n\r\n", rep.Start.Format(time.RFC3339), rep.Stop.Format(time.RFC3339))
+	for _, n := range rep.Nodes {
+		fmt.Fprintf(&b, "%s: uptime %.1f%%, %d anomalies\r\n", n.Node, n.Uptime*100, n.Anomalies)
+		names := make([]string, 0, len(n.Fields))
+		for name := range n.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fs := n.Fields[name]
+			fmt.Fprintf(&b, "  %-26s mean %8.2f  min %8.2f  max %8.2f  (%d readings)\r\n", name, fs.Mean, fs.Min, fs.Max, fs.Count)
+		}
+		b.WriteString("\r\n")
+	}
+
+	var auth smtp.Auth
+	if cfg.SMTPUser != "" {
+		host, _, _ := strings.Cut(cfg.SMTPAddr, ":")
+		auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, host)
+	}
+	return smtp.SendMail(cfg.SMTPAddr, auth, cfg.ReportEmailFrom, cfg.ReportEmailTo, []byte(b.String()))
+}
+
+// getReports lists the stored reports of the tenant, newest first
+func getReports(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	t := r.Context().Value(key("tenant")).(*tenant)
+	cfg := r.Context().Value(key("config")).(*config)
+
+	files, err := filepath.Glob(filepath.Join(cfg.ReportsDir, t.Name+"-*.json"))
+	if err != nil {
+		log.Println(err)
+	}
+	type summary struct {
+		ID     string    `json:"id"`
+		Period string    `json:"period"`
+		Start  time.Time `json:"start"`
+		Stop   time.Time `json:"stop"`
+	}
+	list := []summary{}
+	for _, f := range files {
+		rep, err := loadReport(cfg.ReportsDir, strings.TrimSuffix(filepath.Base(f), ".json"))
+		if err != nil || rep.Tenant != t.Name {
+			continue
+		}
+		if p := r.URL.Query().Get("period"); p != "" && rep.Period != p {
+			continue
+		}
+		list = append(list, summary{rep.ID, rep.Period, rep.Start, rep.Stop})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.After(list[j].Start) })
+	writeJSON(w, map[string]interface{}{"reports": list})
+}
+
+func getReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	t := r.Context().Value(key("tenant")).(*tenant)
+	cfg := r.Context().Value(key("config")).(*config)
+
+	id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	rep, err := loadReport(cfg.ReportsDir, id)
+	if err != nil || rep.Tenant != t.Name {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+	if scope := requestScope(r.Context()); scope != nil {
+		nodes := []nodeReport{}
+		for _, n := range rep.Nodes {
+			if scope.allows(n.Node) {
+				nodes = append(nodes, n)
+			}
+		}
+		rep.Nodes = nodes
+	}
+	writeJSON(w, rep)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The read API as resources below /v1/nodes/{node}:
+//
+//	/v1/nodes/{node}
+//	/v1/nodes/{node}/measurements
+//	/v1/nodes/{node}/measurements/{measurement}/readings
+//
+// Their JSON responses share one envelope, {"data", "meta", "links"}, and
+// errors are {"error": {"status", "message"}}, so clients can be generated
+// from the OpenAPI document. They replace /v1/readings.
+
+type resourceEnvelope struct {
+	Data  interface{}            `json:"data"`
+	Meta  map[string]interface{} `json:"meta,omitempty"`
+	Links map[string]string      `json:"links"`
+}
+
+type resourceError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	// set on internal errors, to find them in the log
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeResource answers data in the resource envelope
+func writeResource(w http.ResponseWriter, r *http.Request, data interface{}, meta map[string]interface{}, links map[string]string) {
+	if links == nil {
+		links = make(map[string]string)
+	}
+	links["self"] = r.URL.RequestURI()
+	writeJSON(w, resourceEnvelope{Data: data, Meta: meta, Links: links})
+}
+
+// writeResourceError answers an error of the resource API
+func writeResourceError(w http.ResponseWriter, status int, msg string) {
+	body, _ := json.Marshal(map[string]resourceError{"error": {Status: status, Message: msg}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// nodeResource serves the resources of node below /nodes/{node}, resource
+// is the rest of the path
+func nodeResource(w http.ResponseWriter, r *http.Request, node, resource string) {
+	if r.Method != "GET" {
+		writeResourceError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	parts := strings.Split(resource, "/")
+	switch {
+	case resource == "":
+		getNodeResource(w, r, node)
+	case resource == "measurements":
+		getNodeMeasurements(w, r, node)
+	case len(parts) == 3 && parts[0] == "measurements" && parts[2] == "readings":
+		getNodeMeasurementReadings(w, r, node, parts[1])
+	default:
+		writeResourceError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func getNodeResource(w http.ResponseWriter, r *http.Request, node string) {
+	t := r.Context().Value(key("tenant")).(*tenant)
+	for _, n := range t.nodes.list() {
+		if n.Node == node {
+			writeResource(w, r, n, nil, map[string]string{
+				"measurements": nodePath(node) + "/measurements",
+			})
+			return
+		}
+	}
+	writeResourceError(w, http.StatusNotFound, "node not seen since the server started")
+}
+
+type measurementResource struct {
+	Name   string            `json:"name"`
+	Fields []string          `json:"fields"`
+	Links  map[string]string `json:"links"`
+}
+
+func getNodeMeasurements(w http.ResponseWriter, r *http.Request, node string) {
+	cfg := r.Context().Value(key("config")).(*config)
+	list := []measurementResource{}
+	for _, m := range cfg.Schema.measurementNames() {
+		list = append(list, measurementResource{
+			Name:   m,
+			Fields: cfg.Schema.Measurements[m],
+			Links:  map[string]string{"readings": nodePath(node) + "/measurements/" + url.PathEscape(m) + "/readings"},
+		})
+	}
+	writeResource(w, r, list, map[string]interface{}{"node": node}, nil)
+}
+
+func getNodeMeasurementReadings(w http.ResponseWriter, r *http.Request, node, measurement string) {
+	format, ok := responseFormat(r)
+	if !ok {
+		writeResourceError(w, http.StatusNotAcceptable, "supported formats are json, csv and ndjson")
+		return
+	}
+
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+
+	if _, ok := cfg.Schema.Measurements[measurement]; !ok {
+		writeResourceError(w, http.StatusNotFound, "unknown measurement")
+		return
+	}
+	req, err := parseReadingsRequest(r.URL.Query(), cfg, node, measurement)
+	if err != nil {
+		writeResourceError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	readings, next, err := readingsPage(ctx, t, r, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Printf("query canceled: %s\n", ctx.Err())
+			return
+		}
+		log.Println(err)
+		writeResourceError(w, http.StatusBadGateway, "query failed")
+		return
+	}
+	if next != "" {
+		w.Header().Add("Link", "<"+next+`>; rel="next"`)
+	}
+
+	switch format {
+	case formatCSV:
+		writeCSV(w, append([]string{"time"}, req.fields...), readings)
+	case formatNDJSON:
+		writeNDJSON(w, readings)
+	default:
+		links := map[string]string{"node": nodePath(node)}
+		if next != "" {
+			links["next"] = next
+		}
+		writeResource(w, r, readings, map[string]interface{}{
+			"node":        node,
+			"measurement": measurement,
+			"start":       req.start,
+			"stop":        req.stop,
+			"limit":       req.limit,
+			"offset":      req.offset,
+		}, links)
+	}
+}
+
+func nodePath(node string) string {
+	return apiPrefix + "/nodes/" + url.PathEscape(node)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// getRollingStats returns the mean, standard deviation, RMS and a percentile
+// of one field of a node for every window of the range, computed by InfluxDB
+func getRollingStats(w http.ResponseWriter, r *http.Request) {
+	format, ok := responseFormat(r)
+	if !ok {
+		http.Error(w, "406 - Supported formats are json, csv and ndjson", http.StatusNotAcceptable)
+		return
+	}
+
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+
+	q := r.URL.Query()
+	node := q.Get("node")
+	field, ok := cfg.Schema.field(q.Get("field"))
+	if node == "" || !ok {
+		http.Error(w, "400 - node and a known field are required", http.StatusBadRequest)
+		return
+	}
+	if !nodeInScope(w, r, node) {
+		return
+	}
+
+	now := time.Now()
+	start, err := parseTimeParam(q.Get("start"), now.Add(-time.Hour))
+	if err != nil {
+		http.Error(w, "400 - invalid start", http.StatusBadRequest)
+		return
+	}
+	stop, err := parseTimeParam(q.Get("stop"), now)
+	if err != nil || !stop.After(start) {
+		http.Error(w, "400 - invalid stop", http.StatusBadRequest)
+		return
+	}
+	every := time.Minute
+	if v := q.Get("every"); v != "" {
+		if every, err = time.ParseDuration(v); err != nil || every < time.Second {
+			http.Error(w, "400 - invalid every", http.StatusBadRequest)
+			return
+		}
+	}
+	if stop.Sub(start)/every > time.Duration(cfg.QueryMaxLimit) {
+		http.Error(w, "400 - too many windows, use a larger every", http.StatusBadRequest)
+		return
+	}
+	percentile := 95.0
+	if v := q.Get("percentile"); v != "" {
+		if percentile, err = strconv.ParseFloat(v, 64); err != nil || percentile <= 0 || percentile >= 100 {
+			http.Error(w, "400 - invalid percentile", http.StatusBadRequest)
+			return
+		}
+	}
+	loc, err := timezoneParam(q, cfg, node)
+	if err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	window := fmt.Sprintf("every: %ds, createEmpty: false", int64(every/time.Second))
+	flux := fmt.Sprintf(`import "math"
+
+data = from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %s and r.location == %s and r._field == %s)
+  |> group(columns: ["_field"])
+  |> sort(columns: ["_time"])
+
+data |> aggregateWindow(%s, fn: mean) |> yield(name: "mean")
+data |> aggregateWindow(%s, fn: stddev) |> yield(name: "stddev")
+data
+  |> map(fn: (r) => ({r with _value: r._value * r._value}))
+  |> aggregateWindow(%s, fn: mean)
+  |> map(fn: (r) => ({r with _value: math.sqrt(x: r._value)}))
+  |> yield(name: "rms")
+data
+  |> aggregateWindow(%s, fn: (column, tables=<-) => tables |> quantile(q: %g, column: column))
+  |> yield(name: "percentile")`,
+		fluxString(t.Bucket), start.UTC().Format(time.RFC3339Nano), stop.UTC().Format(time.RFC3339Nano),
+		fluxString(field.Measurement), fluxString(node), fluxString(field.Name),
+		window, window, window, window, percentile/100)
+
+	t.usage.Queries.Add(1)
+	result, err := t.queryApi.Query(ctx, scopeFlux(ctx, flux))
+	traceOf(ctx).phase("query")
+	if err != nil {
+		queryFailed(w, r, err)
+		return
+	}
+	defer result.Close()
+
+	pLabel := "p" + strconv.FormatFloat(percentile, 'f', -1, 64)
+	byTime := make(map[time.Time]map[string]interface{})
+	for result.Next() {
+		rec := result.Record()
+		v, ok := rec.Value().(float64)
+		if !ok {
+			continue
+		}
+		row := byTime[rec.Time()]
+		if row == nil {
+			row = map[string]interface{}{"time": rec.Time().In(loc)}
+			byTime[rec.Time()] = row
+		}
+		name := rec.Result()
+		if name == "percentile" {
+			name = pLabel
+		}
+		row[name] = v
+	}
+	if result.Err() != nil {
+		queryFailed(w, r, result.Err())
+		return
+	}
+
+	windows := []map[string]interface{}{}
+	for _, row := range byTime {
+		windows = append(windows, row)
+	}
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i]["time"].(time.Time).Before(windows[j]["time"].(time.Time))
+	})
+
+	switch format {
+	case formatCSV:
+		writeCSV(w, []string{"time", "mean", "stddev", "rms", pLabel}, windows)
+	case formatNDJSON:
+		writeNDJSON(w, windows)
+	default:
+		writeJSON(w, map[string]interface{}{
+			"node":       node,
+			"field":      field.Name,
+			"every":      shortDuration(every),
+			"percentile": percentile,
+			"windows":    windows,
+		})
+	}
+}
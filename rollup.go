@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// rollupCatchUp bounds the windows one run aggregates after failed runs
+const rollupCatchUp = 100
+
+// rollupTier is one level of tiered retention: the means of every window of
+// every, kept for retention or forever at 0
+type rollupTier struct {
+	Every     time.Duration
+	Retention time.Duration
+}
+
+// parseRollups reads "1m=2160h,1h", tiers of every=retention with the
+// retention optional
+func parseRollups(v string) ([]rollupTier, error) {
+	var tiers []rollupTier
+	for _, entry := range splitList(v) {
+		every, retention, _ := strings.Cut(entry, "=")
+		var tier rollupTier
+		var err error
+		if tier.Every, err = time.ParseDuration(every); err != nil || tier.Every < time.Minute || tier.Every%time.Minute != 0 {
+			return nil, fmt.Errorf("invalid ROLLUPS: expected whole minutes, got %q", entry)
+		}
+		if retention != "" {
+			if tier.Retention, err = time.ParseDuration(retention); err != nil || tier.Retention < 0 {
+				return nil, fmt.Errorf("invalid ROLLUPS: invalid retention of %q", entry)
+			}
+		}
+		if n := len(tiers); n > 0 && tier.Every <= tiers[n-1].Every {
+			return nil, fmt.Errorf("invalid ROLLUPS: tiers must get coarser, got %q", v)
+		}
+		tiers = append(tiers, tier)
+	}
+	return tiers, nil
+}
+
+// rollupJob aggregates the raw bucket of a tenant into <bucket>_rollup_<every>
+// after the end of every window, with ROLLUP_DELAY for late points. Each
+// tier reads the raw data, so it does not depend on the run of a finer tier.
+type rollupJob struct {
+	Tenant      string    `json:"tenant"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Every       string    `json:"every"`
+	Retention   string    `json:"retention"`
+	LastRun     time.Time `json:"last_run"`
+	// end of the last window aggregated
+	Through time.Time `json:"through"`
+	Error   string    `json:"error,omitempty"`
+
+	tenant *tenant
+	tier   rollupTier
+}
+
+// rollups runs the roll-up jobs of all tenants
+type rollups struct {
+	cfg    *config
+	client influxdb2.Client
+	leader *leaderElector
+
+	mu   sync.Mutex
+	jobs []*rollupJob
+}
+
+func newRollups(cfg *config, client influxdb2.Client, tenants *tenantRegistry, leader *leaderElector) *rollups {
+	ru := &rollups{cfg: cfg, client: client, leader: leader}
+	for _, t := range sortedTenants(tenants) {
+		for _, tier := range cfg.Rollups {
+			retention := "forever"
+			if tier.Retention > 0 {
+				retention = shortDuration(tier.Retention)
+			}
+			ru.jobs = append(ru.jobs, &rollupJob{
+				Tenant:      t.Name,
+				Source:      t.Bucket,
+				Destination: t.Bucket + "_rollup_" + shortDuration(tier.Every),
+				Every:       shortDuration(tier.Every),
+				Retention:   retention,
+				tenant:      t,
+				tier:        tier,
+			})
+		}
+	}
+	return ru
+}
+
+// run applies the retention of the buckets, then starts one loop per job
+func (ru *rollups) run(tenants *tenantRegistry) {
+	// replicas would race creating the same buckets
+	ru.leader.await()
+	ctx := context.Background()
+	for _, t := range sortedTenants(tenants) {
+		if err := ru.ensureBuckets(ctx, t); err != nil {
+			log.Printf("rollups of %s: %s\n", t.Name, err)
+		}
+	}
+	for _, job := range ru.jobs {
+		go ru.loop(job)
+	}
+}
+
+// ensureBuckets creates the roll-up buckets of t and sets the retention of
+// its raw bucket
+func (ru *rollups) ensureBuckets(ctx context.Context, t *tenant) error {
+	org, err := ru.client.OrganizationsAPI().FindOrganizationByName(ctx, t.Org)
+	if err != nil {
+		return err
+	}
+	if ru.cfg.RawRetention > 0 {
+		if err := ensureBucket(ctx, ru.client, org, t.Bucket, ru.cfg.RawRetention); err != nil {
+			return err
+		}
+	}
+	for _, job := range ru.jobs {
+		if job.tenant != t {
+			continue
+		}
+		if err := ensureBucket(ctx, ru.client, org, job.Destination, job.tier.Retention); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ru *rollups) loop(job *rollupJob) {
+	every := job.tier.Every
+	// the first run only aggregates the window that just ended
+	through := time.Now().Add(-ru.cfg.RollupDelay).Truncate(every).Add(-every)
+	for {
+		end := time.Now().Add(-ru.cfg.RollupDelay).Truncate(every)
+		if end.After(through) {
+			if !ru.leader.isLeader() {
+				// the leader aggregates these windows
+				through = end
+			} else {
+				start := through
+				if limit := end.Add(-rollupCatchUp * every); start.Before(limit) {
+					start = limit
+				}
+				err := ru.aggregate(job, start, end)
+				ru.mu.Lock()
+				job.LastRun, job.Error = time.Now(), errString(err)
+				if err == nil {
+					job.Through = end
+				}
+				ru.mu.Unlock()
+				if err != nil {
+					log.Printf("rollup %s of %s: %s\n", job.Destination, job.Tenant, err)
+				} else {
+					through = end
+				}
+			}
+		}
+		time.Sleep(time.Until(end.Add(every).Add(ru.cfg.RollupDelay)))
+	}
+}
+
+// aggregate writes the means of the windows between start and end
+func (ru *rollups) aggregate(job *rollupJob, start, end time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	t := job.tenant
+	flux := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => %s)
+  |> group(columns: ["_measurement", "_field", "location"])
+  |> aggregateWindow(every: %s, fn: mean, createEmpty: false)
+  |> to(bucket: %s, org: %s)`,
+		fluxString(job.Source), start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339),
+		ru.cfg.Schema.measurementFilter(), job.Every, fluxString(job.Destination), fluxString(t.Org))
+
+	t.usage.Queries.Add(1)
+	result, err := t.queryApi.Query(ctx, flux)
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+	for result.Next() {
+	}
+	return result.Err()
+}
+
+// list returns copies of the jobs with their last run
+func (ru *rollups) list() []rollupJob {
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+
+	list := make([]rollupJob, len(ru.jobs))
+	for i, job := range ru.jobs {
+		list[i] = *job
+	}
+	return list
+}
+
+// adminRollups lists the roll-up jobs and the state of their last run
+func adminRollups(w http.ResponseWriter, r *http.Request) {
+	ru, _ := r.Context().Value(key("rollups")).(*rollups)
+	jobs := []rollupJob{}
+	if ru != nil {
+		jobs = ru.list()
+	}
+	writeJSON(w, map[string]interface{}{"jobs": jobs})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// apiVersion is reported in the API-Version header of every response
+const apiVersion = "1"
+
+const apiPrefix = "/v" + apiVersion
+
+// handleAPI registers h under the versioned prefix and under the deprecated
+// /api prefix, so existing clients keep working while they migrate. Callers
+// need perm, see rbac.go.
+func handleAPI(mux *http.ServeMux, path string, perm permission, h http.HandlerFunc, methods ...string) {
+	guarded := withTenant(requirePermission(perm, h))
+	handle(mux, apiPrefix+path, guarded, methods...)
+	handle(mux, "/api"+path, deprecated(apiPrefix+path, guarded), methods...)
+}
+
+// handle registers h for the given methods of path, see allowMethods
+func handle(mux *http.ServeMux, path string, h http.Handler, methods ...string) {
+	mux.Handle(path, allowMethods(methods, h))
+}
+
+// allowMethods lets the methods of a route through. OPTIONS is answered
+// with the Allow header without authentication, HEAD is served as GET
+// without the body, anything else is rejected with 405.
+func allowMethods(methods []string, next http.Handler) http.Handler {
+	allowed := make(map[string]bool)
+	for _, m := range methods {
+		allowed[m] = true
+	}
+	list := append([]string{}, methods...)
+	if allowed["GET"] {
+		allowed["HEAD"] = true
+		list = append(list, "HEAD")
+	}
+	list = append(list, "OPTIONS")
+	allow := strings.Join(list, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "OPTIONS":
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "HEAD" && allowed["HEAD"]:
+			// the server drops the body of responses to HEAD
+			get := r.Clone(r.Context())
+			get.Method = "GET"
+			next.ServeHTTP(w, get)
+		case allowed[r.Method]:
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Allow", allow)
+			http.Error(w, "405 - Method is not supported.", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// deprecated marks responses of a legacy route and points to its successor
+func deprecated(successor string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func withAPIVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("API-Version", apiVersion)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// runDaily calls job once a day, delay after midnight UTC, with the start of
+// the day that just ended. With several replicas only the leader runs it.
+func runDaily(delay time.Duration, leader *leaderElector, job func(day time.Time)) {
+	for {
+		now := time.Now().UTC()
+		next := now.Truncate(24 * time.Hour).Add(delay)
+		if !next.After(now) {
+			next = next.Add(24 * time.Hour)
+		}
+		time.Sleep(time.Until(next))
+
+		if !leader.isLeader() {
+			log.Printf("skipping daily job of %s, another replica leads\n", next.Format("2006-01-02"))
+			continue
+		}
+		job(next.Add(-delay).Add(-24 * time.Hour))
+	}
+}
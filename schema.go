@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// the payload of the original boards: humidity|temperature|x,y,z
+// plus the position of mobile nodes and the battery voltage and signal
+// strength of the device
+const defaultSchema = "air:humidity|air:temperature|accelerometer:x,y,z|?gps:lat,lon|?device_health:battery,rssi"
+
+// built-in plausible ranges, overridden by RANGE_<FIELD>
+var defaultRanges = map[string]valueRange{
+	"humidity":    {0, 100},
+	"temperature": {-40, 85},
+	"x":           {-160, 160},
+	"y":           {-160, 160},
+	"z":           {-160, 160},
+	"lat":         {-90, 90},
+	"lon":         {-180, 180},
+	"battery":     {0, 5},
+	"rssi":        {-140, 0},
+}
+
+// sensorField is one value of a record, stored as a field of a measurement
+type sensorField struct {
+	Measurement string
+	Name        string
+	Optional    bool
+	// plausible values, nil when any value is accepted
+	Range *valueRange
+}
+
+// sensorGroup is one '|' separated segment of a record after the timestamp
+type sensorGroup struct {
+	Fields []sensorField
+	// trailing optional groups may be left out, or sent empty when a later
+	// group is present, by boards without the sensor
+	Optional bool
+}
+
+// sensorSchema describes the records sent by nodes, declared in SENSOR_SCHEMA
+// as groups "measurement:field,field" separated by '|', a leading '?' marking
+// a group optional. Field names are unique across measurements.
+type sensorSchema struct {
+	Groups []sensorGroup
+	// fields of each measurement in declaration order
+	Measurements map[string][]string
+	// every field in declaration order
+	Fields []sensorField
+	// characters of the geohash tag added to points with lat and lon, 0
+	// leaves it out
+	GeohashPrecision int
+	// extra tags of each node, see ENRICHMENT_FILE
+	Enrichment *enrichment
+	// the zone tag of each node, see ZONES_FILE
+	Zones *zones
+
+	required int
+	byName   map[string]sensorField
+}
+
+// parseSchema reads a SENSOR_SCHEMA declaration; ranges come from
+// RANGE_<FIELD> or the built-in defaults
+func parseSchema(v string, env map[string]string) (*sensorSchema, error) {
+	s := &sensorSchema{
+		Measurements: make(map[string][]string),
+		byName:       make(map[string]sensorField),
+	}
+
+	ranges := make(map[string]valueRange)
+	for name, vr := range defaultRanges {
+		ranges[name] = vr
+	}
+	// one range for all three axes, as before the schema existed
+	if env["RANGE_ACCELERATION"] != "" {
+		vr, err := envRange(env, "RANGE_ACCELERATION", valueRange{})
+		if err != nil {
+			return nil, err
+		}
+		ranges["x"], ranges["y"], ranges["z"] = vr, vr, vr
+	}
+
+	for i, decl := range strings.Split(v, "|") {
+		decl = strings.TrimSpace(decl)
+		g := sensorGroup{Optional: strings.HasPrefix(decl, "?")}
+		measurement, fields, ok := strings.Cut(strings.TrimPrefix(decl, "?"), ":")
+		if !ok || measurement == "" || len(splitList(fields)) == 0 {
+			return nil, fmt.Errorf("group %d: expected measurement:field,field", i+1)
+		}
+		if g.Optional {
+			if i == 0 {
+				return nil, fmt.Errorf("group 1: the first group cannot be optional")
+			}
+		} else if s.required < i {
+			return nil, fmt.Errorf("group %d: required groups must come before optional ones", i+1)
+		} else {
+			s.required++
+		}
+
+		for _, name := range splitList(fields) {
+			if _, dup := s.byName[name]; dup {
+				return nil, fmt.Errorf("field %q is declared twice", name)
+			}
+			f := sensorField{Measurement: measurement, Name: name, Optional: g.Optional}
+			if vr, ok := ranges[name]; ok {
+				f.Range = &vr
+			}
+			if env["RANGE_"+strings.ToUpper(name)] != "" {
+				vr, err := envRange(env, "RANGE_"+strings.ToUpper(name), valueRange{})
+				if err != nil {
+					return nil, err
+				}
+				f.Range = &vr
+			}
+			g.Fields = append(g.Fields, f)
+			s.Fields = append(s.Fields, f)
+			s.byName[name] = f
+			s.Measurements[measurement] = append(s.Measurements[measurement], name)
+		}
+		s.Groups = append(s.Groups, g)
+	}
+	return s, nil
+}
+
+// addField declares a field that is only sent in JSON payloads
+func (s *sensorSchema) addField(f sensorField) {
+	s.Fields = append(s.Fields, f)
+	s.byName[f.Name] = f
+	s.Measurements[f.Measurement] = append(s.Measurements[f.Measurement], f.Name)
+}
+
+// field looks up a declared field by name
+func (s *sensorSchema) field(name string) (sensorField, bool) {
+	f, ok := s.byName[name]
+	return f, ok
+}
+
+// primary is the first declared field, present in every record, so its
+// count is the number of stored readings
+func (s *sensorSchema) primary() sensorField {
+	return s.Fields[0]
+}
+
+// measurementNames lists the measurements in a stable order
+func (s *sensorSchema) measurementNames() []string {
+	var names []string
+	for m := range s.Measurements {
+		names = append(names, m)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// measurementFilter is a flux predicate matching the schema's measurements
+func (s *sensorSchema) measurementFilter() string {
+	var filters []string
+	for _, m := range s.measurementNames() {
+		filters = append(filters, "r._measurement == "+fluxString(m))
+	}
+	return strings.Join(filters, " or ")
+}
+
+// parseValues parses the groups of a record after its timestamp, which hold
+// at least the required ones; groups beyond the schema are ignored
+func (s *sensorSchema) parseValues(groups []string) (map[string]float64, error) {
+	if len(groups) > len(s.Groups) {
+		groups = groups[:len(s.Groups)]
+	}
+	values := make(map[string]float64)
+	for i, raw := range groups {
+		g := s.Groups[i]
+		if raw == "" && g.Optional {
+			continue
+		}
+		if len(g.Fields) == 1 {
+			v, err := parseValue(g.Fields[0].Name, raw)
+			if err != nil {
+				return nil, err
+			}
+			values[g.Fields[0].Name] = v
+			continue
+		}
+		parts := strings.Split(raw, ",")
+		if len(parts) < len(g.Fields) {
+			return nil, fmt.Errorf("expected %d %s values, got %d", len(g.Fields), g.Fields[0].Measurement, len(parts))
+		}
+		for j, f := range g.Fields {
+			v, err := parseValue(f.Measurement+" "+f.Name, parts[j])
+			if err != nil {
+				return nil, err
+			}
+			values[f.Name] = v
+		}
+	}
+	return values, nil
+}
+
+// parseValue parses the value of the field called name. NaN and infinite
+// values are rejected, InfluxDB refuses the whole write of a point with one.
+func parseValue(name, raw string) (float64, error) {
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("%s is not a finite number", name)
+	}
+	return v, nil
+}
+
+// checkFinite rejects readings of devices that report NaN or infinite values
+func checkFinite(rd reading) error {
+	for name, v := range rd.Values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("%s is not a finite number", name)
+		}
+	}
+	return nil
+}
+
+// newPoint starts a point of node with its location, zone and enrichment
+// tags
+func (s *sensorSchema) newPoint(measurement string, node string, at time.Time) *write.Point {
+	p := influxdb2.NewPointWithMeasurement(measurement).
+		AddTag("location", node).
+		SetTime(at)
+	if zone := s.Zones.of(node); zone != "" {
+		p.AddTag("zone", zone)
+	}
+	extra := s.Enrichment.tags(node)
+	// sorted, so the series of a node always has the same key
+	var keys []string
+	for k := range extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p.AddTag(k, extra[k])
+	}
+	return p
+}
+
+// points converts a reading into one point per measurement it has values of.
+// A non-zero received is added as the received_at field.
+func (s *sensorSchema) points(node string, rd reading, corrected bool, received time.Time) []*write.Point {
+	var points []*write.Point
+	byMeasurement := make(map[string]*write.Point)
+	for _, f := range s.Fields {
+		v, ok := rd.Values[f.Name]
+		if !ok {
+			continue
+		}
+		p := byMeasurement[f.Measurement]
+		if p == nil {
+			p = s.newPoint(f.Measurement, node, rd.Time)
+			if corrected {
+				p.AddTag("clock_corrected", "true")
+			}
+			if !received.IsZero() {
+				p.AddField("received_at", received.UnixNano())
+			}
+			byMeasurement[f.Measurement] = p
+			points = append(points, p)
+		}
+		p.AddField(f.Name, v)
+	}
+	if s.GeohashPrecision > 0 {
+		lat, okLat := rd.Values["lat"]
+		lon, okLon := rd.Values["lon"]
+		if f, ok := s.byName["lat"]; ok && okLat && okLon {
+			byMeasurement[f.Measurement].AddTag("geohash", geohash(lat, lon, s.GeohashPrecision))
+		}
+	}
+	return points
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Node scopes: an access key or token may be limited to some nodes and the
+// nodes of some zones. The read endpoints then only list those nodes, answer
+// 404 for the others, and the Flux queries get a filter on their location
+// tag injected after the range, so aggregates over zones only cover them.
+
+// nodeScope is the set of nodes a principal may read, nil for all
+type nodeScope struct {
+	nodes map[string]bool
+}
+
+// newNodeScope resolves nodes and zones to a scope, nil when both are empty
+func newNodeScope(cfg *config, nodes, zones []string) (*nodeScope, error) {
+	if len(nodes) == 0 && len(zones) == 0 {
+		return nil, nil
+	}
+	s := &nodeScope{nodes: make(map[string]bool)}
+	for _, n := range nodes {
+		s.nodes[n] = true
+	}
+	for _, name := range zones {
+		z, ok := cfg.Schema.Zones.get(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown zone %q", name)
+		}
+		for _, n := range z.Nodes {
+			s.nodes[n] = true
+		}
+	}
+	return s, nil
+}
+
+func (s *nodeScope) allows(node string) bool {
+	return s == nil || s.nodes[node]
+}
+
+func (s *nodeScope) list() []string {
+	list := make([]string, 0, len(s.nodes))
+	for n := range s.nodes {
+		list = append(list, n)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// predicate is the Flux filter matching the points of the scope
+func (s *nodeScope) predicate() string {
+	var terms []string
+	for _, n := range s.list() {
+		terms = append(terms, "r.location == "+fluxString(n))
+	}
+	if len(terms) == 0 {
+		return "false"
+	}
+	return strings.Join(terms, " or ")
+}
+
+// requestScope returns the scope of the principal of ctx, nil for all nodes
+func requestScope(ctx context.Context) *nodeScope {
+	p, _ := ctx.Value(key("principal")).(*principal)
+	if p == nil {
+		return nil
+	}
+	return p.scope
+}
+
+// scopeKey tells responses to principals of different scopes apart in the
+// query cache
+func scopeKey(ctx context.Context) string {
+	s := requestScope(ctx)
+	if s == nil {
+		return ""
+	}
+	return strings.Join(s.list(), ",")
+}
+
+var fluxRange = regexp.MustCompile(`\|> range\([^)]*\)`)
+
+// scopeFlux injects the filter of the scope of ctx after every range of flux
+func scopeFlux(ctx context.Context, flux string) string {
+	s := requestScope(ctx)
+	if s == nil {
+		return flux
+	}
+	filter := "\n  |> filter(fn: (r) => " + s.predicate() + ")"
+	return fluxRange.ReplaceAllStringFunc(flux, func(m string) string { return m + filter })
+}
+
+// nodeInScope answers 404 for nodes outside the scope of the request, as if
+// they did not exist
+func nodeInScope(w http.ResponseWriter, r *http.Request, node string) bool {
+	if !requestScope(r.Context()).allows(node) {
+		http.Error(w, "404 - Unknown node", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// scopedZone returns z with only the nodes of the scope of ctx, nil when none
+// of them is
+func scopedZone(ctx context.Context, z *zone) *zone {
+	s := requestScope(ctx)
+	if s == nil {
+		return z
+	}
+	scoped := *z
+	scoped.Nodes = nil
+	for _, n := range z.Nodes {
+		if s.allows(n) {
+			scoped.Nodes = append(scoped.Nodes, n)
+		}
+	}
+	if len(scoped.Nodes) == 0 {
+		return nil
+	}
+	return &scoped
+}
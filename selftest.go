@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+)
+
+// measurement of the point written and deleted again by the self-test
+const selfTestMeasurement = "server_selftest"
+
+// logConfig logs the effective settings worth checking after a deploy, with
+// credentials left out
+func logConfig(cfg *config, addr string) {
+	dbURL := cfg.URL
+	if u, err := url.Parse(cfg.URL); err == nil {
+		dbURL = u.Redacted()
+	}
+	token := "missing"
+	if cfg.Token != "" {
+		token = fmt.Sprintf("set (%d characters)", len(cfg.Token))
+	}
+	log.Printf("config: InfluxDB %s, org %q, bucket %q, token %s\n", dbURL, cfg.Org, cfg.Bucket, token)
+	log.Printf("config: listening on %s\n", addr)
+	if cfg.TenantsFile != "" {
+		log.Printf("config: tenants from %s\n", cfg.TenantsFile)
+	}
+
+	onOff := func(on bool) string {
+		if on {
+			return "on"
+		}
+		return "off"
+	}
+	list := func(items []string) string {
+		if len(items) == 0 {
+			return "off"
+		}
+		return strings.Join(items, ",")
+	}
+	var downsample []string
+	for _, d := range cfg.DownsampleEvery {
+		downsample = append(downsample, shortDuration(d))
+	}
+	features := []string{
+		"admin=" + onOff(cfg.AdminToken != ""),
+		"metrics_token=" + onOff(cfg.MetricsToken != ""),
+		"access_keys=" + onOff(cfg.AccessKeysFile != ""),
+		"jwt=" + onOff(cfg.JWTSecret != ""),
+		"basic_auth=" + onOff(len(cfg.BasicAuth) > 0),
+		"users=" + onOff(cfg.UsersFile != ""),
+		"oidc=" + onOff(cfg.OIDCIssuer != ""),
+		"clock_correction=" + onOff(cfg.ClockCorrection),
+		"s3_export=" + onOff(cfg.ExportS3Bucket != ""),
+		"reports=" + list(cfg.ReportPeriods),
+		"downsampling=" + list(downsample),
+		"rollups=" + onOff(len(cfg.Rollups) > 0),
+		"vibration_events=" + onOff(cfg.VibrationThreshold > 0),
+		"shm=" + list(cfg.SHMFields),
+		"peak_capture=" + onOff(cfg.PeakThreshold > 0),
+		"burst=" + list(cfg.BurstEvents),
+		"adaptive_interval=" + onOff(cfg.AdaptiveInterval > 0),
+		"grafana=" + onOff(cfg.GrafanaURL != ""),
+		"escalation=" + onOff(len(cfg.EscalationChain) > 0),
+		"enrichment=" + onOff(cfg.Schema.Enrichment != nil),
+		"zones=" + onOff(cfg.Schema.Zones != nil),
+		"mdns=" + onOff(cfg.MDNS),
+		"modbus=" + onOff(len(cfg.ModbusDevices) > 0),
+		"opcua=" + onOff(len(cfg.OPCUAServers) > 0),
+		"graphite=" + onOff(cfg.GraphiteListen != ""),
+		"statsd=" + onOff(cfg.StatsdListen != ""),
+		"mqtt=" + onOff(cfg.MQTTBroker != ""),
+		"ha_discovery=" + onOff(cfg.HADiscovery),
+		"forward=" + onOff(len(cfg.ForwardURLs) > 0),
+		"shadow=" + onOff(cfg.ShadowBucket != ""),
+		"redis=" + onOff(cfg.RedisURL != ""),
+		"gateway=" + onOff(cfg.GatewayUpstream != ""),
+		"leader_election=" + onOff(cfg.LeaderElection),
+		"cors=" + onOff(len(cfg.CORSAllowedOrigins) > 0),
+		"link_quality=" + onOff(cfg.LinkQualityInterval > 0),
+		"slow_request_log=" + onOff(cfg.SlowRequestThreshold > 0),
+		"log_level=" + cfg.LogLevel,
+		"disk_guard=" + onOff(cfg.DiskCheckInterval > 0),
+		"dry_run=" + onOff(cfg.DryRun),
+		"self_test=" + onOff(cfg.SelfTest),
+		"bootstrap=" + onOff(cfg.Bootstrap),
+	}
+	log.Printf("config: %s\n", strings.Join(features, " "))
+	log.Printf("config: schema %s\n", strings.Join(cfg.Schema.measurementNames(), ","))
+}
+
+// selfTest writes a point to the bucket of every tenant and deletes it again,
+// so a wrong token, org or bucket stops the server at boot instead of
+// surfacing as write errors later. An unreachable InfluxDB is only logged,
+// the server waits for it.
+func selfTest(cfg *config, client influxdb2.Client) error {
+	reg, err := loadTenants(cfg, client)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range sortedTenants(reg) {
+		hint := "check ORG_NAME and BUCKET_NAME"
+		if cfg.TenantsFile != "" {
+			hint = fmt.Sprintf("check tenant %q in %s", t.Name, cfg.TenantsFile)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		now := time.Now()
+		p := influxdb2.NewPointWithMeasurement(selfTestMeasurement).
+			AddTag("location", "server").
+			AddField("ok", 1).
+			SetTime(now)
+		err := client.WriteAPIBlocking(t.Org, t.Bucket).WritePoint(ctx, p)
+		if err != nil {
+			cancel()
+			var herr *influxhttp.Error
+			if !errors.As(err, &herr) || herr.StatusCode == 0 || herr.StatusCode >= 500 {
+				log.Printf("self-test skipped, InfluxDB not usable yet: %s\n", err)
+				return nil
+			}
+			switch herr.StatusCode {
+			case 401:
+				return fmt.Errorf("self-test: InfluxDB rejected the token, check INFLUXDB_TOKEN: %w", err)
+			case 403:
+				return fmt.Errorf("self-test: the token may not write to bucket %q of org %q, %s or the token permissions: %w", t.Bucket, t.Org, hint, err)
+			case 404:
+				return fmt.Errorf("self-test: bucket %q or org %q does not exist, %s: %w", t.Bucket, t.Org, hint, err)
+			default:
+				return fmt.Errorf("self-test: writing to bucket %q of org %q failed, %s: %w", t.Bucket, t.Org, hint, err)
+			}
+		}
+
+		predicate := fmt.Sprintf("_measurement=%q", selfTestMeasurement)
+		err = client.DeleteAPI().DeleteWithName(ctx, t.Org, t.Bucket, now.Add(-time.Second), now.Add(time.Second), predicate)
+		cancel()
+		if err != nil {
+			log.Printf("self-test: could not delete the test point from %q, the token may lack delete permission: %s\n", t.Bucket, err)
+			continue
+		}
+		log.Printf("self-test passed for tenant %q (org %q, bucket %q)\n", t.Name, t.Org, t.Bucket)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Sequence numbers: a node may number its submissions with "seq", counting
+// up by one per request. The gaps between the numbers that arrive tell how
+// many submissions were lost in transit. A number below the last one is a
+// late retry when it is close to it, recovering a number of the gap counted
+// before, and otherwise a reset of the counter, usually a reboot.
+
+// retries arriving up to this many numbers late are not taken for a reset,
+// at most 64 for sequenceStats.missing
+const sequenceReorderWindow = 16
+
+type sequenceStats struct {
+	Last int64 `json:"last"`
+	// submissions that arrived, lost ones are the gaps between them; the
+	// counters only go up, recovered ones were lost and arrived late
+	Received  int64 `json:"received"`
+	Lost      int64 `json:"lost"`
+	Recovered int64 `json:"recovered"`
+	// a number that already arrived, a retry after a lost answer
+	Repeated int64 `json:"repeated"`
+	Resets   int64 `json:"resets"`
+	// still missing of the submissions sent since the server started
+	LossRatio float64    `json:"loss_ratio"`
+	LastGap   *time.Time `json:"last_gap,omitempty"`
+	LastReset *time.Time `json:"last_reset,omitempty"`
+	// bit i is set while number Last-1-i is missing, within the window
+	missing uint64
+}
+
+// observeSequence folds the sequence number of a submission of node into
+// its loss statistics
+func (s *nodeStore) observeSequence(node string, seq int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.get(node)
+	if n.Sequence == nil {
+		n.Sequence = &sequenceStats{Last: seq, Received: 1}
+		return
+	}
+	// list hands out the pointer, so the stats are replaced, not changed
+	st := *n.Sequence
+	defer func() { n.Sequence = &st }()
+	now := time.Now()
+	switch {
+	case seq == st.Last:
+		st.Repeated++
+		return
+	case seq > st.Last:
+		d := seq - st.Last
+		if d < 64 {
+			st.missing <<= d
+		} else {
+			st.missing = 0
+		}
+		if gap := d - 1; gap > 0 {
+			st.Lost += gap
+			st.LastGap = &now
+			if gap < 64 {
+				st.missing |= 1<<gap - 1
+			} else {
+				st.missing = ^uint64(0)
+			}
+			log.Printf("sequence gap: node %s lost %d submissions between %d and %d\n", node, gap, st.Last, seq)
+		}
+		st.missing &= 1<<sequenceReorderWindow - 1
+		st.Last = seq
+	case st.Last-seq <= sequenceReorderWindow:
+		// only a number counted lost when the one after it arrived is
+		// recovered, once
+		bit := uint64(1) << (st.Last - 1 - seq)
+		if st.missing&bit == 0 {
+			st.Repeated++
+			return
+		}
+		st.missing &^= bit
+		st.Recovered++
+	default:
+		st.Resets++
+		st.LastReset = &now
+		log.Printf("sequence reset: node %s went from %d back to %d\n", node, st.Last, seq)
+		st.Last = seq
+		st.missing = 0
+	}
+	st.Received++
+	missing := st.Lost - st.Recovered
+	st.LossRatio = float64(missing) / float64(st.Received+missing)
+}
+
+// collectSequence exports the loss statistics of the nodes sending sequence
+// numbers
+func collectSequence(reg *tenantRegistry) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		families := []struct {
+			name, help string
+			value      func(st *sequenceStats) int64
+		}{
+			{"sensor_node_sequence_received_total", "Numbered submissions received from a node.", func(st *sequenceStats) int64 { return st.Received }},
+			{"sensor_node_sequence_lost_total", "Numbered submissions of a node missing when a later number arrived.", func(st *sequenceStats) int64 { return st.Lost }},
+			{"sensor_node_sequence_recovered_total", "Numbered submissions of a node counted lost that arrived late.", func(st *sequenceStats) int64 { return st.Recovered }},
+			{"sensor_node_sequence_repeated_total", "Submissions of a node repeating a sequence number that already arrived.", func(st *sequenceStats) int64 { return st.Repeated }},
+			{"sensor_node_sequence_resets_total", "Times the sequence number of a node started over.", func(st *sequenceStats) int64 { return st.Resets }},
+		}
+		tenants := sortedTenants(reg)
+		nodes := make([][]nodeStatus, len(tenants))
+		for i, t := range tenants {
+			nodes[i] = t.nodes.list()
+		}
+		for _, f := range families {
+			mw.family(f.name, "counter", f.help)
+			for i, t := range tenants {
+				for _, n := range nodes[i] {
+					if n.Sequence != nil {
+						mw.sample(f.name, float64(f.value(n.Sequence)), "tenant", t.Name, "node", n.Node)
+					}
+				}
+			}
+		}
+	}
+}
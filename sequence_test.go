@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestObserveSequence(t *testing.T) {
+	s := newNodeStore()
+	for _, seq := range []int64{1, 2, 5, 3, 3, 4, 4, 1, 6} {
+		s.observeSequence("n1", seq)
+	}
+	st := s.nodes["n1"].Sequence
+	// 3 and 4 were lost when 5 arrived and came late, once
+	if st.Received != 6 || st.Lost != 2 || st.Recovered != 2 || st.Repeated != 3 || st.Resets != 0 {
+		t.Errorf("stats = %+v, want 6 received, 2 lost and recovered, 3 repeated", *st)
+	}
+	if st.LossRatio != 0 {
+		t.Errorf("loss ratio = %v, want 0", st.LossRatio)
+	}
+
+	// numbers lost beyond the reorder window cannot be recovered
+	s.observeSequence("n1", 6+sequenceReorderWindow+2)
+	s.observeSequence("n1", 7)
+	if st := s.nodes["n1"].Sequence; st.Lost != 2+sequenceReorderWindow+1 || st.Recovered != 2 || st.Resets != 1 {
+		t.Errorf("stats after a late number outside the window = %+v", *st)
+	}
+}
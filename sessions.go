@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sessions: every login of a dashboard user is tracked, and its token only
+// stays valid while the session does. A session ends at logout, when it is
+// revoked, SESSION_TTL after the login or once it was idle for
+// SESSION_IDLE_TIMEOUT. Sessions are kept in memory, a restart ends them.
+
+type session struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	Expires   time.Time `json:"expires"`
+	Remote    string    `json:"remote"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+type sessionStore struct {
+	idle time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionStore(idle time.Duration) *sessionStore {
+	return &sessionStore{idle: idle, sessions: make(map[string]*session)}
+}
+
+// live tells whether s has neither expired nor been idle too long
+func (st *sessionStore) live(s *session, now time.Time) bool {
+	return now.Before(s.Expires) && (st.idle <= 0 || now.Sub(s.LastSeen) < st.idle)
+}
+
+func (st *sessionStore) start(u *user, r *http.Request, expires time.Time) session {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	for id, s := range st.sessions {
+		if !st.live(s, now) {
+			delete(st.sessions, id)
+		}
+	}
+	s := &session{
+		ID:        newJobID(),
+		Username:  u.Username,
+		Role:      u.Role,
+		Created:   now,
+		LastSeen:  now,
+		Expires:   expires,
+		Remote:    r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+	}
+	st.sessions[s.ID] = s
+	return *s
+}
+
+// touch marks a session as used, false when it is over
+func (st *sessionStore) touch(id string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	s, ok := st.sessions[id]
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	if !st.live(s, now) {
+		delete(st.sessions, id)
+		return false
+	}
+	s.LastSeen = now
+	return true
+}
+
+func (st *sessionStore) revoke(id string) (session, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	s, ok := st.sessions[id]
+	if !ok {
+		return session{}, false
+	}
+	delete(st.sessions, id)
+	return *s, true
+}
+
+// revokeUser ends every session of a user, returning how many there were
+func (st *sessionStore) revokeUser(username string) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	n := 0
+	for id, s := range st.sessions {
+		if s.Username == username {
+			delete(st.sessions, id)
+			n++
+		}
+	}
+	return n
+}
+
+func (st *sessionStore) get(id string) (session, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	s, ok := st.sessions[id]
+	if !ok || !st.live(s, time.Now()) {
+		return session{}, false
+	}
+	return *s, true
+}
+
+// list returns the live sessions of a user, of every user when empty, the
+// most recently used first
+func (st *sessionStore) list(username string) []session {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	list := []session{}
+	for _, s := range st.sessions {
+		if st.live(s, now) && (username == "" || s.Username == username) {
+			list = append(list, *s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list
+}
+
+// getSessions lists the sessions of the logged in user (GET /v1/sessions);
+// DELETE /v1/sessions/{id} revokes one of them, e.g. of a lost laptop
+func getSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	p := ctx.Value(key("principal")).(*principal)
+	users := ctx.Value(key("users")).(*userStore)
+	if p.Session == "" {
+		http.Error(w, "404 - Only dashboard users have sessions", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		s, ok := users.sessions.get(id)
+		if !ok || s.Username != p.Name {
+			http.Error(w, "404 - Unknown session", http.StatusNotFound)
+			return
+		}
+		users.sessions.revoke(id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	list := users.sessions.list(p.Name)
+	writeJSON(w, map[string]interface{}{"current": p.Session, "sessions": list})
+}
+
+// adminSessions lists the sessions of all users (GET, ?user= for one) and
+// revokes them: DELETE /admin/sessions/{id} one session, ?user= all of a user
+func adminSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	cfg := ctx.Value(key("config")).(*config)
+	audit := ctx.Value(key("audit")).(*auditLog)
+	users := ctx.Value(key("users")).(*userStore)
+	if !cfg.logins() {
+		http.Error(w, "404 - Users are not configured", http.StatusNotFound)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/sessions"), "/")
+	username := r.URL.Query().Get("user")
+
+	switch {
+	case r.Method == "GET" && id == "":
+		writeJSON(w, map[string]interface{}{"sessions": users.sessions.list(username)})
+	case r.Method == "DELETE" && id != "":
+		s, ok := users.sessions.revoke(id)
+		if !ok {
+			http.Error(w, "404 - Unknown session", http.StatusNotFound)
+			return
+		}
+		audit.record(r, "revoke_session", map[string]interface{}{"id": s.ID, "username": s.Username})
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "DELETE" && username != "":
+		n := users.sessions.revokeUser(username)
+		audit.record(r, "revoke_sessions", map[string]interface{}{"username": username, "count": n})
+		writeJSON(w, map[string]interface{}{"username": username, "revoked": n})
+	default:
+		http.Error(w, "404 not found.", http.StatusNotFound)
+	}
+}
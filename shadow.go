@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// batches of points waiting for the staging server
+const shadowQueueSize = 1000
+
+// shadowWriter copies sampled points of every tenant to the staging bucket of
+// SHADOW_BUCKET. Its own queue and worker keep a slow or failing staging
+// server away from ingest, batches are dropped once the queue is full.
+type shadowWriter struct {
+	api     api.WriteAPIBlocking
+	percent float64
+	queue   chan []*write.Point
+
+	written atomic.Int64
+	failed  atomic.Int64
+	dropped atomic.Int64
+}
+
+func newShadowWriter(cfg *config) *shadowWriter {
+	client := influxdb2.NewClientWithOptions(cfg.ShadowURL, cfg.ShadowToken,
+		influxdb2.DefaultOptions().SetPrecision(cfg.WritePrecision))
+	return &shadowWriter{
+		api:     client.WriteAPIBlocking(cfg.ShadowOrg, cfg.ShadowBucket),
+		percent: cfg.ShadowPercent,
+		queue:   make(chan []*write.Point, shadowQueueSize),
+	}
+}
+
+// offer queues a sample of points, a nil writer takes none
+func (s *shadowWriter) offer(points []*write.Point) {
+	if s == nil {
+		return
+	}
+	sample := points
+	if s.percent < 100 {
+		sample = nil
+		for _, p := range points {
+			if rand.Float64()*100 < s.percent {
+				sample = append(sample, p)
+			}
+		}
+	}
+	if len(sample) == 0 {
+		return
+	}
+	select {
+	case s.queue <- sample:
+	default:
+		s.dropped.Add(int64(len(sample)))
+	}
+}
+
+// run writes the queued points, a failed batch is not retried. Failures are
+// only logged when they start and end.
+func (s *shadowWriter) run() {
+	failing := false
+	for points := range s.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := s.api.WritePoint(ctx, points...)
+		cancel()
+		if err != nil {
+			s.failed.Add(int64(len(points)))
+			if !failing {
+				log.Printf("shadow write failed (%s), dropping points until it recovers: %s\n", writeErrorClass(err), err)
+			}
+			failing = true
+			continue
+		}
+		s.written.Add(int64(len(points)))
+		if failing {
+			log.Println("shadow writes recovered")
+		}
+		failing = false
+	}
+}
+
+func collectShadow(s *shadowWriter) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		mw.family("sensor_shadow_points_total", "counter", "Sampled points copied to the staging bucket by result.")
+		mw.sample("sensor_shadow_points_total", float64(s.written.Load()), "result", "written")
+		mw.sample("sensor_shadow_points_total", float64(s.failed.Load()), "result", "failed")
+		mw.sample("sensor_shadow_points_total", float64(s.dropped.Load()), "result", "dropped")
+		mw.family("sensor_shadow_queued_batches", "gauge", "Batches waiting to be written to the staging bucket.")
+		mw.sample("sensor_shadow_queued_batches", float64(len(s.queue)))
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// shmMeasurement holds the structural health monitoring indicators of the
+// SHM_FIELDS, computed per node over windows of SHM_WINDOW, one field
+// "<field>_<indicator>" each
+const shmMeasurement = "shm_indicators"
+
+// shmIndicators are the vibration indicators of one field over one window.
+// They describe the signal with its mean removed, so gravity and sensor
+// offsets do not count.
+type shmIndicators struct {
+	RMS         float64 `json:"rms"`
+	Peak        float64 `json:"peak"`
+	CrestFactor float64 `json:"crest_factor"`
+	// frequency of the largest spectral peak, 0 when the window is too short
+	DominantFrequency float64 `json:"dominant_frequency_hz"`
+}
+
+// shmIndicatorNames are the suffixes of the stored fields, in the order of
+// the CSV columns
+var shmIndicatorNames = []string{"rms", "peak", "crest_factor", "dominant_hz", "frequency_shift_pct"}
+
+// shmWindow collects the readings of one node until the window is full
+type shmWindow struct {
+	samples []reading
+}
+
+// shmResult is the outcome of one full window
+type shmResult struct {
+	Start      time.Time                `json:"start"`
+	Samples    int                      `json:"samples"`
+	Indicators map[string]shmIndicators `json:"indicators"`
+}
+
+// observeSHM adds rd to the SHM window of node and returns the point of the
+// indicators, with the shifts of their natural frequencies, once the window
+// spans SHM_WINDOW or holds SHM_MAX_SAMPLES, nil otherwise
+func observeSHM(t *tenant, cfg *config, events *eventBus, node string, rd reading) *write.Point {
+	if len(cfg.SHMFields) == 0 {
+		return nil
+	}
+	res := t.nodes.observeSHM(node, rd, cfg.SHMFields, cfg.SHMWindow, cfg.SHMMaxSamples)
+	if res == nil {
+		return nil
+	}
+
+	p := cfg.Schema.newPoint(shmMeasurement, node, res.Start)
+	for _, f := range cfg.SHMFields {
+		ind, ok := res.Indicators[f]
+		if !ok {
+			continue
+		}
+		p.AddField(f+"_rms", ind.RMS)
+		p.AddField(f+"_peak", ind.Peak)
+		p.AddField(f+"_crest_factor", ind.CrestFactor)
+		p.AddField(f+"_dominant_hz", ind.DominantFrequency)
+	}
+	p.AddField("samples", res.Samples)
+	observeFrequencies(t, cfg, events, node, res, p)
+	return p
+}
+
+// observeSHM buffers rd and computes the indicators of the buffered window
+// when rd no longer fits in it, starting the next window with rd
+func (s *nodeStore) observeSHM(node string, rd reading, fields []string, window time.Duration, maxSamples int) *shmResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.get(node)
+	w := &n.shm
+	if len(w.samples) > 0 && !rd.Time.After(w.samples[len(w.samples)-1].Time) {
+		return nil
+	}
+	if len(w.samples) == 0 || (rd.Time.Sub(w.samples[0].Time) < window && len(w.samples) < maxSamples) {
+		w.samples = append(w.samples, rd)
+		return nil
+	}
+
+	res := computeSHM(w.samples, fields)
+	w.samples = append(w.samples[:0], rd)
+	if res != nil {
+		n.SHM = res
+	}
+	return res
+}
+
+// computeSHM derives the indicators of fields over samples, which are ordered
+// by time. The sample rate for the dominant frequency is the mean rate of the
+// window, nodes are expected to sample at a steady rate.
+func computeSHM(samples []reading, fields []string) *shmResult {
+	res := &shmResult{Start: samples[0].Time, Samples: len(samples), Indicators: make(map[string]shmIndicators)}
+	var rate float64
+	if span := samples[len(samples)-1].Time.Sub(samples[0].Time); span > 0 {
+		rate = float64(len(samples)-1) / span.Seconds()
+	}
+
+	for _, f := range fields {
+		var values []float64
+		for _, rd := range samples {
+			if v, ok := rd.Values[f]; ok {
+				values = append(values, v)
+			}
+		}
+		// a field missing from some readings would skew the sample rate
+		if len(values) < 2 || len(values) != len(samples) {
+			continue
+		}
+
+		var mean float64
+		for _, v := range values {
+			mean += v
+		}
+		mean /= float64(len(values))
+
+		var ind shmIndicators
+		var sum float64
+		for i, v := range values {
+			v -= mean
+			values[i] = v
+			sum += v * v
+			if math.Abs(v) > ind.Peak {
+				ind.Peak = math.Abs(v)
+			}
+		}
+		ind.RMS = math.Sqrt(sum / float64(len(values)))
+		if ind.RMS > 0 {
+			ind.CrestFactor = ind.Peak / ind.RMS
+		}
+		if rate > 0 {
+			ind.DominantFrequency = dominantFrequency(values, rate)
+		}
+		res.Indicators[f] = ind
+	}
+	if len(res.Indicators) == 0 {
+		return nil
+	}
+	return res
+}
+
+// dominantFrequency returns the frequency in Hz of the largest bin of the
+// discrete Fourier transform of values sampled at rate, skipping the DC bin.
+// Windows are bounded by SHM_MAX_SAMPLES, so the direct transform is cheap
+// enough.
+func dominantFrequency(values []float64, rate float64) float64 {
+	n := len(values)
+	var best float64
+	bestBin := 0
+	for k := 1; k <= n/2; k++ {
+		var re, im float64
+		for i, v := range values {
+			angle := 2 * math.Pi * float64(k*i) / float64(n)
+			re += v * math.Cos(angle)
+			im -= v * math.Sin(angle)
+		}
+		if power := re*re + im*im; power > best {
+			best = power
+			bestBin = k
+		}
+	}
+	return float64(bestBin) * rate / float64(n)
+}
+
+// getNodeSHM returns the stored SHM indicators of node and those of its last
+// window since the server started
+func getNodeSHM(w http.ResponseWriter, r *http.Request, node string) {
+	format, ok := responseFormat(r)
+	if !ok {
+		http.Error(w, "406 - Supported formats are json, csv and ndjson", http.StatusNotAcceptable)
+		return
+	}
+
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+	if len(cfg.SHMFields) == 0 {
+		http.Error(w, "404 - SHM analysis is disabled, set SHM_FIELDS", http.StatusNotFound)
+		return
+	}
+
+	req, err := parseReadingsRequest(r.URL.Query(), cfg, node, shmMeasurement)
+	if err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.fields = []string{"samples"}
+	for _, f := range cfg.SHMFields {
+		for _, ind := range shmIndicatorNames {
+			req.fields = append(req.fields, f+"_"+ind)
+		}
+	}
+	rows, next, err := readingsPage(ctx, t, r, req)
+	if err != nil {
+		queryFailed(w, r, err)
+		return
+	}
+	if next != "" {
+		w.Header().Add("Link", "<"+next+`>; rel="next"`)
+	}
+
+	switch format {
+	case formatCSV:
+		writeCSV(w, append([]string{"time"}, req.fields...), rows)
+	case formatNDJSON:
+		writeNDJSON(w, rows)
+	default:
+		writeJSON(w, map[string]interface{}{
+			"node":        node,
+			"window":      shortDuration(cfg.SHMWindow),
+			"latest":      t.nodes.shm(node),
+			"frequencies": t.nodes.frequencies(node),
+			"indicators":  rows,
+		})
+	}
+}
+
+// shm returns the indicators of the last full window of node
+func (s *nodeStore) shm(node string) *shmResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if n, ok := s.nodes[node]; ok {
+		return n.SHM
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Slow requests: every request gets an ID, taken from X-Request-ID when the
+// client sends one and echoed back. Handlers mark the end of their phases on
+// the trace of the request; a request taking longer than
+// SLOW_REQUEST_THRESHOLD is logged with its ID, node, body size and the time
+// spent in each phase.
+
+type tracePhase struct {
+	name     string
+	duration time.Duration
+}
+
+// requestTrace collects the phases of a request, its methods do nothing on a
+// nil trace
+type requestTrace struct {
+	id string
+
+	mu     sync.Mutex
+	node   string
+	last   time.Time
+	phases []tracePhase
+	// long-running uploads are expected to exceed the threshold
+	untimed bool
+}
+
+// traceOf returns the trace of the request of ctx, nil outside of requests
+func traceOf(ctx context.Context) *requestTrace {
+	t, _ := ctx.Value(key("trace")).(*requestTrace)
+	return t
+}
+
+// phase ends the phase name, which began when the previous one ended
+func (t *requestTrace) phase(name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.phases = append(t.phases, tracePhase{name, now.Sub(t.last)})
+	t.last = now
+}
+
+// requestID is the ID of the traced request, empty on a nil trace
+func (t *requestTrace) requestID() string {
+	if t == nil {
+		return ""
+	}
+	return t.id
+}
+
+func (t *requestTrace) setNode(node string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.node = node
+}
+
+// nodeName is the node set with setNode, empty on a nil trace
+func (t *requestTrace) nodeName() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.node
+}
+
+// skip exempts the request from the slow request log
+func (t *requestTrace) skip() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.untimed = true
+}
+
+// countingReader counts the bytes of a request body read by the handler
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// statusRecorder remembers the status of a response, Flush is passed through
+// for the NDJSON responses
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// validRequestID accepts IDs of proxies and clients that are safe to log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestTrace assigns the request ID and logs requests slower than
+// SLOW_REQUEST_THRESHOLD, disabled at 0
+func withRequestTrace(cfg *config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newJobID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		now := time.Now()
+		trace := &requestTrace{id: id, last: now, node: r.URL.Query().Get("node")}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), key("trace"), trace)))
+
+		elapsed := time.Since(now)
+		if cfg.SlowRequestThreshold <= 0 || elapsed < cfg.SlowRequestThreshold {
+			return
+		}
+		trace.mu.Lock()
+		defer trace.mu.Unlock()
+		if trace.untimed {
+			return
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		phases := make([]string, 0, len(trace.phases)+1)
+		for _, p := range trace.phases {
+			phases = append(phases, p.name+":"+shortLatency(p.duration))
+		}
+		if rest := time.Since(trace.last); len(trace.phases) > 0 && rest >= time.Millisecond {
+			phases = append(phases, "respond:"+shortLatency(rest))
+		}
+		node := trace.node
+		if node == "" {
+			node = "-"
+		}
+		if len(phases) == 0 {
+			phases = append(phases, "-")
+		}
+		log.Printf("slow request: id=%s method=%s path=%s node=%s status=%d body_bytes=%d duration=%s phases=%s\n",
+			id, r.Method, strconv.Quote(r.URL.Path), strconv.Quote(node), rec.status, body.n,
+			shortLatency(elapsed), strings.Join(phases, ","))
+	})
+}
+
+// shortLatency rounds durations to a precision useful in logs
+func shortLatency(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond).String()
+	}
+	return d.Round(time.Microsecond).String()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type fieldStats struct {
+	Count int64   `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+}
+
+// nodeRoutes dispatches the per-node resources below /nodes/
+func nodeRoutes(w http.ResponseWriter, r *http.Request) {
+	// path is /v1/nodes/{node}/{resource} or its /api alias, see
+	// resources.go for the rest
+	_, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/nodes/")
+	node, resource, _ := strings.Cut(rest, "/")
+	if node == "" {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+	if !nodeInScope(w, r, node) {
+		return
+	}
+	traceOf(r.Context()).setNode(node)
+
+	switch resource {
+	case "stats":
+		getNodeStats(w, r, node)
+	case "quality":
+		getNodeQuality(w, r, node)
+	case "shm":
+		getNodeSHM(w, r, node)
+	default:
+		nodeResource(w, r, node, resource)
+	}
+}
+
+func getNodeStats(w http.ResponseWriter, r *http.Request, node string) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+
+	window := time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "400 - invalid window", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	stop := time.Now()
+	start := stop.Add(-window)
+
+	fields, err := queryFieldStats(ctx, t, cfg.Schema, "r.location == "+fluxString(node), start, stop)
+	if err != nil {
+		queryFailed(w, r, err)
+		return
+	}
+
+	primary := cfg.Schema.primary()
+	readings := fields[primary.Measurement][primary.Name].Count
+	parsed, rejected := t.nodes.records(node)
+	failureRate := 0.0
+	if parsed+rejected > 0 {
+		failureRate = float64(rejected) / float64(parsed+rejected)
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"node":                   node,
+		"start":                  start,
+		"stop":                   stop,
+		"readings":               readings,
+		"ingest_rate_per_minute": float64(readings) / window.Minutes(),
+		// parse outcomes are kept in memory since the server started
+		"records_parsed":     parsed,
+		"records_rejected":   rejected,
+		"parse_failure_rate": failureRate,
+		"fields":             fields,
+	})
+}
+
+// queryFieldStats returns the count, min, max and mean of every schema field
+// over the points matching predicate, by measurement and field
+func queryFieldStats(ctx context.Context, t *tenant, schema *sensorSchema, predicate string, start, stop time.Time) (map[string]map[string]*fieldStats, error) {
+	flux := fmt.Sprintf(`data = from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => %s and (%s))
+  |> group(columns: ["_measurement", "_field"])
+
+data |> count() |> yield(name: "count")
+data |> min() |> yield(name: "min")
+data |> max() |> yield(name: "max")
+data |> mean() |> yield(name: "mean")`,
+		fluxString(t.Bucket), start.UTC().Format(time.RFC3339Nano), stop.UTC().Format(time.RFC3339Nano), predicate,
+		schema.measurementFilter())
+
+	t.usage.Queries.Add(1)
+	result, err := t.queryApi.Query(ctx, scopeFlux(ctx, flux))
+	traceOf(ctx).phase("query")
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	fields := make(map[string]map[string]*fieldStats)
+	for m, names := range schema.Measurements {
+		fields[m] = make(map[string]*fieldStats)
+		for _, f := range names {
+			fields[m][f] = &fieldStats{}
+		}
+	}
+	for result.Next() {
+		rec := result.Record()
+		fs, ok := fields[rec.Measurement()][rec.Field()]
+		if !ok {
+			continue
+		}
+		if rec.Result() == "count" {
+			fs.Count, _ = rec.Value().(int64)
+			continue
+		}
+		v, _ := rec.Value().(float64)
+		switch rec.Result() {
+		case "min":
+			fs.Min = v
+		case "max":
+			fs.Max = v
+		case "mean":
+			fs.Mean = v
+		}
+	}
+	return fields, result.Err()
+}
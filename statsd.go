@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// StatsD listener for the software metrics of gateways and other auxiliary
+// systems: counters ("name:1|c", with an optional sample rate "|@0.1"),
+// gauges ("name:42|g", "+3" or "-3" change the last value) and timers
+// ("name:12.5|ms", h and d are read alike) are aggregated over
+// STATSD_FLUSH_INTERVAL and written as one point per metric and tags to
+// STATSD_MEASUREMENT, tagged with the metric name. DogStatsD tags
+// ("|#role:edge,node:gw-1") become tags; the node tag names the node,
+// STATSD_NODE when missing.
+
+const (
+	// timer values kept per metric and interval for the percentiles
+	statsdMaxSamples = 10000
+	statsdMaxPacket  = 65535
+)
+
+// statsdMetric is what was collected of a metric in the current interval
+type statsdMetric struct {
+	name, kind, node string
+	tags             map[string]string
+
+	// counters
+	count float64
+	// gauges, kept across intervals for relative updates
+	value   float64
+	changed bool
+	// timers: values received, and as sent with the sample rate applied
+	samples       []float64
+	received      int
+	timed         float64
+	sum, min, max float64
+}
+
+type statsdListener struct {
+	cfg    *config
+	tenant *tenant
+
+	mu      sync.Mutex
+	metrics map[string]*statsdMetric
+
+	accepted, invalid, dropped atomic.Int64
+}
+
+func newStatsdListener(cfg *config, reg *tenantRegistry) (*statsdListener, error) {
+	t := reg.byName(cfg.StatsdTenant)
+	if t == nil {
+		return nil, fmt.Errorf("STATSD_TENANT: unknown tenant %q", cfg.StatsdTenant)
+	}
+	return &statsdListener{cfg: cfg, tenant: t, metrics: make(map[string]*statsdMetric)}, nil
+}
+
+// listen receives packets on the UDP address addr until the server stops
+func (s *statsdListener) listen(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("statsd: listening on %s, flushing every %s\n", addr, s.cfg.StatsdFlushInterval)
+	go func() {
+		for range time.Tick(s.cfg.StatsdFlushInterval) {
+			s.flush(time.Now())
+		}
+	}()
+	go func() {
+		buf := make([]byte, statsdMaxPacket)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				log.Printf("statsd: %s\n", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				if line = strings.TrimSpace(line); line == "" {
+					continue
+				}
+				if err := s.line(line); err != nil {
+					s.invalid.Add(1)
+					detailf("statsd: %s: %q\n", err, line)
+				} else {
+					s.accepted.Add(1)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// line adds a metric line to the current interval
+func (s *statsdListener) line(line string) error {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return errors.New("expected name:value|type")
+	}
+	sections := strings.Split(rest, "|")
+	if len(sections) < 2 {
+		return errors.New("expected name:value|type")
+	}
+	raw, kind := sections[0], sections[1]
+	rate := 1.0
+	tags := make(map[string]string)
+	for _, sec := range sections[2:] {
+		switch {
+		case strings.HasPrefix(sec, "@"):
+			r, err := strconv.ParseFloat(sec[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return fmt.Errorf("invalid sample rate %q", sec)
+			}
+			rate = r
+		case strings.HasPrefix(sec, "#"):
+			for _, tag := range strings.Split(sec[1:], ",") {
+				k, v, _ := strings.Cut(tag, ":")
+				if k != "" && v != "" {
+					tags[k] = v
+				}
+			}
+		}
+	}
+	node := s.cfg.StatsdNode
+	if n, ok := tags["node"]; ok {
+		node = n
+		delete(tags, "node")
+	}
+	if err := validNode(node); err != nil {
+		return err
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("invalid value %q", raw)
+	}
+	switch kind {
+	case "h", "d":
+		kind = "ms"
+	case "c", "g", "ms":
+	default:
+		return fmt.Errorf("unsupported type %q", kind)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := statsdKey(name, kind, node, tags)
+	m := s.metrics[k]
+	if m == nil {
+		m = &statsdMetric{name: name, kind: kind, node: node, tags: tags}
+		s.metrics[k] = m
+	}
+	switch kind {
+	case "c":
+		m.count += value / rate
+	case "g":
+		// a sign makes the value relative to the last one, 0 at first
+		if raw[0] == '+' || raw[0] == '-' {
+			m.value += value
+		} else {
+			m.value = value
+		}
+		m.changed = true
+	case "ms":
+		if m.received == 0 || value < m.min {
+			m.min = value
+		}
+		if m.received == 0 || value > m.max {
+			m.max = value
+		}
+		m.received++
+		m.timed += 1 / rate
+		m.sum += value
+		if len(m.samples) < statsdMaxSamples {
+			m.samples = append(m.samples, value)
+		}
+	}
+	return nil
+}
+
+// statsdKey identifies a metric by its name, type, node and tags
+func statsdKey(name, kind, node string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(name + "|" + kind + "|" + node)
+	for _, k := range keys {
+		b.WriteString("|" + k + "=" + tags[k])
+	}
+	return b.String()
+}
+
+// flush writes what was collected since the last flush at now
+func (s *statsdListener) flush(now time.Time) {
+	interval := s.cfg.StatsdFlushInterval.Seconds()
+	cfg := s.cfg
+	t := s.tenant
+
+	s.mu.Lock()
+	var points []*write.Point
+	for k, m := range s.metrics {
+		if m.kind == "g" && !m.changed {
+			continue
+		}
+		p := cfg.Schema.newPoint(cfg.StatsdMeasurement, m.node, now)
+		p.AddTag("metric", m.name)
+		keys := make([]string, 0, len(m.tags))
+		for tk := range m.tags {
+			keys = append(keys, tk)
+		}
+		sort.Strings(keys)
+		for _, tk := range keys {
+			if !hasTag(p, tk) {
+				p.AddTag(tk, m.tags[tk])
+			}
+		}
+		switch m.kind {
+		case "c":
+			p.AddField("count", m.count)
+			p.AddField("rate", m.count/interval)
+			// counters start over, and are forgotten when idle
+			delete(s.metrics, k)
+		case "g":
+			p.AddField("value", m.value)
+			m.changed = false
+		case "ms":
+			sort.Float64s(m.samples)
+			p.AddField("count", m.timed)
+			p.AddField("min", m.min)
+			p.AddField("max", m.max)
+			p.AddField("mean", m.sum/float64(m.received))
+			p.AddField("median", percentile(m.samples, 50))
+			p.AddField("p90", percentile(m.samples, 90))
+			p.AddField("p95", percentile(m.samples, 95))
+			p.AddField("p99", percentile(m.samples, 99))
+			delete(s.metrics, k)
+		}
+		points = append(points, p)
+	}
+	s.mu.Unlock()
+	if len(points) == 0 {
+		return
+	}
+
+	if _, err := t.writer.write(context.Background(), nil, points...); err != nil {
+		s.dropped.Add(int64(len(points)))
+		log.Printf("statsd: %d points dropped: %s\n", len(points), err)
+		return
+	}
+	t.usage.Readings.Add(int64(len(points)))
+}
+
+// percentile is the nearest-rank percentile p of sorted
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func collectStatsd(s *statsdListener) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		mw.family("sensor_statsd_lines_total", "counter", "StatsD lines received by outcome.")
+		mw.sample("sensor_statsd_lines_total", float64(s.accepted.Load()), "result", "accepted")
+		mw.sample("sensor_statsd_lines_total", float64(s.invalid.Load()), "result", "invalid")
+		mw.family("sensor_statsd_points_dropped_total", "counter", "Aggregated StatsD points InfluxDB and the buffer had no room for.")
+		mw.sample("sensor_statsd_points_dropped_total", float64(s.dropped.Load()))
+	}
+}
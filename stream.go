@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// splitRecords is a bufio.SplitFunc yielding the records of a stream, which
+// are separated by newlines or ';'
+func splitRecords(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		i := bytes.IndexAny(data, "\n;")
+		if i < 0 {
+			if !atEOF {
+				return 0, nil, nil
+			}
+			return len(data), bytes.TrimSpace(data), nil
+		}
+		if record := bytes.TrimSpace(data[:i]); len(record) > 0 {
+			return advance + i + 1, record, nil
+		}
+		// skip empty records
+		advance += i + 1
+		data = data[i+1:]
+	}
+}
+
+// postStream ingests a long running upload, typically sent with
+// Transfer-Encoding: chunked during a measurement campaign. Records are
+// parsed as they arrive and written in batches of STREAM_BATCH_SIZE or every
+// STREAM_FLUSH_INTERVAL, without buffering the whole body. The node, and
+// optionally the precision, are query parameters.
+func postStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+	events := ctx.Value(key("events")).(*eventBus)
+	// uploads last as long as the node keeps sending
+	traceOf(ctx).skip()
+	mq := ctx.Value(key("mqtt")).(*mqttPublisher)
+	forward := ctx.Value(key("forwarders")).(forwarders)
+
+	if t.writer.overloaded() {
+		t.usage.Throttled.Add(1)
+		writeOverloaded(w, cfg.RetryAfter)
+		return
+	}
+	if mt, err := mediaType(r); err != nil {
+		writeBodyError(w, err)
+		return
+	} else if mt != "" && mt != "text/plain" {
+		writeBodyError(w, &bodyError{http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported Content-Type %q, expected text/plain", mt)})
+		return
+	}
+
+	q := r.URL.Query()
+	node := q.Get("node")
+	if node == "" {
+		node = "unknown"
+	}
+	unit := cfg.TimestampPrecision
+	if p := q.Get("precision"); p != "" {
+		var err error
+		if unit, err = parsePrecision(p); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+	}
+
+	// the body is read in its own goroutine so batches also go out while
+	// the node is quiet
+	records := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		sc := bufio.NewScanner(r.Body)
+		// a stream may run for hours, only each record is limited
+		sc.Buffer(nil, int(cfg.IngestMaxBytes))
+		sc.Split(splitRecords)
+		for sc.Scan() {
+			select {
+			case records <- sc.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+		readErr <- sc.Err()
+		close(records)
+	}()
+
+	var result ingestResult
+	var points []*write.Point
+	var batch []reading
+	var receipts []pointReceipt
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		n := int64(len(batch))
+		stored, batchReceipts := batch, receipts
+		written := func() {
+			logStored(node, batchReceipts)
+			t.stats.add(node, func(c *ingestCounts) { c.Written.Add(n) })
+			t.cache.invalidate(node)
+			mq.publish(t, node, stored...)
+			forward.forward(t, node, stored...)
+		}
+		t.maintenance.label(node, points)
+		_, err := t.writer.write(ctx, written, points...)
+		if err != nil {
+			t.stats.add(node, func(c *ingestCounts) { c.Dropped.Add(n) })
+		} else {
+			t.usage.Readings.Add(n)
+		}
+		points, batch, receipts = nil, nil, nil
+		return err
+	}
+
+	ticker := time.NewTicker(cfg.StreamFlushInterval)
+	defer ticker.Stop()
+
+	seen := make(map[int64]bool)
+	index := 0
+	for {
+		var err error
+		select {
+		case record, ok := <-records:
+			if !ok {
+				readErr := <-readErr
+				if readErr != nil {
+					log.Printf("stream from %s ended: %s\n", node, readErr)
+				}
+				if err := flush(); err != nil {
+					streamFailed(w, t, cfg, err)
+					return
+				}
+				if errors.Is(readErr, bufio.ErrTooLong) {
+					writeBodyError(w, &bodyError{http.StatusRequestEntityTooLarge, fmt.Sprintf("record %d larger than %d bytes", index, cfg.IngestMaxBytes)})
+					return
+				}
+				result.Commands = t.commands.exchange(node, requestAcks(r))
+				result.Status = "ok"
+				status := http.StatusOK
+				if result.Accepted == 0 {
+					result.Status = "rejected"
+					status = http.StatusBadRequest
+				} else if result.Rejected > 0 {
+					result.Status = "partial"
+				}
+				writeIngestResult(w, status, result)
+				return
+			}
+
+			var rd reading
+			var corrected bool
+			rd, corrected, err = streamRecord(ctx, t, cfg, node, record, unit)
+			t.stats.add(node, func(c *ingestCounts) { c.Received.Add(1) })
+			if err != nil {
+				detailf("Error: stream record %d: %s\n", index, err)
+				t.nodes.countRecords(node, 0, 1)
+				t.stats.add(node, func(c *ingestCounts) { c.Rejected.Add(1) })
+				result.Rejected++
+				result.Errors = append(result.Errors, recordError{Index: index, Reason: err.Error()})
+				index++
+				err = nil
+				continue
+			}
+			t.nodes.countRecords(node, 1, 0)
+			t.stats.add(node, func(c *ingestCounts) { c.Parsed.Add(1) })
+			at := rd.Time.Truncate(cfg.WritePrecision).UnixNano()
+			if seen[at] {
+				t.stats.add(node, func(c *ingestCounts) { c.Duplicates.Add(1) })
+				result.Duplicates++
+				result.DuplicateIndices = append(result.DuplicateIndices, index)
+				index++
+				continue
+			}
+			seen[at] = true
+			index++
+
+			result.Accepted++
+			observeReading(t, cfg, events, node, rd, time.Now())
+			t.nodes.update(node, rd)
+			recordPoints := cfg.Schema.points(node, rd, corrected, cfg.receivedAt(time.Now()))
+			points = append(points, recordPoints...)
+			rc := pointReceipts(node, index-1, recordPoints, cfg.WritePrecision)
+			receipts = append(receipts, rc...)
+			result.Receipts = append(result.Receipts, rc...)
+			if p := observeRate(t, cfg, events, node, rd); p != nil {
+				points = append(points, p)
+			}
+			if p := observeSHM(t, cfg, events, node, rd); p != nil {
+				points = append(points, p)
+			}
+			points = append(points, observePeak(t, cfg, events, node, rd)...)
+			batch = append(batch, rd)
+			if len(batch) >= cfg.StreamBatchSize {
+				err = flush()
+			}
+		case <-ticker.C:
+			err = flush()
+		case <-ctx.Done():
+			log.Printf("stream from %s canceled after %d records: %s\n", node, index, ctx.Err())
+			return
+		}
+		if err != nil {
+			streamFailed(w, t, cfg, err)
+			return
+		}
+	}
+}
+
+// streamRecord parses one record of a stream and applies the clock handling
+// of ingest. There is no age the node could send along, so records without a
+// clock get the time they arrived.
+func streamRecord(ctx context.Context, t *tenant, cfg *config, node string, record string, unit time.Duration) (rd reading, corrected bool, err error) {
+	if record, err = openPayload(ctx, node, record); err != nil {
+		return rd, false, err
+	}
+	record, err = verifyChecksum(record, cfg.RequirePayloadCRC)
+	if err != nil {
+		if err != errChecksumMissing {
+			t.nodes.countCorrupted(node)
+		}
+		return rd, false, err
+	}
+	version, data, err := payloadVersion(record)
+	if err != nil {
+		return rd, false, err
+	}
+	t.nodes.observeVersion(node, version)
+	readings, _, rejected := parseRecords(ctx, data, cfg.Schema, unit, payloadParsers[version])
+	if len(rejected) > 0 {
+		return rd, false, errors.New(rejected[0].Reason)
+	}
+	if len(readings) != 1 {
+		return rd, false, errors.New("expected one record")
+	}
+
+	rd = readings[0]
+	received := time.Now()
+	if rd.Time.Equal(time.Unix(0, 0)) || cfg.serverTime(node) {
+		rd.Time = received
+		return rd, false, nil
+	}
+	rd.Time = cfg.deviceTime(node, rd.Time)
+	offset := t.nodes.observeClock(node, received.Sub(rd.Time))
+	if cfg.ClockCorrection && (offset > cfg.ClockDriftThreshold || offset < -cfg.ClockDriftThreshold) {
+		rd.Time = rd.Time.Add(offset)
+		corrected = true
+	}
+	return rd, corrected, nil
+}
+
+// streamFailed ends a stream whose batch could not be written: on a full
+// buffer the node is asked to resend the rest later, a batch InfluxDB
+// rejected is answered with 400
+func streamFailed(w http.ResponseWriter, t *tenant, cfg *config, err error) {
+	if errors.Is(err, errWriteRejected) {
+		writeRejected(w, err)
+		return
+	}
+	if errors.Is(err, errBufferFull) {
+		log.Println(err)
+		t.usage.Throttled.Add(1)
+		writeOverloaded(w, cfg.RetryAfter)
+		return
+	}
+	log.Printf("stream canceled: %s\n", err)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state such as "READY=1" to systemd when running as a
+// Type=notify service, and does nothing otherwise
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval is the WatchdogSec= of the unit, 0 when the watchdog is
+// off or meant for another process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// waitForInfluxDB pings InfluxDB with a growing delay until it answers, or
+// until limit passed when positive, and reports whether it answered
+func waitForInfluxDB(ping func(ctx context.Context) (bool, error), limit time.Duration) bool {
+	deadline := time.Now().Add(limit)
+	for delay := time.Second; ; {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ok, err := ping(ctx)
+		cancel()
+		if ok {
+			return true
+		}
+		if limit > 0 && time.Now().Add(delay).After(deadline) {
+			return false
+		}
+		log.Printf("waiting for InfluxDB: %v\n", err)
+		sdNotify(fmt.Sprintf("STATUS=Waiting for InfluxDB: %v", err))
+		time.Sleep(delay)
+		if delay *= 2; delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+}
+
+// notifyReady waits until ping reports InfluxDB up, then tells systemd the server is
+// usable and keeps its watchdog fed for as long as the server still answers
+// HTTP requests on addr
+func notifyReady(ping func(ctx context.Context) (bool, error), addr *net.TCPAddr) {
+	waitForInfluxDB(ping, 0)
+	log.Println("InfluxDB is reachable")
+	if err := sdNotify(fmt.Sprintf("READY=1\nSTATUS=Serving on port %d", addr.Port)); err != nil {
+		log.Printf("sd_notify: %s\n", err)
+	}
+
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	// a wedged server stops answering, the missing pings make systemd
+	// restart it
+	self := &http.Client{Timeout: interval / 3}
+	url := fmt.Sprintf("http://127.0.0.1:%d/", addr.Port)
+	for range time.Tick(interval / 3) {
+		res, err := self.Get(url)
+		if err != nil {
+			log.Printf("watchdog: %s\n", err)
+			continue
+		}
+		res.Body.Close()
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("sd_notify: %s\n", err)
+		}
+	}
+}
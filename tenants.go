@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+)
+
+// tenant is a group sharing the server, bound to an API key and to its own
+// InfluxDB org and bucket
+type tenant struct {
+	Name   string `json:"name"`
+	APIKey string `json:"api_key"`
+	Org    string `json:"org"`
+	Bucket string `json:"bucket"`
+
+	writer   *influxWriter
+	queryApi api.QueryAPI
+	nodes    *nodeStore
+	stats    *ingestStats
+	commands *commandQueue
+	cache    *queryCache
+	// payloads in reassembly, see fragments.go
+	fragments *fragmentStore
+	// alerts silenced for maintenance, see maintenance.go
+	maintenance *maintenanceStore
+	usage       tenantUsage
+}
+
+type tenantUsage struct {
+	Requests    atomic.Int64
+	Readings    atomic.Int64
+	WriteErrors atomic.Int64
+	Queries     atomic.Int64
+	// ingest requests turned away while the write buffer was full
+	Throttled atomic.Int64
+	// unix nanoseconds of the last successful write
+	LastWrite atomic.Int64
+}
+
+func (u *tenantUsage) snapshot() map[string]int64 {
+	return map[string]int64{
+		"requests":     u.Requests.Load(),
+		"readings":     u.Readings.Load(),
+		"write_errors": u.WriteErrors.Load(),
+		"queries":      u.Queries.Load(),
+		"throttled":    u.Throttled.Load(),
+	}
+}
+
+// tenantRegistry resolves API keys to tenants. Without a tenants file the
+// server runs with a single default tenant that needs no key.
+type tenantRegistry struct {
+	byKey  map[string]*tenant
+	single *tenant
+	// role keys of ACCESS_KEYS_FILE, see rbac.go
+	keys map[string]*accessKey
+}
+
+func loadTenants(cfg *config, client influxdb2.Client) (*tenantRegistry, error) {
+	reg := &tenantRegistry{byKey: make(map[string]*tenant)}
+
+	if cfg.TenantsFile == "" {
+		reg.single = &tenant{Name: "default", Org: cfg.Org, Bucket: cfg.Bucket}
+		reg.single.init(client, cfg)
+		return reg, loadAccessKeys(cfg, reg)
+	}
+
+	raw, err := os.ReadFile(cfg.TenantsFile)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []*tenant
+	if err := json.Unmarshal(raw, &tenants); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", cfg.TenantsFile, err)
+	}
+	for _, t := range tenants {
+		if t.Name == "" || t.APIKey == "" || t.Org == "" || t.Bucket == "" {
+			return nil, fmt.Errorf("tenant %q: name, api_key, org and bucket are required", t.Name)
+		}
+		if _, ok := reg.byKey[t.APIKey]; ok {
+			return nil, fmt.Errorf("tenant %q: duplicate api_key", t.Name)
+		}
+		t.init(client, cfg)
+		reg.byKey[t.APIKey] = t
+	}
+	return reg, loadAccessKeys(cfg, reg)
+}
+
+func (t *tenant) init(client influxdb2.Client, cfg *config) {
+	// use blocking (synchronous) api to write to db, behind the breaker
+	t.writer = newInfluxWriter(client.WriteAPIBlocking(t.Org, t.Bucket), &t.usage, cfg)
+	if cfg.GatewayUpstream != "" {
+		// the default tenant has no key of its own
+		apiKey := t.APIKey
+		if apiKey == "" {
+			apiKey = cfg.GatewayAPIKey
+		}
+		t.writer.api = newUpstreamWriter(cfg, apiKey)
+		t.writer.probe = cfg.GatewayFlushInterval
+		t.writer.deferred = true
+	}
+	t.queryApi = client.QueryAPI(t.Org)
+	t.nodes = newNodeStore()
+	t.stats = newIngestStats()
+	t.commands = newCommandQueue()
+	t.fragments = newFragmentStore(cfg.FragmentTimeout)
+	t.cache = newQueryCache(cfg.QueryCacheTTL, cfg.QueryCacheMaxEntries, cfg.Schema.Zones)
+	t.maintenance = newMaintenanceStore()
+}
+
+// byName finds a tenant by name, an empty name selects the default tenant
+func (reg *tenantRegistry) byName(name string) *tenant {
+	if reg.single != nil {
+		if name == "" || name == reg.single.Name {
+			return reg.single
+		}
+		return nil
+	}
+	for _, t := range reg.byKey {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (reg *tenantRegistry) all() []*tenant {
+	if reg.single != nil {
+		return []*tenant{reg.single}
+	}
+	tenants := make([]*tenant, 0, len(reg.byKey))
+	for _, t := range reg.byKey {
+		tenants = append(tenants, t)
+	}
+	return tenants
+}
+
+// requestAPIKey reads the key from the X-API-Key header, falling back to the
+// api_key form value for nodes that cannot set headers
+func requestAPIKey(r *http.Request) string {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return k
+	}
+	return r.FormValue("api_key")
+}
+
+// withTenant resolves the tenant and the principal of the request and stores
+// them in the request context, rejecting unknown keys
+func withTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the key may be a form value, and a body that fails to parse
+		// here would read as empty in the handler
+		if err := parseForm(r); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		cfg := r.Context().Value(key("config")).(*config)
+		reg := r.Context().Value(key("tenants")).(*tenantRegistry)
+		p, t, err := authenticate(r, cfg, reg)
+		if err != nil {
+			challengeBasic(w, cfg)
+			http.Error(w, "401 - "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		t.usage.Requests.Add(1)
+		traceOf(r.Context()).phase("auth")
+
+		ctx := context.WithValue(r.Context(), key("tenant"), t)
+		next.ServeHTTP(w, withPrincipal(r.WithContext(ctx), p))
+	})
+}
+
+func getUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	t := r.Context().Value(key("tenant")).(*tenant)
+	writeJSON(w, map[string]interface{}{
+		"tenant": t.Name,
+		"usage":  t.usage.snapshot(),
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Clock sync for nodes without an RTC: GET /v1/time answers the server time
+// with nothing else to do on the way, and every POST response carries it in
+// X-Server-Time, so a node can set its clock from the answer to its own
+// submission. Both are Unix milliseconds as of the moment the response
+// starts.
+
+// getTime answers {"epoch_ms": ...} without authentication
+func getTime(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(`{"epoch_ms":` + epochMillis(time.Now()) + "}\n"))
+}
+
+func epochMillis(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// withServerTime adds X-Server-Time to POST responses
+func withServerTime(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&serverTimeWriter{ResponseWriter: w}, r)
+	})
+}
+
+// serverTimeWriter sets X-Server-Time when the response starts, after a
+// handler took its time writing to InfluxDB
+type serverTimeWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (s *serverTimeWriter) WriteHeader(code int) {
+	if !s.started {
+		s.started = true
+		s.Header().Set("X-Server-Time", epochMillis(time.Now()))
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *serverTimeWriter) Write(b []byte) (int, error) {
+	if !s.started {
+		s.WriteHeader(http.StatusOK)
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *serverTimeWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
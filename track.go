@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash encodes a position with the given number of characters
+func geohash(lat, lon float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	even := true
+	bit, ch := 0, 0
+	for len(hash) < precision {
+		r, v := &latRange, lat
+		if even {
+			r, v = &lonRange, lon
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		if bit++; bit == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// getTrack returns the path of a mobile node over a time range, as rows or
+// as a GeoJSON LineString with format=geojson
+func getTrack(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	geoJSON := q.Get("format") == "geojson"
+	format := formatJSON
+	if !geoJSON {
+		var ok bool
+		if format, ok = responseFormat(r); !ok {
+			http.Error(w, "406 - Supported formats are json, geojson, csv and ndjson", http.StatusNotAcceptable)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+
+	lat, okLat := cfg.Schema.field("lat")
+	lon, okLon := cfg.Schema.field("lon")
+	if !okLat || !okLon || lat.Measurement != lon.Measurement {
+		http.Error(w, "404 - The schema has no lat and lon fields", http.StatusNotFound)
+		return
+	}
+
+	node := q.Get("node")
+	if node == "" {
+		http.Error(w, "400 - node is required", http.StatusBadRequest)
+		return
+	}
+	if !nodeInScope(w, r, node) {
+		return
+	}
+	now := time.Now()
+	start, err := parseTimeParam(q.Get("start"), now.Add(-24*time.Hour))
+	if err != nil {
+		http.Error(w, "400 - invalid start", http.StatusBadRequest)
+		return
+	}
+	stop, err := parseTimeParam(q.Get("stop"), now)
+	if err != nil || !stop.After(start) {
+		http.Error(w, "400 - invalid stop", http.StatusBadRequest)
+		return
+	}
+	limit, offset, err := pageParams(q, cfg)
+	if err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	loc, err := timezoneParam(q, cfg, node)
+	if err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flux := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %s and r.location == %s and (r._field == "lat" or r._field == "lon"))
+  |> group(columns: ["_measurement", "_field", "location"])
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group()
+  |> sort(columns: ["_time"])
+  |> limit(n: %d, offset: %d)`,
+		fluxString(t.Bucket), start.UTC().Format(time.RFC3339Nano), stop.UTC().Format(time.RFC3339Nano),
+		fluxString(lat.Measurement), fluxString(node), limit, offset)
+
+	t.usage.Queries.Add(1)
+	result, err := t.queryApi.Query(ctx, scopeFlux(ctx, flux))
+	traceOf(ctx).phase("query")
+	if err != nil {
+		queryFailed(w, r, err)
+		return
+	}
+	defer result.Close()
+
+	points := []map[string]interface{}{}
+	coordinates := [][2]float64{}
+	for result.Next() {
+		rec := result.Record()
+		la, ok1 := rec.ValueByKey("lat").(float64)
+		lo, ok2 := rec.ValueByKey("lon").(float64)
+		if !ok1 || !ok2 {
+			continue
+		}
+		point := map[string]interface{}{"time": rec.Time().In(loc), "lat": la, "lon": lo}
+		if cfg.Schema.GeohashPrecision > 0 {
+			point["geohash"] = geohash(la, lo, cfg.Schema.GeohashPrecision)
+		}
+		points = append(points, point)
+		coordinates = append(coordinates, [2]float64{lo, la})
+	}
+	if result.Err() != nil {
+		queryFailed(w, r, result.Err())
+		return
+	}
+
+	switch {
+	case geoJSON:
+		msg, err := json.Marshal(map[string]interface{}{
+			"type": "Feature",
+			"geometry": map[string]interface{}{
+				"type":        "LineString",
+				"coordinates": coordinates,
+			},
+			"properties": map[string]interface{}{
+				"node":  node,
+				"start": start,
+				"stop":  stop,
+			},
+		})
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "500 - Something bad happened!", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/geo+json")
+		w.Write(msg)
+	case format == formatCSV:
+		writeCSV(w, []string{"time", "lat", "lon", "geohash"}, points)
+	case format == formatNDJSON:
+		writeNDJSON(w, points)
+	default:
+		writeJSON(w, map[string]interface{}{
+			"node":   node,
+			"start":  start,
+			"stop":   stop,
+			"points": points,
+			"limit":  limit,
+			"offset": offset,
+		})
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// passwordIterations is the PBKDF2 work factor of new password hashes
+const passwordIterations = 100000
+
+// sessionCookie carries the token of a dashboard login
+const sessionCookie = "session"
+
+// Dashboard users: the accounts of USERS_FILE log in at POST /login and get
+// a token signed with JWT_SECRET, as a session cookie for the dashboard and
+// in the response for API clients. Admins manage the accounts at
+// /admin/users; the file only holds password hashes.
+
+type user struct {
+	Username string `json:"username"`
+	// pbkdf2-sha256$<iterations>$<salt>$<hash>, see hashPassword
+	PasswordHash string `json:"password_hash,omitempty"`
+	Role         string `json:"role"`
+	// tenant name, the default tenant when empty
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// userStore holds the dashboard users, saved back to USERS_FILE on change
+type userStore struct {
+	path     string
+	sessions *sessionStore
+
+	mu    sync.RWMutex
+	users map[string]*user
+}
+
+func loadUsers(cfg *config, reg *tenantRegistry) (*userStore, error) {
+	s := &userStore{path: cfg.UsersFile, sessions: newSessionStore(cfg.SessionIdleTimeout), users: make(map[string]*user)}
+	if s.path == "" {
+		return s, nil
+	}
+	raw, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		// the first admin creates the file at /admin/users
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users []*user
+	if err := json.Unmarshal(raw, &users); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", s.path, err)
+	}
+	for _, u := range users {
+		if u.Username == "" || !strings.HasPrefix(u.PasswordHash, "pbkdf2-sha256$") || !validRole(u.Role) {
+			return nil, fmt.Errorf("user %q: username, password_hash and a role are required", u.Username)
+		}
+		if reg.byName(u.Tenant) == nil {
+			return nil, fmt.Errorf("user %q: unknown tenant %q", u.Username, u.Tenant)
+		}
+		s.users[u.Username] = u
+	}
+	return s, nil
+}
+
+func (s *userStore) enabled() bool {
+	return s.path != ""
+}
+
+// save writes the users to a temporary file first, so a crash cannot leave
+// a truncated file behind. The caller must hold the lock.
+func (s *userStore) save() error {
+	users := make([]*user, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	raw, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(raw, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// verify returns the user with the given credentials, nil when they are wrong
+func (s *userStore) verify(username, password string) *user {
+	s.mu.RLock()
+	u, ok := s.users[username]
+	s.mu.RUnlock()
+	if !ok {
+		// spend the same time as for a known user
+		checkPassword(dummyPasswordHash, password)
+		return nil
+	}
+	if !checkPassword(u.PasswordHash, password) {
+		return nil
+	}
+	copied := *u
+	return &copied
+}
+
+// put creates or updates a user, ending the sessions of the old role
+func (s *userStore) put(u user) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.users[u.Username]
+	s.users[u.Username] = &u
+	if err := s.save(); err != nil {
+		if prev != nil {
+			s.users[u.Username] = prev
+		} else {
+			delete(s.users, u.Username)
+		}
+		return err
+	}
+	s.sessions.revokeUser(u.Username)
+	return nil
+}
+
+func (s *userStore) remove(username string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[username]
+	if !ok {
+		return false, nil
+	}
+	delete(s.users, username)
+	if err := s.save(); err != nil {
+		s.users[username] = u
+		return true, err
+	}
+	s.sessions.revokeUser(username)
+	return true, nil
+}
+
+// list returns the users without their password hashes
+func (s *userStore) list() []user {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []user{}
+	for _, u := range s.users {
+		c := *u
+		c.PasswordHash = ""
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+var dummyPasswordHash = hashPassword("")
+
+// hashPassword derives a salted PBKDF2-HMAC-SHA256 hash of password
+func hashPassword(password string) string {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	hash := pbkdf2SHA256([]byte(password), salt, passwordIterations)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash))
+}
+
+func checkPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(password), salt, iterations), want) == 1
+}
+
+// pbkdf2SHA256 is PBKDF2 (RFC 8018) with HMAC-SHA256 and a 32 byte key
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// sessionToken returns the token of the session cookie, empty without one
+func sessionToken(r *http.Request) string {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// serveLogin lists the login methods (GET). POST checks the credentials of a
+// user, given as JSON or as form values, and starts a session; form posts of
+// the login page are redirected to the dashboard.
+func serveLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	cfg := ctx.Value(key("config")).(*config)
+	users := ctx.Value(key("users")).(*userStore)
+	if r.Method == "GET" {
+		writeJSON(w, map[string]bool{"password": users.enabled(), "oidc": cfg.OIDCIssuer != ""})
+		return
+	}
+	if !users.enabled() {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	mt, err := mediaType(r)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	form := mt != "application/json"
+	if form {
+		if err := parseForm(r); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		req.Username, req.Password = r.PostFormValue("username"), r.PostFormValue("password")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "400 - Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	u := users.verify(req.Username, req.Password)
+	if u == nil {
+		if form {
+			http.Redirect(w, r, "/dashboard/login.html?failed=1", http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "401 - Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	token, sess, err := startSession(w, r, cfg, users, u)
+	if err != nil {
+		http.Error(w, "500 - Something bad happened!", http.StatusInternalServerError)
+		return
+	}
+	if form {
+		http.Redirect(w, r, "/dashboard/", http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"token":   token,
+		"session": sess.ID,
+		"expires": sess.Expires,
+		"role":    u.Role,
+	})
+}
+
+// startSession signs the token of a new session of u and sets it as the
+// session cookie
+func startSession(w http.ResponseWriter, r *http.Request, cfg *config, users *userStore, u *user) (string, session, error) {
+	expires := time.Now().Add(cfg.SessionTTL)
+	sess := users.sessions.start(u, r, expires)
+	token, err := signJWT(cfg.JWTSecret, jwtClaims{
+		Subject:   u.Username,
+		Role:      u.Role,
+		Tenant:    u.Tenant,
+		ExpiresAt: expires.Unix(),
+		SessionID: sess.ID,
+	})
+	if err != nil {
+		users.sessions.revoke(sess.ID)
+		return "", sess, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, sess, nil
+}
+
+// postLogout ends the session of the token or cookie of the request
+func postLogout(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value(key("config")).(*config)
+	users := r.Context().Value(key("users")).(*userStore)
+	token := bearerToken(r)
+	if token == "" {
+		token = sessionToken(r)
+	}
+	if cfg.JWTSecret != "" {
+		if claims, err := verifyJWT(cfg.JWTSecret, token); err == nil && claims.SessionID != "" {
+			users.sessions.revoke(claims.SessionID)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// withDashboardLogin sends visitors of the dashboard without a session that
+// may read to the login page, when users log in, or asks for the basic auth
+// credentials of BASIC_AUTH
+func withDashboardLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		cfg := ctx.Value(key("config")).(*config)
+		reg := ctx.Value(key("tenants")).(*tenantRegistry)
+
+		switch strings.TrimPrefix(r.URL.Path, "/dashboard/") {
+		case "login.html", "style.css":
+			next.ServeHTTP(w, r)
+			return
+		}
+		if cfg.logins() || len(cfg.BasicAuth) > 0 {
+			p, _, err := authenticate(r, cfg, reg)
+			switch {
+			case (err != nil || !p.can(permRead)) && cfg.logins():
+				http.Redirect(w, r, "/dashboard/login.html", http.StatusSeeOther)
+				return
+			case err != nil || !p.can(permRead):
+				challengeBasic(w, cfg)
+				http.Error(w, "401 - Log in to see the dashboard", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminUsers lists (GET) and creates or updates (POST) the dashboard users;
+// DELETE /admin/users/{username} removes one
+func adminUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	reg := ctx.Value(key("tenants")).(*tenantRegistry)
+	audit := ctx.Value(key("audit")).(*auditLog)
+	users := ctx.Value(key("users")).(*userStore)
+	if !users.enabled() {
+		http.Error(w, "404 - Users are not configured", http.StatusNotFound)
+		return
+	}
+	username := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/users"), "/")
+
+	switch {
+	case r.Method == "GET" && username == "":
+		writeJSON(w, map[string]interface{}{"users": users.list()})
+	case r.Method == "POST" && username == "":
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+			Tenant   string `json:"tenant"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "400 - Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if req.Username == "" || len(req.Password) < 8 || !validRole(req.Role) {
+			http.Error(w, "400 - username, a password of at least 8 characters and a role of device, viewer, operator or admin are required", http.StatusBadRequest)
+			return
+		}
+		if reg.byName(req.Tenant) == nil {
+			http.Error(w, "400 - Unknown tenant", http.StatusBadRequest)
+			return
+		}
+		u := user{Username: req.Username, PasswordHash: hashPassword(req.Password), Role: req.Role, Tenant: req.Tenant}
+		if err := users.put(u); err != nil {
+			http.Error(w, "500 - Saving users failed", http.StatusInternalServerError)
+			return
+		}
+		audit.record(r, "put_user", map[string]interface{}{
+			"username": u.Username,
+			"role":     u.Role,
+			"tenant":   u.Tenant,
+		})
+		u.PasswordHash = ""
+		writeJSON(w, u)
+	case r.Method == "DELETE" && username != "":
+		found, err := users.remove(username)
+		if !found {
+			http.Error(w, "404 - Unknown user", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "500 - Saving users failed", http.StatusInternalServerError)
+			return
+		}
+		audit.record(r, "remove_user", map[string]interface{}{"username": username})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "404 not found.", http.StatusNotFound)
+	}
+}
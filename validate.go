@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Request validation: the values an endpoint accepts are declared as rules
+// next to its route and checked before the handler runs, which can then
+// rely on them. Checks that depend on the schema, such as known measurements,
+// stay in the handlers.
+
+// fieldRule declares the checks of one request value, an absent value only
+// fails when it is required
+type fieldRule struct {
+	name     string
+	required bool
+	// longest value in characters, unlimited at 0
+	maxLen int
+	// the whole value must match, with chars describing it in the error
+	pattern *regexp.Regexp
+	chars   string
+	// the value must be an integer within min and max
+	integer  bool
+	min, max int64
+	// any other check of the value
+	check func(v string) error
+}
+
+// node names end up in tags, MQTT topics and file names
+var nodePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]*$`)
+
+var agePattern = regexp.MustCompile(`^[0-9]+(,[0-9]+)*$`)
+
+var (
+	nodeRule = fieldRule{name: "node", maxLen: 64, pattern: nodePattern, chars: "letters, digits, '.', '_', ':' and '-'"}
+
+	precisionRule = fieldRule{name: "precision", check: func(v string) error {
+		_, err := parsePrecision(v)
+		return err
+	}}
+	// how long a node held its newest reading or each of its records, in
+	// units of the precision; the handler checks the count and the maximum
+	ageRule = fieldRule{name: "age", maxLen: 4096, pattern: agePattern, chars: "digits separated by commas"}
+	// the records, counted by the handler once decoded, see checkRecordCount
+	dataRule = fieldRule{name: "data", maxLen: maxDataLen}
+	// submission number, see sequence.go
+	seqRule = fieldRule{name: "seq", integer: true, min: 0, max: 1 << 53}
+)
+
+var (
+	ingestRules = []fieldRule{nodeRule, precisionRule, dataRule, ageRule, seqRule, messageIDRule, fragRule, fragsRule}
+	streamRules = []fieldRule{nodeRule, precisionRule}
+	// reads of one node
+	nodeQueryRules = []fieldRule{required(nodeRule),
+		{name: "limit", integer: true, min: 1, max: 1 << 31},
+		{name: "offset", integer: true, min: 0, max: 1 << 31},
+	}
+)
+
+// validNode checks a node name a handler reads itself, from a JSON body, a
+// label or a tag, like nodeRule checks the node value of a request
+func validNode(node string) error {
+	return required(nodeRule).validate(node, true)
+}
+
+// required returns rule for a mandatory value
+func required(rule fieldRule) fieldRule {
+	rule.required = true
+	return rule
+}
+
+func (rule fieldRule) validate(v string, present bool) error {
+	if !present || v == "" {
+		if rule.required {
+			return fmt.Errorf("%s is required", rule.name)
+		}
+		return nil
+	}
+	if rule.maxLen > 0 && utf8.RuneCountInString(v) > rule.maxLen {
+		return fmt.Errorf("%s is longer than %d characters", rule.name, rule.maxLen)
+	}
+	if rule.pattern != nil && !rule.pattern.MatchString(v) {
+		return fmt.Errorf("%s may only contain %s", rule.name, rule.chars)
+	}
+	if rule.integer {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be an integer", rule.name)
+		}
+		if n < rule.min || n > rule.max {
+			return fmt.Errorf("%s must be between %d and %d", rule.name, rule.min, rule.max)
+		}
+	}
+	if rule.check != nil {
+		if err := rule.check(v); err != nil {
+			return fmt.Errorf("invalid %s: %w", rule.name, err)
+		}
+	}
+	return nil
+}
+
+// validateValues checks the value of every rule, get returns a value and
+// whether it was sent
+func validateValues(rules []fieldRule, get func(name string) (string, bool)) error {
+	for _, rule := range rules {
+		v, ok := get(rule.name)
+		if err := rule.validate(v, ok); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withValidation checks the query of a request before next runs
+func withValidation(rules []fieldRule, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		err := validateValues(rules, func(name string) (string, bool) {
+			_, ok := q[name]
+			return q.Get(name), ok
+		})
+		if err != nil {
+			http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// withIngestValidation decodes an ingest body of at most INGEST_MAX_BYTES,
+// checks its values and hands it on to next, see ingestBodyOf
+func withIngestValidation(rules []fieldRule, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := limitBody(w, r)
+		body, err := decodeIngest(r)
+		if err != nil {
+			if tooLarge(err) {
+				err = &bodyError{http.StatusRequestEntityTooLarge, fmt.Sprintf("body larger than %d bytes", limit)}
+			}
+			writeBodyError(w, err)
+			return
+		}
+		values := map[string]string{"node": body.Node, "precision": body.Precision, "data": body.Data, "age": body.Age, "seq": body.Seq,
+			"msg": body.Msg, "frag": body.Frag, "frags": body.Frags}
+		err = validateValues(rules, func(name string) (string, bool) {
+			v, ok := values[name]
+			return v, ok
+		})
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), key("ingestBody"), &body)))
+	}
+}
+
+// ingestBodyOf returns the body decoded by withIngestValidation
+func ingestBodyOf(ctx context.Context) *ingestBody {
+	return ctx.Value(key("ingestBody")).(*ingestBody)
+}
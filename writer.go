@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	ihttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	lp "github.com/influxdata/line-protocol"
+)
+
+// points sent to InfluxDB in one request when draining the buffer
+const flushBatch = 5000
+
+// upper bounds in seconds of the write latency histogram
+var writeLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// classes of failed writes, see writeErrorClass
+var writeErrorClasses = []string{"timeout", "auth", "bad_request", "unavailable", "other"}
+
+var errBufferFull = errors.New("write buffer full, points dropped")
+
+// errWriteRejected wraps the error of a write InfluxDB will never accept,
+// see rejectedWrite
+var errWriteRejected = errors.New("points rejected")
+
+// influxWriter writes the points of a tenant through a circuit breaker. After
+// a number of consecutive failed writes the breaker opens: writes go straight
+// to a bounded in-memory buffer instead of every request waiting for the
+// timeout, and the buffer is flushed once a probe write succeeds again.
+type influxWriter struct {
+	api   api.WriteAPIBlocking
+	usage *tenantUsage
+
+	threshold int
+	probe     time.Duration
+	limit     int
+	highWater int
+	// every write goes to the buffer and is sent with the next flush, see
+	// gateway.go
+	deferred bool
+	// buffered points older than this are dropped, kept until written at 0
+	maxAge time.Duration
+	dedup  *dedupCache
+	// the buffer is mirrored to disk when set, see queue.go
+	queue  *writeQueue
+	tenant string
+	// set while the queue volume is almost full, see diskguard.go
+	diskFull *atomic.Bool
+	// samples of the points go to the staging bucket when set, see shadow.go
+	shadow *shadowWriter
+
+	// held by the flush running, by the probe or a drain
+	flushMu sync.Mutex
+
+	mu       sync.Mutex
+	failures int
+	// zero while the breaker is closed
+	openedAt time.Time
+	buffer   []pendingWrite
+	buffered int
+	dropped  int64
+	// points InfluxDB refused, dropped instead of buffered or retried
+	rejected int64
+	// points skipped by dedup
+	duplicates int64
+
+	// duration of every request to InfluxDB, and failed ones by class
+	latency *histogram
+	errors  map[string]int64
+}
+
+// pendingWrite is a buffered write, written is called once it reached InfluxDB.
+// Writes restored from the write queue have no callback.
+type pendingWrite struct {
+	points  []*write.Point
+	written func()
+	queued  time.Time
+	// entry in the write queue, 0 when not persisted
+	id uint64
+}
+
+// writerStatus is the breaker and buffer state for health and metrics
+type writerStatus struct {
+	Breaker  string     `json:"breaker"`
+	OpenedAt *time.Time `json:"opened_at"`
+	Failures int        `json:"consecutive_failures"`
+	Buffered int        `json:"buffered_points"`
+	Dropped  int64      `json:"dropped_points"`
+	Rejected int64      `json:"rejected_points"`
+	// points already written within DEDUP_WINDOW
+	Duplicates int64 `json:"duplicate_points"`
+	// failed writes by writeErrorClass
+	Errors map[string]int64 `json:"errors"`
+}
+
+func newInfluxWriter(writeApi api.WriteAPIBlocking, usage *tenantUsage, cfg *config) *influxWriter {
+	return &influxWriter{
+		api:       writeApi,
+		usage:     usage,
+		threshold: cfg.BreakerFailures,
+		probe:     cfg.BreakerProbe,
+		limit:     cfg.WriteBufferSize,
+		highWater: cfg.WriteBufferHighWater,
+		maxAge:    cfg.WriteQueueMaxAge,
+		dedup:     newDedupCache(cfg.DedupWindow, cfg.DedupMaxKeys, cfg.WritePrecision),
+		latency:   newHistogram(writeLatencyBuckets...),
+		errors:    make(map[string]int64),
+	}
+}
+
+// persist mirrors the buffer of tenant to q, and first takes over the points
+// a previous run left in it
+func (w *influxWriter) persist(q *writeQueue, tenant string) error {
+	entries, err := q.load(tenant)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.queue, w.tenant = q, tenant
+	var over []uint64
+	for _, e := range entries {
+		if w.buffered+len(e.points) > w.limit {
+			w.dropped += int64(len(e.points))
+			over = append(over, e.id)
+			continue
+		}
+		w.buffer = append(w.buffer, pendingWrite{points: e.points, queued: e.queued, id: e.id})
+		w.buffered += len(e.points)
+	}
+	if len(entries) > 0 {
+		log.Printf("write queue: restored %d points of %s\n", w.buffered, tenant)
+	}
+	if len(over) > 0 {
+		log.Printf("write queue: %d entries of %s did not fit WRITE_BUFFER_SIZE and were dropped\n", len(over), tenant)
+		return q.remove(tenant, over...)
+	}
+	return nil
+}
+
+// overloaded is true once the buffer is filled up to the high water mark,
+// from then on ingest turns data away instead of risking to drop it
+func (w *influxWriter) overloaded() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.highWater > 0 && w.buffered >= w.highWater
+}
+
+// writeRejected answers 400 to a write InfluxDB refused, sending the same
+// points again cannot help
+func writeRejected(w http.ResponseWriter, err error) {
+	log.Println(err)
+	http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+}
+
+// writeOverloaded answers 503 with a Retry-After header, which the firmware
+// honors by keeping its readings and posting them again later
+func writeOverloaded(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "503 - Write buffer full, retry later", http.StatusServiceUnavailable)
+}
+
+// write stores points in InfluxDB, or in the buffer while the breaker is open
+// or when the write fails. It returns false when the points were buffered and
+// errBufferFull when there was no room left for them. Points InfluxDB rejects
+// are not buffered, that returns errWriteRejected. A write canceled with
+// ctx is neither buffered nor held against InfluxDB, it returns ctx.Err().
+// written, which may be nil, is called when the points are stored in
+// InfluxDB, now or later. Points written within the dedup window are
+// skipped.
+func (w *influxWriter) write(ctx context.Context, written func(), points ...*write.Point) (direct bool, err error) {
+	points, duplicates := w.dedup.filter(points)
+	if duplicates > 0 {
+		w.mu.Lock()
+		w.duplicates += int64(duplicates)
+		w.mu.Unlock()
+	}
+	if len(points) == 0 {
+		if written != nil {
+			written()
+		}
+		return true, nil
+	}
+	defer func() {
+		if err != nil {
+			w.dedup.forget(points)
+		}
+	}()
+	w.shadow.offer(points)
+
+	w.mu.Lock()
+	open := !w.openedAt.IsZero()
+	w.mu.Unlock()
+	if !open && !w.deferred {
+		err := w.send(ctx, points)
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		if err != nil && rejectedWrite(err) {
+			// InfluxDB answered, so it is not held against the breaker
+			w.mu.Lock()
+			w.rejected += int64(len(points))
+			w.mu.Unlock()
+			return false, fmt.Errorf("%w: %s", errWriteRejected, err)
+		}
+		w.result(err)
+		if err == nil {
+			if written != nil {
+				written()
+			}
+			return true, nil
+		}
+		log.Printf("write failed (%s), buffering %d points: %s\n", writeErrorClass(err), len(points), err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buffered+len(points) > w.limit {
+		w.dropped += int64(len(points))
+		return false, errBufferFull
+	}
+	if w.queue != nil && w.diskFull != nil && w.diskFull.Load() {
+		w.dropped += int64(len(points))
+		return false, errDiskFull
+	}
+	pw := pendingWrite{points: points, written: written, queued: time.Now()}
+	if w.queue != nil {
+		// kept in memory only when the disk fails, still better than dropping
+		id, err := w.queue.add(w.tenant, pw.queued, points)
+		if err != nil {
+			log.Printf("write queue: %s\n", err)
+		}
+		pw.id = id
+	}
+	w.buffer = append(w.buffer, pw)
+	w.buffered += len(points)
+	return false, nil
+}
+
+// send writes points to InfluxDB, timing the request and counting a failure
+// by its class. Writes canceled by the caller are not counted.
+func (w *influxWriter) send(ctx context.Context, points []*write.Point) error {
+	start := time.Now()
+	err := w.api.WritePoint(ctx, points...)
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	w.latency.observe(time.Since(start).Seconds())
+	if err != nil {
+		w.mu.Lock()
+		w.errors[writeErrorClass(err)]++
+		w.mu.Unlock()
+	}
+	return err
+}
+
+// writeErrorClass tells an overloaded or unreachable InfluxDB (timeout,
+// unavailable) apart from a rejected write (auth, bad_request)
+func writeErrorClass(err error) string {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	var httpErr *ihttp.Error
+	if errors.As(err, &httpErr) && httpErr.StatusCode != 0 {
+		switch code := httpErr.StatusCode; {
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return "auth"
+		case code == http.StatusTooManyRequests || code >= 500:
+			return "unavailable"
+		case code >= 400:
+			return "bad_request"
+		}
+		return "other"
+	}
+	if errors.As(err, &netErr) {
+		// refused or reset connections, unknown hosts
+		return "unavailable"
+	}
+	var fieldErr *lp.FieldError
+	var metricErr *lp.MetricError
+	if errors.As(err, &fieldErr) || errors.As(err, &metricErr) {
+		// the points could not even be encoded, e.g. a NaN field
+		return "bad_request"
+	}
+	return "other"
+}
+
+// rejectedWrite tells whether InfluxDB will never accept the points of a
+// failed write, so retrying it would only hold up the writes behind it
+func rejectedWrite(err error) bool {
+	return writeErrorClass(err) == "bad_request"
+}
+
+// result counts a write attempt towards the breaker
+func (w *influxWriter) result(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err == nil {
+		w.usage.LastWrite.Store(time.Now().UnixNano())
+		if !w.openedAt.IsZero() {
+			log.Printf("InfluxDB writes recovered after %s\n", time.Since(w.openedAt).Round(time.Second))
+		}
+		w.failures = 0
+		w.openedAt = time.Time{}
+		return
+	}
+
+	w.usage.WriteErrors.Add(1)
+	w.failures++
+	if w.openedAt.IsZero() && w.failures >= w.threshold {
+		log.Printf("circuit breaker open after %d failed writes\n", w.failures)
+		w.openedAt = time.Now()
+	}
+}
+
+// run probes InfluxDB with the buffered points every probe interval and
+// drains the buffer once writes succeed again
+func (w *influxWriter) run() {
+	for range time.Tick(w.probe) {
+		w.evict()
+		w.flush()
+	}
+}
+
+// evict drops buffered writes older than maxAge
+func (w *influxWriter) evict() {
+	if w.maxAge <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-w.maxAge)
+
+	w.mu.Lock()
+	n, points := 0, 0
+	var ids []uint64
+	for ; n < len(w.buffer) && w.buffer[n].queued.Before(cutoff); n++ {
+		points += len(w.buffer[n].points)
+		if w.buffer[n].id != 0 {
+			ids = append(ids, w.buffer[n].id)
+		}
+	}
+	w.buffer = append(w.buffer[:0], w.buffer[n:]...)
+	w.buffered -= points
+	w.dropped += int64(points)
+	w.mu.Unlock()
+
+	if n == 0 {
+		return
+	}
+	log.Printf("dropped %d buffered points older than %s\n", points, w.maxAge)
+	if w.queue != nil && len(ids) > 0 {
+		if err := w.queue.remove(w.tenant, ids...); err != nil {
+			log.Printf("write queue: %s\n", err)
+		}
+	}
+}
+
+func (w *influxWriter) flush() {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	for {
+		// whole pending writes up to about flushBatch points
+		var batch []*write.Point
+		w.mu.Lock()
+		n := 0
+		for ; n < len(w.buffer) && len(batch) < flushBatch; n++ {
+			batch = append(batch, w.buffer[n].points...)
+		}
+		done := append([]pendingWrite(nil), w.buffer[:n]...)
+		w.mu.Unlock()
+		if n == 0 {
+			return
+		}
+
+		err := w.sendBuffered(batch)
+		stored := done
+		if err != nil {
+			stored = nil
+			if rejectedWrite(err) {
+				// one bad write fails the whole batch: the writes are sent
+				// one by one and those InfluxDB refuses are dropped
+				stored, n, err = w.flushEach(done)
+			}
+		}
+		if err != nil || len(stored) > 0 {
+			w.result(err)
+		}
+		w.release(done[:n])
+		for _, p := range stored {
+			if p.written != nil {
+				p.written()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sendBuffered sends points taken from the buffer
+func (w *influxWriter) sendBuffered(points []*write.Point) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return w.send(ctx, points)
+}
+
+// flushEach sends the pending writes of a rejected batch one at a time. It
+// returns those stored, how many of them were done with, stored or dropped,
+// and the error of a write that failed for another reason, which stops it.
+func (w *influxWriter) flushEach(pending []pendingWrite) (stored []pendingWrite, n int, err error) {
+	for ; n < len(pending); n++ {
+		p := pending[n]
+		err := w.sendBuffered(p.points)
+		if err == nil {
+			stored = append(stored, p)
+			continue
+		}
+		if !rejectedWrite(err) {
+			return stored, n, err
+		}
+		log.Printf("InfluxDB rejected %d buffered points, dropping them: %s\n", len(p.points), err)
+		// a corrected resend must not be skipped as a duplicate
+		w.dedup.forget(p.points)
+		w.mu.Lock()
+		w.rejected += int64(len(p.points))
+		w.mu.Unlock()
+	}
+	return stored, n, nil
+}
+
+// release takes pending writes that are done with off the front of the
+// buffer and out of the write queue
+func (w *influxWriter) release(pending []pendingWrite) {
+	points := 0
+	var ids []uint64
+	for _, p := range pending {
+		points += len(p.points)
+		if p.id != 0 {
+			ids = append(ids, p.id)
+		}
+	}
+	// writes are only ever appended, the front is still the batch
+	w.mu.Lock()
+	w.buffer = append(w.buffer[:0], w.buffer[len(pending):]...)
+	w.buffered -= points
+	w.mu.Unlock()
+	if w.queue != nil && len(ids) > 0 {
+		if err := w.queue.remove(w.tenant, ids...); err != nil {
+			log.Printf("write queue: %s\n", err)
+		}
+	}
+}
+
+func (w *influxWriter) status() writerStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := writerStatus{
+		Breaker:    "closed",
+		Failures:   w.failures,
+		Buffered:   w.buffered,
+		Dropped:    w.dropped,
+		Rejected:   w.rejected,
+		Duplicates: w.duplicates,
+		Errors:     make(map[string]int64, len(writeErrorClasses)),
+	}
+	for _, class := range writeErrorClasses {
+		s.Errors[class] = w.errors[class]
+	}
+	if !w.openedAt.IsZero() {
+		opened := w.openedAt
+		s.Breaker = "open"
+		s.OpenedAt = &opened
+	}
+	return s
+}
+
+// collectWriters exports the breaker and buffer state of every tenant
+func collectWriters(reg *tenantRegistry) func(mw *metricWriter) {
+	return func(mw *metricWriter) {
+		tenants := sortedTenants(reg)
+		statuses := make([]writerStatus, len(tenants))
+		for i, t := range tenants {
+			statuses[i] = t.writer.status()
+		}
+
+		families := []struct {
+			name, typ, help string
+			value           func(s writerStatus) float64
+		}{
+			{"sensor_write_breaker_open", "gauge", "1 while writes to InfluxDB are short-circuited to the buffer.", func(s writerStatus) float64 {
+				if s.OpenedAt != nil {
+					return 1
+				}
+				return 0
+			}},
+			{"sensor_write_buffered_points", "gauge", "Points waiting in the local buffer for InfluxDB.", func(s writerStatus) float64 { return float64(s.Buffered) }},
+			{"sensor_write_dropped_points_total", "counter", "Points dropped because the local buffer was full.", func(s writerStatus) float64 { return float64(s.Dropped) }},
+			{"sensor_write_rejected_points_total", "counter", "Points dropped because InfluxDB will not accept them, e.g. a field of the wrong type.", func(s writerStatus) float64 { return float64(s.Rejected) }},
+			{"sensor_write_duplicate_points_total", "counter", "Points skipped because they were already written within the dedup window.", func(s writerStatus) float64 { return float64(s.Duplicates) }},
+		}
+		for _, f := range families {
+			mw.family(f.name, f.typ, f.help)
+			for i, t := range tenants {
+				mw.sample(f.name, f.value(statuses[i]), "tenant", t.Name)
+			}
+		}
+
+		mw.family("sensor_write_duration_seconds", "histogram", "Duration of the write requests to InfluxDB, including failed ones.")
+		for _, t := range tenants {
+			t.writer.latency.write(mw, "sensor_write_duration_seconds", "tenant", t.Name)
+		}
+		mw.family("sensor_write_errors_total", "counter", "Failed writes to InfluxDB by type: timeout, auth, bad_request, unavailable or other.")
+		for i, t := range tenants {
+			for _, class := range writeErrorClasses {
+				mw.sample("sensor_write_errors_total", float64(statuses[i].Errors[class]), "tenant", t.Name, "type", class)
+			}
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// zone is a named region of a deployment, such as a building, a span or a
+// pier, and the nodes placed in it
+type zone struct {
+	Name  string   `json:"name"`
+	Type  string   `json:"type,omitempty"`
+	Nodes []string `json:"nodes"`
+}
+
+// zones are declared in ZONES_FILE. The points of a node in a zone carry
+// its name as the zone tag, so zone queries need no join. A nil zones
+// declares none.
+type zones struct {
+	byName map[string]*zone
+	byNode map[string]string
+}
+
+type zonesFile struct {
+	Zones map[string]struct {
+		Type  string   `json:"type"`
+		Nodes []string `json:"nodes"`
+	} `json:"zones"`
+}
+
+func loadZones(path string) (*zones, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file zonesFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	zs := &zones{byName: make(map[string]*zone), byNode: make(map[string]string)}
+	for name, decl := range file.Zones {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("zone %q: invalid name", name)
+		}
+		z := &zone{Name: name, Type: decl.Type, Nodes: decl.Nodes}
+		for _, node := range decl.Nodes {
+			if other, ok := zs.byNode[node]; ok {
+				return nil, fmt.Errorf("node %q is in zones %q and %q", node, other, name)
+			}
+			zs.byNode[node] = name
+		}
+		sort.Strings(z.Nodes)
+		zs.byName[name] = z
+	}
+	return zs, nil
+}
+
+// of returns the zone of node, empty when it is in none
+func (zs *zones) of(node string) string {
+	if zs == nil {
+		return ""
+	}
+	return zs.byNode[node]
+}
+
+func (zs *zones) get(name string) (*zone, bool) {
+	if zs == nil {
+		return nil, false
+	}
+	z, ok := zs.byName[name]
+	return z, ok
+}
+
+// list returns the zones sorted by name
+func (zs *zones) list() []*zone {
+	list := []*zone{}
+	if zs == nil {
+		return list
+	}
+	for _, z := range zs.byName {
+		list = append(list, z)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func getZones(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	cfg := r.Context().Value(key("config")).(*config)
+	list := []*zone{}
+	for _, z := range cfg.Schema.Zones.list() {
+		if z = scopedZone(r.Context(), z); z != nil {
+			list = append(list, z)
+		}
+	}
+	writeJSON(w, map[string]interface{}{"zones": list})
+}
+
+// zoneRoutes dispatches the resources below /zones/
+func zoneRoutes(w http.ResponseWriter, r *http.Request) {
+	// path is /v1/zones/{zone}[/{resource}] or its /api alias
+	_, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/zones/")
+	name, resource, _ := strings.Cut(rest, "/")
+	cfg := r.Context().Value(key("config")).(*config)
+	z, ok := cfg.Schema.Zones.get(name)
+	if ok {
+		z = scopedZone(r.Context(), z)
+	}
+	if z == nil {
+		http.Error(w, "404 - Unknown zone", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	switch resource {
+	case "":
+		writeJSON(w, z)
+	case "stats":
+		getZoneStats(w, r, z)
+	case "readings":
+		getZoneReadings(w, r, z)
+	default:
+		http.Error(w, "404 not found.", http.StatusNotFound)
+	}
+}
+
+func getZoneStats(w http.ResponseWriter, r *http.Request, z *zone) {
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+
+	window := time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "400 - invalid window", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	stop := time.Now()
+	start := stop.Add(-window)
+
+	fields, err := queryFieldStats(ctx, t, cfg.Schema, "r.zone == "+fluxString(z.Name), start, stop)
+	if err != nil {
+		queryFailed(w, r, err)
+		return
+	}
+
+	primary := cfg.Schema.primary()
+	writeJSON(w, map[string]interface{}{
+		"zone":     z.Name,
+		"type":     z.Type,
+		"nodes":    z.Nodes,
+		"start":    start,
+		"stop":     stop,
+		"readings": fields[primary.Measurement][primary.Name].Count,
+		"fields":   fields,
+	})
+}
+
+// the aggregates getZoneReadings combines the nodes of a zone with
+var zoneAggregates = map[string]bool{"mean": true, "min": true, "max": true, "median": true}
+
+// getZoneReadings aggregates the fields of a measurement over all nodes of
+// the zone, one row per window
+func getZoneReadings(w http.ResponseWriter, r *http.Request, z *zone) {
+	format, ok := responseFormat(r)
+	if !ok {
+		http.Error(w, "406 - Supported formats are json, csv and ndjson", http.StatusNotAcceptable)
+		return
+	}
+
+	ctx := r.Context()
+	t := ctx.Value(key("tenant")).(*tenant)
+	cfg := ctx.Value(key("config")).(*config)
+
+	q := r.URL.Query()
+	measurement := q.Get("measurement")
+	if measurement == "" {
+		measurement = cfg.Schema.primary().Measurement
+	}
+	fields, ok := cfg.Schema.Measurements[measurement]
+	if !ok {
+		http.Error(w, "400 - unknown measurement", http.StatusBadRequest)
+		return
+	}
+	fn := q.Get("fn")
+	if fn == "" {
+		fn = "mean"
+	}
+	if !zoneAggregates[fn] {
+		http.Error(w, "400 - fn must be mean, min, max or median", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	start, err := parseTimeParam(q.Get("start"), now.Add(-time.Hour))
+	if err != nil {
+		http.Error(w, "400 - invalid start", http.StatusBadRequest)
+		return
+	}
+	stop, err := parseTimeParam(q.Get("stop"), now)
+	if err != nil || !stop.After(start) {
+		http.Error(w, "400 - invalid stop", http.StatusBadRequest)
+		return
+	}
+	loc, err := timezoneParam(q, cfg, "")
+	if err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	every := 5 * time.Minute
+	if v := q.Get("every"); v != "" {
+		if every, err = time.ParseDuration(v); err != nil || every < time.Second {
+			http.Error(w, "400 - invalid every", http.StatusBadRequest)
+			return
+		}
+	}
+
+	flux := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %s and r.zone == %s)
+  |> group(columns: ["_measurement", "_field"])
+  |> sort(columns: ["_time"])
+  |> aggregateWindow(every: %ds, fn: %s, createEmpty: false)
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group()
+  |> sort(columns: ["_time"])
+  |> limit(n: %d)`,
+		fluxString(t.Bucket), start.UTC().Format(time.RFC3339Nano), stop.UTC().Format(time.RFC3339Nano),
+		fluxString(measurement), fluxString(z.Name), int64(every/time.Second), fn, cfg.QueryMaxLimit)
+
+	t.usage.Queries.Add(1)
+	result, err := t.queryApi.Query(ctx, scopeFlux(ctx, flux))
+	traceOf(ctx).phase("query")
+	if err != nil {
+		queryFailed(w, r, err)
+		return
+	}
+	defer result.Close()
+
+	readings := []map[string]interface{}{}
+	for result.Next() {
+		rec := result.Record()
+		row := map[string]interface{}{"time": rec.Time().In(loc)}
+		for _, f := range fields {
+			if v, ok := rec.Values()[f]; ok {
+				row[f] = v
+			}
+		}
+		readings = append(readings, row)
+	}
+	if result.Err() != nil {
+		queryFailed(w, r, result.Err())
+		return
+	}
+
+	switch format {
+	case formatCSV:
+		writeCSV(w, append([]string{"time"}, fields...), readings)
+	case formatNDJSON:
+		writeNDJSON(w, readings)
+	default:
+		writeJSON(w, map[string]interface{}{
+			"zone":        z.Name,
+			"measurement": measurement,
+			"fn":          fn,
+			"every":       shortDuration(every),
+			"readings":    readings,
+		})
+	}
+}